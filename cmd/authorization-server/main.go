@@ -2,12 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
+	"strings"
 
 	"github.com/openshift/telemeter/pkg/authorizer/server"
+	telemeterhttp "github.com/openshift/telemeter/pkg/http"
 )
 
 type SavedResponse struct {
@@ -17,29 +19,45 @@ type SavedResponse struct {
 }
 
 func main() {
-	if len(os.Args) != 3 {
+	trustForwarded := flag.String("trust-forwarded", "", "Comma separated IP addresses or CIDRs of proxies whose Forwarded or X-Forwarded-For headers identify clients in logs.")
+	flag.Parse()
+	if flag.NArg() != 2 {
 		log.Fatalf("expected two arguments, the listen address and a path to a JSON file containing responses")
 	}
+	var trusted []string
+	if len(*trustForwarded) > 0 {
+		trusted = strings.Split(*trustForwarded, ",")
+	}
+	trustedProxies, err := server.ParseTrustedProxies(trusted)
+	if err != nil {
+		log.Fatalf("-trust-forwarded is invalid: %v", err)
+	}
 
-	data, err := ioutil.ReadFile(os.Args[2])
+	data, err := ioutil.ReadFile(flag.Arg(1))
 	if err != nil {
 		log.Fatalf("unable to read JSON file: %v", err)
 	}
 
 	var responses []SavedResponse
 	if err := json.Unmarshal(data, &responses); err != nil {
-		log.Fatalf("unable to parse contents of %s: %v", os.Args[2], err)
+		log.Fatalf("unable to parse contents of %s: %v", flag.Arg(1), err)
 	}
 
 	s := server.NewServer()
 	s.AllowNewClusters = true
+	s.TrustedProxies = trustedProxies
 	s.Responses = make(map[server.Key]*server.TokenResponse)
 	for i := range responses {
 		r := &responses[i]
 		s.Responses[server.Key{Token: r.Token, Cluster: r.Cluster}] = &r.TokenResponse
 	}
 
-	if err := http.ListenAndServe(os.Args[1], s); err != nil {
+	mux := http.NewServeMux()
+	telemeterhttp.AddMetrics(mux)
+	mux.HandleFunc("/clusters", s.ServeClusters)
+	mux.Handle("/", s)
+
+	if err := http.ListenAndServe(flag.Arg(0), mux); err != nil {
 		log.Fatalf("server exited: %v", err)
 	}
 }
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// secretFlags are the flags whose values should not be readable by other users
+// when set from a config file.
+var secretFlags = []string{"from-token", "to-token", "to-token-fallback", "from-basic-auth", "to-basic-auth", "anonymize-salt", "to-hmac-key", "from-header", "to-header"}
+
+// loadConfig sets the flags in flags from the JSON object in the file at path. Each
+// key is the name of a flag and each value is a string, number, boolean, or, for
+// flags that may be repeated, a list. Flags that were set on the command line take
+// precedence over the file, and unknown keys are an error.
+func loadConfig(flags *pflag.FlagSet, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var config map[string]interface{}
+	if err := decoder.Decode(&config); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	for name, value := range config {
+		f := flags.Lookup(name)
+		if f == nil || name == "config" {
+			return fmt.Errorf("%s: unknown key %q", path, name)
+		}
+		if f.Changed {
+			continue
+		}
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+		for _, v := range values {
+			s, err := configValue(v)
+			if err != nil {
+				return fmt.Errorf("%s: key %q: %v", path, name, err)
+			}
+			if err := f.Value.Set(s); err != nil {
+				return fmt.Errorf("%s: key %q: %v", path, name, err)
+			}
+		}
+	}
+
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0004 != 0 {
+		for _, name := range secretFlags {
+			if _, ok := config[name]; ok {
+				log.Printf("warning: config file %s contains %q and is readable by all users", path, name)
+			}
+		}
+	}
+	return nil
+}
+
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		return "", fmt.Errorf("value must be a string, number, boolean, or a list of them")
+	}
+}
+
+// redacted replaces secrets in the effective configuration.
+const redacted = "<redacted>"
+
+// effectiveConfig is the configuration the client is running with, as served at
+// /config. Fields are listed explicitly so that new secrets are not exposed by
+// accident.
+type effectiveConfig struct {
+	Listen           string            `json:"listen"`
+	From             string            `json:"from"`
+	FromToken        string            `json:"fromToken,omitempty"`
+	FromTokenFile    string            `json:"fromTokenFile,omitempty"`
+	FromCAFile       string            `json:"fromCAFile,omitempty"`
+	To               []string          `json:"to,omitempty"`
+	ToUpload         string            `json:"toUpload,omitempty"`
+	ToAuthorize      []string          `json:"toAuthorize,omitempty"`
+	ToOTLP           []string          `json:"toOTLP,omitempty"`
+	ToToken          string            `json:"toToken,omitempty"`
+	ToTokenFile      string            `json:"toTokenFile,omitempty"`
+	ToTokenFallback  string            `json:"toTokenFallback,omitempty"`
+	ToFallbackFile   string            `json:"toTokenFallbackFile,omitempty"`
+	FromCertPins     []string          `json:"fromCertPins,omitempty"`
+	ToCertPins       []string          `json:"toCertPins,omitempty"`
+	FromBasicAuth    string            `json:"fromBasicAuth,omitempty"`
+	ToBasicAuth      string            `json:"toBasicAuth,omitempty"`
+	FromHeaders      []string          `json:"fromHeaders,omitempty"`
+	ToHeaders        []string          `json:"toHeaders,omitempty"`
+	Identifier       string            `json:"id,omitempty"`
+	UserAgent        string            `json:"userAgent"`
+	Interval         string            `json:"interval"`
+	IntervalJitter   float64           `json:"intervalJitter"`
+	ScrapeTimeout    string            `json:"scrapeTimeout"`
+	UploadTimeout    string            `json:"uploadTimeout"`
+	LimitBytes       int64             `json:"limitBytes"`
+	Rules            []string          `json:"matches"`
+	MatchRegex       string            `json:"matchRegex,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	LabelFile        string            `json:"labelFile,omitempty"`
+	KeepLabels       []string          `json:"keepLabels,omitempty"`
+	Renames          map[string]string `json:"renames,omitempty"`
+	AnonymizeLabels  []string          `json:"anonymizeLabels,omitempty"`
+	AnonymizeBuckets map[string]int    `json:"anonymizeBuckets,omitempty"`
+	AnonymizeSalt    string            `json:"anonymizeSalt,omitempty"`
+	InvalidNames     string            `json:"invalidNames,omitempty"`
+	MaxLabelLength   int               `json:"maxLabelLength,omitempty"`
+	AlignTimestamps  string            `json:"alignTimestamps,omitempty"`
+	GuardCounters    bool              `json:"guardCounterResets,omitempty"`
+	RequireLabels    []string          `json:"requireLabels,omitempty"`
+	RequireLabelMode string            `json:"requireLabelMode,omitempty"`
+}
+
+func (o *Options) effectiveConfig() *effectiveConfig {
+	return &effectiveConfig{
+		Listen:           o.Listen,
+		From:             o.From,
+		FromToken:        redact(o.FromToken),
+		FromTokenFile:    o.FromTokenFile,
+		FromCAFile:       o.FromCAFile,
+		To:               o.To,
+		ToUpload:         o.ToUpload,
+		ToAuthorize:      o.ToAuthorize,
+		ToOTLP:           o.ToOTLP,
+		ToToken:          redact(o.ToToken),
+		ToTokenFile:      o.ToTokenFile,
+		ToTokenFallback:  redact(o.ToTokenFallback),
+		ToFallbackFile:   o.ToTokenFallbackFile,
+		FromCertPins:     o.FromCertPins,
+		ToCertPins:       o.ToCertPins,
+		FromBasicAuth:    redact(o.FromBasicAuth),
+		ToBasicAuth:      redact(o.ToBasicAuth),
+		FromHeaders:      headerNames(o.FromHeaders),
+		ToHeaders:        headerNames(o.ToHeaders),
+		Identifier:       o.Identifier,
+		UserAgent:        o.UserAgent,
+		Interval:         o.Interval.String(),
+		IntervalJitter:   o.IntervalJitter,
+		ScrapeTimeout:    o.ScrapeTimeout.String(),
+		UploadTimeout:    o.UploadTimeout.String(),
+		LimitBytes:       o.LimitBytes,
+		Rules:            o.MatchRules(),
+		MatchRegex:       o.MatchRegex,
+		Labels:           o.Labels,
+		LabelFile:        o.LabelFile,
+		KeepLabels:       o.KeepLabels,
+		Renames:          o.Renames,
+		AnonymizeLabels:  o.AnonymizeLabels,
+		AnonymizeBuckets: o.AnonymizeBuckets,
+		AnonymizeSalt:    redact(o.AnonymizeSalt),
+		InvalidNames:     o.InvalidNames,
+		MaxLabelLength:   o.MaxLabelLength,
+		AlignTimestamps:  o.AlignTimestamps,
+		GuardCounters:    o.GuardCounterResets,
+		RequireLabels:    o.RequireLabels,
+		RequireLabelMode: o.RequireLabelMode,
+	}
+}
+
+// headerNames returns the names of the headers given in Name:Value form, as the
+// values may be credentials for a gateway.
+func headerNames(headers []string) []string {
+	var names []string
+	for _, header := range headers {
+		names = append(names, strings.SplitN(header, ":", 2)[0])
+	}
+	return names
+}
+
+func redact(secret string) string {
+	if len(secret) == 0 {
+		return ""
+	}
+	return redacted
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// unixPrefix marks a --listen address as the path of a unix domain socket.
+const unixPrefix = "unix:"
+
+// listen listens on addr, which is either host:port, with IPv6 hosts in brackets,
+// or unix:PATH. A stale socket left at PATH by a previous process is removed. The
+// socket file is removed again when the listener is closed.
+func listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		path := strings.TrimPrefix(addr, unixPrefix)
+		if len(path) == 0 {
+			return nil, fmt.Errorf("--listen must include a socket path after %s", unixPrefix)
+		}
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(path); err != nil {
+				return nil, fmt.Errorf("unable to remove stale socket %s: %v", path, err)
+			}
+		}
+		return net.Listen("unix", path)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("--listen must be host:port, [ipv6]:port, or %sPATH: %v", unixPrefix, err)
+	}
+	return net.Listen("tcp", addr)
+}
@@ -1,65 +1,256 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
 	"github.com/spf13/cobra"
 
 	"github.com/openshift/telemeter/pkg/authorizer/remote"
 	"github.com/openshift/telemeter/pkg/forwarder"
 	telemeterhttp "github.com/openshift/telemeter/pkg/http"
 	"github.com/openshift/telemeter/pkg/metricsclient"
+	"github.com/openshift/telemeter/pkg/ratelog"
 	"github.com/openshift/telemeter/pkg/transform"
 )
 
+var (
+	gaugeConfigLastReload = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "telemeter_client_config_last_reload_timestamp_seconds",
+		Help: "The time the match rules or the --label-file were last reloaded successfully, or the process start time.",
+	})
+	counterConfigReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "telemeter_client_config_reloads_total",
+		Help: "The number of attempts to reload the match rules or the --label-file by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	gaugeConfigLastReload.SetToCurrentTime()
+	prometheus.MustRegister(gaugeConfigLastReload, counterConfigReloads)
+}
+
+// buildInfoName is the name of the family describing the client added to each batch.
+const buildInfoName = "telemeter_client_build_info"
+
+// minInterval is the shortest --interval allowed without --allow-aggressive-interval.
+const minInterval = 30 * time.Second
+
+// minIntervalFloor returns the shortest interval allowed for the scrape timeout. A
+// scrape that takes the full timeout leaves the source idle for at least as long.
+func minIntervalFloor(scrapeTimeout time.Duration) time.Duration {
+	if floor := 2 * scrapeTimeout; floor > minInterval {
+		return floor
+	}
+	return minInterval
+}
+
+// jitteredMinimum returns the shortest interval produced by applying jitter to
+// interval.
+func jitteredMinimum(interval time.Duration, jitter float64) time.Duration {
+	return interval - time.Duration(jitter*float64(interval))
+}
+
+// maxCounterSeries bounds the number of series remembered by --guard-counter-resets
+// and --counters-as-delta.
+const maxCounterSeries = 100000
+
+// defaultMaxAge is the default --max-age-default, the age of the oldest samples
+// accepted by the server.
+const defaultMaxAge = 24 * time.Hour
+
+// version and commit are set at build time.
+var (
+	version = "unknown"
+	commit  = "unknown"
+)
+
 func main() {
 	opt := &Options{
-		Listen:     "localhost:9002",
-		LimitBytes: 200 * 1024,
-		Rules:      []string{`{__name__="up"}`},
-		Interval:   4*time.Minute + 30*time.Second,
+		Listen:         "localhost:9002",
+		LimitBytes:     200 * 1024,
+		LimitMode:      string(metricsclient.LimitFail),
+		Rules:          []string{`{__name__="up"}`},
+		Interval:       4*time.Minute + 30*time.Second,
+		IntervalJitter: 0.1,
+		UserAgent:      fmt.Sprintf("telemeter-client/%s", version),
+
+		TransformConcurrency: 1,
+
+		FromMode:          "federate",
+		MatchRegexRefresh: time.Hour,
+
+		BreakerCooldown: 5 * time.Minute,
+		LogThrottle:     5 * time.Minute,
+
+		SpoolMaxBytes: 50 * 1024 * 1024,
+		SpoolMaxAge:   time.Hour,
+
+		AlignTimestampsWindow:   time.Minute,
+		AlignTimestampsMaxShift: 5 * time.Minute,
+
+		CounterDeltaSuffix: "_delta",
+		RequireLabelMode:   "error",
+		SummaryGaugesMode:  string(transform.SummaryKeep),
+
+		MaxAgeDefault: defaultMaxAge,
 	}
 	cmd := &cobra.Command{
 		Short: "Federate Prometheus via push",
 
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(opt.Config) > 0 {
+				if err := loadConfig(cmd.Flags(), opt.Config); err != nil {
+					return fmt.Errorf("--config could not be loaded: %v", err)
+				}
+			}
 			return opt.Run()
 		},
 	}
 
+	cmd.Flags().StringVar(&opt.Config, "config", opt.Config, "A JSON file that sets any of the other flags, keyed by flag name. Flags given on the command line take precedence over the file.")
 	cmd.Flags().StringVar(&opt.Listen, "listen", opt.Listen, "A host:port to listen on for health and metrics.")
+	cmd.Flags().StringVar(&opt.TLSCertFile, "tls-cert-file", opt.TLSCertFile, "A certificate to serve --listen over HTTPS. The certificate is reloaded when it changes.")
+	cmd.Flags().StringVar(&opt.TLSKeyFile, "tls-key-file", opt.TLSKeyFile, "The private key for --tls-cert-file.")
+	cmd.Flags().StringVar(&opt.TLSClientCA, "tls-client-ca", opt.TLSClientCA, "A file containing CA certificates. If set, requests to /metrics, /federate, /status, /config, /debug/uploads, and /authorize-labels must present a client certificate signed by one of them.")
 	cmd.Flags().StringVar(&opt.From, "from", opt.From, "The Prometheus server to federate from.")
+	cmd.Flags().StringVar(&opt.FromMode, "from-mode", opt.FromMode, "How to read metrics from the --from server: federate to use the federation endpoint with the match rules, or query to evaluate each --query with the query API.")
+	cmd.Flags().StringVar(&opt.LimitMode, "limit-mode", opt.LimitMode, "What to do when a response from --from is larger than the size limit: fail to skip the whole scrape, or truncate to forward the metric families read before the limit was reached. Truncated scrapes are counted in telemeter_limit_truncated_total.")
+	cmd.Flags().BoolVar(&opt.PartialOnTimeout, "partial-on-timeout", opt.PartialOnTimeout, "Forward the metric families read from --from before --scrape-timeout instead of skipping the scrape when the source is too slow. Batches may then lack some metrics. Partial scrapes are counted in telemeter_retrieve_partial_total. Can't be combined with --passthrough.")
+	cmd.Flags().StringArrayVar(&opt.Queries, "query", opt.Queries, "A PromQL expression evaluated as an instant query with --from-mode=query. The result must be a vector and every series must have a metric name. May be repeated.")
 	cmd.Flags().StringVar(&opt.FromToken, "from-token", opt.FromToken, "A bearer token to use when authenticating to the source Prometheus server.")
 	cmd.Flags().StringVar(&opt.FromCAFile, "from-ca-file", opt.FromCAFile, "A file containing the CA certificate to use to verify the --from URL in addition to the system roots certificates.")
+	cmd.Flags().StringArrayVar(&opt.FromCertPins, "from-cert-pin", opt.FromCertPins, "Accept the --from server only if its certificate has this SHA-256 fingerprint, in sha256:<hex> form, instead of verifying it with certificate authorities. May be repeated to rotate certificates. Can't be combined with --from-ca-file.")
 	cmd.Flags().StringVar(&opt.FromTokenFile, "from-token-file", opt.FromTokenFile, "A file containing a bearer token to use when authenticating to the source Prometheus server.")
+	cmd.Flags().StringVar(&opt.UserAgent, "user-agent", opt.UserAgent, "The User-Agent sent with requests to the --from and --to servers.")
 	cmd.Flags().StringVar(&opt.Identifier, "id", opt.Identifier, "The unique identifier for metrics sent with this client.")
-	cmd.Flags().StringVar(&opt.To, "to", opt.To, "A telemeter server to send metrics to.")
-	cmd.Flags().StringVar(&opt.ToUpload, "to-upload", opt.ToUpload, "A telemeter server endpoint to push metrics to. Will be defaulted for standard servers.")
-	cmd.Flags().StringVar(&opt.ToAuthorize, "to-auth", opt.ToAuthorize, "A telemeter server endpoint to exchange the bearer token for an access token. Will be defaulted for standard servers.")
+	cmd.Flags().StringArrayVar(&opt.To, "to", opt.To, "A telemeter server to send metrics to. May be repeated to send each batch to multiple servers, the labels required by the first server are added to all metrics.")
+	cmd.Flags().StringArrayVar(&opt.ToCertPins, "to-cert-pin", opt.ToCertPins, "Accept the --to and --to-otlp servers only if their certificate has this SHA-256 fingerprint, in sha256:<hex> form, instead of verifying it with certificate authorities. May be repeated to rotate certificates.")
+	cmd.Flags().StringArrayVar(&opt.ToOTLP, "to-otlp", opt.ToOTLP, "An OTLP/HTTP metrics endpoint, such as http://collector:4318/v1/metrics, to send metrics to as protobuf. May be repeated and combined with --to.")
+	cmd.Flags().StringVar(&opt.ToUpload, "to-upload", opt.ToUpload, "A telemeter server endpoint to push metrics to. Will be defaulted for standard servers. Only valid with a single --to.")
+	cmd.Flags().StringArrayVar(&opt.ToAuthorize, "to-auth", opt.ToAuthorize, "A telemeter server endpoint to exchange the bearer token for an access token. Will be defaulted for standard servers. Only valid with a single --to. May be repeated to fail over between endpoints, append ;weight=N to an endpoint to prefer it N times as often when choosing a new one.")
 	cmd.Flags().StringVar(&opt.ToToken, "to-token", opt.ToToken, "A bearer token to use when authenticating to the destination telemeter server.")
+	cmd.Flags().StringVar(&opt.FromBasicAuth, "from-basic-auth", opt.FromBasicAuth, "Credentials in user:password form to send with HTTP basic authentication to the source Prometheus server, in the Authorization header. A request carries a single Authorization header, so with --from-token, which uses it for the bearer token, the credentials are sent in the Proxy-Authorization header instead.")
+	cmd.Flags().StringVar(&opt.FromBasicAuthFile, "from-basic-auth-file", opt.FromBasicAuthFile, "A file containing the --from-basic-auth credentials.")
+	cmd.Flags().StringVar(&opt.ToBasicAuth, "to-basic-auth", opt.ToBasicAuth, "Credentials in user:password form to send with HTTP basic authentication to the destination telemeter server, in the Authorization header. A request carries a single Authorization header, so with --to-token, which uses it for the bearer token, the credentials are sent in the Proxy-Authorization header instead. A gateway in front of the server must then read them from that header.")
+	cmd.Flags().StringVar(&opt.ToBasicAuthFile, "to-basic-auth-file", opt.ToBasicAuthFile, "A file containing the --to-basic-auth credentials.")
+	cmd.Flags().StringArrayVar(&opt.FromHeaders, "from-header", opt.FromHeaders, "A header in Name:Value form, such as X-Tenant:a, to send with requests to the source Prometheus server. May be repeated. The Authorization header is set by --from-token and --from-basic-auth instead.")
+	cmd.Flags().StringArrayVar(&opt.ToHeaders, "to-header", opt.ToHeaders, "A header in Name:Value form, such as X-Tenant:a, to send with authorize and upload requests to the --to and --to-otlp servers. May be repeated. The Authorization header is set by --to-token and --to-basic-auth instead.")
 	cmd.Flags().StringVar(&opt.ToTokenFile, "to-token-file", opt.ToTokenFile, "A file containing a bearer token to use when authenticating to the destination telemeter server.")
+	cmd.Flags().StringVar(&opt.ToTokenFallback, "to-token-fallback", opt.ToTokenFallback, "A bearer token to authenticate with when the server rejects --to-token with 401 or 403, such as while a rotated token is not yet valid. --to-token is tried first every time a token is exchanged.")
+	cmd.Flags().StringVar(&opt.ToTokenFallbackFile, "to-token-fallback-file", opt.ToTokenFallbackFile, "A file containing the --to-token-fallback.")
+	cmd.Flags().StringVar(&opt.ToHMACKey, "to-hmac-key", opt.ToHMACKey, "A key shared with the destination telemeter server to sign uploads with, which lets the server reject forged uploads before validating the token.")
+	cmd.Flags().StringVar(&opt.ToHMACKeyFile, "to-hmac-key-file", opt.ToHMACKeyFile, "A file containing the --to-hmac-key.")
+	cmd.Flags().IntVar(&opt.MaxIdleConns, "http-max-idle-conns", opt.MaxIdleConns, "The maximum number of idle connections kept open to all servers. Zero means no limit.")
+	cmd.Flags().IntVar(&opt.MaxIdleConnsPerHost, "http-max-idle-conns-per-host", opt.MaxIdleConnsPerHost, "The maximum number of idle connections kept open to each server. Zero uses the Go default of 2.")
+	cmd.Flags().DurationVar(&opt.IdleConnTimeout, "http-idle-conn-timeout", opt.IdleConnTimeout, "Close connections that were idle for this long. Zero keeps them open until the server closes them.")
+	cmd.Flags().DurationVar(&opt.KeepAlive, "http-keep-alive", opt.KeepAlive, "The period of TCP keep-alive probes on connections to servers. Zero uses 30s.")
+	cmd.Flags().BoolVar(&opt.DisableKeepAlives, "http-disable-keep-alives", opt.DisableKeepAlives, "Open a new connection for every request instead of reusing idle connections.")
+	cmd.Flags().BoolVar(&opt.HTTP2, "http2", opt.HTTP2, "Negotiate HTTP/2 with the --from and --to servers over HTTPS, falling back to HTTP/1.1 for servers that don't support it. The protocol of each response is counted in telemeter_http_responses_total and logged when it changes.")
 	cmd.Flags().DurationVar(&opt.Interval, "interval", opt.Interval, "The interval between scrapes. Prometheus returns the last 5 minutes of metrics when invoking the federation endpoint.")
+	cmd.Flags().IntVar(&opt.RetainUploads, "debug-retain-uploads", opt.RetainUploads, "Keep the last N uploaded batches in memory and serve them at /debug/uploads. The batches are not redacted.")
+	cmd.Flags().DurationVar(&opt.ScrapeTimeout, "scrape-timeout", opt.ScrapeTimeout, "The maximum time to wait for the --from server to return metrics. Defaults to a third of --interval.")
+	cmd.Flags().DurationVar(&opt.UploadTimeout, "upload-timeout", opt.UploadTimeout, "The maximum time to wait for each upload to a destination. Defaults to a third of --interval.")
+	cmd.Flags().BoolVar(&opt.DrainOnShutdown, "drain-on-shutdown", opt.DrainOnShutdown, "On SIGTERM or interrupt, stop the current cycle and forward one final batch before exiting.")
+	cmd.Flags().DurationVar(&opt.DrainTimeout, "drain-timeout", opt.DrainTimeout, "The maximum time to spend forwarding the final batch with --drain-on-shutdown. Defaults to the sum of --scrape-timeout and --upload-timeout.")
+	cmd.Flags().BoolVar(&opt.AllowAggressiveInterval, "allow-aggressive-interval", opt.AllowAggressiveInterval, "Allow an --interval shorter than the larger of 30s and twice --scrape-timeout.")
+	cmd.Flags().Float64Var(&opt.IntervalJitter, "interval-jitter", opt.IntervalJitter, "Randomly vary each interval by up to this fraction of --interval in either direction, between 0 and 1.")
+	cmd.Flags().BoolVar(&opt.GuardCounterResets, "guard-counter-resets", opt.GuardCounterResets, "Replace small decreases of counters between scrapes, which are usually caused by federating from different Prometheus replicas, with the previous value. Large decreases are treated as real resets.")
+	cmd.Flags().BoolVar(&opt.CountersAsDelta, "counters-as-delta", opt.CountersAsDelta, "Upload the increase of each counter since the previous scrape as a gauge instead of its cumulative value, for destinations that expect deltas. The first sample of each series is not uploaded, and resets yield zero. The increase in a batch that could not be uploaded or spooled is included in the next one.")
+	cmd.Flags().StringVar(&opt.CounterDeltaSuffix, "counters-delta-suffix", opt.CounterDeltaSuffix, "A suffix appended to the name of counters uploaded by --counters-as-delta.")
+	cmd.Flags().IntVar(&opt.TransformConcurrency, "transform-concurrency", opt.TransformConcurrency, "The number of goroutines used to transform large batches. Transformers that keep state between metrics always run serially. Zero uses one goroutine per CPU.")
+	cmd.Flags().BoolVar(&opt.ProfileTransforms, "profile-transforms", opt.ProfileTransforms, "Record the time spent in each transformer in the telemeter_transform_duration_seconds_total metric.")
+	cmd.Flags().BoolVar(&opt.CountTransformDrops, "count-transform-drops", opt.CountTransformDrops, "Record the number of series dropped by each transformer in the telemeter_transform_dropped_total metric.")
+	cmd.Flags().BoolVar(&opt.PrintTransforms, "print-transforms", opt.PrintTransforms, "Print the transformers built from the other flags, in the order they are applied to each batch, with their key parameters and exit. Secrets such as the anonymization salt are not printed.")
+	cmd.Flags().DurationVar(&opt.LogThrottle, "log-throttle", opt.LogThrottle, "Log failures that repeat every interval, such as failed uploads, at most once per this duration and report how many occurred in between once the duration is over. Zero logs every failure.")
+	cmd.Flags().IntVar(&opt.BreakerThreshold, "upload-failure-threshold", opt.BreakerThreshold, "Stop uploading for --upload-failure-cooldown after this many consecutive upload failures. Zero disables the check.")
+	cmd.Flags().DurationVar(&opt.BreakerCooldown, "upload-failure-cooldown", opt.BreakerCooldown, "How long to stop uploading after --upload-failure-threshold consecutive failures before a single upload is attempted again.")
+	cmd.Flags().IntVar(&opt.SourceBackoffThreshold, "scrape-failure-threshold", opt.SourceBackoffThreshold, "Double the interval after this many consecutive failed scrapes of the --from server, and again after every further failure up to --scrape-backoff-max, to relieve a struggling source. The interval is restored after a successful scrape and reported in federate_interval_seconds. Zero disables the backoff.")
+	cmd.Flags().DurationVar(&opt.SourceBackoffMax, "scrape-backoff-max", opt.SourceBackoffMax, "The longest interval used after failed scrapes with --scrape-failure-threshold. Defaults to four times --interval.")
+	cmd.Flags().DurationVar(&opt.MaxRetryAfter, "max-retry-after", opt.MaxRetryAfter, "The longest delay before the next upload honored when a destination answers with a Retry-After header. Defaults to three times --interval.")
+	cmd.Flags().IntVar(&opt.MaxBatchBytes, "max-batch-bytes", opt.MaxBatchBytes, "Drop whole metrics, lowest --metric-priority first and then largest, until the uncompressed size of each batch is at most this many bytes. Zero disables the limit.")
+	cmd.Flags().IntVar(&opt.MaxUploadBytes, "max-upload-bytes", opt.MaxUploadBytes, "Split each batch into several uploads whose uncompressed size is at most about this many bytes, to stay below the request size limit of the destination. The uploads of a batch share an X-Telemeter-Batch-Id header and each one that fails is retried once. Only valid with --to-otlp destinations, telemeter servers keep only the latest upload of each cluster. Zero uploads each batch in a single request.")
+	cmd.Flags().StringVar(&opt.SequenceStateFile, "sequence-state-file", opt.SequenceStateFile, "A file to store the sequence number of the next upload to each server in, so that numbering continues after a restart. Every upload carries its number in the X-Telemeter-Sequence header, and --id in the X-Telemeter-Client-Id header, so that the server can detect lost uploads. Numbering starts at the time the client starts in milliseconds if not set.")
+	cmd.Flags().StringVar(&opt.SpoolDir, "spool-dir", opt.SpoolDir, "A directory to store the parts of batches that could not be uploaded in, including batches skipped after --upload-failure-threshold consecutive failures. Stored batches are uploaded again, oldest first, once the server accepts uploads, including after a restart.")
+	cmd.Flags().Int64Var(&opt.SpoolMaxBytes, "spool-max-bytes", opt.SpoolMaxBytes, "The maximum size of the batches stored in --spool-dir for each server. The oldest batches are discarded first.")
+	cmd.Flags().DurationVar(&opt.SpoolMaxAge, "spool-max-age", opt.SpoolMaxAge, "Discard batches stored in --spool-dir after this long.")
+	cmd.Flags().BoolVar(&opt.Passthrough, "passthrough", opt.Passthrough, "Upload federated metrics as they were retrieved without decoding them, which saves CPU. Labels required by the server are still added. The build info metric is not added and samples are not checked or sorted. Can't be combined with flags that transform metrics.")
+	cmd.Flags().StringVar(&opt.PartitionLabel, "partition-label", opt.PartitionLabel, "Split each batch by the value of this label and upload every partition in a separate request. Series without the label are uploaded together. Only valid with --to-otlp destinations, telemeter servers keep only the latest upload of each cluster.")
+	cmd.Flags().BoolVar(&opt.SkipUnchanged, "skip-unchanged", opt.SkipUnchanged, "Send a hash of each batch and skip uploading a batch to a server that acknowledged the same hash for the previous batch. The build info metric is not included in the hash.")
+	cmd.Flags().IntVar(&opt.MaxUploadsPerMinute, "max-uploads-per-minute", opt.MaxUploadsPerMinute, "The maximum number of uploads per minute. Batches exceeding the rate are skipped. Zero disables the limit.")
 
 	// TODO: more complex input definition, such as a JSON struct
 	cmd.Flags().StringArrayVar(&opt.Rules, "match", opt.Rules, "Match rules to federate.")
-	cmd.Flags().StringVar(&opt.RulesFile, "match-file", opt.RulesFile, "A file containing match rules to federate, one rule per line.")
+	cmd.Flags().StringArrayVar(&opt.RulesFiles, "match-file", opt.RulesFiles, "A file containing match rules to federate, one rule per line. Lines starting with # or // are ignored, every other line must be a valid series selector. May be repeated to combine the rules of several files.")
+	cmd.Flags().StringVar(&opt.MatchConfig, "match-config", opt.MatchConfig, "A YAML or JSON file with match rules to federate under the \"matches\" key. Each rule is a string or an object with \"match\" and an optional \"description\".")
+	cmd.Flags().StringVar(&opt.MatchRegex, "match-regex", opt.MatchRegex, "Federate every metric whose name fully matches this regular expression. Metric names are read from the --from server and a match rule is added for each matching name.")
+	cmd.Flags().DurationVar(&opt.MatchRegexRefresh, "match-regex-refresh", opt.MatchRegexRefresh, "How often to refresh the metric names used by --match-regex.")
+	cmd.Flags().StringVar(&opt.ValidateMatch, "validate-match", opt.ValidateMatch, "Federate each match rule from the --from server once at startup and report rules that match no series: warn to log them, or error to exit. Rules are checked concurrently and each is given up on after --scrape-timeout, the check as a whole after three times --scrape-timeout. Rules that can't be retrieved never fail startup. Rules are not checked if not set.")
 
-	cmd.Flags().StringArrayVar(&opt.LabelFlag, "label", opt.LabelFlag, "Labels to add to each outgoing metric, in key=value form.")
+	cmd.Flags().StringArrayVar(&opt.LabelFlag, "label", opt.LabelFlag, "Labels to add to each outgoing metric, in key=value form. $VAR and ${VAR} are replaced with the value of the environment variable, use $$ for a literal $.")
+	cmd.Flags().StringVar(&opt.LabelFile, "label-file", opt.LabelFile, "A file of key=value lines with labels to add to each outgoing metric, such as pod labels written by the Kubernetes downward API. Values may be double quoted, and blank lines and lines starting with # are ignored. Keys and values are expanded like --label, which takes precedence over the file, and characters that are not valid in label names are replaced by '_'. The file is reloaded when it changes.")
+	cmd.Flags().StringVar(&opt.ExtraMetricsFile, "extra-metrics-file", opt.ExtraMetricsFile, "A file of metrics in the Prometheus text exposition format added to every uploaded batch, such as info metrics describing the deployment. Added metrics replace federated metrics with the same name and get --label and the labels required by the server. The file is reloaded when it changes.")
+	cmd.Flags().StringVar(&opt.RemapConfig, "remap-config", opt.RemapConfig, "A YAML or JSON file with lookup tables that replace label values, such as verbose OS names with short canonical ones, applied after --relabel-config. Under the \"label_values\" key each label name maps to an object with \"values\" from old to new values, an optional list of \"patterns\" with a \"regex\" and a \"replacement\" for values not in the table, and an optional \"default\" for values matched by neither. An empty new value removes the label.")
+	cmd.Flags().StringVar(&opt.RelabelConfig, "relabel-config", opt.RelabelConfig, "A YAML or JSON file with a list of Prometheus relabeling rules under the \"relabel_configs\" key, applied in order to each outgoing metric after --label. The replace, keep, drop, labeldrop, and labelkeep actions are supported.")
+	cmd.Flags().StringVar(&opt.SourceLabel, "source-label", opt.SourceLabel, "Add a label with this name and the host of the --from server as its value to each outgoing metric. A --label or a label required by the server with the same name takes precedence. Not added if empty.")
+	cmd.Flags().StringArrayVar(&opt.RoundFlag, "round-value", opt.RoundFlag, "Round the values of a metric before sending, in NAME=nearest:STEP or NAME=significant:DIGITS form. Counters are only rounded if :counters is appended. NAME is matched after --rename and --metric-prefix. May be repeated.")
+	cmd.Flags().StringArrayVar(&opt.PriorityFlag, "metric-priority", opt.PriorityFlag, "The priority of a metric in NAME=N form, used to choose the metrics to drop when a batch exceeds --max-batch-bytes. Metrics with a lower priority are dropped first, unlisted metrics have priority 0. NAME is matched after --rename and --metric-prefix. May be repeated.")
+	cmd.Flags().StringArrayVar(&opt.CoerceTypeFlag, "coerce-type", opt.CoerceTypeFlag, "Declare an untyped metric as a counter or gauge, in NAME=TYPE form. Only the type changes, not the samples. NAME is matched after --rename and --metric-prefix. May be repeated.")
+	cmd.Flags().StringArrayVar(&opt.AggregateFlag, "aggregate", opt.AggregateFlag, "Remove labels from the series of a metric and combine the series left with the same labels, in NAME=OP:LABEL,LABEL,... form, where OP is sum, max, or min and defaults to sum if omitted with its colon. NAME is matched after --rename and --metric-prefix. Histograms and summaries are not aggregated. May be repeated.")
+	cmd.Flags().StringArrayVar(&opt.SummaryGaugesFlag, "summary-to-gauge", opt.SummaryGaugesFlag, "Extract quantiles of a summary into gauges, in NAME=Q,Q,... form. The gauge of quantile 0.99 of a summary is named NAME_p99, and of 0.999 NAME_p99_9. NAME is matched after --rename and --metric-prefix. May be repeated.")
+	cmd.Flags().StringVar(&opt.SummaryGaugesMode, "summary-to-gauge-summary", opt.SummaryGaugesMode, "What to do with a summary named by --summary-to-gauge after extracting its quantiles: keep it, drop it, or replace it with counters named NAME_sum and NAME_count.")
+	cmd.Flags().StringArrayVar(&opt.DownsampleFlag, "downsample", opt.DownsampleFlag, "Upload a slowly changing metric only in every Nth batch it appears in, in NAME=N form. The metric is always uploaded in the first batch after the client starts. Samples of the metric are spaced unevenly downstream whenever the interval changes or the client restarts. NAME is matched after --rename and --metric-prefix. May be repeated.")
+	cmd.Flags().StringArrayVar(&opt.SampleRateFlag, "sample-rate", opt.SampleRateFlag, "Upload only a fraction of the series of a high cardinality metric, in NAME=RATE form with a RATE from 0 to 1, such as 0.1. Whether a series is uploaded depends on a hash of its labels, so the same series are uploaded in every batch. NAME is matched after --rename and --metric-prefix. May be repeated.")
+	cmd.Flags().StringArrayVar(&opt.ReduceBucketsFlag, "reduce-buckets", opt.ReduceBucketsFlag, "Keep only the listed bucket boundaries of a histogram, in NAME=LE,LE,... form, where NAME is the histogram name without the _bucket suffix, matched after --rename and --metric-prefix. The +Inf bucket, sum, and count are always kept. May be repeated.")
+	cmd.Flags().StringArrayVar(&opt.KeepLabels, "keep-label", opt.KeepLabels, "Only send these labels from the --from server, removing all others. May be repeated. Labels added with --label or required by the server are always sent. All labels are sent if not set.")
+	cmd.Flags().BoolVar(&opt.StripMetaLabels, "strip-meta-labels", opt.StripMetaLabels, fmt.Sprintf("Remove labels that describe where a series was scraped rather than what it measures: %s. Series left with the same labels are merged, keeping the newest sample.", strings.Join(transform.DefaultMetaLabels, ", ")))
+	cmd.Flags().StringArrayVar(&opt.StripMetaLabelsExtra, "strip-meta-label", opt.StripMetaLabelsExtra, "An additional label removed by --strip-meta-labels. May be repeated.")
 	cmd.Flags().StringSliceVar(&opt.RenameFlag, "rename", opt.RenameFlag, "Rename metrics before sending by specifying OLD=NEW name pairs. Defaults to renaming ALERTS to alerts. Defaults to ALERTS=alerts.")
+	cmd.Flags().StringVar(&opt.MetricPrefix, "metric-prefix", opt.MetricPrefix, "A prefix added to the name of every metric that does not already start with it, after --rename. The match rules, --relabel-config, and --rename see the names without the prefix, the destination and the other flags that name metrics see the prefixed names.")
+
+	cmd.Flags().StringVar(&opt.TimestampOrder, "timestamp-order", opt.TimestampOrder, "How to fix series of a metric whose sample timestamps do not strictly increase, which some servers reject: drop keeps the first sample of each timestamp, and keep-last keeps the last one. Applied after samples are sorted by timestamp. Dropped samples are counted in telemeter_client_timestamp_order_fixed_samples_total. Samples are left as they are if not set.")
+	cmd.Flags().StringVar(&opt.DedupeSeries, "dedupe-series", opt.DedupeSeries, "How to resolve series of a metric with identical labels, which some servers reject: newest keeps the newest sample, max keeps the largest value, and drop drops all of them. Applied after every other change to names and labels. Duplicates are kept if not set.")
+	cmd.Flags().StringArrayVar(&opt.RequireLabels, "require-label", opt.RequireLabels, "A label that every uploaded series must carry with a non-empty value, checked after every other change to labels. May be repeated.")
+	cmd.Flags().StringVar(&opt.RequireLabelMode, "require-label-mode", opt.RequireLabelMode, "What to do with series that lack a --require-label: error to skip uploading the batch, or drop to drop the series. Dropped series are counted in telemeter_client_required_labels_dropped_series_total.")
+	cmd.Flags().StringVar(&opt.InvalidNames, "invalid-names", opt.InvalidNames, "How to handle metric and label names that are not valid Prometheus names: drop, sanitize, or error. Names are passed through unchanged if not set.")
+
+	cmd.Flags().IntVar(&opt.MaxLabelLength, "max-label-length", opt.MaxLabelLength, "Truncate label values longer than this many bytes, appending a short hash of the original value. Zero disables truncation.")
+	cmd.Flags().DurationVar(&opt.MaxAgeDefault, "max-age-default", opt.MaxAgeDefault, "Drop samples older than this, unless a --max-age is set for their metric. The server may drop samples older than its own limit regardless.")
+	cmd.Flags().StringArrayVar(&opt.MaxAgeFlag, "max-age", opt.MaxAgeFlag, "Drop samples of a metric older than a maximum age, in NAME=DURATION form, such as up=5m, instead of --max-age-default. NAME is matched after --rename and --metric-prefix. May be repeated.")
+	cmd.Flags().BoolVar(&opt.KeepStaleMarkers, "keep-stale-markers", opt.KeepStaleMarkers, "Upload samples that are Prometheus staleness markers, which are dropped by default. Markers are always uploaded with --passthrough.")
+	cmd.Flags().IntVar(&opt.MaxLabelsPerSeries, "max-labels-per-series", opt.MaxLabelsPerSeries, "Remove labels from series with more than this many labels, keeping the --max-labels-priority labels first. Series left with the same labels are merged, keeping the newest sample. Removed labels are counted in telemeter_client_series_labels_dropped_total. Zero disables the limit.")
+	cmd.Flags().StringArrayVar(&opt.MaxLabelsPriority, "max-labels-priority", opt.MaxLabelsPriority, "A label kept by --max-labels-per-series before any other label, such as cluster. May be repeated, earlier labels are kept first.")
+
+	cmd.Flags().StringVar(&opt.AlignTimestamps, "align-timestamps", opt.AlignTimestamps, "Move the timestamps of samples older than --align-timestamps-window closer to the scrape time: clamp sets them to the scrape time, shift moves them forward by at most --align-timestamps-max-shift. Timestamps are unchanged if not set.")
+	cmd.Flags().DurationVar(&opt.AlignTimestampsWindow, "align-timestamps-window", opt.AlignTimestampsWindow, "Samples newer than this are never changed by --align-timestamps.")
+	cmd.Flags().DurationVar(&opt.AlignTimestampsMaxShift, "align-timestamps-max-shift", opt.AlignTimestampsMaxShift, "The maximum amount a timestamp is moved when --align-timestamps=shift.")
 
 	cmd.Flags().StringArrayVar(&opt.AnonymizeLabels, "anonymize-labels", opt.AnonymizeLabels, "Anonymize the values of the provided values before sending them on.")
+	cmd.Flags().StringArrayVar(&opt.AnonymizeBucketFlag, "anonymize-buckets", opt.AnonymizeBucketFlag, "Anonymize the values of a label by mapping each value to one of K buckets, in label=K form. Values in the same bucket become equal. Uses --anonymize-salt.")
 	cmd.Flags().StringVar(&opt.AnonymizeSalt, "anonymize-salt", opt.AnonymizeSalt, "A secret and unguessable value used to anonymize the input data.")
 	cmd.Flags().StringVar(&opt.AnonymizeSaltFile, "anonymize-salt-file", opt.AnonymizeSaltFile, "A file containing a secret and unguessable value used to anonymize the input data.")
 
@@ -69,59 +260,445 @@ func main() {
 }
 
 type Options struct {
+	Config string
+
 	Listen     string
 	LimitBytes int64
+	LimitMode  string
+
+	PartialOnTimeout bool
+
+	TLSCertFile string
+	TLSKeyFile  string
+	TLSClientCA string
 
 	From          string
-	To            string
+	FromMode      string
+	Queries       []string
+	To            []string
+	ToOTLP        []string
 	ToUpload      string
-	ToAuthorize   string
+	ToAuthorize   []string
 	FromCAFile    string
 	FromToken     string
 	FromTokenFile string
 	ToToken       string
 	ToTokenFile   string
+	ToHMACKey     string
+	ToHMACKeyFile string
 	Identifier    string
 
-	RenameFlag []string
-	Renames    map[string]string
+	ToTokenFallback     string
+	ToTokenFallbackFile string
 
-	AnonymizeLabels   []string
-	AnonymizeSalt     string
-	AnonymizeSaltFile string
+	FromCertPins []string
+	ToCertPins   []string
 
-	Rules     []string
-	RulesFile string
+	FromBasicAuth     string
+	FromBasicAuthFile string
+	ToBasicAuth       string
+	ToBasicAuthFile   string
+	UserAgent         string
+	FromHeaders       []string
+	ToHeaders         []string
 
-	LabelFlag []string
-	Labels    map[string]string
+	RenameFlag   []string
+	Renames      map[string]string
+	MetricPrefix string
 
-	Interval time.Duration
+	InvalidNames   string
+	DedupeSeries   string
+	TimestampOrder string
+	MaxLabelLength int
+
+	MaxAgeDefault time.Duration
+	MaxAgeFlag    []string
+	MaxAges       map[string]time.Duration
+
+	KeepStaleMarkers   bool
+	MaxLabelsPerSeries int
+	MaxLabelsPriority  []string
+
+	RequireLabels    []string
+	RequireLabelMode string
+
+	AlignTimestamps         string
+	AlignTimestampsWindow   time.Duration
+	AlignTimestampsMaxShift time.Duration
+
+	AnonymizeLabels     []string
+	AnonymizeBucketFlag []string
+	AnonymizeBuckets    map[string]int
+	AnonymizeSalt       string
+	AnonymizeSaltFile   string
+
+	Rules       []string
+	RulesFiles  []string
+	MatchConfig string
+
+	MatchRegex        string
+	MatchRegexRefresh time.Duration
+	ValidateMatch     string
+
+	KeepLabels []string
+
+	StripMetaLabels      bool
+	StripMetaLabelsExtra []string
+
+	RoundFlag []string
+	Rounding  map[string]transform.Rounding
+
+	PriorityFlag []string
+	Priorities   map[string]int
+
+	CoerceTypeFlag []string
+	CoerceTypes    map[string]clientmodel.MetricType
+
+	AggregateFlag []string
+	Aggregations  map[string]transform.Aggregation
+
+	ReduceBucketsFlag []string
+	ReduceBuckets     map[string][]float64
+
+	DownsampleFlag []string
+	Downsample     map[string]int
+
+	SampleRateFlag []string
+	SampleRates    map[string]float64
+
+	SummaryGaugesFlag []string
+	SummaryGauges     map[string][]float64
+	SummaryGaugesMode string
+
+	LabelFlag   []string
+	Labels      map[string]string
+	SourceLabel string
+
+	Interval             time.Duration
+	IntervalJitter       float64
+	ScrapeTimeout        time.Duration
+	UploadTimeout        time.Duration
+	DrainOnShutdown      bool
+	DrainTimeout         time.Duration
+	ProfileTransforms    bool
+	CountTransformDrops  bool
+	PrintTransforms      bool
+	GuardCounterResets   bool
+	CountersAsDelta      bool
+	CounterDeltaSuffix   string
+	TransformConcurrency int
+	RetainUploads        int
+	MaxUploadsPerMinute  int
+	MaxBatchBytes        int
+	MaxUploadBytes       int
+	SkipUnchanged        bool
+	PartitionLabel       string
+	Passthrough          bool
+	BreakerThreshold     int
+	BreakerCooldown      time.Duration
+	LogThrottle          time.Duration
+
+	SourceBackoffThreshold int
+	SourceBackoffMax       time.Duration
+
+	MaxRetryAfter time.Duration
+
+	AllowAggressiveInterval bool
+
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	KeepAlive           time.Duration
+	DisableKeepAlives   bool
+	HTTP2               bool
+
+	SpoolDir      string
+	SpoolMaxBytes int64
+	SpoolMaxAge   time.Duration
+
+	SequenceStateFile string
+
+	RelabelConfig    string
+	RemapConfig      string
+	ExtraMetricsFile string
+	LabelFile        string
 
 	LabelRetriever transform.LabelRetriever
+
+	lock         sync.Mutex
+	regexRules   []string
+	counterGuard *transform.CounterResetGuard
+	counterDelta *transform.CounterToDelta
+	requireLabel transform.Interface
+	labelLimiter *transform.LabelCountLimiter
+	monotonic    *transform.MonotonicTimestamps
+	relabeler    transform.Interface
+	remapper     transform.Interface
+	extraMetrics *transform.ExtraMetrics
+	labelFile    *transform.LabelFile
+	summaries    *transform.SummaryGauges
+	downsampler  *transform.Downsampler
 }
 
 func (o *Options) Transforms() []transform.Interface {
+	if o.Passthrough {
+		// the worker uploads batches without decoding them if there are no transforms
+		return nil
+	}
 	var transforms transform.All
+	if len(o.KeepLabels) > 0 {
+		// before the build info and added labels so they are not removed
+		transforms = append(transforms, transform.NewLabelAllowlist(o.KeepLabels))
+	}
+	if o.StripMetaLabels {
+		// before the added labels for the same reason
+		transforms = append(transforms, transform.NewStripMetaLabels(o.StripMetaLabelsExtra...))
+	}
+	transforms = append(transforms,
+		// added before the remaining transformers so they apply to it
+		transform.NewBuildInfo(buildInfoName, map[string]string{
+			"version":   version,
+			"goversion": runtime.Version(),
+			"commit":    commit,
+		}, time.Now()),
+	)
+	if o.extraMetrics != nil {
+		// with the build info, so that added labels and the remaining transformers
+		// apply to them
+		transforms = append(transforms, o.extraMetrics)
+	}
+	if len(o.InvalidNames) > 0 {
+		transforms = append(transforms, transform.NewNameValidator(transform.InvalidNamesMode(o.InvalidNames)))
+	}
+	if o.labelFile != nil {
+		// before the other added labels, so that they take precedence
+		transforms = append(transforms, o.labelFile)
+	}
 	if len(o.Labels) > 0 || o.LabelRetriever != nil {
 		transforms = append(transforms, transform.NewLabel(o.Labels, o.LabelRetriever))
 	}
-	if len(o.AnonymizeLabels) > 0 {
-		transforms = append(transforms, transform.NewMetricsAnonymizer(o.AnonymizeSalt, o.AnonymizeLabels, nil))
+	if o.relabeler != nil {
+		transforms = append(transforms, o.relabeler)
+	}
+	if o.remapper != nil {
+		transforms = append(transforms, o.remapper)
+	}
+	if len(o.AnonymizeLabels) > 0 || len(o.AnonymizeBuckets) > 0 {
+		transforms = append(transforms, transform.NewMetricsAnonymizer(o.AnonymizeSalt, o.AnonymizeLabels, nil).WithBuckets(o.AnonymizeBuckets))
 	}
 	if len(o.Renames) > 0 {
 		transforms = append(transforms, transform.RenameMetrics{Names: o.Renames})
 	}
+	if len(o.MetricPrefix) > 0 {
+		// after renames, so they match names without the prefix, and before the
+		// transformers below, which match the prefixed names
+		transforms = append(transforms, transform.NewPrefixMetrics(o.MetricPrefix))
+	}
+	if len(o.CoerceTypes) > 0 {
+		transforms = append(transforms, transform.NewTypeCoercer(o.CoerceTypes))
+	}
+	if o.summaries != nil {
+		// before the downsampler, so that it can select the extracted gauges
+		transforms = append(transforms, o.summaries)
+	}
+	if o.downsampler != nil {
+		transforms = append(transforms, o.downsampler)
+	}
+	if len(o.SampleRates) > 0 {
+		transforms = append(transforms, transform.NewSeriesSampler(o.SampleRates))
+	}
+	if len(o.ReduceBuckets) > 0 {
+		transforms = append(transforms, transform.NewBucketReducer(o.ReduceBuckets))
+	}
+	if len(o.Rounding) > 0 {
+		transforms = append(transforms, transform.NewValueRounder(o.Rounding))
+	}
+	if o.MaxLabelLength > 0 {
+		transforms = append(transforms, transform.NewLabelValueTruncator(o.MaxLabelLength))
+	}
+	if o.labelLimiter != nil {
+		transforms = append(transforms, o.labelLimiter)
+	}
+	now := time.Now()
+	maxAge := o.MaxAgeDefault
+	for _, age := range o.MaxAges {
+		if age > maxAge {
+			maxAge = age
+		}
+	}
+	transforms = append(transforms, transform.NewDropInvalidFederateSamples(now.Add(-maxAge)))
+	if len(o.MaxAges) > 0 {
+		// the samples of metrics with a shorter age than the oldest allowed above
+		transforms = append(transforms, transform.NewDropOldSamples(now, o.MaxAgeDefault, o.MaxAges))
+	}
+	if !o.KeepStaleMarkers {
+		transforms = append(transforms, transform.NewDropStaleMarkers())
+	}
+	if len(o.Aggregations) > 0 {
+		// before the counter guard, so that it sees the aggregated series
+		transforms = append(transforms, transform.NewAggregator(o.Aggregations))
+	}
+	if o.counterGuard != nil {
+		transforms = append(transforms, o.counterGuard)
+	}
+	if o.counterDelta != nil {
+		transforms = append(transforms, o.counterDelta)
+	}
+	if len(o.AlignTimestamps) > 0 {
+		transforms = append(transforms, transform.NewTimestampAlign(transform.TimestampAlignMode(o.AlignTimestamps), time.Now(), o.AlignTimestampsWindow, o.AlignTimestampsMaxShift))
+	}
+	if len(o.DedupeSeries) > 0 {
+		transforms = append(transforms, transform.NewDedupeSeries(transform.DedupePolicy(o.DedupeSeries)))
+	}
+	if o.requireLabel != nil {
+		// after every change to labels, so that the uploaded series are checked
+		transforms = append(transforms, o.requireLabel)
+	}
 	transforms = append(transforms,
-		transform.NewDropInvalidFederateSamples(time.Now().Add(-24*time.Hour)),
 		transform.PackMetrics,
 		transform.SortMetrics,
 	)
-	return []transform.Interface{transforms}
+	if o.monotonic != nil {
+		transforms = append(transforms, o.monotonic)
+	}
+	if o.MaxBatchBytes > 0 {
+		// last, so that the size of the batch as it will be sent is measured
+		transforms = append(transforms, transform.NewBudgetEnforcer(o.MaxBatchBytes, func(name string) int { return o.Priorities[name] }))
+	}
+	if o.CountTransformDrops {
+		transforms = forwarder.CountDropped(transforms)
+	}
+	if o.ProfileTransforms {
+		transforms = forwarder.ProfileTransforms(transforms)
+	}
+	// returned separately rather than as a single transform.All so the worker calls
+	// the Append method of each transformer in turn
+	return transforms
+}
+
+// counterDrops counts the series dropped by a transformer in counter.
+type counterDrops struct {
+	counter prometheus.Counter
+}
+
+func (c counterDrops) Add(transform string, series int) { c.counter.Add(float64(series)) }
+
+// printTransforms writes the transformers returned by Transforms to w, one per line
+// in the order they are applied.
+func (o *Options) printTransforms(w io.Writer) {
+	transforms := o.Transforms()
+	if len(transforms) == 0 {
+		fmt.Fprintln(w, "no transformers, batches are uploaded unchanged")
+		return
+	}
+	for i, t := range transforms {
+		fmt.Fprintf(w, "%d. %s\n", i+1, transform.Describe(t))
+	}
+}
+
+// transformFlags returns the flags that are set and transform metrics.
+func (o *Options) transformFlags() []string {
+	var flags []string
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"--keep-label", len(o.KeepLabels) > 0},
+		{"--strip-meta-labels", o.StripMetaLabels},
+		{"--invalid-names", len(o.InvalidNames) > 0},
+		{"--dedupe-series", len(o.DedupeSeries) > 0},
+		{"--timestamp-order", len(o.TimestampOrder) > 0},
+		{"--max-age-default", o.MaxAgeDefault != defaultMaxAge},
+		{"--max-age", len(o.MaxAgeFlag) > 0},
+		{"--require-label", len(o.RequireLabels) > 0},
+		{"--label", len(o.LabelFlag) > 0},
+		{"--source-label", len(o.SourceLabel) > 0},
+		{"--relabel-config", len(o.RelabelConfig) > 0},
+		{"--remap-config", len(o.RemapConfig) > 0},
+		{"--extra-metrics-file", len(o.ExtraMetricsFile) > 0},
+		{"--label-file", len(o.LabelFile) > 0},
+		{"--anonymize-labels", len(o.AnonymizeLabels) > 0},
+		{"--anonymize-buckets", len(o.AnonymizeBucketFlag) > 0},
+		{"--rename", len(o.RenameFlag) > 0},
+		{"--metric-prefix", len(o.MetricPrefix) > 0},
+		{"--coerce-type", len(o.CoerceTypeFlag) > 0},
+		{"--aggregate", len(o.AggregateFlag) > 0},
+		{"--reduce-buckets", len(o.ReduceBucketsFlag) > 0},
+		{"--downsample", len(o.DownsampleFlag) > 0},
+		{"--sample-rate", len(o.SampleRateFlag) > 0},
+		{"--summary-to-gauge", len(o.SummaryGaugesFlag) > 0},
+		{"--round-value", len(o.RoundFlag) > 0},
+		{"--max-label-length", o.MaxLabelLength > 0},
+		{"--max-labels-per-series", o.MaxLabelsPerSeries > 0},
+		{"--guard-counter-resets", o.GuardCounterResets},
+		{"--counters-as-delta", o.CountersAsDelta},
+		{"--align-timestamps", len(o.AlignTimestamps) > 0},
+		{"--max-batch-bytes", o.MaxBatchBytes > 0},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	return flags
 }
 
 func (o *Options) MatchRules() []string {
-	return o.Rules
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if len(o.regexRules) == 0 {
+		return o.Rules
+	}
+	rules := make([]string, 0, len(o.Rules)+len(o.regexRules))
+	rules = append(rules, o.Rules...)
+	return append(rules, o.regexRules...)
+}
+
+// configReloaded records the result of an attempt to reload the configuration.
+func configReloaded(err error) {
+	if err != nil {
+		counterConfigReloads.WithLabelValues("failure").Inc()
+		return
+	}
+	counterConfigReloads.WithLabelValues("success").Inc()
+	gaugeConfigLastReload.SetToCurrentTime()
+}
+
+// refreshRegexRules replaces the rules generated from --match-regex with one rule
+// for each metric name returned by the label values API at u that matches re.
+func (o *Options) refreshRegexRules(ctx context.Context, client *metricsclient.Client, u *url.URL, re *regexp.Regexp) error {
+	names, err := client.LabelValues(ctx, &http.Request{Method: "GET", URL: u})
+	if err != nil {
+		configReloaded(err)
+		return err
+	}
+	defer configReloaded(nil)
+	var rules []string
+	for _, name := range names {
+		if re.MatchString(name) {
+			rules = append(rules, fmt.Sprintf("{__name__=%q}", name))
+		}
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.regexRules = rules
+	return nil
+}
+
+// runRegexRefresh refreshes the rules generated from --match-regex every interval
+// until ctx is done.
+func (o *Options) runRegexRefresh(ctx context.Context, interval time.Duration, client *metricsclient.Client, u *url.URL, re *regexp.Regexp) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := o.refreshRegexRules(ctx, client, u, re); err != nil && ctx.Err() == nil {
+				log.Printf("error: unable to refresh metric names for --match-regex: %v", err)
+			}
+		}
+	}
 }
 
 func (o *Options) Run() error {
@@ -136,6 +713,23 @@ func (o *Options) Run() error {
 		}
 		o.ToToken = strings.TrimSpace(string(data))
 	}
+	if len(o.ToTokenFallback) == 0 && len(o.ToTokenFallbackFile) > 0 {
+		data, err := ioutil.ReadFile(o.ToTokenFallbackFile)
+		if err != nil {
+			return fmt.Errorf("unable to read --to-token-fallback-file: %v", err)
+		}
+		o.ToTokenFallback = strings.TrimSpace(string(data))
+	}
+	if len(o.ToTokenFallback) > 0 && len(o.ToToken) == 0 {
+		return fmt.Errorf("--to-token-fallback requires --to-token")
+	}
+	if len(o.ToHMACKey) == 0 && len(o.ToHMACKeyFile) > 0 {
+		data, err := ioutil.ReadFile(o.ToHMACKeyFile)
+		if err != nil {
+			return fmt.Errorf("unable to read --to-hmac-key-file: %v", err)
+		}
+		o.ToHMACKey = strings.TrimSpace(string(data))
+	}
 	if len(o.FromToken) == 0 && len(o.FromTokenFile) > 0 {
 		data, err := ioutil.ReadFile(o.FromTokenFile)
 		if err != nil {
@@ -143,6 +737,26 @@ func (o *Options) Run() error {
 		}
 		o.FromToken = strings.TrimSpace(string(data))
 	}
+	if len(o.FromBasicAuth) == 0 && len(o.FromBasicAuthFile) > 0 {
+		data, err := ioutil.ReadFile(o.FromBasicAuthFile)
+		if err != nil {
+			return fmt.Errorf("unable to read --from-basic-auth-file: %v", err)
+		}
+		o.FromBasicAuth = strings.TrimSpace(string(data))
+	}
+	if len(o.ToBasicAuth) == 0 && len(o.ToBasicAuthFile) > 0 {
+		data, err := ioutil.ReadFile(o.ToBasicAuthFile)
+		if err != nil {
+			return fmt.Errorf("unable to read --to-basic-auth-file: %v", err)
+		}
+		o.ToBasicAuth = strings.TrimSpace(string(data))
+	}
+	if len(o.FromBasicAuth) > 0 && !strings.Contains(o.FromBasicAuth, ":") {
+		return fmt.Errorf("--from-basic-auth must be of the form user:password")
+	}
+	if len(o.ToBasicAuth) > 0 && !strings.Contains(o.ToBasicAuth, ":") {
+		return fmt.Errorf("--to-basic-auth must be of the form user:password")
+	}
 	if len(o.AnonymizeSalt) == 0 && len(o.AnonymizeSaltFile) > 0 {
 		data, err := ioutil.ReadFile(o.AnonymizeSaltFile)
 		if err != nil {
@@ -151,20 +765,346 @@ func (o *Options) Run() error {
 		o.AnonymizeSalt = strings.TrimSpace(string(data))
 	}
 
+	if flags := o.transformFlags(); o.Passthrough && len(flags) > 0 {
+		return fmt.Errorf("--passthrough can't be combined with flags that transform metrics: %s", strings.Join(flags, ", "))
+	}
+	if o.Passthrough && o.PartialOnTimeout {
+		return fmt.Errorf("--passthrough can't be combined with --partial-on-timeout")
+	}
+
+	switch metricsclient.LimitMode(o.LimitMode) {
+	case metricsclient.LimitFail, metricsclient.LimitTruncate:
+	default:
+		return fmt.Errorf("--limit-mode must be one of fail or truncate: %s", o.LimitMode)
+	}
+
+	switch transform.InvalidNamesMode(o.InvalidNames) {
+	case "", transform.InvalidNamesDrop, transform.InvalidNamesSanitize, transform.InvalidNamesError:
+	default:
+		return fmt.Errorf("--invalid-names must be one of drop, sanitize, or error: %s", o.InvalidNames)
+	}
+
+	switch transform.DedupePolicy(o.DedupeSeries) {
+	case "", transform.DedupeNewest, transform.DedupeMax, transform.DedupeDrop:
+	default:
+		return fmt.Errorf("--dedupe-series must be one of newest, max, or drop: %s", o.DedupeSeries)
+	}
+
+	switch transform.TimestampOrderPolicy(o.TimestampOrder) {
+	case "", transform.TimestampOrderDrop, transform.TimestampOrderKeepLast:
+	default:
+		return fmt.Errorf("--timestamp-order must be one of drop or keep-last: %s", o.TimestampOrder)
+	}
+
+	if len(o.StripMetaLabelsExtra) > 0 && !o.StripMetaLabels {
+		return fmt.Errorf("--strip-meta-label requires --strip-meta-labels")
+	}
+
+	switch transform.RequireLabelsMode(o.RequireLabelMode) {
+	case transform.RequireLabelsError, transform.RequireLabelsDrop:
+	default:
+		return fmt.Errorf("--require-label-mode must be one of error or drop: %s", o.RequireLabelMode)
+	}
+
+	switch transform.TimestampAlignMode(o.AlignTimestamps) {
+	case "", transform.TimestampAlignClamp, transform.TimestampAlignShift:
+	default:
+		return fmt.Errorf("--align-timestamps must be one of clamp or shift: %s", o.AlignTimestamps)
+	}
+
+	if o.ScrapeTimeout == 0 {
+		o.ScrapeTimeout = o.Interval / 3
+	}
+	if o.UploadTimeout == 0 {
+		o.UploadTimeout = o.Interval / 3
+	}
+	if o.ScrapeTimeout < 0 || o.UploadTimeout < 0 {
+		return fmt.Errorf("--scrape-timeout and --upload-timeout must be positive durations")
+	}
+	if o.DrainTimeout == 0 {
+		o.DrainTimeout = o.ScrapeTimeout + o.UploadTimeout
+	}
+
+	if o.TransformConcurrency < 0 {
+		return fmt.Errorf("--transform-concurrency must be zero or a positive number")
+	}
+	if o.TransformConcurrency == 0 {
+		o.TransformConcurrency = runtime.GOMAXPROCS(0)
+	}
+
+	if o.IntervalJitter < 0 || o.IntervalJitter > 1 {
+		return fmt.Errorf("--interval-jitter must be between 0 and 1")
+	}
+	if floor := minIntervalFloor(o.ScrapeTimeout); !o.AllowAggressiveInterval && jitteredMinimum(o.Interval, o.IntervalJitter) < floor {
+		return fmt.Errorf("--interval of %s with --interval-jitter of %g may scrape the --from server more often than every %s, which can overload it because each scrape reads the last 5 minutes of every matching series. Increase --interval or pass --allow-aggressive-interval if the source can handle it", o.Interval, o.IntervalJitter, floor)
+	}
+
+	if o.GuardCounterResets {
+		// state is kept across batches, so the guard is not recreated in Transforms
+		o.counterGuard = transform.NewCounterResetGuard(2*o.Interval, maxCounterSeries)
+	}
+	if o.CountersAsDelta {
+		o.counterDelta = transform.NewCounterToDelta(o.CounterDeltaSuffix, 2*o.Interval, maxCounterSeries)
+	}
+	if o.MaxUploadBytes < 0 {
+		return fmt.Errorf("--max-upload-bytes must be zero or a positive number")
+	}
+	if o.MaxLabelsPerSeries < 0 {
+		return fmt.Errorf("--max-labels-per-series must be zero or a positive number")
+	}
+	if o.MaxLabelsPerSeries > 0 {
+		// created once so that removed labels are counted across batches
+		o.labelLimiter = transform.NewLabelCountLimiter(o.MaxLabelsPerSeries, o.MaxLabelsPriority)
+		prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "telemeter_client_series_labels_dropped_total",
+			Help: "The number of labels removed from series with more labels than --max-labels-per-series.",
+		}, func() float64 { return float64(o.labelLimiter.Dropped()) }))
+	}
+	logger := ratelog.New(o.LogThrottle)
+	if len(o.RequireLabels) > 0 {
+		// created once so that the dropped series are counted by a single counter
+		dropped := prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "telemeter_client_required_labels_dropped_series_total",
+			Help: "The number of series dropped because they lacked a label required by --require-label.",
+		})
+		prometheus.MustRegister(dropped)
+		o.requireLabel = transform.NewCountDropped("require_label", transform.NewRequireLabels(o.RequireLabels, transform.RequireLabelsMode(o.RequireLabelMode), logger), counterDrops{dropped})
+	}
+	if len(o.TimestampOrder) > 0 {
+		// created once so that fixed samples are counted across batches
+		o.monotonic = transform.NewMonotonicTimestamps(transform.TimestampOrderPolicy(o.TimestampOrder))
+		prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "telemeter_client_timestamp_order_fixed_samples_total",
+			Help: "The number of samples dropped because their timestamp did not increase within their series, by --timestamp-order.",
+		}, func() float64 { return float64(o.monotonic.Fixed()) }))
+	}
+
+	if o.MaxIdleConns < 0 || o.MaxIdleConnsPerHost < 0 || o.IdleConnTimeout < 0 || o.KeepAlive < 0 {
+		return fmt.Errorf("--http-max-idle-conns, --http-max-idle-conns-per-host, --http-idle-conn-timeout, and --http-keep-alive must not be negative")
+	}
+
+	if o.MaxUploadsPerMinute < 0 {
+		return fmt.Errorf("--max-uploads-per-minute must be zero or a positive number")
+	}
+	if o.SourceBackoffThreshold < 0 || o.SourceBackoffMax < 0 {
+		return fmt.Errorf("--scrape-failure-threshold and --scrape-backoff-max must not be negative")
+	}
+	if o.MaxRetryAfter < 0 {
+		return fmt.Errorf("--max-retry-after must not be negative")
+	}
+	if len(o.SpoolDir) > 0 {
+		if o.SpoolMaxBytes <= 0 || o.SpoolMaxAge <= 0 {
+			return fmt.Errorf("--spool-max-bytes and --spool-max-age must be positive")
+		}
+		if err := os.MkdirAll(o.SpoolDir, 0700); err != nil {
+			return fmt.Errorf("--spool-dir could not be created: %v", err)
+		}
+	}
+	if o.MaxBatchBytes < 0 {
+		return fmt.Errorf("--max-batch-bytes must be zero or a positive number")
+	}
+
 	if len(o.AnonymizeLabels) > 0 && len(o.AnonymizeSalt) == 0 {
 		return fmt.Errorf("you must specify --anonymize-salt when --anonymize-labels is used")
 	}
+	for _, flag := range o.AnonymizeBucketFlag {
+		values := strings.SplitN(flag, "=", 2)
+		if len(values) != 2 {
+			return fmt.Errorf("--anonymize-buckets must be of the form label=K: %s", flag)
+		}
+		n, err := strconv.Atoi(values[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("--anonymize-buckets must have a positive number of buckets: %s", flag)
+		}
+		if o.AnonymizeBuckets == nil {
+			o.AnonymizeBuckets = make(map[string]int)
+		}
+		o.AnonymizeBuckets[values[0]] = n
+	}
+	if len(o.AnonymizeBuckets) > 0 && len(o.AnonymizeSalt) == 0 {
+		return fmt.Errorf("you must specify --anonymize-salt when --anonymize-buckets is used")
+	}
 	for _, flag := range o.LabelFlag {
 		values := strings.SplitN(flag, "=", 2)
 		if len(values) != 2 {
 			return fmt.Errorf("--label must be of the form key=value: %s", flag)
 		}
+		for i := range values {
+			value, err := expandEnv(values[i])
+			if err != nil {
+				return fmt.Errorf("--label %s: %v", flag, err)
+			}
+			values[i] = value
+		}
 		if o.Labels == nil {
 			o.Labels = make(map[string]string)
 		}
 		o.Labels[values[0]] = values[1]
 	}
 
+	for _, flag := range o.RoundFlag {
+		values := strings.SplitN(flag, "=", 2)
+		if len(values) != 2 {
+			return fmt.Errorf("--round-value must be of the form NAME=MODE:PRECISION: %s", flag)
+		}
+		rounding, err := parseRounding(values[1])
+		if err != nil {
+			return fmt.Errorf("--round-value %s: %v", flag, err)
+		}
+		if o.Rounding == nil {
+			o.Rounding = make(map[string]transform.Rounding)
+		}
+		o.Rounding[values[0]] = rounding
+	}
+
+	for _, flag := range o.CoerceTypeFlag {
+		values := strings.SplitN(flag, "=", 2)
+		if len(values) != 2 || len(values[0]) == 0 {
+			return fmt.Errorf("--coerce-type must be of the form NAME=TYPE: %s", flag)
+		}
+		var typ clientmodel.MetricType
+		switch values[1] {
+		case "counter":
+			typ = clientmodel.MetricType_COUNTER
+		case "gauge":
+			typ = clientmodel.MetricType_GAUGE
+		default:
+			return fmt.Errorf("--coerce-type must set the type to counter or gauge: %s", flag)
+		}
+		if o.CoerceTypes == nil {
+			o.CoerceTypes = make(map[string]clientmodel.MetricType)
+		}
+		o.CoerceTypes[values[0]] = typ
+	}
+
+	for _, flag := range o.AggregateFlag {
+		values := strings.SplitN(flag, "=", 2)
+		if len(values) != 2 || len(values[0]) == 0 {
+			return fmt.Errorf("--aggregate must be of the form NAME=OP:LABEL,LABEL,...: %s", flag)
+		}
+		aggregation, err := parseAggregation(values[1])
+		if err != nil {
+			return fmt.Errorf("--aggregate %s: %v", flag, err)
+		}
+		if o.Aggregations == nil {
+			o.Aggregations = make(map[string]transform.Aggregation)
+		}
+		o.Aggregations[values[0]] = aggregation
+	}
+
+	for _, flag := range o.ReduceBucketsFlag {
+		values := strings.SplitN(flag, "=", 2)
+		if len(values) != 2 {
+			return fmt.Errorf("--reduce-buckets must be of the form NAME=LE,LE,...: %s", flag)
+		}
+		var bounds []float64
+		for _, s := range strings.Split(values[1], ",") {
+			le, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil {
+				return fmt.Errorf("--reduce-buckets %s: %v", flag, err)
+			}
+			bounds = append(bounds, le)
+		}
+		if o.ReduceBuckets == nil {
+			o.ReduceBuckets = make(map[string][]float64)
+		}
+		o.ReduceBuckets[values[0]] = bounds
+	}
+
+	if o.MaxAgeDefault <= 0 {
+		return fmt.Errorf("--max-age-default must be a positive duration")
+	}
+	for _, flag := range o.MaxAgeFlag {
+		values := strings.SplitN(flag, "=", 2)
+		if len(values) != 2 || len(values[0]) == 0 {
+			return fmt.Errorf("--max-age must be of the form NAME=DURATION: %s", flag)
+		}
+		age, err := time.ParseDuration(values[1])
+		if err != nil || age <= 0 {
+			return fmt.Errorf("--max-age must have a positive duration: %s", flag)
+		}
+		if o.MaxAges == nil {
+			o.MaxAges = make(map[string]time.Duration)
+		}
+		o.MaxAges[values[0]] = age
+	}
+
+	for _, flag := range o.SummaryGaugesFlag {
+		values := strings.SplitN(flag, "=", 2)
+		if len(values) != 2 || len(values[0]) == 0 {
+			return fmt.Errorf("--summary-to-gauge must be of the form NAME=Q,Q,...: %s", flag)
+		}
+		var quantiles []float64
+		for _, s := range strings.Split(values[1], ",") {
+			q, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil || q < 0 || q > 1 {
+				return fmt.Errorf("--summary-to-gauge must list quantiles between 0 and 1: %s", flag)
+			}
+			quantiles = append(quantiles, q)
+		}
+		if o.SummaryGauges == nil {
+			o.SummaryGauges = make(map[string][]float64)
+		}
+		o.SummaryGauges[values[0]] = quantiles
+	}
+	switch transform.SummaryMode(o.SummaryGaugesMode) {
+	case transform.SummaryKeep, transform.SummaryDrop, transform.SummaryCounters:
+	default:
+		return fmt.Errorf("--summary-to-gauge-summary must be one of keep, drop, or counters: %s", o.SummaryGaugesMode)
+	}
+	if len(o.SummaryGauges) > 0 {
+		o.summaries = transform.NewSummaryGauges(o.SummaryGauges, transform.SummaryMode(o.SummaryGaugesMode))
+	}
+
+	for _, flag := range o.DownsampleFlag {
+		values := strings.SplitN(flag, "=", 2)
+		if len(values) != 2 || len(values[0]) == 0 {
+			return fmt.Errorf("--downsample must be of the form NAME=N: %s", flag)
+		}
+		n, err := strconv.Atoi(values[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("--downsample must keep every Nth batch with a positive N: %s", flag)
+		}
+		if o.Downsample == nil {
+			o.Downsample = make(map[string]int)
+		}
+		o.Downsample[values[0]] = n
+	}
+	if len(o.Downsample) > 0 {
+		// state is kept across batches, so the downsampler is not recreated in Transforms
+		o.downsampler = transform.NewDownsampler(o.Downsample)
+	}
+
+	for _, flag := range o.SampleRateFlag {
+		values := strings.SplitN(flag, "=", 2)
+		if len(values) != 2 || len(values[0]) == 0 {
+			return fmt.Errorf("--sample-rate must be of the form NAME=RATE: %s", flag)
+		}
+		rate, err := strconv.ParseFloat(values[1], 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return fmt.Errorf("--sample-rate must be a rate from 0 to 1: %s", flag)
+		}
+		if o.SampleRates == nil {
+			o.SampleRates = make(map[string]float64)
+		}
+		o.SampleRates[values[0]] = rate
+	}
+
+	for _, flag := range o.PriorityFlag {
+		values := strings.SplitN(flag, "=", 2)
+		if len(values) != 2 {
+			return fmt.Errorf("--metric-priority must be of the form NAME=N: %s", flag)
+		}
+		priority, err := strconv.Atoi(values[1])
+		if err != nil {
+			return fmt.Errorf("--metric-priority %s: %v", flag, err)
+		}
+		if o.Priorities == nil {
+			o.Priorities = make(map[string]int)
+		}
+		o.Priorities[values[0]] = priority
+	}
+
 	if len(o.RenameFlag) == 0 {
 		o.RenameFlag = []string{"ALERTS=alerts"}
 	}
@@ -182,23 +1122,108 @@ func (o *Options) Run() error {
 		o.Renames[values[0]] = values[1]
 	}
 
-	if len(o.RulesFile) > 0 {
-		data, err := ioutil.ReadFile(o.RulesFile)
+	for _, rule := range o.Rules {
+		if len(strings.TrimSpace(rule)) == 0 {
+			continue
+		}
+		if err := parseMatchRule(rule); err != nil {
+			return fmt.Errorf("--match %s is invalid: %v", rule, err)
+		}
+	}
+	if len(o.RulesFiles) > 0 {
+		rules, err := loadMatchFiles(o.RulesFiles)
 		if err != nil {
 			return fmt.Errorf("--match-file could not be loaded: %v", err)
 		}
-		o.Rules = append(o.Rules, strings.Split(string(data), "\n")...)
+		o.Rules = append(o.Rules, rules...)
+	}
+	if len(o.MatchConfig) > 0 {
+		rules, err := loadMatchConfig(o.MatchConfig)
+		if err != nil {
+			return fmt.Errorf("--match-config could not be loaded: %v", err)
+		}
+		o.Rules = append(o.Rules, rules...)
+	}
+	if len(o.RelabelConfig) > 0 {
+		relabeler, err := loadRelabelConfig(o.RelabelConfig)
+		if err != nil {
+			return fmt.Errorf("--relabel-config could not be loaded: %v", err)
+		}
+		o.relabeler = relabeler
+	}
+	if len(o.RemapConfig) > 0 {
+		remapper, err := loadRemapConfig(o.RemapConfig)
+		if err != nil {
+			return fmt.Errorf("--remap-config could not be loaded: %v", err)
+		}
+		o.remapper = remapper
+	}
+	if len(o.ExtraMetricsFile) > 0 {
+		extraMetrics, err := transform.NewExtraMetrics(o.ExtraMetricsFile)
+		if err != nil {
+			return fmt.Errorf("--extra-metrics-file could not be loaded: %v", err)
+		}
+		o.extraMetrics = extraMetrics
+	}
+	if len(o.LabelFile) > 0 {
+		labelFile, err := transform.NewLabelFile(o.LabelFile, expandEnv, configReloaded)
+		if err != nil {
+			return fmt.Errorf("--label-file could not be loaded: %v", err)
+		}
+		o.labelFile = labelFile
 	}
 	var rules []string
+	seen := make(map[string]struct{})
 	for _, s := range o.Rules {
 		s = strings.TrimSpace(s)
 		if len(s) == 0 {
 			continue
 		}
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
 		rules = append(rules, s)
 	}
 	o.Rules = rules
 
+	switch o.FromMode {
+	case "federate":
+		if len(o.Queries) > 0 {
+			return fmt.Errorf("--query may only be used with --from-mode=query")
+		}
+	case "query":
+		if len(o.Queries) == 0 {
+			return fmt.Errorf("--from-mode=query requires at least one --query")
+		}
+		if len(o.MatchRegex) > 0 {
+			return fmt.Errorf("--match-regex may not be used with --from-mode=query")
+		}
+	default:
+		return fmt.Errorf("--from-mode must be federate or query")
+	}
+
+	switch o.ValidateMatch {
+	case "", "warn", "error":
+	default:
+		return fmt.Errorf("--validate-match must be one of warn or error: %s", o.ValidateMatch)
+	}
+	if len(o.ValidateMatch) > 0 && o.FromMode != "federate" {
+		return fmt.Errorf("--validate-match may only be used with --from-mode=federate")
+	}
+
+	var matchRegex *regexp.Regexp
+	if len(o.MatchRegex) > 0 {
+		re, err := regexp.Compile("^(?:" + o.MatchRegex + ")$")
+		if err != nil {
+			return fmt.Errorf("--match-regex is not a valid regular expression: %v", err)
+		}
+		if o.MatchRegexRefresh <= 0 {
+			return fmt.Errorf("--match-regex-refresh must be a positive duration")
+		}
+		matchRegex = re
+	}
+
 	from, err := url.Parse(o.From)
 	if err != nil {
 		return fmt.Errorf("--from is not a valid URL: %v", err)
@@ -206,51 +1231,124 @@ func (o *Options) Run() error {
 	from.Path = strings.TrimRight(from.Path, "/")
 	if len(from.Path) == 0 {
 		from.Path = "/federate"
+		if o.FromMode == "query" {
+			from.Path = "/api/v1/query"
+		}
 	}
-
-	var to, toUpload, toAuthorize *url.URL
-	if len(o.ToUpload) > 0 {
-		to, err = url.Parse(o.ToUpload)
-		if err != nil {
-			return fmt.Errorf("--to is not a valid URL: %v", err)
+	if len(o.SourceLabel) > 0 {
+		if !model.LabelName(o.SourceLabel).IsValid() {
+			return fmt.Errorf("--source-label is not a valid label name: %s", o.SourceLabel)
 		}
+		if _, ok := o.Labels[o.SourceLabel]; !ok {
+			if o.Labels == nil {
+				o.Labels = make(map[string]string)
+			}
+			o.Labels[o.SourceLabel] = from.Host
+		}
+	}
+
+	if len(o.To) > 1 && (len(o.ToUpload) > 0 || len(o.ToAuthorize) > 0) {
+		return fmt.Errorf("--to-upload and --to-auth may only be used with a single --to")
+	}
+	targets := o.To
+	if len(targets) == 0 && (len(o.ToOTLP) == 0 || len(o.ToUpload) > 0 || len(o.ToAuthorize) > 0) {
+		targets = []string{""}
+	}
+	if o.MaxUploadBytes > 0 && len(targets) > 0 {
+		// the server keeps only the latest upload of each cluster, so every chunk
+		// would replace the previous one
+		return fmt.Errorf("--max-upload-bytes may only be used with --to-otlp, telemeter servers do not reassemble chunks")
+	}
+	if len(o.PartitionLabel) > 0 && len(targets) > 0 {
+		// for the same reason, only the last partition would be kept
+		return fmt.Errorf("--partition-label may only be used with --to-otlp, telemeter servers keep only the latest upload of each cluster")
+	}
+	type endpoints struct {
+		upload    *url.URL
+		authorize []remote.Endpoint
 	}
-	if len(o.ToAuthorize) > 0 {
-		toAuthorize, err = url.Parse(o.ToAuthorize)
+	var destinations []endpoints
+	for _, to := range targets {
+		toUpload, toAuthorize, err := o.destination(to)
 		if err != nil {
-			return fmt.Errorf("--to-auth is not a valid URL: %v", err)
+			return err
 		}
+		destinations = append(destinations, endpoints{upload: toUpload, authorize: toAuthorize})
 	}
-	if len(o.To) > 0 {
-		to, err = url.Parse(o.To)
+
+	switch {
+	case len(o.TLSCertFile) == 0 && len(o.TLSKeyFile) > 0,
+		len(o.TLSCertFile) > 0 && len(o.TLSKeyFile) == 0:
+		return fmt.Errorf("both --tls-cert-file and --tls-key-file must be provided")
+	case len(o.TLSClientCA) > 0 && len(o.TLSCertFile) == 0:
+		return fmt.Errorf("--tls-client-ca requires --tls-cert-file and --tls-key-file")
+	}
+	var tlsConfig *tls.Config
+	if len(o.TLSCertFile) > 0 {
+		reloader, err := telemeterhttp.NewCertificateReloader(o.TLSCertFile, o.TLSKeyFile)
 		if err != nil {
-			return fmt.Errorf("--to is not a valid URL: %v", err)
+			return fmt.Errorf("unable to load --tls-cert-file and --tls-key-file: %v", err)
 		}
-		if len(to.Path) == 0 {
-			to.Path = "/"
-		}
-		if toAuthorize == nil {
-			u := *to
-			u.Path = path.Join(to.Path, "authorize")
-			if len(o.Identifier) > 0 {
-				q := to.Query()
-				q.Add("id", o.Identifier)
-				u.RawQuery = q.Encode()
+		tlsConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+		if len(o.TLSClientCA) > 0 {
+			data, err := ioutil.ReadFile(o.TLSClientCA)
+			if err != nil {
+				return fmt.Errorf("can't read --tls-client-ca: %v", err)
 			}
-			toAuthorize = &u
-		}
-		if toUpload == nil {
-			u := *to
-			u.Path = path.Join(to.Path, "upload")
-			toUpload = &u
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				return fmt.Errorf("no certs found in --tls-client-ca")
+			}
+			tlsConfig.ClientCAs = pool
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
 		}
 	}
 
-	if toUpload == nil || toAuthorize == nil {
-		return fmt.Errorf("either --to or --to-auth and --to-upload must be specified")
+	transportOptions := metricsclient.TransportOptions{
+		MaxIdleConns:        o.MaxIdleConns,
+		MaxIdleConnsPerHost: o.MaxIdleConnsPerHost,
+		IdleConnTimeout:     o.IdleConnTimeout,
+		KeepAlive:           o.KeepAlive,
+		DisableKeepAlives:   o.DisableKeepAlives,
+		HTTP2:               o.HTTP2,
+	}
+	fromPins, err := parseCertificatePins("--from-cert-pin", o.FromCertPins)
+	if err != nil {
+		return err
+	}
+	toPins, err := parseCertificatePins("--to-cert-pin", o.ToCertPins)
+	if err != nil {
+		return err
+	}
+	if len(fromPins) > 0 && len(o.FromCAFile) > 0 {
+		return fmt.Errorf("--from-cert-pin can't be combined with --from-ca-file")
+	}
+	fromHeaders, err := parseHeaders("--from-header", o.FromHeaders)
+	if err != nil {
+		return err
+	}
+	toHeaders, err := parseHeaders("--to-header", o.ToHeaders)
+	if err != nil {
+		return err
+	}
+	toTransport := func() *http.Transport {
+		t := metricsclient.NewTransport(transportOptions)
+		if len(toPins) > 0 {
+			if t.TLSClientConfig == nil {
+				t.TLSClientConfig = &tls.Config{}
+			}
+			telemeterhttp.PinCertificates(t.TLSClientConfig, toPins)
+		}
+		return t
 	}
 
-	fromTransport := metricsclient.DefaultTransport()
+	fromTransport := metricsclient.NewTransport(transportOptions)
+	if len(fromPins) > 0 {
+		if fromTransport.TLSClientConfig == nil {
+			fromTransport.TLSClientConfig = &tls.Config{}
+		}
+		telemeterhttp.PinCertificates(fromTransport.TLSClientConfig, fromPins)
+	}
 	if len(o.FromCAFile) > 0 {
 		if fromTransport.TLSClientConfig == nil {
 			fromTransport.TLSClientConfig = &tls.Config{}
@@ -268,43 +1366,378 @@ func (o *Options) Run() error {
 		}
 		fromTransport.TLSClientConfig.RootCAs = pool
 	}
-	fromClient := &http.Client{Transport: fromTransport}
+	fromClient := &http.Client{Transport: telemeterhttp.NewUserAgentRoundTripper(o.UserAgent, fromTransport)}
+	if len(fromHeaders) > 0 {
+		fromClient.Transport = telemeterhttp.NewHeaderRoundTripper(fromHeaders, fromClient.Transport)
+	}
+	if len(o.FromBasicAuth) > 0 {
+		user := strings.SplitN(o.FromBasicAuth, ":", 2)
+		fromClient.Transport = telemeterhttp.NewBasicAuthRoundTripper(user[0], user[1], fromClient.Transport)
+	}
 	if len(o.FromToken) > 0 {
 		fromClient.Transport = telemeterhttp.NewBearerRoundTripper(o.FromToken, fromClient.Transport)
 	}
-	toClient := &http.Client{Transport: metricsclient.DefaultTransport()}
-	if len(o.ToToken) > 0 {
-		// exchange our token for a token from the authorize endpoint, which also gives us a
-		// set of expected labels we must include
-		rt := remote.NewServerRotatingRoundTripper(o.ToToken, toAuthorize, toClient.Transport)
-		o.LabelRetriever = rt
-		toClient.Transport = rt
+	worker := forwarder.New(*from, nil, o)
+	worker.Logger = logger
+	var authorizers []destinationAuthorizer
+	for i, d := range destinations {
+		toClient := &http.Client{Transport: telemeterhttp.NewUserAgentRoundTripper(o.UserAgent, toTransport())}
+		if len(toHeaders) > 0 {
+			// applied below the token exchange so that authorize requests carry them too
+			toClient.Transport = telemeterhttp.NewHeaderRoundTripper(toHeaders, toClient.Transport)
+		}
+		if len(o.ToBasicAuth) > 0 {
+			// applied below the token exchange so that authorize requests pass the gateway too
+			user := strings.SplitN(o.ToBasicAuth, ":", 2)
+			toClient.Transport = telemeterhttp.NewBasicAuthRoundTripper(user[0], user[1], toClient.Transport)
+		}
+		if len(o.ToToken) > 0 {
+			// exchange our token for a token from the authorize endpoint, which also gives us a
+			// set of expected labels we must include. The labels of the first destination are
+			// added to all outgoing metrics.
+			rt := remote.NewServerRotatingRoundTripper(o.ToToken, d.authorize, toClient.Transport).WithFallbackToken(o.ToTokenFallback).WithDestination(d.upload.String())
+			if i == 0 {
+				o.LabelRetriever = rt
+				worker.Authorizer = rt
+			}
+			toClient.Transport = rt
+			authorizers = append(authorizers, destinationAuthorizer{destination: d.upload.String(), authorizer: rt})
+		}
+		metricsName := "federate_to"
+		if i > 0 {
+			metricsName = fmt.Sprintf("federate_to_%d", i)
+		}
+		worker.Destinations = append(worker.Destinations, &forwarder.Destination{
+			URL:    d.upload,
+			Client: metricsclient.New(toClient, o.LimitBytes, o.UploadTimeout, metricsName).WithSigningKey([]byte(o.ToHMACKey)),
+		})
 	}
-
-	worker := forwarder.New(*from, toUpload, o)
-	worker.ToClient = metricsclient.New(toClient, o.LimitBytes, o.Interval, "federate_to")
-	worker.FromClient = metricsclient.New(fromClient, o.LimitBytes, o.Interval, "federate_from")
+	for i, to := range o.ToOTLP {
+		u, err := url.Parse(to)
+		if err != nil {
+			return fmt.Errorf("--to-otlp is not a valid URL: %v", err)
+		}
+		metricsName := "federate_otlp"
+		if i > 0 {
+			metricsName = fmt.Sprintf("federate_otlp_%d", i)
+		}
+		otlpClient := &http.Client{Transport: telemeterhttp.NewUserAgentRoundTripper(o.UserAgent, toTransport())}
+		if len(toHeaders) > 0 {
+			otlpClient.Transport = telemeterhttp.NewHeaderRoundTripper(toHeaders, otlpClient.Transport)
+		}
+		worker.Destinations = append(worker.Destinations, &forwarder.Destination{
+			URL:    u,
+			Client: metricsclient.NewOTLP(otlpClient, o.LimitBytes, o.UploadTimeout, metricsName),
+		})
+	}
+	if o.PrintTransforms {
+		// after the destinations, so that the labels required by the server are listed
+		o.printTransforms(os.Stdout)
+		return nil
+	}
+	worker.FromClient = metricsclient.New(fromClient, o.LimitBytes, o.ScrapeTimeout, "federate_from").WithLimitMode(metricsclient.LimitMode(o.LimitMode)).WithPartialOnTimeout(o.PartialOnTimeout).WithLogger(logger)
 	worker.Interval = o.Interval
+	worker.IntervalJitter = o.IntervalJitter
+	worker.Queries = o.Queries
+	worker.SkipUnchanged = o.SkipUnchanged
+	worker.PartitionLabel = o.PartitionLabel
+	worker.MaxUploadBytes = o.MaxUploadBytes
+	worker.SpoolDir = o.SpoolDir
+	worker.SequenceFile = o.SequenceStateFile
+	worker.ClientID = o.Identifier
+	worker.SpoolMaxBytes = o.SpoolMaxBytes
+	worker.SpoolMaxAge = o.SpoolMaxAge
+	worker.UnhashedFamilies = []string{buildInfoName}
+	if len(o.MetricPrefix) > 0 && !strings.HasPrefix(buildInfoName, o.MetricPrefix) {
+		worker.UnhashedFamilies = []string{o.MetricPrefix + buildInfoName}
+	}
+	worker.TransformConcurrency = o.TransformConcurrency
+	worker.RetainUploads = o.RetainUploads
+
+	var names url.URL
+	if matchRegex != nil {
+		names = *from
+		names.Path = path.Join(strings.TrimSuffix(from.Path, "/federate"), "/api/v1/label/__name__/values")
+		names.RawQuery = ""
+		if err := o.refreshRegexRules(context.Background(), worker.FromClient, &names, matchRegex); err != nil {
+			log.Printf("error: unable to load metric names for --match-regex: %v", err)
+		}
+	}
+	if len(o.ValidateMatch) > 0 {
+		// a separate client, so that the responses of single rules are not cached
+		client := metricsclient.New(fromClient, o.LimitBytes, o.ScrapeTimeout, "validate_match").WithLimitMode(metricsclient.LimitMode(o.LimitMode))
+		// every rule may take up to the scrape timeout, but the check as a whole only
+		// delays startup by a few of them
+		ctx, cancel := context.WithTimeout(context.Background(), 3*o.ScrapeTimeout)
+		empty, err := checkMatchRules(ctx, client, *from, o.Rules, o.ScrapeTimeout)
+		cancel()
+		if err != nil {
+			log.Printf("warning: unable to validate the match rules: %v", err)
+		}
+		switch {
+		case len(empty) > 0 && o.ValidateMatch == "error":
+			return fmt.Errorf("--validate-match found match rules that match no series: %s", strings.Join(empty, ", "))
+		case len(empty) > 0:
+			log.Printf("warning: match rules match no series: %s", strings.Join(empty, ", "))
+		}
+	}
+	worker.MaxUploadsPerMinute = o.MaxUploadsPerMinute
+	worker.BreakerThreshold = o.BreakerThreshold
+	worker.BreakerCooldown = o.BreakerCooldown
+	worker.SourceBackoffThreshold = o.SourceBackoffThreshold
+	worker.SourceBackoffMax = o.SourceBackoffMax
+	worker.MaxRetryAfter = o.MaxRetryAfter
 
-	log.Printf("Starting telemeter-client reading from %s and sending to %s (listen=%s)", o.From, o.To, o.Listen)
+	log.Printf("Starting telemeter-client reading from %s and sending to %s (listen=%s)", o.From, strings.Join(append(o.To, o.ToOTLP...), ", "), o.Listen)
 
-	go worker.Run()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go logger.Run(ctx)
+	if matchRegex != nil {
+		go o.runRegexRefresh(ctx, o.MatchRegexRefresh, worker.FromClient, &names, matchRegex)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		worker.Run(ctx)
+		close(stopped)
+	}()
 
 	if len(o.Listen) > 0 {
 		handlers := http.NewServeMux()
 		telemeterhttp.AddDebug(handlers)
 		telemeterhttp.AddHealth(handlers)
-		telemeterhttp.AddMetrics(handlers)
-		handlers.Handle("/federate", serveLastMetrics(worker))
+		telemeterhttp.AddReady(handlers, worker.Ready)
+
+		// everything that exposes metrics or the configuration
+		protected := http.NewServeMux()
+		telemeterhttp.AddMetrics(protected)
+		protected.Handle("/federate", serveLastMetrics(worker))
+		protected.Handle("/status", serveStatus(worker))
+		telemeterhttp.AddConfig(protected, func() interface{} { return o.effectiveConfig() })
+		if o.RetainUploads > 0 {
+			protected.Handle("/debug/uploads", serveUploads(worker))
+		}
+		if len(authorizers) > 0 {
+			protected.Handle("/authorize-labels", serveAuthorizeLabels(authorizers, o.Labels))
+		}
+		var protectedHandler http.Handler = protected
+		if len(o.TLSClientCA) > 0 {
+			protectedHandler = requireClientCertificate(protected)
+		}
+		for _, path := range []string{"/metrics", "/federate", "/status", "/config", "/debug/uploads", "/authorize-labels"} {
+			handlers.Handle(path, protectedHandler)
+		}
+
+		listener, err := listen(o.Listen)
+		if err != nil {
+			return err
+		}
+		server := &http.Server{Handler: handlers, TLSConfig: tlsConfig}
+		// closing the server closes the listener, which removes a unix socket file
+		defer server.Close()
 		go func() {
-			if err := http.ListenAndServe(o.Listen, handlers); err != nil && err != http.ErrServerClosed {
+			var err error
+			if tlsConfig != nil {
+				err = server.ServeTLS(listener, "", "")
+			} else {
+				err = server.Serve(listener)
+			}
+			if err != nil && err != http.ErrServerClosed {
 				log.Printf("error: server exited: %v", err)
 				os.Exit(1)
 			}
 		}()
 	}
 
-	select {}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	<-signals
+	cancel()
+	if !o.DrainOnShutdown {
+		return nil
+	}
+
+	log.Printf("Shutting down, uploading a final batch within %s", o.DrainTimeout)
+	<-stopped
+
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), o.DrainTimeout)
+	defer drainCancel()
+	if err := worker.Drain(drainCtx); err != nil {
+		return fmt.Errorf("unable to upload the final batch: %v", err)
+	}
+	log.Printf("Uploaded the final batch")
+	return nil
+}
+
+// parseAggregation parses OP:LABEL,LABEL,... where OP:, and with it the operation,
+// may be omitted to sum.
+func parseAggregation(s string) (transform.Aggregation, error) {
+	aggregation := transform.Aggregation{Op: transform.AggregateSum}
+	if i := strings.Index(s, ":"); i >= 0 {
+		aggregation.Op, s = transform.AggregateOp(s[:i]), s[i+1:]
+	}
+	switch aggregation.Op {
+	case transform.AggregateSum, transform.AggregateMax, transform.AggregateMin:
+	default:
+		return aggregation, fmt.Errorf("the operation must be one of sum, max, or min")
+	}
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			aggregation.Drop = append(aggregation.Drop, name)
+		}
+	}
+	if len(aggregation.Drop) == 0 {
+		return aggregation, fmt.Errorf("at least one label must be removed")
+	}
+	return aggregation, nil
+}
+
+// parseRounding parses MODE:PRECISION with an optional :counters suffix.
+func parseRounding(s string) (transform.Rounding, error) {
+	var rounding transform.Rounding
+	parts := strings.Split(s, ":")
+	if len(parts) == 3 && parts[2] == "counters" {
+		rounding.Counters = true
+		parts = parts[:2]
+	}
+	if len(parts) != 2 {
+		return rounding, fmt.Errorf("expected MODE:PRECISION")
+	}
+	precision, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || precision <= 0 {
+		return rounding, fmt.Errorf("precision must be a positive number")
+	}
+	rounding.Mode, rounding.Precision = transform.RoundingMode(parts[0]), precision
+	switch rounding.Mode {
+	case transform.RoundNearest:
+	case transform.RoundSignificant:
+		if precision != float64(int(precision)) {
+			return rounding, fmt.Errorf("the number of significant digits must be a whole number")
+		}
+	default:
+		return rounding, fmt.Errorf("mode must be nearest or significant")
+	}
+	return rounding, nil
+}
+
+// destination returns the upload and authorize endpoints for the telemeter server to,
+// applying --to-upload and --to-auth if set. to may be empty if both are set.
+func (o *Options) destination(to string) (*url.URL, []remote.Endpoint, error) {
+	var toUpload *url.URL
+	var toAuthorize []remote.Endpoint
+	var err error
+	if len(o.ToUpload) > 0 {
+		toUpload, err = url.Parse(o.ToUpload)
+		if err != nil {
+			return nil, nil, fmt.Errorf("--to-upload is not a valid URL: %v", err)
+		}
+	}
+	for _, s := range o.ToAuthorize {
+		weight := 1
+		if i := strings.LastIndex(s, ";weight="); i >= 0 {
+			weight, err = strconv.Atoi(s[i+len(";weight="):])
+			if err != nil || weight < 1 {
+				return nil, nil, fmt.Errorf("--to-auth weight must be a positive number: %s", s)
+			}
+			s = s[:i]
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("--to-auth is not a valid URL: %v", err)
+		}
+		toAuthorize = append(toAuthorize, remote.Endpoint{URL: u, Weight: weight})
+	}
+	if len(to) > 0 {
+		u, err := url.Parse(to)
+		if err != nil {
+			return nil, nil, fmt.Errorf("--to is not a valid URL: %v", err)
+		}
+		if len(u.Path) == 0 {
+			u.Path = "/"
+		}
+		if toAuthorize == nil {
+			a := *u
+			a.Path = path.Join(u.Path, "authorize")
+			if len(o.Identifier) > 0 {
+				q := u.Query()
+				q.Add("id", o.Identifier)
+				a.RawQuery = q.Encode()
+			}
+			toAuthorize = []remote.Endpoint{{URL: &a}}
+		}
+		if toUpload == nil {
+			a := *u
+			a.Path = path.Join(u.Path, "upload")
+			toUpload = &a
+		}
+	}
+	if toUpload == nil || toAuthorize == nil {
+		return nil, nil, fmt.Errorf("either --to or --to-auth and --to-upload must be specified")
+	}
+	return toUpload, toAuthorize, nil
+}
+
+// parseCertificatePins parses the pins given to flag.
+func parseCertificatePins(flag string, values []string) ([][]byte, error) {
+	var pins [][]byte
+	for _, value := range values {
+		pin, err := telemeterhttp.ParseCertificatePin(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s %v", flag, err)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// parseHeaders parses the headers given to flag. Authorization may not be set, as it
+// would replace the credentials of the client.
+func parseHeaders(flag string, values []string) (http.Header, error) {
+	header := make(http.Header)
+	for _, value := range values {
+		name, v, err := telemeterhttp.ParseHeader(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s %v", flag, err)
+		}
+		if name == "Authorization" {
+			return nil, fmt.Errorf("%s can't set the Authorization header", flag)
+		}
+		header.Add(name, v)
+	}
+	return header, nil
+}
+
+// expandEnv replaces $VAR and ${VAR} references in s with the values of the
+// corresponding environment variables. A literal '$' may be written as '$$'. An
+// error is returned if a referenced variable is not set.
+func expandEnv(s string) (string, error) {
+	var missing []string
+	value := os.Expand(s, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variables are not set: %s", strings.Join(missing, ", "))
+	}
+	return value, nil
+}
+
+// requireClientCertificate rejects requests that did not present a verified client
+// certificate.
+func requireClientCertificate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			http.Error(w, "A client certificate is required", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
 }
 
 // serveLastMetrics retrieves the last set of metrics served
@@ -316,7 +1749,19 @@ func serveLastMetrics(worker *forwarder.Worker) http.Handler {
 		}
 		families := worker.LastMetrics()
 		w.Header().Set("Content-Type", string(expfmt.FmtText))
-		encoder := expfmt.NewEncoder(w, expfmt.FmtText)
+		w.Header().Add("Vary", "Accept-Encoding")
+		var out io.Writer = w
+		if telemeterhttp.AcceptsGzip(req.Header) {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer func() {
+				if err := gz.Close(); err != nil {
+					log.Printf("error: unable to write compressed metrics: %v", err)
+				}
+			}()
+			out = gz
+		}
+		encoder := expfmt.NewEncoder(out, expfmt.FmtText)
 		for _, family := range families {
 			if family == nil {
 				continue
@@ -328,3 +1773,111 @@ func serveLastMetrics(worker *forwarder.Worker) http.Handler {
 		}
 	})
 }
+
+// serveUploads lists the retained uploads as JSON, or returns the upload identified by
+// the id parameter in the text exposition format.
+func serveUploads(worker *forwarder.Worker) http.Handler {
+	type upload struct {
+		ID       int64     `json:"id"`
+		Time     time.Time `json:"time"`
+		Error    string    `json:"error,omitempty"`
+		Families int       `json:"families"`
+		Samples  int       `json:"samples"`
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		uploads := worker.Uploads()
+		if id := req.URL.Query().Get("id"); len(id) > 0 {
+			for _, u := range uploads {
+				if strconv.FormatInt(u.ID, 10) != id {
+					continue
+				}
+				w.Header().Set("Content-Type", string(expfmt.FmtText))
+				w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=upload-%d.txt", u.ID))
+				encoder := expfmt.NewEncoder(w, expfmt.FmtText)
+				for _, family := range u.Families {
+					if family == nil {
+						continue
+					}
+					if err := encoder.Encode(family); err != nil {
+						log.Printf("error: unable to write metrics for family: %v", err)
+						break
+					}
+				}
+				return
+			}
+			http.Error(w, "No upload with that id is retained", http.StatusNotFound)
+			return
+		}
+		list := make([]upload, 0, len(uploads))
+		for _, u := range uploads {
+			list = append(list, upload{ID: u.ID, Time: u.Time, Error: u.Error, Families: len(u.Families), Samples: transform.Metrics(u.Families)})
+		}
+		data, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+}
+
+// destinationAuthorizer is the token exchange of an upload destination.
+type destinationAuthorizer struct {
+	destination string
+	authorizer  *remote.ServerRotatingRoundTripper
+}
+
+// serveAuthorizeLabels reports the labels each destination's server required in the
+// last token exchange as JSON, next to the labels the client adds from --label, so
+// that uploads rejected for missing labels can be diagnosed. The token is not
+// exchanged if there is no current token.
+func serveAuthorizeLabels(authorizers []destinationAuthorizer, labels map[string]string) http.Handler {
+	type destination struct {
+		Destination string            `json:"destination"`
+		Authorized  bool              `json:"authorized"`
+		Expected    map[string]string `json:"expected,omitempty"`
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		list := make([]destination, 0, len(authorizers))
+		for _, a := range authorizers {
+			expected, ok := a.authorizer.ExpectedLabels()
+			list = append(list, destination{Destination: a.destination, Authorized: ok, Expected: expected})
+		}
+		data, err := json.MarshalIndent(struct {
+			Labels       map[string]string `json:"labels,omitempty"`
+			Destinations []destination     `json:"destinations"`
+		}{Labels: labels, Destinations: list}, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+}
+
+// serveStatus reports the outcome of the most recent forwarding stages as JSON
+func serveStatus(worker *forwarder.Worker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := json.MarshalIndent(worker.Status(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+}
@@ -0,0 +1,916 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/spf13/pflag"
+
+	"github.com/openshift/telemeter/pkg/authorizer/remote"
+	telemeterhttp "github.com/openshift/telemeter/pkg/http"
+	"github.com/openshift/telemeter/pkg/metricsclient"
+	"github.com/openshift/telemeter/pkg/transform"
+)
+
+func testFamilies(n int) []*clientmodel.MetricFamily {
+	families := make([]*clientmodel.MetricFamily, 0, n)
+	for i := 0; i < n; i++ {
+		name, label, value := fmt.Sprintf("metric_%04d", i), "instance", fmt.Sprintf("host-%d", i)
+		families = append(families, &clientmodel.MetricFamily{
+			Name: &name,
+			Type: clientmodel.MetricType_GAUGE.Enum(),
+			Metric: []*clientmodel.Metric{{
+				Label: []*clientmodel.LabelPair{{Name: &label, Value: &value}},
+				Gauge: &clientmodel.Gauge{Value: new(float64)},
+			}},
+		})
+	}
+	return families
+}
+
+func TestTransformsShardStatelessTransformers(t *testing.T) {
+	o := &Options{
+		Renames:             map[string]string{"metric_0001": "renamed"},
+		MetricPrefix:        "cluster_",
+		Labels:              map[string]string{"cluster": "a"},
+		MaxLabelLength:      10,
+		CountTransformDrops: true,
+		ProfileTransforms:   true,
+	}
+	transforms := o.Transforms()
+
+	stateless := make(map[string]bool)
+	for _, tr := range transforms {
+		stateless[transform.Describe(tr)] = transform.IsStateless(tr)
+	}
+	for description, want := range map[string]bool{
+		"rename names=metric_0001->renamed": true,
+		"prefix prefix=cluster_":            true,
+		"truncate-label-values max=10":      true,
+		"pack":                              true,
+		"label keys=cluster":                false,
+	} {
+		got, ok := stateless[description]
+		if !ok {
+			t.Errorf("transformer %q is missing from %v", description, transform.All(transforms))
+			continue
+		}
+		if got != want {
+			t.Errorf("IsStateless(%s) = %t, want %t", description, got, want)
+		}
+	}
+
+	serial, concurrent := testFamilies(1000), testFamilies(1000)
+	for _, tr := range transforms {
+		if err := transform.Filter(serial, tr); err != nil {
+			t.Fatal(err)
+		}
+		if err := transform.FilterConcurrent(concurrent, tr, 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(serial, concurrent) {
+		t.Error("concurrent transform of the client transformers differs from the serial transform")
+	}
+}
+
+type testLabelRetriever map[string]string
+
+func (r testLabelRetriever) Labels(context.Context) (map[string]string, error) { return r, nil }
+
+func TestPrintTransforms(t *testing.T) {
+	tests := []struct {
+		name string
+		o    *Options
+		want []string
+	}{
+		{
+			name: "passthrough",
+			o:    &Options{Passthrough: true},
+			want: []string{"no transformers, batches are uploaded unchanged"},
+		},
+		{
+			name: "labels required by the server",
+			o: &Options{
+				Labels:         map[string]string{"cluster": "a"},
+				LabelRetriever: testLabelRetriever{"id": "1"},
+				MetricPrefix:   "cluster_",
+			},
+			want: []string{
+				"1. build-info name=telemeter_client_build_info",
+				"2. label keys=cluster retriever=true",
+				"3. prefix prefix=cluster_",
+				"4. drop-invalid-federate-samples before=",
+				"5. drop-stale-markers",
+				"6. pack",
+				"7. sort",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			tt.o.printTransforms(buf)
+			lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			if len(lines) != len(tt.want) {
+				t.Fatalf("printTransforms() = %q, want %q", lines, tt.want)
+			}
+			for i, line := range lines {
+				// the cutoff depends on the current time
+				if !strings.HasPrefix(line, tt.want[i]) {
+					t.Errorf("line %d = %q, want %q", i+1, line, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// writeTestFile writes data to a new file in dir and returns its path.
+func writeTestFile(t *testing.T, dir, name, data string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telemeter-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		config  string
+		args    []string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:   "values of every type",
+			config: `{"from": "https://a", "interval": "1m", "limit": 5, "passthrough": true, "match": ["up", "ALERTS"]}`,
+			want:   map[string]string{"from": "https://a", "interval": "1m0s", "limit": "5", "passthrough": "true", "match": "[up,ALERTS]"},
+		},
+		{
+			name:   "command line takes precedence",
+			config: `{"from": "https://a", "match": ["up"]}`,
+			args:   []string{"--from=https://b", "--match=ALERTS"},
+			want:   map[string]string{"from": "https://b", "match": "[ALERTS]"},
+		},
+		{
+			name:    "unknown key",
+			config:  `{"form": "https://a"}`,
+			wantErr: `unknown key "form"`,
+		},
+		{
+			name:    "config may not load another config",
+			config:  `{"config": "other.json"}`,
+			wantErr: `unknown key "config"`,
+		},
+		{
+			name:    "invalid value",
+			config:  `{"interval": "soon"}`,
+			wantErr: `key "interval"`,
+		},
+		{
+			name:    "invalid JSON",
+			config:  `{"from": }`,
+			wantErr: "invalid character",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			flags.String("config", "", "")
+			flags.String("from", "", "")
+			flags.Duration("interval", 0, "")
+			flags.Int("limit", 0, "")
+			flags.Bool("passthrough", false, "")
+			flags.StringArray("match", nil, "")
+			if err := flags.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			path := writeTestFile(t, dir, fmt.Sprintf("config-%d.json", i), tt.config)
+			err := loadConfig(flags, path)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.want {
+				if got := flags.Lookup(name).Value.String(); got != want {
+					t.Errorf("--%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEffectiveConfigRedactsSecrets(t *testing.T) {
+	o := &Options{
+		From:            "https://prometheus:9090",
+		FromToken:       "secret-from-token",
+		To:              []string{"https://telemeter"},
+		ToToken:         "secret-to-token",
+		ToTokenFallback: "secret-fallback-token",
+		FromBasicAuth:   "user:secret-from-password",
+		ToBasicAuth:     "user:secret-to-password",
+		FromHeaders:     []string{"X-From-Key:secret-from-header"},
+		ToHeaders:       []string{"X-To-Key: secret-to-header"},
+		AnonymizeSalt:   "secret-salt",
+	}
+	mux := telemeterhttp.AddConfig(http.NewServeMux(), func() interface{} { return o.effectiveConfig() })
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, httptest.NewRequest("GET", "/config", nil))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("GET /config = %d", resp.Code)
+	}
+	body := resp.Body.String()
+	if strings.Contains(body, "secret") {
+		t.Errorf("/config exposes a secret:\n%s", body)
+	}
+
+	var config map[string]interface{}
+	if err := json.Unmarshal(resp.Body.Bytes(), &config); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"fromToken", "toToken", "toTokenFallback", "fromBasicAuth", "toBasicAuth", "anonymizeSalt"} {
+		if config[key] != redacted {
+			t.Errorf("%s = %v, want %s", key, config[key], redacted)
+		}
+	}
+	if got := fmt.Sprint(config["fromHeaders"], config["toHeaders"]); got != "[X-From-Key] [X-To-Key]" {
+		t.Errorf("headers = %s, want only their names", got)
+	}
+	if config["from"] != o.From {
+		t.Errorf("from = %v, want %s", config["from"], o.From)
+	}
+}
+
+func TestLoadMatchConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telemeter-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		config  string
+		want    []string
+		wantErr string
+	}{
+		{
+			name:   "strings and objects",
+			config: `{"matches": ["up", {"match": "{__name__=\"ALERTS\"}", "description": "alerts"}]}`,
+			want:   []string{"up", `{__name__="ALERTS"}`},
+		},
+		{
+			name:   "no rules",
+			config: `{}`,
+		},
+		{
+			name:    "empty rule",
+			config:  `{"matches": ["up", {"description": "nothing"}]}`,
+			wantErr: "match rule 1 is empty",
+		},
+		{
+			name:    "error reports the line",
+			config:  "{\n  \"matches\": [\n    \"up\",\n  ]\n}",
+			wantErr: ":4:",
+		},
+		{
+			name:   "yaml",
+			config: "# federated series\nmatches:\n- up\n- match: '{__name__=\"ALERTS\"}'\n  description: alerts\n",
+			want:   []string{"up", `{__name__="ALERTS"}`},
+		},
+		{
+			name:    "yaml error reports the line",
+			config:  "matches:\n- up\n- [down\n",
+			wantErr: ":3:",
+		},
+		{
+			name:    "yaml type error",
+			config:  "matches: up\n",
+			wantErr: "cannot unmarshal",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestFile(t, dir, fmt.Sprintf("match-%d.yaml", i), tt.config)
+			rules, err := loadMatchConfig(path)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadMatchConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rules, tt.want) {
+				t.Errorf("loadMatchConfig() = %q, want %q", rules, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadYAMLConfigs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telemeter-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	relabeler, err := loadRelabelConfig(writeTestFile(t, dir, "relabel.yaml", `
+relabel_configs:
+- source_labels: [instance]
+  regex: host-(.*)
+  target_label: host
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remapper, err := loadRemapConfig(writeTestFile(t, dir, "remap.yaml", `
+label_values:
+  host:
+    values:
+      "0": first
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	family := testFamilies(1)[0]
+	for _, t1 := range []transform.Interface{relabeler, remapper} {
+		if _, err := t1.Transform(family); err != nil {
+			t.Fatal(err)
+		}
+	}
+	labels := make(map[string]string)
+	for _, pair := range family.Metric[0].Label {
+		labels[pair.GetName()] = pair.GetValue()
+	}
+	if want := map[string]string{"instance": "host-0", "host": "first"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("labels = %v, want %v", labels, want)
+	}
+
+	_, err = loadRemapConfig(writeTestFile(t, dir, "invalid.yaml", "label_values:\n  host:\n    values: [\n"))
+	if err == nil || !strings.Contains(err.Error(), "invalid.yaml:") {
+		t.Errorf("loadRemapConfig() error = %v, want the file and line", err)
+	}
+}
+
+func TestRefreshRegexRules(t *testing.T) {
+	var names atomic.Value
+	names.Store(`["up","http_requests_total","http_request_duration_seconds_bucket"]`)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/v1/label/__name__/values" {
+			t.Errorf("unexpected path: %s", req.URL.Path)
+		}
+		fmt.Fprintf(w, `{"status":"success","data":%s}`, names.Load())
+	}))
+	defer s.Close()
+
+	o := &Options{Rules: []string{"up"}}
+	client := metricsclient.New(http.DefaultClient, 0, time.Second, "test")
+	u, _ := url.Parse(s.URL + "/api/v1/label/__name__/values")
+	re := regexp.MustCompile("^(?:http_.*_total)$")
+	if err := o.refreshRegexRules(context.Background(), client, u, re); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := o.MatchRules(), []string{"up", `{__name__="http_requests_total"}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MatchRules() = %q, want %q", got, want)
+	}
+
+	names.Store(`["up","http_requests_total","http_responses_total"]`)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		o.runRegexRefresh(ctx, 10*time.Millisecond, client, u, re)
+		close(stopped)
+	}()
+	want := []string{"up", `{__name__="http_requests_total"}`, `{__name__="http_responses_total"}`}
+	for deadline := time.Now().Add(5 * time.Second); !reflect.DeepEqual(o.MatchRules(), want); {
+		if time.Now().After(deadline) {
+			t.Fatalf("MatchRules() = %q after refreshing, want %q", o.MatchRules(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the refresh did not stop when its context was done")
+	}
+}
+
+func TestLoadMatchFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telemeter-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		files   []string
+		want    []string
+		wantErr string
+	}{
+		{
+			name:  "comments and blank lines are skipped",
+			files: []string{"# alerts\nALERTS\n\n  // health\n  up  \n", `{__name__="a"}`},
+			want:  []string{"ALERTS", "up", `{__name__="a"}`},
+		},
+		{
+			name:    "invalid rule reports the line",
+			files:   []string{"up\n\nup{job=}\n"},
+			wantErr: "match-0.txt:3: invalid match rule up{job=}",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var paths []string
+			for i, data := range tt.files {
+				paths = append(paths, writeTestFile(t, dir, fmt.Sprintf("match-%d.txt", i), data))
+			}
+			rules, err := loadMatchFiles(paths)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadMatchFiles() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rules, tt.want) {
+				t.Errorf("loadMatchFiles() = %q, want %q", rules, tt.want)
+			}
+		})
+	}
+	if _, err := loadMatchFiles([]string{filepath.Join(dir, "missing.txt")}); err == nil {
+		t.Error("loadMatchFiles() of a missing file succeeded, want an error")
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("TELEMETER_TEST_TOKEN", "secret")
+	defer os.Unsetenv("TELEMETER_TEST_TOKEN")
+	os.Unsetenv("TELEMETER_TEST_MISSING")
+
+	tests := []struct {
+		in      string
+		want    string
+		wantErr string
+	}{
+		{in: "plain", want: "plain"},
+		{in: "$TELEMETER_TEST_TOKEN", want: "secret"},
+		{in: "Bearer ${TELEMETER_TEST_TOKEN}!", want: "Bearer secret!"},
+		{in: "cost $$5", want: "cost $5"},
+		{in: "$TELEMETER_TEST_MISSING and ${TELEMETER_TEST_MISSING}", wantErr: "environment variables are not set: TELEMETER_TEST_MISSING, TELEMETER_TEST_MISSING"},
+	}
+	for _, tt := range tests {
+		got, err := expandEnv(tt.in)
+		if len(tt.wantErr) > 0 {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("expandEnv(%q) error = %v, want %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expandEnv(%q) error = %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("expandEnv(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDestination(t *testing.T) {
+	tests := []struct {
+		name          string
+		o             *Options
+		to            string
+		wantUpload    string
+		wantAuthorize []string
+		wantWeights   []int
+		wantErr       string
+	}{
+		{
+			name:          "derived from --to",
+			o:             &Options{Identifier: "cluster-1"},
+			to:            "https://telemeter.example.com",
+			wantUpload:    "https://telemeter.example.com/upload",
+			wantAuthorize: []string{"https://telemeter.example.com/authorize?id=cluster-1"},
+			wantWeights:   []int{0},
+		},
+		{
+			name:          "weights",
+			o:             &Options{ToUpload: "https://u/upload", ToAuthorize: []string{"https://a/authorize;weight=3", "https://b/authorize"}},
+			wantUpload:    "https://u/upload",
+			wantAuthorize: []string{"https://a/authorize", "https://b/authorize"},
+			wantWeights:   []int{3, 1},
+		},
+		{
+			name:          "--to-auth and --to-upload take precedence",
+			o:             &Options{ToUpload: "https://u/upload", ToAuthorize: []string{"https://a/authorize"}},
+			to:            "https://telemeter.example.com/",
+			wantUpload:    "https://u/upload",
+			wantAuthorize: []string{"https://a/authorize"},
+			wantWeights:   []int{1},
+		},
+		{
+			name:    "zero weight",
+			o:       &Options{ToUpload: "https://u/upload", ToAuthorize: []string{"https://a/authorize;weight=0"}},
+			wantErr: "--to-auth weight must be a positive number",
+		},
+		{
+			name:    "invalid weight",
+			o:       &Options{ToUpload: "https://u/upload", ToAuthorize: []string{"https://a/authorize;weight=high"}},
+			wantErr: "--to-auth weight must be a positive number",
+		},
+		{
+			name:    "no destination",
+			o:       &Options{ToAuthorize: []string{"https://a/authorize"}},
+			wantErr: "either --to or --to-auth and --to-upload must be specified",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upload, authorize, err := tt.o.destination(tt.to)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("destination() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if upload.String() != tt.wantUpload {
+				t.Errorf("upload = %s, want %s", upload, tt.wantUpload)
+			}
+			var urls []string
+			var weights []int
+			for _, e := range authorize {
+				urls = append(urls, e.URL.String())
+				weights = append(weights, e.Weight)
+			}
+			if !reflect.DeepEqual(urls, tt.wantAuthorize) || !reflect.DeepEqual(weights, tt.wantWeights) {
+				t.Errorf("authorize = %q weights %v, want %q weights %v", urls, weights, tt.wantAuthorize, tt.wantWeights)
+			}
+		})
+	}
+}
+
+func TestParseRounding(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    transform.Rounding
+		wantErr string
+	}{
+		{in: "nearest:0.5", want: transform.Rounding{Mode: transform.RoundNearest, Precision: 0.5}},
+		{in: "significant:3:counters", want: transform.Rounding{Mode: transform.RoundSignificant, Precision: 3, Counters: true}},
+		{in: "nearest", wantErr: "expected MODE:PRECISION"},
+		{in: "nearest:1:gauges", wantErr: "expected MODE:PRECISION"},
+		{in: "nearest:0", wantErr: "precision must be a positive number"},
+		{in: "nearest:x", wantErr: "precision must be a positive number"},
+		{in: "significant:2.5", wantErr: "the number of significant digits must be a whole number"},
+		{in: "up:1", wantErr: "mode must be nearest or significant"},
+	}
+	for _, tt := range tests {
+		got, err := parseRounding(tt.in)
+		if len(tt.wantErr) > 0 {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("parseRounding(%q) error = %v, want %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRounding(%q) error = %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseRounding(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestJitteredMinimum(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		jitter   float64
+		want     time.Duration
+	}{
+		{interval: time.Minute, want: time.Minute},
+		{interval: time.Minute, jitter: 0.5, want: 30 * time.Second},
+		{interval: 4*time.Minute + 30*time.Second, jitter: 0.1, want: 4*time.Minute + 3*time.Second},
+		{interval: time.Minute, jitter: 1},
+	}
+	for _, tt := range tests {
+		if got := jitteredMinimum(tt.interval, tt.jitter); got != tt.want {
+			t.Errorf("jitteredMinimum(%s, %v) = %s, want %s", tt.interval, tt.jitter, got, tt.want)
+		}
+	}
+}
+
+func TestListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telemeter-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a socket left behind by a process that did not remove it
+	stale := filepath.Join(dir, "stale.sock")
+	l, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	tests := []struct {
+		addr    string
+		network string
+		wantErr string
+	}{
+		{addr: "127.0.0.1:0", network: "tcp"},
+		{addr: "unix:" + filepath.Join(dir, "new.sock"), network: "unix"},
+		{addr: "unix:" + stale, network: "unix"},
+		{addr: "unix:", wantErr: "--listen must include a socket path after unix:"},
+		{addr: "::1:8080", wantErr: "--listen must be host:port"},
+		{addr: "localhost", wantErr: "--listen must be host:port"},
+	}
+	for _, tt := range tests {
+		l, err := listen(tt.addr)
+		if len(tt.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("listen(%q) error = %v, want %q", tt.addr, err, tt.wantErr)
+			}
+			if err == nil {
+				l.Close()
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("listen(%q) error = %v", tt.addr, err)
+			continue
+		}
+		if got := l.Addr().Network(); got != tt.network {
+			t.Errorf("listen(%q) network = %s, want %s", tt.addr, got, tt.network)
+		}
+		l.Close()
+	}
+}
+
+func TestTransformFlags(t *testing.T) {
+	tests := []struct {
+		name string
+		o    *Options
+		want []string
+	}{
+		{
+			name: "defaults",
+			o:    &Options{MaxAgeDefault: defaultMaxAge},
+		},
+		{
+			name: "flags in the order they are applied",
+			o: &Options{
+				MaxAgeDefault:      time.Hour,
+				KeepLabels:         []string{"job"},
+				StripMetaLabels:    true,
+				MaxLabelLength:     64,
+				GuardCounterResets: true,
+			},
+			want: []string{"--keep-label", "--strip-meta-labels", "--max-age-default", "--max-label-length", "--guard-counter-resets"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.o.transformFlags(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("transformFlags() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		want    http.Header
+		wantErr string
+	}{
+		{
+			name:   "repeated names are kept",
+			values: []string{"x-tenant: a", "X-Tenant:b", "X-Gateway-Key: secret"},
+			want:   http.Header{"X-Tenant": {"a", "b"}, "X-Gateway-Key": {"secret"}},
+		},
+		{
+			name: "none",
+			want: http.Header{},
+		},
+		{
+			name:    "authorization",
+			values:  []string{"authorization: Bearer x"},
+			wantErr: "--to-header can't set the Authorization header",
+		},
+		{
+			name:    "missing value",
+			values:  []string{"X-Tenant"},
+			wantErr: "--to-header must be of the form Name:Value",
+		},
+		{
+			name:    "invalid name",
+			values:  []string{"X Tenant: a"},
+			wantErr: "--to-header is not a valid header name",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHeaders("--to-header", tt.values)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("parseHeaders() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseHeaders() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckMatchRules(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Query().Get("match[]") {
+		case "up":
+			fmt.Fprintln(w, "up 1")
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "slow":
+			time.Sleep(50 * time.Millisecond)
+			fmt.Fprintln(w, "up 1")
+		}
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	client := metricsclient.New(&http.Client{}, 1024, time.Second, "test")
+
+	tests := []struct {
+		name      string
+		rules     []string
+		wantEmpty []string
+		wantErr   string
+	}{
+		{
+			name:      "empty rules are returned",
+			rules:     []string{"up", "ALERTS", "missing"},
+			wantEmpty: []string{"ALERTS", "missing"},
+		},
+		{
+			name:      "each rule has its own timeout",
+			rules:     []string{"slow", "slow", "slow", "ALERTS"},
+			wantEmpty: []string{"ALERTS"},
+		},
+		{
+			name:      "empty rules are returned with failures",
+			rules:     []string{"broken", "ALERTS", "broken"},
+			wantEmpty: []string{"ALERTS"},
+			wantErr:   "rule broken: ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			empty, err := checkMatchRules(context.Background(), client, *u, tt.rules, 100*time.Millisecond)
+			if len(tt.wantErr) > 0 {
+				if err == nil || strings.Count(err.Error(), tt.wantErr) != strings.Count(strings.Join(tt.rules, " "), "broken") {
+					t.Errorf("checkMatchRules() error = %v, want %q for every failed rule", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(empty, tt.wantEmpty) {
+				t.Errorf("checkMatchRules() = %q, want %q", empty, tt.wantEmpty)
+			}
+		})
+	}
+}
+
+func TestCheckMatchRulesDeadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprintln(w, "up 1")
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	client := metricsclient.New(&http.Client{}, 1024, time.Second, "test")
+
+	rules := make([]string, 4*maxConcurrentRuleChecks)
+	for i := range rules {
+		rules[i] = fmt.Sprintf("up{rule=\"%d\"}", i)
+	}
+
+	// checked one after another, the rules would take 1.6s
+	start := time.Now()
+	if _, err := checkMatchRules(context.Background(), client, *u, rules, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("checking %d rules took %s, want them checked concurrently", len(rules), elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 75*time.Millisecond)
+	defer cancel()
+	_, err := checkMatchRules(ctx, client, *u, rules, time.Second)
+	if err == nil || strings.Count(err.Error(), "rule up{") < len(rules)-2*maxConcurrentRuleChecks {
+		t.Errorf("checkMatchRules() error = %v, want the rules not checked before the deadline", err)
+	}
+}
+
+func TestServeAuthorizeLabels(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(remote.TokenResponse{Token: "token", ExpiresInSeconds: 3600, Labels: map[string]string{"_id": "cluster-1"}})
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	authorized := remote.NewServerRotatingRoundTripper("initial", []remote.Endpoint{{URL: u}}, http.DefaultTransport)
+	if _, err := authorized.Labels(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	unauthorized := remote.NewServerRotatingRoundTripper("initial", []remote.Endpoint{{URL: u}}, http.DefaultTransport)
+	h := serveAuthorizeLabels([]destinationAuthorizer{
+		{destination: "https://a/upload", authorizer: authorized},
+		{destination: "https://b/upload", authorizer: unauthorized},
+	}, map[string]string{"cluster": "a"})
+
+	tests := []struct {
+		method     string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			method:     "GET",
+			wantStatus: http.StatusOK,
+			wantBody: `{
+  "labels": {
+    "cluster": "a"
+  },
+  "destinations": [
+    {
+      "destination": "https://a/upload",
+      "authorized": true,
+      "expected": {
+        "_id": "cluster-1"
+      }
+    },
+    {
+      "destination": "https://b/upload",
+      "authorized": false
+    }
+  ]
+}`,
+		},
+		{method: "POST", wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(tt.method, "/authorize-labels", nil))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s status = %d, want %d", tt.method, rec.Code, tt.wantStatus)
+		}
+		if got := rec.Body.String(); got != tt.wantBody {
+			t.Errorf("%s body = %s, want %s", tt.method, got, tt.wantBody)
+		}
+	}
+}
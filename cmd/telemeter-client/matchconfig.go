@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// matchConfig is the structure of the file passed to --match-config.
+type matchConfig struct {
+	Matches []matchRule `json:"matches"`
+}
+
+// matchRule is a single match rule. It may be written as a plain string or as an
+// object with the rule in "match" and optional metadata about it.
+type matchRule struct {
+	Match       string `json:"match"`
+	Description string `json:"description,omitempty"`
+}
+
+func (r *matchRule) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &r.Match)
+	}
+	type plain matchRule
+	return json.Unmarshal(data, (*plain)(r))
+}
+
+// loadMatchConfig reads the match rules from the YAML or JSON config file at path.
+// Parse errors report the line they occurred on. Every rule must be a valid series
+// selector, see parseMatchRule.
+func loadMatchConfig(path string) ([]string, error) {
+	var config matchConfig
+	if err := readConfigFile(path, &config); err != nil {
+		return nil, err
+	}
+	var rules []string
+	for i, rule := range config.Matches {
+		if len(rule.Match) == 0 {
+			return nil, fmt.Errorf("%s: match rule %d is empty", path, i)
+		}
+		if err := parseMatchRule(rule.Match); err != nil {
+			return nil, fmt.Errorf("%s: invalid match rule %d %s: %v", path, i, rule.Match, err)
+		}
+		rules = append(rules, rule.Match)
+	}
+	return rules, nil
+}
+
+// loadMatchFiles reads the match rules from the files at paths, one rule per line.
+// Blank lines and lines starting with # or // are skipped. Every other line must be
+// a valid series selector, see parseMatchRule.
+func loadMatchFiles(paths []string) ([]string, error) {
+	var rules []string
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for i, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if len(line) == 0 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+				continue
+			}
+			if err := parseMatchRule(line); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid match rule %s: %v", path, i+1, line, err)
+			}
+			rules = append(rules, line)
+		}
+	}
+	return rules, nil
+}
+
+// yamlLine matches the line number in the errors of the YAML parser.
+var yamlLine = regexp.MustCompile(`^yaml: line (\d+): `)
+
+// readConfigFile unmarshals the YAML or JSON file at path into v, using the JSON
+// field names of v for both. A file starting with "{" is read as JSON. Parse errors
+// report the line they occurred on.
+func readConfigFile(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		converted, err := yaml.YAMLToJSON(data)
+		if err != nil {
+			if m := yamlLine.FindStringSubmatch(err.Error()); m != nil {
+				return fmt.Errorf("%s:%s: %s", path, m[1], strings.TrimPrefix(err.Error(), m[0]))
+			}
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if err := json.Unmarshal(converted, v); err != nil {
+			// the offsets refer to the converted document
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		return nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		var offset int64
+		switch err := err.(type) {
+		case *json.SyntaxError:
+			offset = err.Offset
+		case *json.UnmarshalTypeError:
+			offset = err.Offset
+		default:
+			return err
+		}
+		return fmt.Errorf("%s:%d: %v", path, bytes.Count(data[:offset], []byte("\n"))+1, err)
+	}
+	return nil
+}
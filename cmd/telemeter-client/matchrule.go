@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openshift/telemeter/pkg/metricsclient"
+	"github.com/openshift/telemeter/pkg/transform"
+)
+
+// parseMatchRule returns an error unless rule is a series selector as accepted by
+// the match[] parameter of the federation endpoint, such as up or
+// {job="a",instance=~"b.*"}. No PromQL parser is available to the client, so the
+// selector grammar is checked here.
+func parseMatchRule(rule string) error {
+	s := strings.TrimSpace(rule)
+	i := 0
+	for i < len(s) && isNameChar(s[i], i == 0, true) {
+		i++
+	}
+	nonEmpty := i > 0
+	s = strings.TrimSpace(s[i:])
+	if len(s) == 0 {
+		if !nonEmpty {
+			return fmt.Errorf("rule is empty")
+		}
+		return nil
+	}
+	if s[0] != '{' {
+		return fmt.Errorf("unexpected %q, expected a metric name or {", s)
+	}
+	s = s[1:]
+	for {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			return fmt.Errorf("missing closing }")
+		}
+		if s[0] == '}' {
+			if rest := strings.TrimSpace(s[1:]); len(rest) > 0 {
+				return fmt.Errorf("unexpected %q after }", rest)
+			}
+			break
+		}
+
+		j := 0
+		for j < len(s) && isNameChar(s[j], j == 0, false) {
+			j++
+		}
+		if j == 0 {
+			return fmt.Errorf("unexpected %q, expected a label name", s)
+		}
+		label := s[:j]
+		s = strings.TrimSpace(s[j:])
+
+		var op string
+		for _, candidate := range []string{"=~", "!~", "!=", "="} {
+			if strings.HasPrefix(s, candidate) {
+				op = candidate
+				break
+			}
+		}
+		if len(op) == 0 {
+			return fmt.Errorf("unexpected %q after label %s, expected one of =, !=, =~, or !~", s, label)
+		}
+		value, rest, err := unquoteLabelValue(strings.TrimSpace(s[len(op):]))
+		if err != nil {
+			return fmt.Errorf("label %s: %v", label, err)
+		}
+		matchesEmpty := false
+		switch op {
+		case "=":
+			matchesEmpty = len(value) == 0
+		case "!=":
+			matchesEmpty = len(value) > 0
+		default:
+			// label regular expressions are anchored
+			re, err := regexp.Compile("^(?:" + value + ")$")
+			if err != nil {
+				return fmt.Errorf("label %s: %v", label, err)
+			}
+			matchesEmpty = re.MatchString("") == (op == "=~")
+		}
+		nonEmpty = nonEmpty || !matchesEmpty
+
+		s = strings.TrimSpace(rest)
+		switch {
+		case strings.HasPrefix(s, ","):
+			s = s[1:]
+		case strings.HasPrefix(s, "}"):
+		default:
+			return fmt.Errorf("unexpected %q after label %s, expected , or }", s, label)
+		}
+	}
+	if !nonEmpty {
+		return fmt.Errorf("rule must have a metric name or a matcher that does not match the empty string")
+	}
+	return nil
+}
+
+// isNameChar returns true if c may appear in a metric name, or a label name if
+// metric is false, at the first position if first is true.
+func isNameChar(c byte, first, metric bool) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || metric && c == ':' || !first && c >= '0' && c <= '9'
+}
+
+// unquoteLabelValue reads the string literal quoted with ", ', or ` at the start of s
+// and returns its value and the rest of s.
+func unquoteLabelValue(s string) (string, string, error) {
+	if len(s) == 0 || !strings.ContainsAny(s[:1], "\"'`") {
+		return "", "", fmt.Errorf("expected a quoted value at %q", s)
+	}
+	quote := s[0]
+	end := -1
+	for i := 1; i < len(s); i++ {
+		if s[i] == '\\' && quote != '`' {
+			i++
+			continue
+		}
+		if s[i] == quote {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		return "", "", fmt.Errorf("unterminated value %s", s)
+	}
+	literal := s[:end+1]
+	if quote == '\'' {
+		// strconv only unquotes single characters in single quotes
+		body := strings.Replace(literal[1:end], `\'`, `'`, -1)
+		literal = `"` + strings.Replace(body, `"`, `\"`, -1) + `"`
+	}
+	value, err := strconv.Unquote(literal)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid value %s: %v", s[:end+1], err)
+	}
+	return value, s[end+1:], nil
+}
+
+// maxConcurrentRuleChecks limits the requests checkMatchRules makes at once.
+const maxConcurrentRuleChecks = 8
+
+// checkMatchRules federates each of rules from u on its own, allowing each rule up
+// to timeout, and returns the rules that matched no series. Up to
+// maxConcurrentRuleChecks rules are checked at once, and rules not checked before
+// ctx is done fail. Rules that can't be retrieved are reported in the error
+// together, after the rest have been checked.
+func checkMatchRules(ctx context.Context, client *metricsclient.Client, u url.URL, rules []string, timeout time.Duration) ([]string, error) {
+	errs := make([]error, len(rules))
+	isEmpty := make([]bool, len(rules))
+	limit := make(chan struct{}, maxConcurrentRuleChecks)
+	var wg sync.WaitGroup
+	for i, rule := range rules {
+		v := u.Query()
+		v.Add("match[]", rule)
+		ruleURL := u
+		ruleURL.RawQuery = v.Encode()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			select {
+			case limit <- struct{}{}:
+				defer func() { <-limit }()
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+			ruleCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			families, err := client.Retrieve(ruleCtx, &http.Request{Method: "GET", URL: &ruleURL})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			isEmpty[i] = transform.Metrics(families) == 0
+		}(i)
+	}
+	wg.Wait()
+
+	var empty, failed []string
+	for i, rule := range rules {
+		switch {
+		case errs[i] != nil:
+			failed = append(failed, fmt.Sprintf("rule %s: %v", rule, errs[i]))
+		case isEmpty[i]:
+			empty = append(empty, rule)
+		}
+	}
+	if len(failed) > 0 {
+		return empty, fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return empty, nil
+}
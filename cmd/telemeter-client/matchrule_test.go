@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseMatchRule(t *testing.T) {
+	tests := []struct {
+		rule    string
+		wantErr string
+	}{
+		{rule: `up`},
+		{rule: ` cluster:usage:ratio `},
+		{rule: `{__name__="up"}`},
+		{rule: `up{}`},
+		{rule: `up{job="a",instance=~"b.*"}`},
+		{rule: `up{job="a",}`},
+		{rule: `{job != "", instance !~ "b.*"}`},
+		{rule: `{job=~"a|b"}`},
+		{rule: `up{job!~"a"}`},
+		{rule: `{job='a'}`},
+		{rule: "{job=`a\\d`}"},
+		{rule: `{job="a\"b"}`},
+		{rule: `{job='a\'b'}`},
+		{rule: `{job="é"}`},
+
+		{rule: ``, wantErr: "rule is empty"},
+		{rule: `   `, wantErr: "rule is empty"},
+		{rule: `{}`, wantErr: "does not match the empty string"},
+		{rule: `{job=""}`, wantErr: "does not match the empty string"},
+		{rule: `{job=~".*"}`, wantErr: "does not match the empty string"},
+		{rule: `{job!~"a"}`, wantErr: "does not match the empty string"},
+		{rule: `{job!~".*"}`},
+		{rule: `{job!="a"}`, wantErr: "does not match the empty string"},
+		{rule: `1up`, wantErr: "expected a metric name"},
+		{rule: `up job`, wantErr: "expected a metric name or {"},
+		{rule: `up{job="a",`, wantErr: "missing closing }"},
+		{rule: `up{job="a"`, wantErr: "expected , or }"},
+		{rule: `up{job="a"} x`, wantErr: `unexpected "x" after }`},
+		{rule: `up{="a"}`, wantErr: "expected a label name"},
+		{rule: `up{1job="a"}`, wantErr: "expected a label name"},
+		{rule: `up{job:x="a"}`, wantErr: "after label job"},
+		{rule: `up{job=="a"}`, wantErr: "expected a quoted value"},
+		{rule: `up{job<"a"}`, wantErr: "expected one of =, !=, =~, or !~"},
+		{rule: `up{job=a}`, wantErr: "expected a quoted value"},
+		{rule: `up{job="a}`, wantErr: "unterminated value"},
+		{rule: `up{job="a" instance="b"}`, wantErr: "expected , or }"},
+		{rule: `up{job=~"a("}`, wantErr: "label job: error parsing regexp"},
+		{rule: `up{job="\q"}`, wantErr: "invalid value"},
+	}
+	for _, tt := range tests {
+		err := parseMatchRule(tt.rule)
+		if len(tt.wantErr) == 0 {
+			if err != nil {
+				t.Errorf("parseMatchRule(%s) = %v, want no error", tt.rule, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("parseMatchRule(%s) = %v, want an error containing %q", tt.rule, err, tt.wantErr)
+		}
+	}
+}
+
+func TestUnquoteLabelValue(t *testing.T) {
+	tests := []struct {
+		s         string
+		wantValue string
+		wantRest  string
+		wantErr   bool
+	}{
+		{s: `"a",b`, wantValue: "a", wantRest: ",b"},
+		{s: `""}`, wantValue: "", wantRest: "}"},
+		{s: `'a'}`, wantValue: "a", wantRest: "}"},
+		{s: `'a"b'`, wantValue: `a"b`},
+		{s: `'a\'b'`, wantValue: "a'b"},
+		{s: `"a\"b"`, wantValue: `a"b`},
+		{s: `"a\\"`, wantValue: `a\`},
+		{s: `"a\nb"`, wantValue: "a\nb"},
+		{s: "`a\\d`}", wantValue: `a\d`, wantRest: "}"},
+		{s: "`a\\`", wantValue: `a\`},
+		{s: ``, wantErr: true},
+		{s: `a`, wantErr: true},
+		{s: `"a`, wantErr: true},
+		{s: `"a\"`, wantErr: true},
+		{s: `'a`, wantErr: true},
+		{s: `"\q"`, wantErr: true},
+	}
+	for _, tt := range tests {
+		value, rest, err := unquoteLabelValue(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("unquoteLabelValue(%s) error = %v, wantErr %t", tt.s, err, tt.wantErr)
+			continue
+		}
+		if value != tt.wantValue || rest != tt.wantRest {
+			t.Errorf("unquoteLabelValue(%s) = %q, %q, want %q, %q", tt.s, value, rest, tt.wantValue, tt.wantRest)
+		}
+	}
+}
+
+func TestIsNameChar(t *testing.T) {
+	tests := []struct {
+		c             byte
+		first, metric bool
+		want          bool
+	}{
+		{c: 'a', first: true, want: true},
+		{c: 'Z', first: true, want: true},
+		{c: '_', first: true, want: true},
+		{c: '0', first: true, want: false},
+		{c: '0', want: true},
+		{c: ':', first: true, metric: true, want: true},
+		{c: ':', metric: true, want: true},
+		{c: ':', want: false},
+		{c: '-', metric: true, want: false},
+		{c: '.', want: false},
+		{c: '{', metric: true, want: false},
+	}
+	for _, tt := range tests {
+		if got := isNameChar(tt.c, tt.first, tt.metric); got != tt.want {
+			t.Errorf("isNameChar(%q, first=%t, metric=%t) = %t, want %t", tt.c, tt.first, tt.metric, got, tt.want)
+		}
+	}
+}
+
+func TestLoadMatchConfigValidatesRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matchconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(`{"matches": ["up", {"match": "{job=\"a\""}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadMatchConfig(path); err == nil || !strings.Contains(err.Error(), "invalid match rule 1") {
+		t.Errorf("loadMatchConfig() error = %v, want an invalid rule", err)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"github.com/openshift/telemeter/pkg/transform"
+)
+
+// relabelConfig is the structure of the file passed to --relabel-config. The rules
+// use the field names of Prometheus relabel_configs.
+type relabelConfig struct {
+	RelabelConfigs []transform.RelabelConfig `json:"relabel_configs"`
+}
+
+// loadRelabelConfig reads the relabel rules from the YAML or JSON config file at
+// path and returns a transformer that applies them.
+func loadRelabelConfig(path string) (transform.Interface, error) {
+	var config relabelConfig
+	if err := readConfigFile(path, &config); err != nil {
+		return nil, err
+	}
+	return transform.NewRelabeler(config.RelabelConfigs)
+}
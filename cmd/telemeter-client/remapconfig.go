@@ -0,0 +1,21 @@
+package main
+
+import (
+	"github.com/openshift/telemeter/pkg/transform"
+)
+
+// remapConfig is the structure of the file passed to --remap-config. The lookup
+// tables are keyed by label name under "label_values".
+type remapConfig struct {
+	LabelValues map[string]transform.ValueRemap `json:"label_values"`
+}
+
+// loadRemapConfig reads the label value lookup tables from the YAML or JSON config
+// file at path and returns a transformer that applies them.
+func loadRemapConfig(path string) (transform.Interface, error) {
+	var config remapConfig
+	if err := readConfigFile(path, &config); err != nil {
+		return nil, err
+	}
+	return transform.NewValueRemapper(config.LabelValues)
+}
@@ -125,6 +125,8 @@ func main() {
 
 	cmd.Flags().StringVar(&opt.AuthorizeEndpoint, "authorize", opt.AuthorizeEndpoint, "A endpoint URL to authorize against when a client requests a token.")
 	cmd.Flags().StringVar(&opt.AuthorizeTokenFile, "authorize-token-file", opt.AuthorizeTokenFile, "The path to a file containing a bearer token to use with the authorization endpoint.")
+	cmd.Flags().StringVar(&opt.UploadHMACKeyFile, "upload-hmac-key-file", opt.UploadHMACKeyFile, "The path to a file containing a key shared with clients. If set, uploads must be signed with it and uploads without a valid signature are rejected before their token is validated.")
+	cmd.Flags().StringArrayVar(&opt.TrustForwarded, "trust-forwarded", opt.TrustForwarded, "An IP address or CIDR of proxies whose Forwarded or X-Forwarded-For headers identify the clients of the authorize endpoint, instead of the connection address. The nearest address in the headers that is not a trusted proxy is used, as clients can forge the others. May be repeated.")
 
 	cmd.Flags().BoolVarP(&opt.Verbose, "verbose", "v", opt.Verbose, "Show verbose output.")
 
@@ -149,6 +151,8 @@ type Options struct {
 
 	AuthorizeEndpoint  string
 	AuthorizeTokenFile string
+	UploadHMACKeyFile  string
+	TrustForwarded     []string
 
 	PartitionKey string
 	LabelFlag    []string
@@ -210,6 +214,15 @@ func (o *Options) Run() error {
 		}
 	}
 
+	var uploadKey []byte
+	if len(o.UploadHMACKeyFile) > 0 {
+		data, err := ioutil.ReadFile(o.UploadHMACKeyFile)
+		if err != nil {
+			return fmt.Errorf("unable to read --upload-hmac-key-file: %v", err)
+		}
+		uploadKey = []byte(strings.TrimSpace(string(data)))
+	}
+
 	switch {
 	case len(o.TLSCertificatePath) == 0 && len(o.TLSKeyPath) > 0,
 		len(o.TLSCertificatePath) > 0 && len(o.TLSKeyPath) == 0:
@@ -284,7 +297,11 @@ func (o *Options) Run() error {
 	internalPaths := []string{"/", "/federate", "/metrics", "/debug/pprof", "/healthz", "/healthz/ready"}
 
 	// configure the authenticator and incoming data validator
-	auth := server.New(o.PartitionKey, authorizeURL, authorizeClient, o.TokenExpireSeconds, signer, o.Labels)
+	trustedProxies, err := server.ParseTrustedProxies(o.TrustForwarded)
+	if err != nil {
+		return fmt.Errorf("--trust-forwarded is invalid: %v", err)
+	}
+	auth := server.New(o.PartitionKey, authorizeURL, authorizeClient, o.TokenExpireSeconds, signer, o.Labels).WithTrustedProxies(trustedProxies)
 	validator := untrusted.NewValidator(o.PartitionKey, o.Labels, o.LimitBytes, 24*time.Hour)
 
 	// register a store
@@ -319,14 +336,14 @@ func (o *Options) Run() error {
 		internalProtected.Handle("/debug/cluster", cluster)
 	}
 
-	server := httpserver.New(store, validator)
+	metricsServer := httpserver.New(store, validator)
 
 	internalPathJSON, _ := json.MarshalIndent(Paths{Paths: internalPaths}, "", "  ")
 	externalPathJSON, _ := json.MarshalIndent(Paths{Paths: []string{"/", "/authorize", "/upload", "/healthz", "/healthz/ready"}}, "", "  ")
 
 	// TODO: add internal authorization
 	telemeterhttp.AddDebug(internalProtected)
-	internalProtected.Handle("/federate", http.HandlerFunc(server.Get))
+	internalProtected.Handle("/federate", http.HandlerFunc(metricsServer.Get))
 
 	internal.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		if req.URL.Path == "/" && req.Method == "GET" {
@@ -342,11 +359,15 @@ func (o *Options) Run() error {
 	externalProtected.Handle("/upload",
 		promhttp.InstrumentHandlerCounter(metricRequestFederate,
 			promhttp.InstrumentHandlerDuration(metricRequestFederateLatency,
-				http.HandlerFunc(server.Post),
+				http.HandlerFunc(metricsServer.Post),
 			),
 		),
 	)
 	externalProtectedHandler := httpauthorizer.New(externalProtected, authorizer)
+	if len(uploadKey) > 0 {
+		// verified before the token so that forged uploads are rejected cheaply
+		externalProtectedHandler = server.NewSignatureVerifier(uploadKey, o.LimitBytes, externalProtectedHandler)
+	}
 
 	external.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		if req.URL.Path == "/" && req.Method == "GET" {
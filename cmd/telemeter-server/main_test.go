@@ -53,17 +53,19 @@ func TestPostError(t *testing.T) {
 	testCases := []struct {
 		name   string
 		send   []*clientmodel.MetricFamily
+		code   int
 		expect string
 	}{
-		{name: "without cluster ID", send: sort(mustReadString(sampleMetrics)), expect: "a required label is missing from the metric"},
-		{name: "out of order", send: withLabels(mustReadString(sampleMetrics), labels), expect: "are not in increasing timestamp order"},
-		{name: "lack timestamp", send: withLabels(mustReadString(missingTimestamp), labels), expect: "do not have a timestamp"},
-		{name: "too large", send: []*clientmodel.MetricFamily{{Name: &longName}}, expect: "incoming sample data is too long"},
+		{name: "without cluster ID", send: sort(mustReadString(sampleMetrics)), code: http.StatusBadRequest, expect: `metric openshift_build_info is missing the required label cluster="test"`},
+		{name: "wrong cluster ID", send: withLabels(sort(mustReadString(sampleMetrics)), map[string]string{"cluster": "other"}), code: http.StatusBadRequest, expect: `metric openshift_build_info has label cluster="other", expected "test"`},
+		{name: "out of order", send: withLabels(mustReadString(sampleMetrics), labels), code: http.StatusInternalServerError, expect: "are not in increasing timestamp order"},
+		{name: "lack timestamp", send: withLabels(mustReadString(missingTimestamp), labels), code: http.StatusInternalServerError, expect: "do not have a timestamp"},
+		{name: "too large", send: []*clientmodel.MetricFamily{{Name: &longName}}, code: http.StatusInternalServerError, expect: "incoming sample data is too long"},
 	}
 	for _, test := range testCases {
 		t.Run(test.name, func(t *testing.T) {
 			code, body := mustPostError(s.URL, expfmt.FmtProtoDelim, test.send)
-			if code != http.StatusInternalServerError {
+			if code != test.code {
 				t.Errorf("unexpected code: %d", code)
 			}
 			if !strings.Contains(body, test.expect) {
@@ -74,6 +76,30 @@ func TestPostError(t *testing.T) {
 
 }
 
+func TestPostSkipLabelCheck(t *testing.T) {
+	validator := untrusted.NewValidator("cluster", nil, 0, 0)
+	store := server.NewMemoryStore()
+	server := server.New(store, validator)
+
+	labels := map[string]string{"cluster": "test"}
+	s := httptest.NewServer(fakeAuthorizeHandler(http.HandlerFunc(server.Post), &authorizer.User{ID: "test", Labels: labels, SkipLabelCheck: true}))
+	defer s.Close()
+
+	mustPost(s.URL, expfmt.FmtProtoDelim, withLabels(sort(mustReadString(sampleMetrics)), map[string]string{"cluster": "other"}))
+
+	var actual []*clientmodel.MetricFamily
+	err := store.ReadMetrics(context.Background(), 0, func(partitionKey string, families []*clientmodel.MetricFamily) error {
+		actual = families
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := metricsAsStringOrDie(withLabels(sort(mustReadString(sampleMetrics)), labels)), metricsAsStringOrDie(actual); e != a {
+		t.Errorf("expected:\n%s\nactual:\n%s", e, a)
+	}
+}
+
 func testPost(t *testing.T, validator server.UploadValidator, send, expect []*clientmodel.MetricFamily) {
 	t.Helper()
 
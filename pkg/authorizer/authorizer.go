@@ -11,6 +11,9 @@ type Interface interface {
 type User struct {
 	ID     string
 	Labels map[string]string
+	// SkipLabelCheck exempts the uploads of the user from the check that every
+	// series carries Labels, which are set on each series instead.
+	SkipLabelCheck bool
 }
 
 var userKey key = 0
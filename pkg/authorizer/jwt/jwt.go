@@ -220,14 +220,15 @@ type privateClaims struct {
 }
 
 type telemeter struct {
-	Labels map[string]string `json:"labels,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	SkipLabelCheck bool              `json:"skipLabelCheck,omitempty"`
 }
 
 func now() time.Time {
 	return time.Now()
 }
 
-func Claims(subject string, labels map[string]string, expirationSeconds int64, audience []string) (*jwt.Claims, interface{}) {
+func Claims(subject string, labels map[string]string, skipLabelCheck bool, expirationSeconds int64, audience []string) (*jwt.Claims, interface{}) {
 	now := now()
 	sc := &jwt.Claims{
 		Subject:   subject,
@@ -238,7 +239,8 @@ func Claims(subject string, labels map[string]string, expirationSeconds int64, a
 	}
 	pc := &privateClaims{
 		Telemeter: telemeter{
-			Labels: labels,
+			Labels:         labels,
+			SkipLabelCheck: skipLabelCheck,
 		},
 	}
 	return sc, pc
@@ -288,8 +290,9 @@ func (v *validator) Validate(_ string, public *jwt.Claims, privateObj interface{
 	}
 
 	return &authorizer.User{
-		ID:     public.Subject,
-		Labels: private.Telemeter.Labels,
+		ID:             public.Subject,
+		Labels:         private.Telemeter.Labels,
+		SkipLabelCheck: private.Telemeter.SkipLabelCheck,
 	}, nil
 }
 
@@ -1,69 +1,223 @@
 package remote
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	telemeterhttp "github.com/openshift/telemeter/pkg/http"
 )
 
+var (
+	histogramAuthorizeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "telemeter_authorize_duration_seconds",
+		Help: "Time taken to exchange the initial token at an authorize endpoint.",
+	})
+	counterAuthorizeExchanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "telemeter_authorize_exchanges_total",
+		Help: "Token exchanges by result and HTTP status code, the code is empty if no response was received.",
+	}, []string{"result", "code"})
+	gaugeAuthorizeTokenExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "telemeter_authorize_token_expiry_seconds",
+		Help: "Seconds until the current token must be exchanged again, 0 if the token does not expire.",
+	})
+	gaugeAuthorizeExpectedLabels = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "telemeter_authorize_expected_labels",
+		Help: "The number of labels a destination requires on every uploaded series, as returned by the last token exchange.",
+	}, []string{"destination"})
+)
+
+func init() {
+	prometheus.MustRegister(histogramAuthorizeDuration, counterAuthorizeExchanges, gaugeAuthorizeTokenExpiry, gaugeAuthorizeExpectedLabels)
+}
+
 type token struct {
 	lock    sync.Mutex
 	value   string
 	expires time.Time
 	labels  map[string]string
+	// previous are the labels of the last exchange, kept when the token is
+	// invalidated so that only changes are logged.
+	previous map[string]string
+	// fallback is true if the last exchange succeeded with a fallback token.
+	fallback bool
+	// expectedLabels, if set, records the number of labels of each exchange.
+	expectedLabels prometheus.Gauge
 }
 
 func now() time.Time {
 	return time.Now()
 }
 
-func (t *token) Load(endpoint *url.URL, initialToken string, rt http.RoundTripper) (string, error) {
+// Load returns the current token, exchanging one of initialTokens at one of the
+// endpoints for a new one if necessary. The initial tokens are tried in order, moving
+// on to the next one only if the previous one is rejected, so the first token is used
+// whenever it is accepted. Endpoints are tried in the order chosen by endpoints until
+// one succeeds, failing over on connection errors and server errors. The request ID
+// on ctx, if any, is sent along with the exchange.
+func (t *token) Load(ctx context.Context, endpoints *endpointSelector, initialTokens []string, rt http.RoundTripper) (string, error) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 	if len(t.value) > 0 && (t.expires.IsZero() || t.expires.After(time.Now())) {
+		t.updateExpiry()
 		return t.value, nil
 	}
 
+	var response *TokenResponse
+	err := fmt.Errorf("no initial token is configured")
+	for n, initialToken := range initialTokens {
+		response, err = exchangeAny(ctx, endpoints, initialToken, rt)
+		if _, rejected := err.(rejectedTokenError); rejected && n+1 < len(initialTokens) {
+			log.Printf("warning: the initial token was rejected, trying the fallback token: %v", err)
+			continue
+		}
+		if err == nil && n > 0 {
+			log.Printf("Authorized with the fallback token")
+		}
+		if err == nil && n == 0 && t.fallback {
+			log.Printf("Authorized with the primary token again")
+		}
+		if err == nil {
+			t.fallback = n > 0
+		}
+		break
+	}
+	if err != nil {
+		return "", err
+	}
+
+	t.value = response.Token
+	labels := response.Labels
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	if !equalLabels(t.previous, labels) {
+		set := make(model.LabelSet, len(labels))
+		for k, v := range labels {
+			set[model.LabelName(k)] = model.LabelValue(v)
+		}
+		log.Printf("The server expects the labels %s on every series", set)
+	}
+	t.labels, t.previous = labels, labels
+	if t.expectedLabels != nil {
+		t.expectedLabels.Set(float64(len(labels)))
+	}
+	if response.ExpiresInSeconds >= 60 {
+		t.expires = time.Now().Add(time.Duration(response.ExpiresInSeconds-15) * time.Second)
+	} else {
+		t.expires = time.Time{}
+	}
+	t.updateExpiry()
+
+	return t.value, nil
+}
+
+// updateExpiry reports the time left until the token expires. The caller must hold
+// the lock.
+func (t *token) updateExpiry() {
+	if t.expires.IsZero() {
+		gaugeAuthorizeTokenExpiry.Set(0)
+		return
+	}
+	gaugeAuthorizeTokenExpiry.Set(t.expires.Sub(time.Now()).Seconds())
+}
+
+// exchangeAny exchanges initialToken at the endpoints in the order chosen by
+// endpoints until one succeeds or fails with an error that another endpoint would
+// return as well.
+func exchangeAny(ctx context.Context, endpoints *endpointSelector, initialToken string, rt http.RoundTripper) (*TokenResponse, error) {
+	var response *TokenResponse
+	err := fmt.Errorf("no authorize endpoint is configured")
+	tried := make(map[int]bool)
+	for i := endpoints.Next(tried); i >= 0; i = endpoints.Next(tried) {
+		tried[i] = true
+		var retry bool
+		response, retry, err = exchange(ctx, endpoints.URL(i), initialToken, rt)
+		endpoints.Done(i, err)
+		if err == nil || !retry {
+			break
+		}
+	}
+	return response, err
+}
+
+// rejectedTokenError is returned by exchange if the endpoint rejected the initial
+// token with 401 Unauthorized or 403 Forbidden.
+type rejectedTokenError struct {
+	error
+}
+
+// exchange exchanges initialToken for a token at endpoint. If the exchange failed
+// because the endpoint could not be reached or reported a server error, retry is
+// true and another endpoint may succeed.
+func exchange(ctx context.Context, endpoint *url.URL, initialToken string, rt http.RoundTripper) (response *TokenResponse, retry bool, err error) {
+	var code string
+	defer func(start time.Time) {
+		histogramAuthorizeDuration.Observe(time.Since(start).Seconds())
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		counterAuthorizeExchanges.WithLabelValues(result, code).Inc()
+	}(time.Now())
+
 	c := http.Client{Transport: rt, Timeout: 10 * time.Second}
 	req, err := http.NewRequest("POST", endpoint.String(), nil)
 	if err != nil {
-		return "", fmt.Errorf("unable to create authentication request: %v", err)
+		return nil, false, fmt.Errorf("unable to create authentication request: %v", err)
 	}
+	req = req.WithContext(ctx)
 	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", initialToken))
+	// setting the header disables transparent decompression by the transport
+	req.Header.Set("Accept-Encoding", "gzip")
+	if requestID := telemeterhttp.RequestIDFromContext(ctx); len(requestID) > 0 {
+		req.Header.Set(telemeterhttp.RequestIDHeader, requestID)
+	}
 	resp, err := c.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("unable to perform authentication request: %v", err)
+		return nil, true, fmt.Errorf("unable to perform authentication request: %v", err)
 	}
 	defer resp.Body.Close()
+	code = strconv.Itoa(resp.StatusCode)
 
 	switch resp.StatusCode {
 	case http.StatusOK, http.StatusCreated:
 	case http.StatusUnauthorized:
-		return "", fmt.Errorf("initial authentication token is expired or invalid")
+		return nil, false, rejectedTokenError{fmt.Errorf("initial authentication token is expired or invalid")}
+	case http.StatusForbidden:
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4*1024))
+		return nil, false, rejectedTokenError{fmt.Errorf("initial authentication token is not allowed to authorize: %d:\n%s", resp.StatusCode, string(body))}
 	default:
 		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4*1024))
-		return "", fmt.Errorf("unable to exchange initial token for a long lived token: %d:\n%s", resp.StatusCode, string(body))
+		return nil, resp.StatusCode >= 500, fmt.Errorf("unable to exchange initial token for a long lived token: %d:\n%s", resp.StatusCode, string(body))
 	}
 
-	response, parseErr := parseTokenFromBody(resp.Body, 16*1024)
-	if parseErr != nil {
-		return "", parseErr
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, false, fmt.Errorf("unable to decompress the authentication response: %v", err)
+		}
+		defer gz.Close()
+		body = gz
 	}
-
-	t.value = response.Token
-	t.labels = response.Labels
-	if response.ExpiresInSeconds >= 60 {
-		t.expires = time.Now().Add(time.Duration(response.ExpiresInSeconds-15) * time.Second)
-	} else {
-		t.expires = time.Time{}
+	response, err = parseTokenFromBody(body, 16*1024)
+	if err != nil {
+		return nil, false, err
 	}
-
-	return t.value, nil
+	return response, false, nil
 }
 
 func (t *token) Invalidate(token string) {
@@ -89,6 +243,20 @@ func (t *token) Labels() (map[string]string, bool) {
 	return labels, true
 }
 
+// equalLabels returns true if a and b have the same labels and values. A nil a is
+// never equal, so that the labels of the first exchange are logged.
+func equalLabels(a, b map[string]string) bool {
+	if a == nil || len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if value, ok := b[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
 func parseTokenFromBody(r io.Reader, limitBytes int64) (*TokenResponse, error) {
 	data, err := ioutil.ReadAll(io.LimitReader(r, limitBytes))
 	if err != nil {
@@ -101,24 +269,72 @@ func parseTokenFromBody(r io.Reader, limitBytes int64) (*TokenResponse, error) {
 	return response, nil
 }
 
+// Authorizer returns a token that authorizes uploads to a server and the labels the
+// server requires on every uploaded series.
+type Authorizer interface {
+	Authorize(ctx context.Context) (token string, labels map[string]string, err error)
+}
+
 type ServerRotatingRoundTripper struct {
-	endpoint     *url.URL
-	initialToken string
-	token        token
+	endpoints     *endpointSelector
+	initialTokens []string
+	token         token
 
 	wrapper http.RoundTripper
 }
 
-func NewServerRotatingRoundTripper(initialToken string, endpoint *url.URL, rt http.RoundTripper) *ServerRotatingRoundTripper {
+// NewServerRotatingRoundTripper exchanges initialToken for a token at one of the
+// authorize endpoints and uses it to authorize requests. The endpoint that last
+// succeeded is preferred, other endpoints are tried by weight when it fails.
+func NewServerRotatingRoundTripper(initialToken string, endpoints []Endpoint, rt http.RoundTripper) *ServerRotatingRoundTripper {
 	return &ServerRotatingRoundTripper{
-		initialToken: initialToken,
-		endpoint:     endpoint,
-		wrapper:      rt,
+		initialTokens: []string{initialToken},
+		endpoints:     newEndpointSelector(endpoints),
+		wrapper:       rt,
+	}
+}
+
+// WithFallbackToken exchanges fallback instead of the initial token if the authorize
+// endpoint rejects the initial token with 401 Unauthorized or 403 Forbidden, such as
+// while a rotated token is not yet known to the server. The initial token is tried
+// first on every exchange, so it is used again once it is accepted.
+func (rt *ServerRotatingRoundTripper) WithFallbackToken(fallback string) *ServerRotatingRoundTripper {
+	if len(fallback) > 0 {
+		rt.initialTokens = append(rt.initialTokens[:1:1], fallback)
 	}
+	return rt
 }
 
+// WithDestination records the number of labels the server requires in
+// telemeter_authorize_expected_labels for destination, the server the tokens are
+// used for.
+func (rt *ServerRotatingRoundTripper) WithDestination(destination string) *ServerRotatingRoundTripper {
+	rt.token.expectedLabels = gaugeAuthorizeExpectedLabels.WithLabelValues(destination)
+	return rt
+}
+
+// Authorize returns the current token and the labels the server requires on every
+// series, exchanging the initial token if necessary.
+func (rt *ServerRotatingRoundTripper) Authorize(ctx context.Context) (string, map[string]string, error) {
+	token, err := rt.token.Load(ctx, rt.endpoints, rt.initialTokens, rt.wrapper)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to authorize to server: %v", err)
+	}
+	labels, ok := rt.token.Labels()
+	if !ok {
+		return "", nil, fmt.Errorf("labels from server have expired")
+	}
+	return token, labels, nil
+}
+
+// RoundTrip authorizes the request, exchanging the initial token if necessary. The
+// request ID of req, if any, is propagated to the exchange.
 func (rt *ServerRotatingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	token, err := rt.token.Load(rt.endpoint, rt.initialToken, rt.wrapper)
+	ctx := req.Context()
+	if id := req.Header.Get(telemeterhttp.RequestIDHeader); len(id) > 0 {
+		ctx = telemeterhttp.WithRequestID(ctx, id)
+	}
+	token, _, err := rt.Authorize(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -131,14 +347,16 @@ func (rt *ServerRotatingRoundTripper) RoundTrip(req *http.Request) (*http.Respon
 	return resp, err
 }
 
-func (rt *ServerRotatingRoundTripper) Labels() (map[string]string, error) {
-	_, err := rt.token.Load(rt.endpoint, rt.initialToken, rt.wrapper)
-	if err != nil {
-		return nil, fmt.Errorf("unable to authorize to server: %v", err)
-	}
-	labels, ok := rt.token.Labels()
-	if !ok {
-		return nil, fmt.Errorf("labels from server have expired")
-	}
-	return labels, nil
+// ExpectedLabels returns the labels the server required in the last token exchange
+// without exchanging the initial token. It returns false if there is no current
+// token, before the first exchange or after the token was rejected.
+func (rt *ServerRotatingRoundTripper) ExpectedLabels() (map[string]string, bool) {
+	return rt.token.Labels()
+}
+
+// Labels returns the labels the server requires on every series, exchanging the
+// initial token with ctx if necessary.
+func (rt *ServerRotatingRoundTripper) Labels(ctx context.Context) (map[string]string, error) {
+	_, labels, err := rt.Authorize(ctx)
+	return labels, err
 }
@@ -0,0 +1,157 @@
+package remote
+
+import (
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func counterValue(t *testing.T, result, code string) float64 {
+	m := &clientmodel.Metric{}
+	if err := counterAuthorizeExchanges.WithLabelValues(result, code).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestTokenLoad(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer initial" {
+			t.Errorf("unexpected Authorization header %q", req.Header.Get("Authorization"))
+		}
+		if req.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("unexpected Accept-Encoding header %q", req.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(`{"version":1,"token":"long","expiresInSeconds":3600,"labels":{"a":"b"}}`))
+		gz.Close()
+	}))
+	defer ok.Close()
+
+	var endpoints []Endpoint
+	for _, s := range []string{failing.URL, ok.URL} {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoints = append(endpoints, Endpoint{URL: u, Weight: 1})
+	}
+
+	failures, successes := counterValue(t, "failure", "503"), counterValue(t, "success", "200")
+	tok := &token{}
+	value, err := tok.Load(context.Background(), newEndpointSelector(endpoints), []string{"initial"}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "long" {
+		t.Errorf("Load() = %q, want long", value)
+	}
+	if labels, _ := tok.Labels(); labels["a"] != "b" {
+		t.Errorf("Labels() = %v", labels)
+	}
+	if got := counterValue(t, "success", "200") - successes; got != 1 {
+		t.Errorf("successful exchanges = %v, want 1", got)
+	}
+	if got := counterValue(t, "failure", "503") - failures; got != 1 {
+		t.Errorf("failed exchanges = %v, want 1", got)
+	}
+}
+
+func TestTokenLoadFallback(t *testing.T) {
+	accepted := "fallback"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Header.Get("Authorization") {
+		case "Bearer " + accepted:
+			w.Write([]byte(`{"version":1,"token":"from-` + accepted + `"}`))
+		case "Bearer primary":
+			http.Error(w, "not yet valid", http.StatusForbidden)
+		default:
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints := newEndpointSelector([]Endpoint{{URL: u, Weight: 1}})
+
+	tok := &token{}
+	value, err := tok.Load(context.Background(), endpoints, []string{"primary", "fallback"}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "from-fallback" {
+		t.Errorf("Load() = %q, want the token exchanged for the fallback", value)
+	}
+
+	accepted = "primary"
+	tok.Invalidate(value)
+	value, err = tok.Load(context.Background(), endpoints, []string{"primary", "fallback"}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "from-primary" {
+		t.Errorf("Load() = %q, want the token exchanged for the primary", value)
+	}
+
+	tok.Invalidate(value)
+	if _, err := tok.Load(context.Background(), endpoints, []string{"unknown", "other"}, http.DefaultTransport); err == nil {
+		t.Errorf("Load() succeeded although every initial token was rejected")
+	}
+}
+
+func TestExpectedLabels(t *testing.T) {
+	exchanges := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		exchanges++
+		w.Write([]byte(`{"version":1,"token":"long","labels":{"cluster":"a"}}`))
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := NewServerRotatingRoundTripper("initial", []Endpoint{{URL: u, Weight: 1}}, http.DefaultTransport).WithDestination("https://a/upload")
+	if labels, ok := rt.ExpectedLabels(); ok || exchanges != 0 {
+		t.Fatalf("ExpectedLabels() before an exchange = %v, %t after %d exchanges", labels, ok, exchanges)
+	}
+	if _, _, err := rt.Authorize(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	labels, ok := rt.ExpectedLabels()
+	if !ok || len(labels) != 1 || labels["cluster"] != "a" {
+		t.Errorf("ExpectedLabels() = %v, %t", labels, ok)
+	}
+	m := &clientmodel.Metric{}
+	if err := gaugeAuthorizeExpectedLabels.WithLabelValues("https://a/upload").Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetGauge().GetValue(); got != 1 {
+		t.Errorf("expected labels of the destination = %v, want 1", got)
+	}
+	labels["cluster"] = "changed"
+	if labels, _ := rt.ExpectedLabels(); labels["cluster"] != "a" {
+		t.Errorf("ExpectedLabels() returned the stored labels, not a copy")
+	}
+	if exchanges != 1 {
+		t.Errorf("exchanged the token %d times, want 1", exchanges)
+	}
+}
+
+func TestEqualLabels(t *testing.T) {
+	if !equalLabels(map[string]string{}, nil) || equalLabels(nil, map[string]string{}) || equalLabels(map[string]string{"a": "1"}, map[string]string{"a": "2"}) {
+		t.Errorf("equalLabels() compared labels incorrectly")
+	}
+}
@@ -0,0 +1,101 @@
+package remote
+
+import (
+	"net/url"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var gaugeAuthorizeEndpoint = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "telemeter_authorize_endpoint_active",
+	Help: "Set to 1 for the authorize endpoint currently used to exchange tokens.",
+}, []string{"endpoint"})
+
+func init() {
+	prometheus.MustRegister(gaugeAuthorizeEndpoint)
+}
+
+// Endpoint is an authorize endpoint. Endpoints with a higher weight are chosen
+// proportionally more often when a new endpoint has to be selected. A weight of
+// zero or less is treated as 1.
+type Endpoint struct {
+	URL    *url.URL
+	Weight int
+}
+
+// endpointSelector picks the authorize endpoint for each token exchange. The last
+// endpoint that succeeded is used until it fails, then the others are tried in
+// smooth weighted round-robin order.
+type endpointSelector struct {
+	lock      sync.Mutex
+	endpoints []Endpoint
+	current   []int
+	active    int
+}
+
+func newEndpointSelector(endpoints []Endpoint) *endpointSelector {
+	for i := range endpoints {
+		if endpoints[i].Weight <= 0 {
+			endpoints[i].Weight = 1
+		}
+		gaugeAuthorizeEndpoint.WithLabelValues(endpoints[i].URL.String()).Set(0)
+	}
+	return &endpointSelector{
+		endpoints: endpoints,
+		current:   make([]int, len(endpoints)),
+		active:    -1,
+	}
+}
+
+// Next returns the index of the endpoint to try next, skipping the endpoints in
+// tried, or -1 if every endpoint has been tried.
+func (s *endpointSelector) Next(tried map[int]bool) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.active >= 0 && !tried[s.active] {
+		return s.active
+	}
+	best, total := -1, 0
+	for i, e := range s.endpoints {
+		if tried[i] {
+			continue
+		}
+		s.current[i] += e.Weight
+		total += e.Weight
+		if best < 0 || s.current[i] > s.current[best] {
+			best = i
+		}
+	}
+	if best >= 0 {
+		s.current[best] -= total
+	}
+	return best
+}
+
+// Done records the outcome of an exchange with endpoint i. A successful endpoint
+// becomes the active one, a failed active endpoint is abandoned. An endpoint that
+// rejected the initial token has answered correctly and is kept.
+func (s *endpointSelector) Done(i int, err error) {
+	if _, rejected := err.(rejectedTokenError); rejected {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch {
+	case err == nil && s.active != i:
+		if s.active >= 0 {
+			gaugeAuthorizeEndpoint.WithLabelValues(s.endpoints[s.active].URL.String()).Set(0)
+		}
+		s.active = i
+		gaugeAuthorizeEndpoint.WithLabelValues(s.endpoints[i].URL.String()).Set(1)
+	case err != nil && s.active == i:
+		gaugeAuthorizeEndpoint.WithLabelValues(s.endpoints[i].URL.String()).Set(0)
+		s.active = -1
+	}
+}
+
+// URL returns the URL of endpoint i.
+func (s *endpointSelector) URL(i int) *url.URL {
+	return s.endpoints[i].URL
+}
@@ -0,0 +1,66 @@
+package remote
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+)
+
+func testEndpoints(weights ...int) []Endpoint {
+	var endpoints []Endpoint
+	for i, w := range weights {
+		endpoints = append(endpoints, Endpoint{URL: &url.URL{Scheme: "http", Host: fmt.Sprintf("e%d", i)}, Weight: w})
+	}
+	return endpoints
+}
+
+func TestEndpointSelectorWeights(t *testing.T) {
+	s := newEndpointSelector(testEndpoints(2, 1, 0))
+	counts := make([]int, 3)
+	for i := 0; i < 40; i++ {
+		counts[s.Next(nil)]++
+	}
+	if counts[0] != 20 || counts[1] != 10 || counts[2] != 10 {
+		t.Errorf("counts = %v, want [20 10 10]", counts)
+	}
+}
+
+func TestEndpointSelectorFailover(t *testing.T) {
+	s := newEndpointSelector(testEndpoints(1, 1))
+
+	tried := map[int]bool{}
+	first := s.Next(tried)
+	tried[first] = true
+	s.Done(first, fmt.Errorf("unavailable"))
+	second := s.Next(tried)
+	if second == first || second < 0 {
+		t.Fatalf("Next() = %d after %d failed", second, first)
+	}
+	tried[second] = true
+	s.Done(second, nil)
+	if next := s.Next(tried); next != -1 {
+		t.Fatalf("Next() = %d after every endpoint was tried", next)
+	}
+
+	// the successful endpoint is used until it fails
+	for i := 0; i < 3; i++ {
+		if next := s.Next(nil); next != second {
+			t.Errorf("Next() = %d, want %d", next, second)
+		}
+	}
+	s.Done(second, fmt.Errorf("unavailable"))
+	if next := s.Next(map[int]bool{second: true}); next != first {
+		t.Errorf("Next() = %d, want %d", next, first)
+	}
+}
+
+func TestEndpointSelectorKeepsEndpointRejectingToken(t *testing.T) {
+	s := newEndpointSelector(testEndpoints(1, 1))
+
+	active := s.Next(nil)
+	s.Done(active, nil)
+	s.Done(active, rejectedTokenError{fmt.Errorf("initial authentication token is expired or invalid")})
+	if next := s.Next(nil); next != active {
+		t.Errorf("Next() = %d after the token was rejected, want the active endpoint %d", next, active)
+	}
+}
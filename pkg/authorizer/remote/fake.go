@@ -0,0 +1,38 @@
+package remote
+
+import (
+	"context"
+	"sync"
+)
+
+// FakeAuthorizer is an Authorizer for tests that returns Token and Labels, or Err if
+// it is set, and counts the calls to Authorize.
+type FakeAuthorizer struct {
+	Token  string
+	Labels map[string]string
+	Err    error
+
+	lock  sync.Mutex
+	calls int
+}
+
+func (a *FakeAuthorizer) Authorize(ctx context.Context) (string, map[string]string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.calls++
+	if a.Err != nil {
+		return "", nil, a.Err
+	}
+	labels := make(map[string]string, len(a.Labels))
+	for k, v := range a.Labels {
+		labels[k] = v
+	}
+	return a.Token, labels, nil
+}
+
+// Calls returns the number of times Authorize was called.
+func (a *FakeAuthorizer) Calls() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.calls
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseTrustedProxies parses the networks of trusted proxies, each either a CIDR
+// such as 10.0.0.0/8 or a single IP address.
+func ParseTrustedProxies(values []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address or CIDR: %s", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address or CIDR: %s", value)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// ClientIP returns the IP address of the client that sent req. If the request was
+// received from one of the trusted proxies, the hops in the Forwarded header, or
+// else the X-Forwarded-For header, are followed back from the nearest one to the
+// first address that is not a trusted proxy. Each proxy appends the address it
+// received the request from, so addresses before that one may have been forged by
+// the client. An address that is obfuscated or invalid stops the search at the proxy
+// that added it. Otherwise the address of the connection is used.
+func ClientIP(req *http.Request, trusted []*net.IPNet) string {
+	ip := parseIP(req.RemoteAddr)
+	if len(ip) == 0 {
+		return req.RemoteAddr
+	}
+	if !isTrusted(ip, trusted) {
+		return ip
+	}
+	hops := forwardedFor(req.Header["Forwarded"])
+	if len(hops) == 0 {
+		hops = xForwardedFor(req.Header["X-Forwarded-For"])
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseIP(hops[i])
+		if len(hop) == 0 {
+			break
+		}
+		ip = hop
+		if !isTrusted(ip, trusted) {
+			break
+		}
+	}
+	return ip
+}
+
+// isTrusted returns true if ip is in one of the trusted networks.
+func isTrusted(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	for _, network := range trusted {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the for parameter of each hop in the RFC 7239 Forwarded header
+// values, in order. Hops without one are returned as empty strings.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			var address string
+			for _, pair := range strings.Split(hop, ";") {
+				pair = strings.TrimSpace(pair)
+				if strings.HasPrefix(strings.ToLower(pair), "for=") {
+					address = strings.Trim(pair[len("for="):], `"`)
+					break
+				}
+			}
+			hops = append(hops, address)
+		}
+	}
+	return hops
+}
+
+// xForwardedFor returns the addresses in the X-Forwarded-For header values, in order.
+func xForwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// parseIP returns the IP address in s, which may have a port and IPv6 addresses
+// may be enclosed in brackets, or an empty string if s is not an IP address.
+func parseIP(s string) string {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string][]string
+		trusted []string
+		want    string
+	}{
+		{
+			name: "remote address",
+			want: "192.0.2.1",
+		},
+		{
+			name:    "headers are ignored unless the proxy is trusted",
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.7"}},
+			trusted: []string{"198.51.100.0/24"},
+			want:    "192.0.2.1",
+		},
+		{
+			name:    "x-forwarded-for with multiple hops",
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.7, 198.51.100.2", "198.51.100.3"}},
+			trusted: []string{"192.0.2.1"},
+			want:    "198.51.100.3",
+		},
+		{
+			name:    "x-forwarded-for through trusted proxies",
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.7, 198.51.100.2", "198.51.100.3"}},
+			trusted: []string{"192.0.2.0/24", "198.51.100.0/24"},
+			want:    "203.0.113.7",
+		},
+		{
+			name:    "address forged by the client is skipped",
+			headers: map[string][]string{"X-Forwarded-For": {"10.0.0.1, 203.0.113.7"}},
+			trusted: []string{"192.0.2.1"},
+			want:    "203.0.113.7",
+		},
+		{
+			name:    "only trusted proxies",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.2, 198.51.100.3"}},
+			trusted: []string{"192.0.2.0/24", "198.51.100.0/24"},
+			want:    "198.51.100.2",
+		},
+		{
+			name:    "forwarded with multiple hops",
+			headers: map[string][]string{"Forwarded": {`for="[2001:db8:cafe::17]:4711";proto=https, for=198.51.100.2`}},
+			trusted: []string{"192.0.2.1", "198.51.100.2"},
+			want:    "2001:db8:cafe::17",
+		},
+		{
+			name:    "forwarded takes precedence",
+			headers: map[string][]string{"Forwarded": {"proto=https;For=203.0.113.8"}, "X-Forwarded-For": {"203.0.113.7"}},
+			trusted: []string{"192.0.2.1"},
+			want:    "203.0.113.8",
+		},
+		{
+			name:    "obfuscated forwarded stops at the proxy",
+			headers: map[string][]string{"Forwarded": {"for=_hidden"}, "X-Forwarded-For": {"203.0.113.7"}},
+			trusted: []string{"192.0.2.1"},
+			want:    "192.0.2.1",
+		},
+		{
+			name:    "invalid x-forwarded-for before the client is ignored",
+			headers: map[string][]string{"X-Forwarded-For": {"unknown, 203.0.113.7"}},
+			trusted: []string{"192.0.2.1"},
+			want:    "203.0.113.7",
+		},
+		{
+			name:    "invalid x-forwarded-for stops at the proxy",
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.7, unknown"}},
+			trusted: []string{"192.0.2.1"},
+			want:    "192.0.2.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trusted, err := ParseTrustedProxies(tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest("POST", "/authorize", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			for k, v := range tt.headers {
+				req.Header[k] = v
+			}
+			if got := ClientIP(req, trusted); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	networks, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::1/128"} {
+		if got := networks[i].String(); got != want {
+			t.Errorf("network %d = %s, want %s", i, got, want)
+		}
+	}
+	for _, value := range []string{"10.0.0.0/33", "proxy", ""} {
+		if _, err := ParseTrustedProxies([]string{value}); err == nil {
+			t.Errorf("ParseTrustedProxies(%q) succeeded, want an error", value)
+		}
+	}
+}
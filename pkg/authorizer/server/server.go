@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"hash/fnv"
@@ -10,6 +11,7 @@ import (
 	"log"
 	"math/rand"
 	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -17,6 +19,7 @@ import (
 
 	"github.com/openshift/telemeter/pkg/authorizer/jwt"
 	"github.com/openshift/telemeter/pkg/authorizer/remote"
+	telemeterhttp "github.com/openshift/telemeter/pkg/http"
 )
 
 type Authorizer struct {
@@ -28,6 +31,8 @@ type Authorizer struct {
 
 	expireInSeconds int64
 	signer          *jwt.Signer
+
+	trustedProxies []*net.IPNet
 }
 
 // New creates an authorizer HTTP endpoint that will invoke the remote URL with the user's provided authorization
@@ -46,6 +51,13 @@ func New(partitionKey string, to *url.URL, client *http.Client, expireInSeconds
 	}
 }
 
+// WithTrustedProxies makes the authorizer identify clients in logs by the Forwarded
+// and X-Forwarded-For headers of requests from the trusted proxies, see ClientIP.
+func (a *Authorizer) WithTrustedProxies(trusted []*net.IPNet) *Authorizer {
+	a.trustedProxies = trusted
+	return a
+}
+
 func (a *Authorizer) AuthorizeHTTP(w http.ResponseWriter, req *http.Request) {
 	if req.Method != "POST" {
 		http.Error(w, "Only POST is allowed to this endpoint", http.StatusMethodNotAllowed)
@@ -92,7 +104,7 @@ func (a *Authorizer) AuthorizeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	if err != nil {
 		if code, ok := err.(errWithCode); ok {
-			log.Printf("error: unable to authorize request: %v", err)
+			log.Printf("error: unable to authorize request from %s: %v", ClientIP(req, a.trustedProxies), err)
 			if code.code == http.StatusTooManyRequests {
 				w.Header().Set("Retry-After", "300")
 			}
@@ -101,7 +113,7 @@ func (a *Authorizer) AuthorizeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 		// always hide errors from the upstream service from the client
 		uid := rand.Int63()
-		log.Printf("error: unable to authorize request %d: %v", uid, err)
+		log.Printf("error: unable to authorize request %d from %s: %v", uid, ClientIP(req, a.trustedProxies), err)
 		http.Error(w, fmt.Sprintf("Internal server error, requestid=%d", uid), http.StatusInternalServerError)
 		return
 	}
@@ -118,7 +130,7 @@ func (a *Authorizer) AuthorizeHTTP(w http.ResponseWriter, req *http.Request) {
 	labels[a.partitionKey] = cluster
 
 	// create a token that asserts the user and the labels
-	authToken, err := a.signer.GenerateToken(jwt.Claims(resp.AccountID, resp.Labels, a.expireInSeconds, []string{"federate"}))
+	authToken, err := a.signer.GenerateToken(jwt.Claims(resp.AccountID, resp.Labels, resp.SkipLabelCheck, a.expireInSeconds, []string{"federate"}))
 	if err != nil {
 		log.Printf("error: unable to generate token: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -137,7 +149,26 @@ func (a *Authorizer) AuthorizeHTTP(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.Write(data)
+	writeResponse(w, req, data)
+}
+
+// writeResponse writes data to w, gzip-compressed if the client accepts it.
+func writeResponse(w http.ResponseWriter, req *http.Request, data []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !telemeterhttp.AcceptsGzip(req.Header) {
+		w.Write(data)
+		return
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(data); err != nil {
+		log.Printf("error: unable to write compressed token response: %v", err)
+		return
+	}
+	if err := gz.Close(); err != nil {
+		log.Printf("error: unable to write compressed token response: %v", err)
+	}
 }
 
 func (a *Authorizer) authorizeStub(token, cluster string) (*TokenResponse, error) {
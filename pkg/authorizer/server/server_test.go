@@ -1,6 +1,9 @@
 package server
 
 import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -8,7 +11,10 @@ import (
 	"strings"
 	"testing"
 
+	clientmodel "github.com/prometheus/client_model/go"
+
 	"github.com/openshift/telemeter/pkg/authorizer/jwt"
+	"github.com/openshift/telemeter/pkg/authorizer/remote"
 )
 
 func TestAuthorizer_authorizeRemote(t *testing.T) {
@@ -101,3 +107,133 @@ func TestAuthorizer_authorizeRemote(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthorizer_AuthorizeHTTPEncoding(t *testing.T) {
+	signer, _, _, _, err := jwt.New("federate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := New("_id", nil, nil, 60, signer, map[string]string{"a": "b"})
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		wantGzip       bool
+	}{
+		{name: "identity"},
+		{name: "gzip", acceptEncoding: "gzip", wantGzip: true},
+		{name: "gzip among others", acceptEncoding: "deflate, gzip;q=0.5", wantGzip: true},
+		{name: "gzip refused", acceptEncoding: "gzip;q=0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/authorize?id=cluster", nil)
+			req.Header.Set("Authorization", "Bearer token")
+			if len(tt.acceptEncoding) > 0 {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			a.AuthorizeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("AuthorizeHTTP() code = %d: %s", w.Code, w.Body.String())
+			}
+
+			var body io.Reader = w.Body
+			if got := w.Header().Get("Content-Encoding") == "gzip"; got != tt.wantGzip {
+				t.Fatalf("Content-Encoding = %q, want gzip %t", w.Header().Get("Content-Encoding"), tt.wantGzip)
+			}
+			if tt.wantGzip {
+				gz, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = gz
+			}
+			resp := &remote.TokenResponse{}
+			if err := json.NewDecoder(body).Decode(resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Token) == 0 {
+				t.Errorf("expected a token")
+			}
+			if want := map[string]string{"a": "b", "_id": "cluster"}; !reflect.DeepEqual(resp.Labels, want) {
+				t.Errorf("labels = %v, want %v", resp.Labels, want)
+			}
+		})
+	}
+}
+
+func TestServer_ServeClusters(t *testing.T) {
+	s := NewServer()
+	s.Responses = map[Key]*TokenResponse{
+		{Token: "secret-a", Cluster: "b"}: {APIVersion: "v1", Code: http.StatusOK},
+		{Token: "secret-c", Cluster: "a"}: {APIVersion: "v1", Code: http.StatusOK},
+		{Token: "secret-d", Cluster: "a"}: {APIVersion: "v1", Code: http.StatusOK},
+		{Token: "secret-e"}:               {APIVersion: "v1", Code: http.StatusOK},
+	}
+	s.Received[Key{Token: "secret-a", Cluster: "b"}] = struct{}{}
+
+	w := httptest.NewRecorder()
+	s.ServeClusters(w, httptest.NewRequest("GET", "/clusters", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("ServeClusters() code = %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "secret") {
+		t.Fatalf("ServeClusters() exposed a token: %s", w.Body.String())
+	}
+	var got Clusters
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := Clusters{Clusters: []string{"a", "b"}, Authorized: []string{"b"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ServeClusters() = %+v, want %+v", got, want)
+	}
+}
+
+func TestServer_ServeHTTPOutcomes(t *testing.T) {
+	s := NewServer()
+	s.Responses = map[Key]*TokenResponse{
+		{Token: "known", Cluster: "a"}:  {APIVersion: "v1", Status: "ok", Code: http.StatusOK},
+		{Token: "new", Cluster: "b"}:    {APIVersion: "v1", Status: "ok", Code: http.StatusCreated},
+		{Token: "denied", Cluster: "c"}: {APIVersion: "v1", Status: "failure", Code: http.StatusConflict},
+	}
+	tests := []struct {
+		body    string
+		outcome string
+	}{
+		{body: `{"api_version":"v1","authorization_token":"known","cluster_id":"a"}`, outcome: outcomeOK},
+		{body: `{"api_version":"v1","authorization_token":"new","cluster_id":"b"}`, outcome: outcomeNewClusterCreated},
+		{body: `{"api_version":"v1","authorization_token":"denied","cluster_id":"c"}`, outcome: outcomeRejected},
+		{body: `{"api_version":"v1","authorization_token":"known","cluster_id":"x"}`, outcome: outcomeUnknownCluster},
+		{body: `{"api_version":"v2"}`, outcome: outcomeInvalidRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.outcome, func(t *testing.T) {
+			before := serverRequests(t, tt.outcome)
+			req := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			s.ServeHTTP(httptest.NewRecorder(), req)
+			if got := serverRequests(t, tt.outcome) - before; got != 1 {
+				t.Errorf("counted %g requests with outcome %s, want 1", got, tt.outcome)
+			}
+		})
+	}
+
+	s.AllowNewClusters = true
+	before := serverRequests(t, outcomeUnknownToken)
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"api_version":"v1","authorization_token":"other","cluster_id":"a"}`))
+	req.Header.Set("Content-Type", "application/json")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+	if got := serverRequests(t, outcomeUnknownToken) - before; got != 1 {
+		t.Errorf("counted %g requests with outcome %s, want 1", got, outcomeUnknownToken)
+	}
+}
+
+func serverRequests(t *testing.T, outcome string) float64 {
+	m := &clientmodel.Metric{}
+	if err := counterServerRequests.WithLabelValues(outcome).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	telemeterhttp "github.com/openshift/telemeter/pkg/http"
+)
+
+// maxSignatureSkew is how far the timestamp of an upload signature may be from the
+// current time. Signed uploads can be replayed within this window.
+const maxSignatureSkew = 5 * time.Minute
+
+// NewSignatureVerifier rejects requests with 401 Unauthorized unless they carry a
+// signature of their body made with key, see telemeterhttp.SignatureHeader, before
+// passing them to next. Bodies larger than limitBytes are rejected with 413 Request
+// Entity Too Large if limitBytes is positive.
+func NewSignatureVerifier(key []byte, limitBytes int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header := req.Header.Get(telemeterhttp.SignatureHeader)
+		if len(header) == 0 {
+			http.Error(w, "Upload signature required", http.StatusUnauthorized)
+			return
+		}
+		var r io.Reader = req.Body
+		if limitBytes > 0 {
+			r = io.LimitReader(r, limitBytes+1)
+		}
+		body, err := ioutil.ReadAll(r)
+		req.Body.Close()
+		if err != nil {
+			http.Error(w, "Unable to read the request body", http.StatusBadRequest)
+			return
+		}
+		if limitBytes > 0 && int64(len(body)) > limitBytes {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err := telemeterhttp.VerifySignature(key, header, body, time.Now(), maxSignatureSkew); err != nil {
+			log.Printf("warning: rejected upload from %s: %v", req.RemoteAddr, err)
+			http.Error(w, "Upload signature invalid", http.StatusUnauthorized)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, req)
+	})
+}
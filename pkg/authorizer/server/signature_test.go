@@ -0,0 +1,52 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	telemeterhttp "github.com/openshift/telemeter/pkg/http"
+)
+
+func TestSignatureVerifier(t *testing.T) {
+	key := []byte("secret")
+	body := "upload"
+	tests := []struct {
+		name      string
+		signature string
+		body      string
+		wantCode  int
+	}{
+		{name: "valid", signature: telemeterhttp.Signature(key, time.Now(), []byte(body)), body: body, wantCode: http.StatusOK},
+		{name: "missing", body: body, wantCode: http.StatusUnauthorized},
+		{name: "other key", signature: telemeterhttp.Signature([]byte("other"), time.Now(), []byte(body)), body: body, wantCode: http.StatusUnauthorized},
+		{name: "changed body", signature: telemeterhttp.Signature(key, time.Now(), []byte(body)), body: "Upload", wantCode: http.StatusUnauthorized},
+		{name: "replayed", signature: telemeterhttp.Signature(key, time.Now().Add(-time.Hour), []byte(body)), body: body, wantCode: http.StatusUnauthorized},
+		{name: "malformed", signature: "v1=00", body: body, wantCode: http.StatusUnauthorized},
+		{name: "too large", signature: telemeterhttp.Signature(key, time.Now(), []byte(body+body)), body: body + body, wantCode: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received string
+			h := NewSignatureVerifier(key, int64(len(body)), http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				data, _ := ioutil.ReadAll(req.Body)
+				received = string(data)
+			}))
+			req := httptest.NewRequest("POST", "/upload", strings.NewReader(tt.body))
+			if len(tt.signature) > 0 {
+				req.Header.Set(telemeterhttp.SignatureHeader, tt.signature)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if tt.wantCode == http.StatusOK && received != tt.body {
+				t.Errorf("handler received %q, want %q", received, tt.body)
+			}
+		})
+	}
+}
@@ -3,9 +3,41 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The outcomes of the authorize requests handled by Server.
+const (
+	outcomeOK                = "ok"
+	outcomeNewClusterCreated = "new-cluster-created"
+	outcomeUnknownCluster    = "unknown-cluster"
+	outcomeUnknownToken      = "unknown-token"
+	outcomeRejected          = "rejected"
+	outcomeInvalidRequest    = "invalid-request"
+)
+
+var (
+	counterServerRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "telemeter_authorization_server_requests_total",
+		Help: "Authorize requests handled by the authorization server by outcome: ok, new-cluster-created, unknown-cluster, unknown-token, rejected for configured failure responses, or invalid-request.",
+	}, []string{"outcome"})
+	histogramServerDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "telemeter_authorization_server_request_duration_seconds",
+		Help: "Time taken by the authorization server to handle an authorize request.",
+	})
 )
 
+func init() {
+	prometheus.MustRegister(counterServerRequests, histogramServerDuration)
+}
+
 type Key struct {
 	Token   string
 	Cluster string
@@ -14,7 +46,22 @@ type Key struct {
 type Server struct {
 	AllowNewClusters bool
 	Responses        map[Key]*TokenResponse
-	Received         map[Key]struct{}
+	// TrustedProxies are the proxies whose forwarded headers identify clients in
+	// logs, see ClientIP.
+	TrustedProxies []*net.IPNet
+
+	// lock guards Received, which is read by ServeClusters.
+	lock     sync.Mutex
+	Received map[Key]struct{}
+}
+
+// Clusters is the response of ServeClusters. It never includes tokens.
+type Clusters struct {
+	AllowNewClusters bool `json:"allow_new_clusters"`
+	// Clusters are the cluster IDs that have a response configured.
+	Clusters []string `json:"clusters"`
+	// Authorized are the cluster IDs that were authorized since the server started.
+	Authorized []string `json:"authorized"`
 }
 
 func NewServer() *Server {
@@ -24,34 +71,47 @@ func NewServer() *Server {
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	outcome := s.serve(w, req)
+	histogramServerDuration.Observe(time.Since(start).Seconds())
+	counterServerRequests.WithLabelValues(outcome).Inc()
+	if outcome != outcomeOK && outcome != outcomeNewClusterCreated {
+		log.Printf("warning: authorize request from %s failed: %s", ClientIP(req, s.TrustedProxies), outcome)
+	}
+}
+
+// serve handles an authorize request and returns its outcome.
+func (s *Server) serve(w http.ResponseWriter, req *http.Request) string {
 	defer req.Body.Close()
 	if req.Method != "POST" {
 		Write(w, &TokenResponse{APIVersion: "v1", Status: "failure", Code: http.StatusMethodNotAllowed, Reason: "MethodNotAllowed", Message: "Only requests of type 'POST' are accepted."})
-		return
+		return outcomeInvalidRequest
 	}
 	if req.Header.Get("Content-Type") != "application/json" {
 		Write(w, &TokenResponse{APIVersion: "v1", Status: "failure", Code: http.StatusBadRequest, Reason: "InvalidContentType", Message: "Only requests with Content-Type application/json are accepted."})
-		return
+		return outcomeInvalidRequest
 	}
 	tokenRequest := &TokenRequest{}
 	if err := json.NewDecoder(req.Body).Decode(tokenRequest); err != nil {
 		Write(w, &TokenResponse{APIVersion: "v1", Status: "failure", Code: http.StatusBadRequest, Reason: "InvalidBody", Message: fmt.Sprintf("Unable to parse body as JSON: %v", err)})
-		return
+		return outcomeInvalidRequest
 	}
 	if tokenRequest.APIVersion != "v1" {
 		Write(w, &TokenResponse{APIVersion: "v1", Status: "failure", Code: http.StatusBadRequest, Reason: "InvalidAPIVersion", Message: "Only requests with api_version 'v1' are accepted."})
-		return
+		return outcomeInvalidRequest
 	}
 	key := Key{Token: tokenRequest.AuthorizationToken, Cluster: tokenRequest.ClusterID}
 	resp, ok := s.Responses[key]
 	if !s.AllowNewClusters {
 		if !ok {
 			Write(w, &TokenResponse{APIVersion: "v1", Status: "failure", Code: http.StatusInternalServerError, Reason: "UnknownError", Message: "Generic error."})
-			return
+			return outcomeUnknownCluster
 		}
+		s.lock.Lock()
 		s.Received[key] = struct{}{}
+		s.lock.Unlock()
 		Write(w, resp)
-		return
+		return responseOutcome(resp)
 	}
 
 	// lookup without cluster ID specified
@@ -59,17 +119,78 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	resp, ok = s.Responses[key]
 	if !ok {
 		Write(w, &TokenResponse{APIVersion: "v1", Status: "failure", Code: http.StatusUnauthorized, Reason: "NotAuthorized", Message: "The provided token is not recognized."})
-		return
+		return outcomeUnknownToken
 	}
 
 	// provide simple 201 vs 200 behavior if we have already received this request
-	if _, ok := s.Received[key]; ok && resp.Status == "ok" && resp.Code == http.StatusCreated {
+	s.lock.Lock()
+	_, received := s.Received[key]
+	s.lock.Unlock()
+	if received && resp.Status == "ok" && resp.Code == http.StatusCreated {
 		copied := *resp
 		copied.Code = http.StatusOK
 		resp = &copied
 	}
 
 	Write(w, resp)
+	return responseOutcome(resp)
+}
+
+// responseOutcome returns the outcome of a request answered with a configured
+// response.
+func responseOutcome(resp *TokenResponse) string {
+	switch {
+	case resp.Code == http.StatusCreated:
+		return outcomeNewClusterCreated
+	case resp.Code >= http.StatusBadRequest:
+		return outcomeRejected
+	}
+	return outcomeOK
+}
+
+// ServeClusters lists the known cluster IDs and whether new clusters are allowed as
+// JSON. Tokens are never returned.
+func (s *Server) ServeClusters(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "Only GET is allowed to this endpoint", http.StatusMethodNotAllowed)
+		return
+	}
+	clusters := Clusters{
+		AllowNewClusters: s.AllowNewClusters,
+		Clusters:         []string{},
+		Authorized:       []string{},
+	}
+	for key := range s.Responses {
+		if len(key.Cluster) > 0 {
+			clusters.Clusters = append(clusters.Clusters, key.Cluster)
+		}
+	}
+	s.lock.Lock()
+	for key := range s.Received {
+		clusters.Authorized = append(clusters.Authorized, key.Cluster)
+	}
+	s.lock.Unlock()
+	clusters.Clusters = uniqueSorted(clusters.Clusters)
+	clusters.Authorized = uniqueSorted(clusters.Authorized)
+
+	data, err := json.MarshalIndent(clusters, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func uniqueSorted(values []string) []string {
+	sort.Strings(values)
+	out := values[:0]
+	for _, v := range values {
+		if len(out) == 0 || v != out[len(out)-1] {
+			out = append(out, v)
+		}
+	}
+	return out
 }
 
 func Write(w http.ResponseWriter, resp *TokenResponse) error {
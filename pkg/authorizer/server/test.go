@@ -17,7 +17,7 @@ func (v *validator) Validate(t *testing.T) {
 	}
 	for name, testCase := range testCases {
 		t.Run(name, func(t *testing.T) {
-			t.Logf(testCase.partitionKey)
+			t.Logf("%s", testCase.partitionKey)
 		})
 	}
 }
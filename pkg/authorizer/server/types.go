@@ -18,4 +18,9 @@ type TokenResponse struct {
 	AccountID string `json:"account_id"`
 
 	Labels map[string]string `json:"labels"`
+
+	// SkipLabelCheck exempts the cluster from the check that every uploaded series
+	// carries Labels with the same values. The labels are set on each series
+	// instead.
+	SkipLabelCheck bool `json:"skip_label_check,omitempty"`
 }
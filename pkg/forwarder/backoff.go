@@ -0,0 +1,59 @@
+package forwarder
+
+import (
+	"sync"
+	"time"
+)
+
+// sourceBackoff lengthens the interval between scrapes to relieve a struggling
+// source. After threshold consecutive failed scrapes the interval is doubled, and
+// doubled again for every further failure, up to max. A successful scrape restores
+// the normal interval.
+type sourceBackoff struct {
+	threshold int
+	max       time.Duration
+
+	lock     sync.Mutex
+	failures int
+}
+
+func newSourceBackoff(threshold int, max time.Duration) *sourceBackoff {
+	return &sourceBackoff{
+		threshold: threshold,
+		max:       max,
+	}
+}
+
+// Done records the result of a scrape.
+func (b *sourceBackoff) Done(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+}
+
+// Active returns true if the interval is currently lengthened.
+func (b *sourceBackoff) Active() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.failures >= b.threshold
+}
+
+// Interval returns the interval to wait before the next scrape in place of interval.
+func (b *sourceBackoff) Interval(interval time.Duration) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.failures < b.threshold || interval >= b.max {
+		return interval
+	}
+	for i := b.threshold; i <= b.failures && interval < b.max; i++ {
+		interval *= 2
+	}
+	if interval > b.max {
+		interval = b.max
+	}
+	return interval
+}
@@ -0,0 +1,34 @@
+package forwarder
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSourceBackoff(t *testing.T) {
+	b := newSourceBackoff(2, 5*time.Minute)
+	failed := fmt.Errorf("failed")
+
+	steps := []struct {
+		err          error
+		wantInterval time.Duration
+	}{
+		{err: failed, wantInterval: time.Minute},
+		{err: failed, wantInterval: 2 * time.Minute},
+		{err: failed, wantInterval: 4 * time.Minute},
+		{err: failed, wantInterval: 5 * time.Minute},
+		{err: failed, wantInterval: 5 * time.Minute},
+		{wantInterval: time.Minute},
+		{err: failed, wantInterval: time.Minute},
+	}
+	for i, step := range steps {
+		b.Done(step.err)
+		if interval := b.Interval(time.Minute); interval != step.wantInterval {
+			t.Fatalf("Interval() after step %d = %s, want %s", i, interval, step.wantInterval)
+		}
+		if active := b.Active(); active != (step.wantInterval != time.Minute) {
+			t.Fatalf("Active() after step %d = %t", i, active)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package forwarder
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker stops uploads after threshold consecutive failures. Once the
+// cooldown has passed a single probe upload is allowed (half-open); a success
+// closes the breaker and a failure opens it for another cooldown.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	gauge     prometheus.Gauge
+
+	lock     sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+// newCircuitBreaker creates a breaker that reports its state to the optional gauge.
+func newCircuitBreaker(threshold int, cooldown time.Duration, gauge prometheus.Gauge) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		gauge:     gauge,
+	}
+}
+
+// Allow returns true if an upload may be attempted at now.
+func (b *circuitBreaker) Allow(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == breakerOpen {
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+	}
+	return true
+}
+
+// Done records the result of an upload attempted at now.
+func (b *circuitBreaker) Done(now time.Time, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err == nil {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = now
+		b.setState(breakerOpen)
+	}
+}
+
+func (b *circuitBreaker) setState(state breakerState) {
+	b.state = state
+	if b.gauge != nil {
+		b.gauge.Set(float64(state))
+	}
+}
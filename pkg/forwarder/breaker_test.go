@@ -0,0 +1,41 @@
+package forwarder
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	start := time.Unix(0, 0)
+	b := newCircuitBreaker(2, time.Minute, nil)
+	failed := fmt.Errorf("failed")
+
+	steps := []struct {
+		offset    time.Duration
+		wantAllow bool
+		err       error
+		wantState breakerState
+	}{
+		{offset: 0, wantAllow: true, err: failed, wantState: breakerClosed},
+		{offset: time.Second, wantAllow: true, err: failed, wantState: breakerOpen},
+		{offset: 30 * time.Second, wantState: breakerOpen},
+		{offset: 61 * time.Second, wantAllow: true, err: failed, wantState: breakerOpen},
+		{offset: 90 * time.Second, wantState: breakerOpen},
+		{offset: 121 * time.Second, wantAllow: true, wantState: breakerClosed},
+		{offset: 122 * time.Second, wantAllow: true, err: failed, wantState: breakerClosed},
+	}
+	for _, step := range steps {
+		now := start.Add(step.offset)
+		allow := b.Allow(now)
+		if allow != step.wantAllow {
+			t.Fatalf("Allow() at %s = %t, want %t", step.offset, allow, step.wantAllow)
+		}
+		if allow {
+			b.Done(now, step.err)
+		}
+		if b.state != step.wantState {
+			t.Fatalf("state at %s = %d, want %d", step.offset, b.state, step.wantState)
+		}
+	}
+}
@@ -2,20 +2,38 @@ package forwarder
 
 import (
 	"context"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
 	"log"
+	"math"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 
+	"github.com/openshift/telemeter/pkg/authorizer/remote"
+	telemeterhttp "github.com/openshift/telemeter/pkg/http"
 	"github.com/openshift/telemeter/pkg/metricsclient"
+	"github.com/openshift/telemeter/pkg/ratelog"
 	"github.com/openshift/telemeter/pkg/transform"
 )
 
 type Interface interface {
+	// Transforms returns the transformers applied to the next batch. If there are
+	// none, federated batches are uploaded as they were retrieved without decoding
+	// them, unless Queries, PartitionLabel, SkipUnchanged, MaxUploadBytes, or
+	// RetainUploads are set, a destination has a Sink, or the authorizer requires
+	// labels, which are then added to the batch.
+	// LastMetrics is empty for batches that are not decoded.
 	Transforms() []transform.Interface
 	MatchRules() []string
 }
@@ -33,35 +51,290 @@ var (
 		Name: "federate_errors",
 		Help: "The number of times forwarding federated metrics has failed",
 	})
+	gaugeFederateInterval = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "federate_interval_seconds",
+		Help: "The current interval between scrapes before jitter, which is lengthened while scrapes of the source fail",
+	})
+	counterFederateThrottled = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "federate_throttled",
+		Help: "The number of federated batches that were not uploaded due to rate limiting",
+	})
+	gaugeFederateBreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "federate_circuit_breaker_state",
+		Help: "The state of the upload circuit breaker per destination: 0 is closed, 1 is open, and 2 is half-open",
+	}, []string{"destination"})
+	counterFederateUploads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "federate_uploads",
+		Help: "The number of uploads per destination by result",
+	}, []string{"destination", "result"})
+	counterFederatePartitionUploads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "federate_partition_uploads",
+		Help: "The number of uploads per partition by result when batches are partitioned by a label, the default partition has an empty value",
+	}, []string{"partition", "result"})
+	gaugeFederateSpoolBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "federate_spool_bytes",
+		Help: "The size of the batches spooled for each destination",
+	}, []string{"destination"})
+	counterFederateSpoolReplayed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "federate_spool_replayed",
+		Help: "The number of spooled batches uploaded to each destination",
+	}, []string{"destination"})
+	histogramStageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "telemeter_forward_stage_duration_seconds",
+		Help:    "The time spent in each stage of forwarding a batch",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"stage"})
+	counterTransformDuration = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "telemeter_transform_duration_seconds_total",
+		Help: "The total time spent in each transformer, only reported when transforms are profiled",
+	}, []string{"transform"})
+	counterTransformDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "telemeter_transform_dropped_total",
+		Help: "The number of series dropped by each transformer, only reported when drops are counted",
+	}, []string{"transform"})
+	gaugeFederateRetryAfter = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "federate_retry_after_seconds",
+		Help: "The delay before the next upload that a destination asked for with Retry-After after the last batch, zero if none did",
+	})
+	gaugeBatchOldestSampleAge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "telemeter_batch_oldest_sample_age_seconds",
+		Help: "The age of the oldest sample in the last transformed batch, NaN if no sample had a timestamp",
+	})
+	gaugeBatchNewestSampleAge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "telemeter_batch_newest_sample_age_seconds",
+		Help: "The age of the newest sample in the last transformed batch, NaN if no sample had a timestamp",
+	})
 )
 
 func init() {
 	prometheus.MustRegister(
 		gaugeFederateErrors, gaugeFederateSamples, gaugeFederateFilteredSamples,
+		counterFederateThrottled, gaugeFederateBreakerState, counterFederateUploads,
+		counterFederatePartitionUploads, gaugeFederateSpoolBytes, counterFederateSpoolReplayed,
+		histogramStageDuration, counterTransformDuration, counterTransformDropped,
+		gaugeFederateInterval, gaugeBatchOldestSampleAge, gaugeBatchNewestSampleAge,
+		gaugeFederateRetryAfter,
 	)
 }
 
+// CountDropped wraps each transformer to record the number of series it drops,
+// labelled by the transformer type.
+func CountDropped(transforms transform.All) transform.All {
+	counted := make(transform.All, 0, len(transforms))
+	for _, t := range transforms {
+		counted = append(counted, transform.NewCountDropped(transformName(t), t, droppedCounter{}))
+	}
+	return counted
+}
+
+// droppedCounter records dropped series in telemeter_transform_dropped_total.
+type droppedCounter struct{}
+
+func (droppedCounter) Add(transform string, series int) {
+	counterTransformDropped.WithLabelValues(transform).Add(float64(series))
+}
+
+// transformName returns the name of the type of t, or of the transformer it wraps.
+func transformName(t transform.Interface) string {
+	for {
+		w, ok := t.(interface{ Unwrap() transform.Interface })
+		if !ok {
+			return strings.TrimPrefix(fmt.Sprintf("%T", t), "*")
+		}
+		t = w.Unwrap()
+	}
+}
+
+// ProfileTransforms wraps each transformer to record the time spent in it,
+// labelled by the transformer type.
+func ProfileTransforms(transforms transform.All) transform.All {
+	profiled := make(transform.All, 0, len(transforms))
+	for _, t := range transforms {
+		counter := counterTransformDuration.WithLabelValues(transformName(t))
+		profiled = append(profiled, transform.NewTimed(t, func(d time.Duration) { counter.Add(d.Seconds()) }))
+	}
+	return profiled
+}
+
+// Destination is a server that each transformed batch is uploaded to.
+type Destination struct {
+	URL *url.URL
+	// Client is used to upload to URL. If nil the worker's ToClient is used.
+	Client *metricsclient.Client
+	// Sink, if set, receives each batch instead of an upload to URL, which then only
+	// identifies the destination in metrics, logs, and the status. Every partition
+	// and chunk of a batch is sent separately, and content hashes are not sent.
+	Sink Sink
+
+	breaker *circuitBreaker
+	// pending is true until the current batch has been uploaded successfully.
+	pending bool
+	// lock serializes the uploads of batches and of spooled batches to the
+	// destination.
+	lock sync.Mutex
+	// sink receives every batch for the destination: Sink, or one that uploads to URL
+	// with Client.
+	sink Sink
+	// spool stores batches that failed to upload, if spooling is enabled.
+	spool *spool
+	// acceptedHashes are the content hashes the destination acknowledged for the
+	// last uploaded batch, by partition.
+	acceptedHashes map[string]string
+}
+
 type Worker struct {
 	FromClient *metricsclient.Client
-	ToClient   *metricsclient.Client
-	Interval   time.Duration
-	Timeout    time.Duration
-	MaxBytes   int64
+	// ToClient is the default client for destinations without their own client.
+	ToClient *metricsclient.Client
+	Interval time.Duration
+	Timeout  time.Duration
+	MaxBytes int64
+
+	// SpoolDir, if set, is a directory where the partitions and chunks of batches
+	// that failed to upload, or were skipped by the breaker, are stored and from where
+	// they are uploaded again once the destination accepts uploads, oldest first.
+	// Batches are kept until the spool of a destination exceeds SpoolMaxBytes or they
+	// are older than SpoolMaxAge.
+	SpoolDir      string
+	SpoolMaxBytes int64
+	SpoolMaxAge   time.Duration
+
+	// SequenceFile, if set, stores the sequence number of the next upload to each
+	// destination so that numbering continues after a restart. Without it, numbering
+	// starts at the time Run starts in milliseconds. Every upload over HTTP carries
+	// its number in the telemeterhttp.SequenceHeader and is numbered one higher than
+	// the last successful upload to the same destination.
+	SequenceFile string
+	// ClientID, if set, is sent with every upload over HTTP in the
+	// telemeterhttp.ClientIDHeader.
+	ClientID string
+
+	// PartitionLabel, if set, splits each batch by the value of this label and
+	// uploads every partition in a separate request. Series without the label are
+	// uploaded together in a default partition.
+	PartitionLabel string
+
+	// MaxUploadBytes, if set, splits each partition into chunks whose uncompressed
+	// encoding is at most about this many bytes and uploads every chunk in a separate
+	// request. The chunks of a batch share a batch ID header. A chunk that fails to
+	// upload is retried once after ChunkRetryDelay before the upload fails.
+	MaxUploadBytes int
+	// ChunkRetryDelay is the time waited before a failed chunk is sent again, varied
+	// by up to half. Defaults to one second.
+	ChunkRetryDelay time.Duration
+
+	// MaxRetryAfter is the longest delay before the next upload honored when a
+	// destination answers with a Retry-After header, so that a misconfigured or
+	// hostile server cannot stop uploads indefinitely. Defaults to three intervals.
+	MaxRetryAfter time.Duration
+
+	// SkipUnchanged sends a content hash with each upload and skips uploading a
+	// batch to a destination that acknowledged the same hash for the previous one.
+	SkipUnchanged bool
+	// UnhashedFamilies are left out of the content hash. They are still uploaded, but
+	// a change to them alone does not cause an upload.
+	UnhashedFamilies []string
+
+	// Queries, if set, are evaluated as instant queries with the query API at the
+	// from URL instead of federating the match rules. Their results are combined into
+	// a single batch, with the series of metrics returned by several queries in one
+	// family.
+	Queries []string
+
+	// Authorizer, if set, is asked to authorize each batch before it is uploaded and
+	// returns the labels every uploaded series must carry. Batches are not uploaded if
+	// authorization fails or series are missing any of the labels.
+	Authorizer remote.Authorizer
+
+	// TransformConcurrency is the number of goroutines used to apply each stateless
+	// transformer to large batches. Values below 2 transform serially.
+	TransformConcurrency int
+
+	// IntervalJitter randomly varies each interval by up to this fraction of
+	// Interval in either direction. It must be between 0 and 1.
+	IntervalJitter float64
+
+	// MaxUploadsPerMinute limits how often a batch is uploaded. Batches that
+	// exceed the rate are skipped rather than queued. Zero disables the limit.
+	MaxUploadsPerMinute int
+
+	// BreakerThreshold is the number of consecutive upload failures to a destination
+	// after which uploads to it are skipped for BreakerCooldown. Zero disables the
+	// breaker.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// SourceBackoffThreshold is the number of consecutive failed scrapes after which
+	// the interval is doubled with every further failure, up to SourceBackoffMax, to
+	// avoid adding load to a struggling source. A successful scrape restores the
+	// interval. Zero disables the backoff.
+	SourceBackoffThreshold int
+	SourceBackoffMax       time.Duration
+
+	// RetainUploads is the number of uploaded batches to keep in memory for
+	// debugging. Zero disables retention.
+	RetainUploads int
+
+	// Logger, if set, throttles the messages logged for failures that repeat every
+	// interval, such as failed uploads. All messages are logged if nil.
+	Logger *ratelog.Logger
+
+	// Destinations receive every batch. A failure to upload to one destination does
+	// not prevent delivery to the others and only failed destinations are retried.
+	Destinations []*Destination
 
 	from      url.URL
-	to        *url.URL
 	forwarder Interface
+	limiter   *rateLimiter
+	history   *uploadHistory
+	backoff   *sourceBackoff
+	sequence  *sequence
 
 	lock        sync.Mutex
 	lastMetrics []*clientmodel.MetricFamily
+	retryAfter  time.Duration
+	status      Status
+	scraped     bool
+	authorized  bool
 }
 
+// Status reports the outcome of the most recent run of each stage of forwarding.
+// A nil stage has never run.
+type Status struct {
+	Scrape    *StageStatus `json:"scrape,omitempty"`
+	Transform *StageStatus `json:"transform,omitempty"`
+	Upload    *StageStatus `json:"upload,omitempty"`
+
+	// Destinations is the outcome of the most recent upload to each destination,
+	// keyed by destination URL.
+	Destinations map[string]*StageStatus `json:"destinations,omitempty"`
+}
+
+// StageStatus is the time a stage last completed and the error it returned, if any.
+type StageStatus struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+func newStageStatus(err error) *StageStatus {
+	s := &StageStatus{Time: time.Now()}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	return s
+}
+
+// New creates a worker that federates from and uploads to the optional to
+// destination. More destinations may be added to Destinations before Run.
 func New(from url.URL, to *url.URL, f Interface) *Worker {
-	return &Worker{
+	w := &Worker{
 		from:      from,
-		to:        to,
 		forwarder: f,
 	}
+	if to != nil {
+		w.Destinations = []*Destination{{URL: to}}
+	}
+	return w
 }
 
 func (w *Worker) LastMetrics() []*clientmodel.MetricFamily {
@@ -76,7 +349,57 @@ func (w *Worker) setLastMetrics(families []*clientmodel.MetricFamily) {
 	w.lastMetrics = families
 }
 
-func (w *Worker) Run() {
+// Uploads returns the retained uploads from oldest to newest. It returns nil unless
+// RetainUploads is set.
+func (w *Worker) Uploads() []Upload {
+	w.lock.Lock()
+	history := w.history
+	w.lock.Unlock()
+	if history == nil {
+		return nil
+	}
+	return history.List()
+}
+
+// Status returns the outcome of the most recent scrape, transform, and upload.
+func (w *Worker) Status() Status {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	status := w.status
+	if status.Destinations != nil {
+		status.Destinations = make(map[string]*StageStatus, len(w.status.Destinations))
+		for k, v := range w.status.Destinations {
+			status.Destinations[k] = v
+		}
+	}
+	return status
+}
+
+// Ready returns an error until a scrape has succeeded and, if an Authorizer is set,
+// a batch has been authorized. It stays ready once both have happened, even if
+// later attempts fail.
+func (w *Worker) Ready() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	switch {
+	case !w.scraped:
+		return fmt.Errorf("no scrape has succeeded yet")
+	case w.Authorizer != nil && !w.authorized:
+		return fmt.Errorf("no batch has been authorized yet")
+	}
+	return nil
+}
+
+func (w *Worker) setStatus(fn func(*Status)) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	fn(&w.status)
+}
+
+// init sets the defaults of unset fields and creates the state of the worker from
+// its configuration. It is called by Run, and must be called before Drain if Run was
+// not.
+func (w *Worker) init() {
 	if w.Interval == 0 {
 		w.Interval = 4*time.Minute + 30*time.Second
 	}
@@ -93,58 +416,743 @@ func (w *Worker) Run() {
 		w.ToClient = metricsclient.New(&http.Client{Transport: metricsclient.DefaultTransport()}, w.MaxBytes, w.Timeout, "federate_to")
 	}
 
-	ctx := context.Background()
+	if w.MaxUploadsPerMinute > 0 {
+		w.limiter = newRateLimiter(w.MaxUploadsPerMinute)
+	}
+	if w.RetainUploads > 0 {
+		w.lock.Lock()
+		w.history = newUploadHistory(w.RetainUploads)
+		w.lock.Unlock()
+	}
+	if w.BreakerCooldown == 0 {
+		w.BreakerCooldown = 5 * time.Minute
+	}
+	if w.ChunkRetryDelay == 0 {
+		w.ChunkRetryDelay = time.Second
+	}
+	if w.MaxRetryAfter == 0 {
+		w.MaxRetryAfter = 3 * w.Interval
+	}
+	if w.SourceBackoffThreshold > 0 {
+		if w.SourceBackoffMax == 0 {
+			w.SourceBackoffMax = 4 * w.Interval
+		}
+		w.backoff = newSourceBackoff(w.SourceBackoffThreshold, w.SourceBackoffMax)
+	}
+	start := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	sequence, err := newSequence(w.SequenceFile, start)
+	if err != nil {
+		log.Printf("error: unable to read the sequence numbers from %s, starting at %d: %v", w.SequenceFile, start, err)
+	}
+	w.sequence = sequence
+	for _, d := range w.Destinations {
+		if d.Client == nil && d.Sink == nil {
+			d.Client = w.ToClient
+		}
+		d.sink = d.Sink
+		if d.sink == nil {
+			d.sink = NewHTTPSink(d.Client, d.URL)
+		}
+		if w.BreakerThreshold > 0 {
+			d.breaker = newCircuitBreaker(w.BreakerThreshold, w.BreakerCooldown, gaugeFederateBreakerState.WithLabelValues(d.URL.String()))
+		}
+		if len(w.SpoolDir) > 0 {
+			spool, err := newSpool(filepath.Join(w.SpoolDir, spoolName(d.URL)), w.SpoolMaxBytes, w.SpoolMaxAge)
+			if err != nil {
+				log.Printf("error: unable to spool batches for %s: %v", d.URL, err)
+				continue
+			}
+			d.spool = spool
+		}
+	}
+}
+
+// Run forwards a batch every interval until ctx is done.
+func (w *Worker) Run(ctx context.Context) {
+	w.init()
+	for _, d := range w.Destinations {
+		if d.spool != nil {
+			go w.replay(ctx, d)
+		}
+	}
+
+	retry := false
 	for {
-		// load the match rules each time
-		from := w.from
+		err := w.cycle(ctx, retry)
+		interval := w.Interval
+		if w.backoff != nil {
+			interval = w.backoff.Interval(interval)
+		}
+		gaugeFederateInterval.Set(interval.Seconds())
+		wait := jitter(interval, w.IntervalJitter)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			gaugeFederateErrors.Inc()
+			w.Logger.Printf("forward failures", "error: unable to forward results: %v", err)
+			retry = true
+			if w.backoff == nil || !w.backoff.Active() {
+				// retry sooner, unless the source is failing
+				wait = time.Minute
+			}
+		} else {
+			retry = false
+		}
+		if delay := w.takeRetryAfter(); delay > 0 {
+			// the destination knows best when it can accept uploads again
+			w.Logger.Printf("retry after", "warning: a destination asked to wait %s before the next upload", delay)
+			wait = delay
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// deferUploads records the delay a destination asked for before the next upload if
+// err carries one, at most MaxRetryAfter. The longest delay since the last call to
+// takeRetryAfter wins.
+func (w *Worker) deferUploads(err error) {
+	delay := metricsclient.RetryAfter(err)
+	if delay <= 0 {
+		return
+	}
+	if w.MaxRetryAfter > 0 && delay > w.MaxRetryAfter {
+		delay = w.MaxRetryAfter
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if delay > w.retryAfter {
+		w.retryAfter = delay
+	}
+}
+
+// takeRetryAfter returns and clears the delay recorded by deferUploads.
+func (w *Worker) takeRetryAfter() time.Duration {
+	w.lock.Lock()
+	delay := w.retryAfter
+	w.retryAfter = 0
+	w.lock.Unlock()
+	gaugeFederateRetryAfter.Set(delay.Seconds())
+	return delay
+}
+
+// Drain forwards a single batch to every destination, giving up when ctx is done.
+// It is intended to send the last batch before the process exits and must only be
+// called after Run has returned, or after init if Run was never called.
+func (w *Worker) Drain(ctx context.Context) error {
+	return w.cycle(ctx, false)
+}
+
+// cycle forwards a batch using the current match rules and transforms.
+func (w *Worker) cycle(ctx context.Context, retry bool) error {
+	// load the match rules each time
+	from := w.from
+	if len(w.Queries) == 0 {
 		v := from.Query()
 		for _, rule := range w.forwarder.MatchRules() {
 			v.Add("match[]", rule)
 		}
 		from.RawQuery = v.Encode()
+	}
 
-		transforms := w.forwarder.Transforms()
+	transforms := w.forwarder.Transforms()
 
-		if err := w.forward(ctx, &from, transforms); err != nil {
-			gaugeFederateErrors.Inc()
-			log.Printf("error: unable to forward results: %v", err)
-			time.Sleep(time.Minute)
-			continue
-		}
-		time.Sleep(w.Interval)
+	// correlate the authorize and upload requests of this attempt
+	id := telemeterhttp.NewRequestID()
+	if err := w.forward(telemeterhttp.WithRequestID(ctx, id), &from, transforms, retry); err != nil {
+		return fmt.Errorf("request %s: %v", id, err)
+	}
+	return nil
+}
+
+// jitter returns d varied uniformly by up to fraction of d in either direction.
+// The fraction is clamped to [0, 1] so the result is never negative.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
 	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	return d + time.Duration(fraction*(2*rand.Float64()-1)*float64(d))
 }
 
-func (w *Worker) forward(ctx context.Context, from *url.URL, transforms []transform.Interface) error {
-	req := &http.Request{Method: "GET", URL: from}
-	families, err := w.FromClient.Retrieve(ctx, req)
+// forward retrieves, transforms, and uploads a batch. If retry is true only the
+// destinations that have not received the previous batch are uploaded to.
+func (w *Worker) forward(ctx context.Context, from *url.URL, transforms []transform.Interface, retry bool) error {
+	if !retry {
+		for _, d := range w.Destinations {
+			d.pending = true
+			if b, ok := d.sink.(batchSink); ok {
+				b.newBatch()
+			}
+		}
+	}
+
+	start := time.Now()
+	var (
+		families []*clientmodel.MetricFamily
+		raw      []byte
+		isRaw    bool
+		err      error
+	)
+	if len(transforms) == 0 && w.passthrough() {
+		raw, isRaw, families, err = w.retrieveRaw(ctx, from)
+	} else {
+		families, err = w.retrieve(ctx, from)
+	}
+	histogramStageDuration.WithLabelValues("scrape").Observe(time.Since(start).Seconds())
+	w.setStatus(func(s *Status) {
+		s.Scrape = newStageStatus(err)
+		w.scraped = w.scraped || err == nil
+	})
+	if w.backoff != nil && ctx.Err() == nil {
+		w.backoff.Done(err)
+	}
 	if err != nil {
 		return err
 	}
+	if isRaw {
+		return w.forwardRaw(ctx, raw)
+	}
+	return w.process(ctx, families, transforms)
+}
+
+// process transforms and uploads a batch.
+func (w *Worker) process(ctx context.Context, families []*clientmodel.MetricFamily, transforms []transform.Interface) error {
+	// the state of the transforms only advances with batches that were delivered
+	delivered := false
+	defer func() {
+		for _, t := range transforms {
+			if c, ok := t.(transform.Committer); ok {
+				c.Commit(delivered)
+			}
+		}
+	}()
 
+	start := time.Now()
 	before := transform.Metrics(families)
 	for _, t := range transforms {
-		if err := transform.Filter(families, t); err != nil {
+		if p, ok := t.(transform.Preparer); ok {
+			if err := p.Prepare(ctx); err != nil {
+				w.setStatus(func(s *Status) { s.Transform = newStageStatus(err) })
+				return err
+			}
+		}
+	}
+	for _, t := range transforms {
+		if err := transform.FilterConcurrent(families, t, w.TransformConcurrency); err != nil {
+			w.setStatus(func(s *Status) { s.Transform = newStageStatus(err) })
 			return err
 		}
+		if a, ok := t.(transform.Appender); ok {
+			families = a.Append(families)
+		}
 	}
+	w.setStatus(func(s *Status) { s.Transform = newStageStatus(nil) })
 	families = transform.Pack(families)
+	histogramStageDuration.WithLabelValues("transform").Observe(time.Since(start).Seconds())
 	after := transform.Metrics(families)
 
 	gaugeFederateSamples.Set(float64(before))
 	gaugeFederateFilteredSamples.Set(float64(before - after))
+	setSampleAges(families, time.Now())
 
 	w.setLastMetrics(families)
 
 	if len(families) == 0 {
 		log.Printf("warning: no metrics to send, doing nothing")
+		delivered = true
 		return nil
 	}
 
-	if w.to == nil {
+	if len(w.Destinations) == 0 {
+		delivered = true
 		return nil
 	}
 
-	req = &http.Request{Method: "POST", URL: w.to}
-	return w.ToClient.Send(ctx, req, families)
+	if w.Authorizer != nil {
+		_, labels, err := w.Authorizer.Authorize(ctx)
+		if err == nil {
+			w.setStatus(func(*Status) { w.authorized = true })
+			err = checkRequiredLabels(families, labels)
+		}
+		if err != nil {
+			w.setStatus(func(s *Status) { s.Upload = newStageStatus(err) })
+			return err
+		}
+	}
+
+	if w.limiter != nil && !w.limiter.Allow(time.Now()) {
+		counterFederateThrottled.Inc()
+		w.Logger.Printf("rate limited batches", "warning: upload rate limit exceeded, skipping batch")
+		return nil
+	}
+
+	partitions, err := w.partitions(families)
+	if err != nil {
+		return err
+	}
+
+	start = time.Now()
+	var failed []string
+	delivered = true
+	for _, d := range w.Destinations {
+		if !d.pending {
+			continue
+		}
+		unsent, err := w.upload(ctx, d, partitions)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", d.URL, err))
+		} else {
+			d.pending = false
+		}
+		if len(unsent) > 0 && d.spool != nil {
+			if !w.spoolBatch(d, joinPartitions(unsent)) {
+				delivered = false
+			}
+		} else if err != nil || len(unsent) > 0 {
+			delivered = false
+		}
+	}
+	err = nil
+	if len(failed) > 0 {
+		err = fmt.Errorf("unable to upload to %d of %d destinations: %s", len(failed), len(w.Destinations), strings.Join(failed, "; "))
+	}
+	histogramStageDuration.WithLabelValues("upload").Observe(time.Since(start).Seconds())
+	if w.history != nil {
+		w.history.Add(start, families, err)
+	}
+	w.setStatus(func(s *Status) { s.Upload = newStageStatus(err) })
+	return err
+}
+
+// partitions splits families into the partitions and chunks that are uploaded in
+// separate requests.
+func (w *Worker) partitions(families []*clientmodel.MetricFamily) ([]*partition, error) {
+	partitions := []*partition{{families: families}}
+	if len(w.PartitionLabel) > 0 {
+		partitions = partitionFamilies(families, w.PartitionLabel)
+	}
+	if w.MaxUploadBytes > 0 {
+		partitions = chunkPartitions(partitions, w.MaxUploadBytes, fmt.Sprintf("%016x", rand.Uint64()))
+	}
+	if w.SkipUnchanged {
+		for _, p := range partitions {
+			var err error
+			if p.hash, err = metricsclient.ContentHash(w.hashedFamilies(p.families)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return partitions, nil
+}
+
+// spoolBatch stores families in the spool of d to be uploaded later and returns
+// true if they were stored.
+func (w *Worker) spoolBatch(d *Destination, families []*clientmodel.MetricFamily) bool {
+	err := d.spool.Add(time.Now(), families)
+	if err != nil {
+		w.Logger.Printf("spool failures for "+d.URL.String(), "error: unable to spool batch for %s: %v", d.URL, err)
+	}
+	w.updateSpoolSize(d)
+	return err == nil
+}
+
+// setSampleAges records the age of the oldest and newest timestamped samples in
+// families relative to now. Both ages are NaN when no sample has a timestamp.
+func setSampleAges(families []*clientmodel.MetricFamily, now time.Time) {
+	oldest, newest, ok := sampleTimeRange(families)
+	if !ok {
+		gaugeBatchOldestSampleAge.Set(math.NaN())
+		gaugeBatchNewestSampleAge.Set(math.NaN())
+		return
+	}
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+	gaugeBatchOldestSampleAge.Set(float64(nowMs-oldest) / 1000)
+	gaugeBatchNewestSampleAge.Set(float64(nowMs-newest) / 1000)
+}
+
+// sampleTimeRange returns the smallest and largest sample timestamps in families,
+// in milliseconds. ok is false if no sample has a timestamp.
+func sampleTimeRange(families []*clientmodel.MetricFamily) (oldest, newest int64, ok bool) {
+	for _, family := range families {
+		if family == nil {
+			continue
+		}
+		for _, m := range family.Metric {
+			if m == nil || m.TimestampMs == nil {
+				continue
+			}
+			ts := *m.TimestampMs
+			if !ok || ts < oldest {
+				oldest = ts
+			}
+			if !ok || ts > newest {
+				newest = ts
+			}
+			ok = true
+		}
+	}
+	return oldest, newest, ok
+}
+
+// passthrough returns true if a batch that is not transformed can be uploaded as it
+// was retrieved, without decoding it.
+func (w *Worker) passthrough() bool {
+	for _, d := range w.Destinations {
+		if _, ok := d.sink.(uploader); !ok {
+			return false
+		}
+	}
+	return len(w.Queries) == 0 && len(w.PartitionLabel) == 0 && !w.SkipUnchanged && w.MaxUploadBytes == 0 && w.RetainUploads == 0
+}
+
+// retrieveRaw federates from the from URL without decoding the response. If the
+// response is not in the delimited protobuf format, it is decoded and returned as
+// families instead and ok is false.
+func (w *Worker) retrieveRaw(ctx context.Context, from *url.URL) (raw []byte, ok bool, families []*clientmodel.MetricFamily, err error) {
+	data, format, err := w.FromClient.RetrieveRaw(ctx, &http.Request{Method: "GET", URL: from})
+	if err != nil {
+		return nil, false, nil, err
+	}
+	if format == expfmt.FmtProtoDelim {
+		return data, true, nil, nil
+	}
+	families, err = metricsclient.Decode(data, format)
+	return nil, false, families, err
+}
+
+// forwardRaw uploads a batch that is not transformed without decoding it. If the
+// authorizer requires labels, the batch is decoded to add them and processed as
+// usual.
+func (w *Worker) forwardRaw(ctx context.Context, data []byte) error {
+	w.setLastMetrics(nil)
+
+	if len(data) == 0 {
+		log.Printf("warning: no metrics to send, doing nothing")
+		return nil
+	}
+
+	if len(w.Destinations) == 0 {
+		return nil
+	}
+
+	if w.Authorizer != nil {
+		_, labels, err := w.Authorizer.Authorize(ctx)
+		if err != nil {
+			w.setStatus(func(s *Status) { s.Upload = newStageStatus(err) })
+			return err
+		}
+		w.setStatus(func(*Status) { w.authorized = true })
+		if len(labels) > 0 {
+			families, err := metricsclient.Decode(data, expfmt.FmtProtoDelim)
+			if err != nil {
+				return err
+			}
+			return w.process(ctx, families, []transform.Interface{transform.NewLabel(labels, nil)})
+		}
+	}
+
+	if w.limiter != nil && !w.limiter.Allow(time.Now()) {
+		counterFederateThrottled.Inc()
+		w.Logger.Printf("rate limited batches", "warning: upload rate limit exceeded, skipping batch")
+		return nil
+	}
+
+	start := time.Now()
+	var failed []string
+	var err error
+	for _, d := range w.Destinations {
+		if !d.pending {
+			continue
+		}
+		sent, err := w.uploadRaw(ctx, d, data)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", d.URL, err))
+		} else {
+			d.pending = false
+		}
+		if !sent && d.spool != nil {
+			families, err := metricsclient.Decode(data, expfmt.FmtProtoDelim)
+			if err != nil {
+				w.Logger.Printf("spool failures for "+d.URL.String(), "error: unable to spool batch for %s: %v", d.URL, err)
+				continue
+			}
+			w.spoolBatch(d, families)
+		}
+	}
+	if len(failed) > 0 {
+		err = fmt.Errorf("unable to upload to %d of %d destinations: %s", len(failed), len(w.Destinations), strings.Join(failed, "; "))
+	}
+	histogramStageDuration.WithLabelValues("upload").Observe(time.Since(start).Seconds())
+	w.setStatus(func(s *Status) { s.Upload = newStageStatus(err) })
+	return err
+}
+
+// uploadRaw sends the undecoded batch in data to d. sent is false if the batch was
+// not uploaded, also when it was skipped because of earlier failures.
+func (w *Worker) uploadRaw(ctx context.Context, d *Destination, data []byte) (sent bool, err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.breaker != nil && !d.breaker.Allow(time.Now()) {
+		w.Logger.Printf("batches skipped for "+d.URL.String(), "warning: too many consecutive upload failures to %s, skipping batch", d.URL)
+		return false, nil
+	}
+	header := make(http.Header)
+	done := w.numberUpload(d, header)
+	err = d.sink.(uploader).uploadRaw(ctx, header, data)
+	done(err)
+	w.deferUploads(err)
+	w.uploaded(d, err)
+	return err == nil, err
+}
+
+// replay uploads the batches spooled for d when Run starts and then every minute
+// until ctx is done. Spooled batches are partitioned, chunked, and numbered like
+// every other batch, and only the parts that fail to upload again are kept.
+func (w *Worker) replay(ctx context.Context, d *Destination) {
+	for {
+		sent, err := d.spool.Replay(time.Now(), func(families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+			partitions, err := w.partitions(families)
+			if err != nil {
+				return families, err
+			}
+			unsent, err := w.upload(ctx, d, partitions)
+			if err == nil && len(unsent) > 0 {
+				err = fmt.Errorf("uploads are paused after too many consecutive failures")
+			}
+			return joinPartitions(unsent), err
+		})
+		counterFederateSpoolReplayed.WithLabelValues(d.URL.String()).Add(float64(sent))
+		if err != nil && ctx.Err() == nil {
+			w.Logger.Printf("spool replay failures for "+d.URL.String(), "warning: unable to upload spooled batches to %s, %d were uploaded: %v", d.URL, sent, err)
+		}
+		w.updateSpoolSize(d)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+	}
+}
+
+func (w *Worker) updateSpoolSize(d *Destination) {
+	size, err := d.spool.Size()
+	if err != nil {
+		log.Printf("error: unable to read the spool of %s: %v", d.URL, err)
+		return
+	}
+	gaugeFederateSpoolBytes.WithLabelValues(d.URL.String()).Set(float64(size))
+}
+
+// spoolName returns the name of the spool directory for a destination.
+func spoolName(u *url.URL) string {
+	h := fnv.New64a()
+	h.Write([]byte(u.String()))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// retrieve federates from the from URL, or evaluates each of the queries against it.
+func (w *Worker) retrieve(ctx context.Context, from *url.URL) ([]*clientmodel.MetricFamily, error) {
+	if len(w.Queries) == 0 {
+		return w.FromClient.Retrieve(ctx, &http.Request{Method: "GET", URL: from})
+	}
+	var families []*clientmodel.MetricFamily
+	byName := make(map[string]*clientmodel.MetricFamily)
+	for _, query := range w.Queries {
+		u := *from
+		v := u.Query()
+		v.Set("query", query)
+		u.RawQuery = v.Encode()
+		result, err := w.FromClient.Query(ctx, &http.Request{Method: "GET", URL: &u})
+		if err != nil {
+			return nil, fmt.Errorf("query %q: %v", query, err)
+		}
+		// several queries may return the same metric, which is uploaded as one family
+		for _, family := range result {
+			if existing, ok := byName[family.GetName()]; ok {
+				existing.Metric = append(existing.Metric, family.Metric...)
+				continue
+			}
+			byName[family.GetName()] = family
+			families = append(families, family)
+		}
+	}
+	return families, nil
+}
+
+func (w *Worker) hashedFamilies(families []*clientmodel.MetricFamily) []*clientmodel.MetricFamily {
+	if len(w.UnhashedFamilies) == 0 {
+		return families
+	}
+	hashed := make([]*clientmodel.MetricFamily, 0, len(families))
+Families:
+	for _, family := range families {
+		for _, name := range w.UnhashedFamilies {
+			if family.GetName() == name {
+				continue Families
+			}
+		}
+		hashed = append(hashed, family)
+	}
+	return hashed
+}
+
+// upload sends each partition to d in a separate request and returns the partitions
+// that were not uploaded. Partitions with a hash that d acknowledged for the previous
+// batch are skipped. All partitions are returned without an error if uploads to d
+// are paused after too many consecutive failures.
+func (w *Worker) upload(ctx context.Context, d *Destination, partitions []*partition) ([]*partition, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var changed []*partition
+	for _, p := range partitions {
+		if len(p.hash) > 0 && p.hash == d.acceptedHashes[p.key()] {
+			w.countPartition(p, "unchanged")
+			continue
+		}
+		changed = append(changed, p)
+	}
+	if len(changed) == 0 {
+		counterFederateUploads.WithLabelValues(d.URL.String(), "unchanged").Inc()
+		return nil, nil
+	}
+	if d.breaker != nil && !d.breaker.Allow(time.Now()) {
+		w.Logger.Printf("batches skipped for "+d.URL.String(), "warning: too many consecutive upload failures to %s, skipping batch", d.URL)
+		return changed, nil
+	}
+
+	var failed []string
+	var unsent []*partition
+	var deferred error
+	for _, p := range changed {
+		if deferred != nil {
+			// the destination asked to wait, sending it the rest of the batch now
+			// would only be rejected as well
+			failed = append(failed, w.partitionError(p, deferred).Error())
+			unsent = append(unsent, p)
+			w.countPartition(p, "skipped")
+			continue
+		}
+		err := w.send(ctx, d, p)
+		w.deferUploads(err)
+		if metricsclient.RetryAfter(err) > 0 {
+			deferred = err
+		}
+		if err != nil && p.chunks > 0 && ctx.Err() == nil && metricsclient.RetryAfter(err) == 0 {
+			// only the failed chunk is sent again, once the destination had time to
+			// recover
+			select {
+			case <-ctx.Done():
+			case <-time.After(jitter(w.ChunkRetryDelay, 0.5)):
+				err = w.send(ctx, d, p)
+			}
+		}
+		result := "success"
+		if err != nil {
+			result = "failure"
+			failed = append(failed, w.partitionError(p, err).Error())
+			unsent = append(unsent, p)
+		}
+		w.countPartition(p, result)
+	}
+	var err error
+	if len(failed) > 0 {
+		err = fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	w.uploaded(d, err)
+	return unsent, err
+}
+
+// partitionError prefixes err with the chunk and partition of p it occurred for.
+func (w *Worker) partitionError(p *partition, err error) error {
+	if p.chunks > 0 {
+		err = fmt.Errorf("chunk %d/%d: %v", p.chunk, p.chunks, err)
+	}
+	if len(w.PartitionLabel) > 0 {
+		err = fmt.Errorf("partition %s=%q: %v", w.PartitionLabel, p.value, err)
+	}
+	return err
+}
+
+// uploaded records the outcome of an upload to d.
+func (w *Worker) uploaded(d *Destination, err error) {
+	if d.breaker != nil {
+		d.breaker.Done(time.Now(), err)
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	counterFederateUploads.WithLabelValues(d.URL.String(), result).Inc()
+	w.setStatus(func(s *Status) {
+		if s.Destinations == nil {
+			s.Destinations = make(map[string]*StageStatus)
+		}
+		s.Destinations[d.URL.String()] = newStageStatus(err)
+	})
+}
+
+// send uploads a single partition to d, sending its hash if it has one.
+func (w *Worker) send(ctx context.Context, d *Destination, p *partition) error {
+	u, ok := d.sink.(uploader)
+	if !ok {
+		return d.sink.Send(ctx, p.families)
+	}
+	header := make(http.Header)
+	if p.chunks > 0 {
+		header.Set(telemeterhttp.BatchIDHeader, p.batchID)
+		header.Set(telemeterhttp.BatchChunkHeader, fmt.Sprintf("%d/%d", p.chunk, p.chunks))
+	}
+	done := w.numberUpload(d, header)
+	accepted, err := u.upload(ctx, header, p.families, p.hash)
+	done(err)
+	if len(p.hash) == 0 {
+		return err
+	}
+	if d.acceptedHashes == nil {
+		d.acceptedHashes = make(map[string]string)
+	}
+	if accepted {
+		d.acceptedHashes[p.key()] = p.hash
+	} else {
+		delete(d.acceptedHashes, p.key())
+	}
+	return err
+}
+
+// numberUpload adds the client ID and the sequence number of the next upload to d to
+// header. The returned function must be called with the result of the upload and
+// advances the number if it succeeded.
+func (w *Worker) numberUpload(d *Destination, header http.Header) func(error) {
+	if len(w.ClientID) > 0 {
+		header.Set(telemeterhttp.ClientIDHeader, w.ClientID)
+	}
+	if w.sequence == nil {
+		return func(error) {}
+	}
+	destination := d.URL.String()
+	n := w.sequence.Next(destination)
+	header.Set(telemeterhttp.SequenceHeader, strconv.FormatUint(n, 10))
+	return func(err error) {
+		if err != nil {
+			return
+		}
+		if err := w.sequence.Done(destination, n); err != nil {
+			w.Logger.Printf("sequence failures", "error: unable to store the sequence numbers in %s: %v", w.SequenceFile, err)
+		}
+	}
+}
+
+func (w *Worker) countPartition(p *partition, result string) {
+	if len(w.PartitionLabel) > 0 {
+		counterFederatePartitionUploads.WithLabelValues(p.value, result).Inc()
+	}
 }
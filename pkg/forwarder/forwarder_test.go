@@ -0,0 +1,594 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/openshift/telemeter/pkg/authorizer/remote"
+	telemeterhttp "github.com/openshift/telemeter/pkg/http"
+	"github.com/openshift/telemeter/pkg/metricsclient"
+	"github.com/openshift/telemeter/pkg/transform"
+)
+
+func TestJitter(t *testing.T) {
+	if got := jitter(time.Minute, 0); got != time.Minute {
+		t.Errorf("jitter() without fraction = %s, want %s", got, time.Minute)
+	}
+
+	var total time.Duration
+	n := 10000
+	for i := 0; i < n; i++ {
+		d := jitter(time.Minute, 2)
+		if d < 0 || d > 2*time.Minute {
+			t.Fatalf("jitter() = %s, out of range", d)
+		}
+		total += d
+	}
+	if avg := total / time.Duration(n); avg < 55*time.Second || avg > 65*time.Second {
+		t.Errorf("average jitter() = %s, want close to %s", avg, time.Minute)
+	}
+}
+
+func TestSampleTimeRange(t *testing.T) {
+	if _, _, ok := sampleTimeRange([]*clientmodel.MetricFamily{{Name: proto.String("up"), Metric: []*clientmodel.Metric{{}}}}); ok {
+		t.Errorf("sampleTimeRange() without timestamps returned ok")
+	}
+
+	families := []*clientmodel.MetricFamily{
+		{Name: proto.String("a"), Metric: []*clientmodel.Metric{{TimestampMs: proto.Int64(2000)}, {}}},
+		nil,
+		{Name: proto.String("b"), Metric: []*clientmodel.Metric{{TimestampMs: proto.Int64(5000)}, {TimestampMs: proto.Int64(1000)}}},
+	}
+	oldest, newest, ok := sampleTimeRange(families)
+	if !ok || oldest != 1000 || newest != 5000 {
+		t.Errorf("sampleTimeRange() = %d, %d, %t, want 1000, 5000, true", oldest, newest, ok)
+	}
+}
+
+type testForwarder struct {
+	transforms []transform.Interface
+}
+
+func (testForwarder) MatchRules() []string                { return []string{`{__name__="up"}`} }
+func (f testForwarder) Transforms() []transform.Interface { return f.transforms }
+
+// textMetrics serves the lines in the text exposition format.
+func textMetrics(lines ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// testWorker starts a source served by from and, unless to is nil, a destination
+// served by to, and returns an initialized worker forwarding from one to the other
+// after configure has been applied. The returned func stops the servers.
+func testWorker(from, to http.HandlerFunc, configure func(*Worker)) (*Worker, func()) {
+	fromServer := httptest.NewServer(from)
+	fromURL, _ := url.Parse(fromServer.URL)
+	var toURL *url.URL
+	var toServer *httptest.Server
+	if to != nil {
+		toServer = httptest.NewServer(to)
+		toURL, _ = url.Parse(toServer.URL)
+	}
+	w := New(*fromURL, toURL, testForwarder{})
+	if configure != nil {
+		configure(w)
+	}
+	w.init()
+	return w, func() {
+		fromServer.Close()
+		if toServer != nil {
+			toServer.Close()
+		}
+	}
+}
+
+func TestRunStopsAndDrainUploads(t *testing.T) {
+	var uploads int32
+	var sequence atomic.Value
+	w, stop := testWorker(textMetrics("up 1"), func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&uploads, 1)
+		sequence.Store(req.Header.Get(telemeterhttp.SequenceHeader) + " " + req.Header.Get(telemeterhttp.ClientIDHeader))
+	}, func(w *Worker) {
+		w.ClientID = "test"
+	})
+	defer stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after the context was cancelled")
+	}
+	if n := atomic.LoadInt32(&uploads); n != 0 {
+		t.Fatalf("uploads = %d before Drain(), want 0", n)
+	}
+
+	if err := w.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&uploads); n != 1 {
+		t.Errorf("uploads = %d, want 1", n)
+	}
+	if v, _ := sequence.Load().(string); !strings.HasSuffix(v, " test") || len(v) < len("1 test") {
+		t.Errorf("upload sequence and client ID = %q, want a number and test", v)
+	}
+}
+
+func TestRetryAfterDefersUploads(t *testing.T) {
+	w, stop := testWorker(textMetrics("up 1"), func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Retry-After", "90")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}, func(w *Worker) {
+		w.FromClient = metricsclient.New(&http.Client{Transport: metricsclient.DefaultTransport()}, 1024, time.Second, "from")
+		w.Destinations[0].Client = metricsclient.New(&http.Client{Transport: metricsclient.DefaultTransport()}, 1024, time.Second, "to")
+	})
+	defer stop()
+	if err := w.Drain(context.Background()); err == nil {
+		t.Fatal("Drain() succeeded, want an error for the rejected upload")
+	}
+	if delay := w.takeRetryAfter(); delay != 90*time.Second {
+		t.Errorf("takeRetryAfter() = %s, want 1m30s", delay)
+	}
+	if delay := w.takeRetryAfter(); delay != 0 {
+		t.Errorf("takeRetryAfter() = %s after it was taken, want 0", delay)
+	}
+}
+
+func TestRetryAfterSkipsRemainingPartitions(t *testing.T) {
+	var uploads int32
+	w, stop := testWorker(textMetrics(`up{tenant="a"} 1 1000`, `up{tenant="b"} 1 1000`, `up 1 1000`), func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&uploads, 1)
+		w.Header().Set("Retry-After", "86400")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}, func(w *Worker) {
+		w.PartitionLabel = "tenant"
+		w.Interval = time.Minute
+	})
+	defer stop()
+
+	if err := w.Drain(context.Background()); err == nil {
+		t.Fatal("Drain() succeeded, want an error for the rejected upload")
+	}
+	if n := atomic.LoadInt32(&uploads); n != 1 {
+		t.Errorf("uploads = %d, want 1 before the destination asked to wait", n)
+	}
+	if delay := w.takeRetryAfter(); delay != 3*time.Minute {
+		t.Errorf("takeRetryAfter() = %s, want it limited to 3m0s", delay)
+	}
+}
+
+func TestAuthorizerRequiredLabels(t *testing.T) {
+	tests := []struct {
+		name       string
+		authorizer *remote.FakeAuthorizer
+		wantErr    bool
+		wantReady  bool
+	}{
+		{name: "labels present", authorizer: &remote.FakeAuthorizer{Labels: map[string]string{"cluster": "a"}}, wantReady: true},
+		{name: "labels missing", authorizer: &remote.FakeAuthorizer{Labels: map[string]string{"cluster": "a", "id": "1"}}, wantErr: true, wantReady: true},
+		{name: "authorization fails", authorizer: &remote.FakeAuthorizer{Err: fmt.Errorf("unauthorized")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var uploads int32
+			w, stop := testWorker(textMetrics(`up{cluster="a"} 1`), func(w http.ResponseWriter, req *http.Request) {
+				atomic.AddInt32(&uploads, 1)
+			}, func(w *Worker) {
+				w.Authorizer = tt.authorizer
+			})
+			defer stop()
+			if err := w.Ready(); err == nil {
+				t.Fatal("Ready() succeeded before the first scrape")
+			}
+
+			err := w.Drain(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Drain() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if err := w.Ready(); (err == nil) != tt.wantReady {
+				t.Errorf("Ready() error = %v, wantReady %t", err, tt.wantReady)
+			}
+			if tt.authorizer.Calls() != 1 {
+				t.Errorf("Authorize() called %d times, want 1", tt.authorizer.Calls())
+			}
+			want := int32(1)
+			if tt.wantErr {
+				want = 0
+			}
+			if n := atomic.LoadInt32(&uploads); n != want {
+				t.Errorf("uploads = %d, want %d", n, want)
+			}
+			if w.Status().Upload == nil || (w.Status().Upload.Error != "") != tt.wantErr {
+				t.Errorf("upload status = %+v", w.Status().Upload)
+			}
+		})
+	}
+}
+
+func TestSkipUnchanged(t *testing.T) {
+	var value, uploads int32
+	w, stop := testWorker(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		fmt.Fprintf(w, "up %d 1000\n", atomic.LoadInt32(&value))
+	}, func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&uploads, 1)
+		w.Header().Set(telemeterhttp.ContentHashHeader, req.Header.Get(telemeterhttp.ContentHashHeader))
+	}, func(w *Worker) {
+		w.SkipUnchanged = true
+	})
+	defer stop()
+
+	for i, want := range []int32{1, 1, 2} {
+		if i == 2 {
+			atomic.StoreInt32(&value, 1)
+		}
+		if err := w.Drain(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if n := atomic.LoadInt32(&uploads); n != want {
+			t.Fatalf("batch %d: uploads = %d, want %d", i, n, want)
+		}
+	}
+}
+
+func TestPartitionLabelUploadsEachPartition(t *testing.T) {
+	var uploads int32
+	w, stop := testWorker(textMetrics(`up{tenant="a"} 1 1000`, `up{tenant="b"} 1 1000`, `up 1 1000`), func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&uploads, 1)
+	}, func(w *Worker) {
+		w.PartitionLabel = "tenant"
+	})
+	defer stop()
+
+	if err := w.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&uploads); n != 3 {
+		t.Errorf("uploads = %d, want 3", n)
+	}
+}
+
+func TestQueriesMergeFamiliesByName(t *testing.T) {
+	w, stop := testWorker(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Query().Get("query") {
+		case "up":
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","job":"a"},"value":[1,"1"]}]}}`)
+		case "up_b":
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","job":"b"},"value":[1,"0"]},{"metric":{"__name__":"ALERTS"},"value":[1,"1"]}]}}`)
+		}
+	}, nil, func(w *Worker) {
+		w.Queries = []string{"up", "up_b"}
+	})
+	defer stop()
+
+	families, err := w.retrieve(context.Background(), &w.from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, family := range families {
+		got = append(got, fmt.Sprintf("%s=%d", family.GetName(), len(family.Metric)))
+	}
+	if want := []string{"up=2", "ALERTS=1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("retrieve() = %v, want %v", got, want)
+	}
+}
+
+func TestChunkRetriedAfterDelay(t *testing.T) {
+	var uploads int32
+	var failed time.Time
+	var retryDelay time.Duration
+	w, stop := testWorker(textMetrics(`up{instance="a"} 1 1000`, `up{instance="b"} 1 1000`), func(w http.ResponseWriter, req *http.Request) {
+		switch atomic.AddInt32(&uploads, 1) {
+		case 1:
+			failed = time.Now()
+			w.WriteHeader(http.StatusInternalServerError)
+		case 2:
+			retryDelay = time.Since(failed)
+		}
+	}, func(w *Worker) {
+		w.MaxUploadBytes = 1
+		w.ChunkRetryDelay = 100 * time.Millisecond
+	})
+	defer stop()
+
+	if err := w.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&uploads); n != 3 {
+		t.Errorf("uploads = %d, want 2 chunks and 1 retry", n)
+	}
+	if retryDelay < 50*time.Millisecond {
+		t.Errorf("chunk retried after %s, want at least 50ms", retryDelay)
+	}
+}
+
+func TestSpoolOnlyFailedPartitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var failing int32 = 1
+	var lock sync.Mutex
+	var uploaded []string
+	w, stop := testWorker(textMetrics(`up{tenant="a"} 1 1000`, `up{tenant="b"} 1 1000`), func(w http.ResponseWriter, req *http.Request) {
+		family := &clientmodel.MetricFamily{}
+		if err := expfmt.NewDecoder(snappy.NewReader(req.Body), expfmt.FmtProtoDelim).Decode(family); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		tenant := labelValue(family.Metric[0], "tenant")
+		if tenant == "b" && atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		uploaded = append(uploaded, tenant+" "+req.Header.Get(telemeterhttp.SequenceHeader))
+	}, func(w *Worker) {
+		w.PartitionLabel = "tenant"
+		w.SpoolDir = dir
+		w.SpoolMaxBytes = 1024 * 1024
+		w.SpoolMaxAge = time.Hour
+	})
+	defer stop()
+	d := w.Destinations[0]
+
+	if err := w.Drain(context.Background()); err == nil {
+		t.Fatal("Drain() succeeded, want an error for partition b")
+	}
+	atomic.StoreInt32(&failing, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	replayed := make(chan struct{})
+	go func() {
+		w.replay(ctx, d)
+		close(replayed)
+	}()
+	for i := 0; i < 100; i++ {
+		if size, _ := d.spool.Size(); size == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-replayed
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(uploaded) != 2 || !strings.HasPrefix(uploaded[0], "a ") || !strings.HasPrefix(uploaded[1], "b ") {
+		t.Fatalf("uploaded %q, want partition a and then only the spooled partition b", uploaded)
+	}
+	if uploaded[1] == "b " {
+		t.Errorf("uploaded %q, want the replayed upload numbered", uploaded)
+	}
+}
+
+func TestSpoolBatchesSkippedByBreaker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, stop := testWorker(textMetrics("up 1 1000"), func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}, func(w *Worker) {
+		w.BreakerThreshold = 1
+		w.SpoolDir = dir
+		w.SpoolMaxBytes = 1024 * 1024
+		w.SpoolMaxAge = time.Hour
+	})
+	defer stop()
+	d := w.Destinations[0]
+
+	if err := w.Drain(context.Background()); err == nil {
+		t.Fatal("Drain() succeeded, want an error")
+	}
+	if err := w.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain() while the breaker is open = %v, want the batch skipped", err)
+	}
+	if files, _ := d.spool.files(); len(files) != 2 {
+		t.Errorf("spooled %d batches, want the failed and the skipped batch", len(files))
+	}
+}
+
+type requestIDRetriever struct {
+	id *string
+}
+
+func (r requestIDRetriever) Labels(ctx context.Context) (map[string]string, error) {
+	*r.id = telemeterhttp.RequestIDFromContext(ctx)
+	return map[string]string{"cluster": "a"}, nil
+}
+
+func TestLabelRetrieverUsesBatchContext(t *testing.T) {
+	var id string
+	w, stop := testWorker(textMetrics("up 1 1000"), func(w http.ResponseWriter, req *http.Request) {}, func(w *Worker) {
+		w.forwarder = testForwarder{transforms: []transform.Interface{
+			transform.NewTimed(transform.NewLabel(nil, requestIDRetriever{id: &id}), func(time.Duration) {}),
+		}}
+	})
+	defer stop()
+
+	if err := w.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(id) == 0 {
+		t.Error("labels were retrieved without the request ID of the batch")
+	}
+}
+
+// commitRecorder records the calls to Commit.
+type commitRecorder struct {
+	commits *[]bool
+}
+
+func (r commitRecorder) Transform(*clientmodel.MetricFamily) (bool, error) { return true, nil }
+
+func (r commitRecorder) Commit(delivered bool) { *r.commits = append(*r.commits, delivered) }
+
+func TestCommitAfterDelivery(t *testing.T) {
+	var commits []bool
+	var status int32 = http.StatusInternalServerError
+	w, stop := testWorker(textMetrics("up 1 1000"), func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}, func(w *Worker) {
+		w.forwarder = testForwarder{transforms: []transform.Interface{
+			transform.NewTimed(commitRecorder{commits: &commits}, func(time.Duration) {}),
+		}}
+	})
+	defer stop()
+
+	if err := w.Drain(context.Background()); err == nil {
+		t.Fatal("expected the upload to fail")
+	}
+	atomic.StoreInt32(&status, http.StatusOK)
+	if err := w.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []bool{false, true}; !reflect.DeepEqual(commits, want) {
+		t.Errorf("commits = %v, want %v", commits, want)
+	}
+}
+
+func TestBuildInfoReachesDestination(t *testing.T) {
+	var uploaded []*clientmodel.MetricFamily
+	w, stop := testWorker(textMetrics("up 1 1000"), func(w http.ResponseWriter, req *http.Request) {
+		decoder := expfmt.NewDecoder(snappy.NewReader(req.Body), expfmt.FmtProtoDelim)
+		for {
+			family := &clientmodel.MetricFamily{}
+			if err := decoder.Decode(family); err != nil {
+				break
+			}
+			uploaded = append(uploaded, family)
+		}
+	}, func(w *Worker) {
+		w.forwarder = testForwarder{transforms: []transform.Interface{
+			transform.NewBuildInfo("build_info", map[string]string{"version": "v1"}, time.Unix(1, 0)),
+			transform.NewLabel(map[string]string{"cluster": "a"}, nil),
+		}}
+	})
+	defer stop()
+
+	if err := w.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(uploaded) != 2 || uploaded[0].GetName() != "build_info" || uploaded[1].GetName() != "up" {
+		t.Fatalf("uploaded %v, want build_info and up", uploaded)
+	}
+	labels := make(map[string]string)
+	for _, label := range uploaded[0].Metric[0].Label {
+		labels[label.GetName()] = label.GetValue()
+	}
+	if labels["version"] != "v1" || labels["cluster"] != "a" {
+		t.Errorf("build_info labels = %v, want the version and the added cluster label", labels)
+	}
+}
+
+func TestSinkReceivesBatch(t *testing.T) {
+	var received []*clientmodel.MetricFamily
+	var sends, failures int
+	sink := FanOut(
+		SinkFunc(func(ctx context.Context, families []*clientmodel.MetricFamily) error {
+			sends++
+			received = families
+			return nil
+		}),
+		SinkFunc(func(ctx context.Context, families []*clientmodel.MetricFamily) error {
+			failures++
+			return fmt.Errorf("unavailable")
+		}),
+	)
+	w, stop := testWorker(textMetrics("up 1 1000"), nil, func(w *Worker) {
+		w.Destinations = append(w.Destinations, &Destination{URL: &url.URL{Scheme: "sink", Opaque: "test"}, Sink: sink})
+	})
+	defer stop()
+
+	if err := w.Drain(context.Background()); err == nil || !strings.Contains(err.Error(), "sink 1: unavailable") {
+		t.Fatalf("Drain() error = %v, want the error of the failing sink", err)
+	}
+	if len(received) != 1 || received[0].GetName() != "up" {
+		t.Errorf("sink received %v", received)
+	}
+	if status := w.Status().Destinations["sink:test"]; status == nil || len(status.Error) == 0 {
+		t.Errorf("destination status = %+v, want an error", status)
+	}
+
+	// a retry only goes to the sink that failed, the next batch to both
+	if err := w.cycle(context.Background(), true); err == nil {
+		t.Fatal("retry succeeded, want the error of the failing sink")
+	}
+	if sends != 1 || failures != 2 {
+		t.Errorf("after the retry the sinks were sent %d and %d batches, want 1 and 2", sends, failures)
+	}
+	if err := w.Drain(context.Background()); err == nil {
+		t.Fatal("Drain() succeeded, want the error of the failing sink")
+	}
+	if sends != 2 || failures != 3 {
+		t.Errorf("after the next batch the sinks were sent %d and %d batches, want 2 and 3", sends, failures)
+	}
+}
+
+func TestPassthroughUploadsRetrievedBody(t *testing.T) {
+	family := &clientmodel.MetricFamily{
+		Name:   proto.String("up"),
+		Type:   clientmodel.MetricType_GAUGE.Enum(),
+		Metric: []*clientmodel.Metric{{Gauge: &clientmodel.Gauge{Value: proto.Float64(1)}}},
+	}
+	body := &bytes.Buffer{}
+	if err := expfmt.NewEncoder(body, expfmt.FmtProtoDelim).Encode(family); err != nil {
+		t.Fatal(err)
+	}
+	var uploaded []byte
+	w, stop := testWorker(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", string(expfmt.FmtProtoDelim))
+		w.Write(body.Bytes())
+	}, func(w http.ResponseWriter, req *http.Request) {
+		data, err := ioutil.ReadAll(snappy.NewReader(req.Body))
+		if err != nil {
+			t.Error(err)
+		}
+		uploaded = data
+	}, nil)
+	defer stop()
+
+	if err := w.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(uploaded, body.Bytes()) {
+		t.Errorf("uploaded %q, want the retrieved body %q", uploaded, body.Bytes())
+	}
+	if families := w.LastMetrics(); families != nil {
+		t.Errorf("LastMetrics() = %v, want nil for a passthrough batch", families)
+	}
+}
@@ -0,0 +1,53 @@
+package forwarder
+
+import (
+	"sync"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// Upload is a batch that was uploaded, retained for debugging.
+type Upload struct {
+	ID       int64
+	Time     time.Time
+	Error    string
+	Families []*clientmodel.MetricFamily
+}
+
+// uploadHistory is a fixed size ring buffer of the most recent uploads.
+type uploadHistory struct {
+	lock    sync.Mutex
+	uploads []Upload
+	next    int
+	nextID  int64
+}
+
+func newUploadHistory(size int) *uploadHistory {
+	return &uploadHistory{uploads: make([]Upload, 0, size)}
+}
+
+func (h *uploadHistory) Add(t time.Time, families []*clientmodel.MetricFamily, err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.nextID++
+	u := Upload{ID: h.nextID, Time: t, Families: families}
+	if err != nil {
+		u.Error = err.Error()
+	}
+	if len(h.uploads) < cap(h.uploads) {
+		h.uploads = append(h.uploads, u)
+		return
+	}
+	h.uploads[h.next] = u
+	h.next = (h.next + 1) % len(h.uploads)
+}
+
+// List returns the retained uploads from oldest to newest.
+func (h *uploadHistory) List() []Upload {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	uploads := make([]Upload, 0, len(h.uploads))
+	uploads = append(uploads, h.uploads[h.next:]...)
+	return append(uploads, h.uploads[:h.next]...)
+}
@@ -0,0 +1,25 @@
+package forwarder
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUploadHistory(t *testing.T) {
+	h := newUploadHistory(3)
+	if l := h.List(); len(l) != 0 {
+		t.Fatalf("expected empty history, got %v", l)
+	}
+	for i := 0; i < 5; i++ {
+		h.Add(time.Unix(int64(i), 0), nil, nil)
+	}
+	l := h.List()
+	if len(l) != 3 {
+		t.Fatalf("expected 3 uploads, got %d", len(l))
+	}
+	for i, u := range l {
+		if want := int64(i + 3); u.ID != want {
+			t.Errorf("%d: ID = %d, want %d", i, u.ID, want)
+		}
+	}
+}
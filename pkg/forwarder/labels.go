@@ -0,0 +1,77 @@
+package forwarder
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// maxMissingLabelErrors limits how many series are listed by checkRequiredLabels.
+const maxMissingLabelErrors = 5
+
+// checkRequiredLabels returns an error listing the series in families that do not
+// carry every label in required.
+func checkRequiredLabels(families []*clientmodel.MetricFamily, required map[string]string) error {
+	if len(required) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(required))
+	for name := range required {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var series []string
+	count := 0
+	for _, family := range families {
+		if family == nil {
+			continue
+		}
+		for _, m := range family.Metric {
+			if m == nil {
+				continue
+			}
+			missing := missingLabels(m.Label, names)
+			if len(missing) == 0 {
+				continue
+			}
+			count++
+			if len(series) < maxMissingLabelErrors {
+				series = append(series, fmt.Sprintf("%s%s is missing %s", family.GetName(), formatLabels(m.Label), strings.Join(missing, ", ")))
+			}
+		}
+	}
+	if count == 0 {
+		return nil
+	}
+	if count > len(series) {
+		series = append(series, fmt.Sprintf("and %d more", count-len(series)))
+	}
+	return fmt.Errorf("%d series are missing labels required by the server: %s", count, strings.Join(series, "; "))
+}
+
+func missingLabels(labels []*clientmodel.LabelPair, names []string) []string {
+	var missing []string
+Names:
+	for _, name := range names {
+		for _, label := range labels {
+			if label != nil && label.GetName() == name {
+				continue Names
+			}
+		}
+		missing = append(missing, name)
+	}
+	return missing
+}
+
+func formatLabels(labels []*clientmodel.LabelPair) string {
+	pairs := make([]string, 0, len(labels))
+	for _, label := range labels {
+		if label != nil {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", label.GetName(), label.GetValue()))
+		}
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,38 @@
+package forwarder
+
+import (
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func family(name string, labels ...[]string) *clientmodel.MetricFamily {
+	f := &clientmodel.MetricFamily{Name: &name}
+	for _, pairs := range labels {
+		m := &clientmodel.Metric{}
+		for i := 0; i < len(pairs); i += 2 {
+			k, v := pairs[i], pairs[i+1]
+			m.Label = append(m.Label, &clientmodel.LabelPair{Name: &k, Value: &v})
+		}
+		f.Metric = append(f.Metric, m)
+	}
+	return f
+}
+
+func TestCheckRequiredLabels(t *testing.T) {
+	required := map[string]string{"_id": "a", "cluster": "b"}
+	families := []*clientmodel.MetricFamily{
+		family("up", []string{"_id", "a", "cluster", "b", "job", "x"}),
+		nil,
+	}
+	if err := checkRequiredLabels(families, required); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	families = append(families, family("down", []string{"cluster", "b"}, []string{"job", "y"}))
+	err := checkRequiredLabels(families, required)
+	want := `2 series are missing labels required by the server: down{cluster="b"} is missing _id; down{job="y"} is missing _id, cluster`
+	if err == nil || err.Error() != want {
+		t.Fatalf("error = %v, want %s", err, want)
+	}
+}
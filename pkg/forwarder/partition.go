@@ -0,0 +1,168 @@
+package forwarder
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// partition is the part of a batch that is uploaded in a single request.
+type partition struct {
+	// value is the value of the partition label, empty for the default partition.
+	value    string
+	families []*clientmodel.MetricFamily
+	// hash is the content hash of families, if content hashes are sent.
+	hash string
+
+	// batchID identifies the batch a chunk belongs to and chunk numbers the chunks
+	// of a partition from 1 to chunks. They are unset unless batches are chunked.
+	batchID string
+	chunk   int
+	chunks  int
+}
+
+// key identifies the partition, and its chunk if it is one, across batches.
+func (p *partition) key() string {
+	if p.chunks == 0 {
+		return p.value
+	}
+	return fmt.Sprintf("%s/%d", p.value, p.chunk)
+}
+
+// partitionFamilies splits families by the value of label, sorted by value. Series
+// without the label are placed in the default partition. The families of each
+// partition are copies that share their metrics with the original families.
+func partitionFamilies(families []*clientmodel.MetricFamily, label string) []*partition {
+	byValue := make(map[string]*partition)
+	for _, family := range families {
+		if family == nil {
+			continue
+		}
+		split := make(map[string]*clientmodel.MetricFamily)
+		for _, m := range family.Metric {
+			if m == nil {
+				continue
+			}
+			value := labelValue(m, label)
+			f, ok := split[value]
+			if !ok {
+				f = &clientmodel.MetricFamily{Name: family.Name, Help: family.Help, Type: family.Type}
+				split[value] = f
+				p, ok := byValue[value]
+				if !ok {
+					p = &partition{value: value}
+					byValue[value] = p
+				}
+				p.families = append(p.families, f)
+			}
+			f.Metric = append(f.Metric, m)
+		}
+	}
+
+	partitions := make([]*partition, 0, len(byValue))
+	for _, p := range byValue {
+		partitions = append(partitions, p)
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i].value < partitions[j].value })
+	return partitions
+}
+
+// joinPartitions returns the families of partitions as a single batch. Families with
+// the same name are joined into copies that share their metrics with the partitions.
+func joinPartitions(partitions []*partition) []*clientmodel.MetricFamily {
+	var families []*clientmodel.MetricFamily
+	byName := make(map[string]*clientmodel.MetricFamily)
+	for _, p := range partitions {
+		for _, family := range p.families {
+			f, ok := byName[family.GetName()]
+			if !ok {
+				f = &clientmodel.MetricFamily{Name: family.Name, Help: family.Help, Type: family.Type}
+				byName[family.GetName()] = f
+				families = append(families, f)
+			}
+			f.Metric = append(f.Metric, family.Metric...)
+		}
+	}
+	return families
+}
+
+func labelValue(m *clientmodel.Metric, name string) string {
+	for _, label := range m.Label {
+		if label != nil && label.GetName() == name {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
+
+// chunkPartitions splits each partition into chunks whose delimited protobuf
+// encoding is at most about maxBytes, see chunkFamilies. Chunks of the same
+// partition share its value and are numbered from 1. All chunks share batchID.
+func chunkPartitions(partitions []*partition, maxBytes int, batchID string) []*partition {
+	var chunked []*partition
+	for _, p := range partitions {
+		chunks := chunkFamilies(p.families, maxBytes)
+		for i, families := range chunks {
+			chunked = append(chunked, &partition{
+				value:    p.value,
+				families: families,
+				batchID:  batchID,
+				chunk:    i + 1,
+				chunks:   len(chunks),
+			})
+		}
+	}
+	return chunked
+}
+
+// chunkFamilies splits families into chunks whose delimited protobuf encoding is at
+// most about maxBytes, so that each chunk can be uploaded on its own. Families are
+// split between their metrics if necessary. A metric that is larger than maxBytes
+// on its own is placed in a chunk by itself. The families of each chunk are copies
+// that share their metrics with the original families.
+func chunkFamilies(families []*clientmodel.MetricFamily, maxBytes int) [][]*clientmodel.MetricFamily {
+	var chunks [][]*clientmodel.MetricFamily
+	var chunk []*clientmodel.MetricFamily
+	size := 0
+	for _, family := range families {
+		if family == nil {
+			continue
+		}
+		var f *clientmodel.MetricFamily
+		header := delimitedSize(&clientmodel.MetricFamily{Name: family.Name, Help: family.Help, Type: family.Type})
+		for _, m := range family.Metric {
+			if m == nil {
+				continue
+			}
+			// the metric field tag, length, and message
+			metricSize := 1 + delimitedSize(m)
+			needed := metricSize
+			if f == nil {
+				needed += header
+			}
+			if size+needed > maxBytes && len(chunk) > 0 {
+				chunks = append(chunks, chunk)
+				chunk, f, size = nil, nil, 0
+				needed = header + metricSize
+			}
+			if f == nil {
+				f = &clientmodel.MetricFamily{Name: family.Name, Help: family.Help, Type: family.Type}
+				chunk = append(chunk, f)
+			}
+			f.Metric = append(f.Metric, m)
+			size += needed
+		}
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// delimitedSize returns the size of msg encoded with a length prefix.
+func delimitedSize(msg proto.Message) int {
+	size := proto.Size(msg)
+	return size + len(proto.EncodeVarint(uint64(size)))
+}
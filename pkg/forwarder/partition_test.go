@@ -0,0 +1,75 @@
+package forwarder
+
+import (
+	"reflect"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestPartitionFamilies(t *testing.T) {
+	families := []*clientmodel.MetricFamily{
+		family("a", []string{"tenant", "2"}, []string{"tenant", "1"}, []string{"job", "x"}),
+		nil,
+		family("b", []string{"tenant", "1", "job", "y"}),
+	}
+	partitions := partitionFamilies(families, "tenant")
+
+	got := make(map[string][]string)
+	var order []string
+	for _, p := range partitions {
+		order = append(order, p.value)
+		for _, f := range p.families {
+			for _, m := range f.Metric {
+				got[p.value] = append(got[p.value], f.GetName()+"/"+labelValue(m, "job"))
+			}
+		}
+	}
+	if want := []string{"", "1", "2"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("partitions = %v, want %v", order, want)
+	}
+	want := map[string][]string{
+		"":  {"a/x"},
+		"1": {"a/", "b/y"},
+		"2": {"a/"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("partitioned series = %v, want %v", got, want)
+	}
+	if len(families[0].Metric) != 3 {
+		t.Errorf("the original family was modified: %v", families[0])
+	}
+}
+
+func TestChunkFamilies(t *testing.T) {
+	families := []*clientmodel.MetricFamily{
+		family("a", []string{"job", "1"}, []string{"job", "2"}, []string{"job", "3"}),
+		nil,
+		family("b", []string{"job", "4"}),
+	}
+	maxBytes := delimitedSize(family("a", []string{"job", "1"}, []string{"job", "2"}))
+	chunks := chunkFamilies(families, maxBytes)
+
+	var got [][]string
+	for _, chunk := range chunks {
+		size := 0
+		var series []string
+		for _, f := range chunk {
+			size += delimitedSize(f)
+			for _, m := range f.Metric {
+				series = append(series, f.GetName()+"/"+labelValue(m, "job"))
+			}
+		}
+		if size > maxBytes {
+			t.Errorf("chunk %v is %d bytes, more than %d", series, size, maxBytes)
+		}
+		got = append(got, series)
+	}
+	want := [][]string{{"a/1", "a/2"}, {"a/3"}, {"b/4"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("chunks = %v, want %v", got, want)
+	}
+	if len(families[0].Metric) != 3 {
+		t.Errorf("the original family was modified: %v", families[0])
+	}
+}
@@ -0,0 +1,31 @@
+package forwarder
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket with a burst of one that refills a single
+// token every period. It is used to cap how often a worker may upload.
+type rateLimiter struct {
+	lock   sync.Mutex
+	period time.Duration
+	next   time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{
+		period: time.Minute / time.Duration(perMinute),
+	}
+}
+
+// Allow returns true and consumes the token if it is available at now.
+func (l *rateLimiter) Allow(now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if now.Before(l.next) {
+		return false
+	}
+	l.next = now.Add(l.period)
+	return true
+}
@@ -0,0 +1,29 @@
+package forwarder
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Unix(0, 0)
+	b := newRateLimiter(2)
+
+	steps := []struct {
+		offset time.Duration
+		want   bool
+	}{
+		{offset: 0, want: true},
+		{offset: 10 * time.Second, want: false},
+		{offset: 29 * time.Second, want: false},
+		{offset: 30 * time.Second, want: true},
+		{offset: 31 * time.Second, want: false},
+		{offset: 10 * time.Minute, want: true},
+		{offset: 10*time.Minute + time.Second, want: false},
+	}
+	for _, step := range steps {
+		if got := b.Allow(start.Add(step.offset)); got != step.want {
+			t.Errorf("Allow() at %s = %t, want %t", step.offset, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// sequence numbers the uploads to each destination. The number of a destination is
+// incremented after each successful upload, so a retried upload is sent with the
+// same number and the server can detect missing uploads by gaps. If path is set the
+// next numbers are stored in it, keyed by destination URL, and survive restarts.
+type sequence struct {
+	path  string
+	start uint64
+
+	lock sync.Mutex
+	next map[string]uint64
+}
+
+// newSequence reads the next numbers from path if it exists. Destinations without a
+// stored number start at start. If path can't be read or parsed, the error is
+// returned together with a sequence that starts every destination at start and
+// replaces the file after the first successful upload.
+func newSequence(path string, start uint64) (*sequence, error) {
+	s := &sequence{path: path, start: start, next: make(map[string]uint64)}
+	if len(path) == 0 {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(data, &s.next); err != nil {
+		s.next = make(map[string]uint64)
+		return s, err
+	}
+	return s, nil
+}
+
+// Next returns the number of the next upload to destination.
+func (s *sequence) Next(destination string) uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if n, ok := s.next[destination]; ok {
+		return n
+	}
+	return s.start
+}
+
+// Done advances the number of destination after the upload numbered n succeeded and
+// stores the next numbers.
+func (s *sequence) Done(destination string, n uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.next[destination] = n + 1
+	if len(s.path) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(s.next)
+	if err != nil {
+		return err
+	}
+	// written under a temporary name so a partial file is never read
+	if err := ioutil.WriteFile(s.path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(s.path+".tmp", s.path)
+}
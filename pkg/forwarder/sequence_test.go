@@ -0,0 +1,53 @@
+package forwarder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSequencePersistsAcrossRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sequence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sequence.json")
+
+	s, err := newSequence(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Next("a"); n != 100 {
+		t.Fatalf("Next() = %d, want the start 100", n)
+	}
+	if err := s.Done("a", 100); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Next("a"); n != 101 {
+		t.Fatalf("Next() after Done() = %d, want 101", n)
+	}
+
+	s, err = newSequence(path, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Next("a"); n != 101 {
+		t.Errorf("Next() after a restart = %d, want 101", n)
+	}
+	if n := s.Next("b"); n != 5 {
+		t.Errorf("Next() for a new destination = %d, want the start 5", n)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err = newSequence(path, 7)
+	if err == nil {
+		t.Errorf("newSequence() accepted an invalid state file")
+	}
+	if n := s.Next("a"); n != 7 {
+		t.Errorf("Next() with an invalid state file = %d, want the start 7", n)
+	}
+}
@@ -0,0 +1,120 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/metricsclient"
+)
+
+// Sink receives transformed batches in place of an upload over HTTP, see
+// Destination.Sink. Send must not modify families, which may be shared with other
+// destinations.
+type Sink interface {
+	Send(ctx context.Context, families []*clientmodel.MetricFamily) error
+}
+
+// SinkFunc adapts a function to a Sink.
+type SinkFunc func(ctx context.Context, families []*clientmodel.MetricFamily) error
+
+func (fn SinkFunc) Send(ctx context.Context, families []*clientmodel.MetricFamily) error {
+	return fn(ctx, families)
+}
+
+type httpSink struct {
+	client *metricsclient.Client
+	url    *url.URL
+}
+
+// NewHTTPSink uploads batches to u with client, as destinations without a sink do.
+func NewHTTPSink(client *metricsclient.Client, u *url.URL) Sink {
+	return &httpSink{client: client, url: u}
+}
+
+func (s *httpSink) Send(ctx context.Context, families []*clientmodel.MetricFamily) error {
+	_, err := s.upload(ctx, make(http.Header), families, "")
+	return err
+}
+
+// uploader is implemented by sinks that upload over HTTP. The worker uses it to send
+// the headers that identify each upload, content hashes, and undecoded batches.
+type uploader interface {
+	Sink
+	upload(ctx context.Context, header http.Header, families []*clientmodel.MetricFamily, hash string) (accepted bool, err error)
+	uploadRaw(ctx context.Context, header http.Header, data []byte) error
+}
+
+// upload sends families with header. If hash is set it is sent in the content hash
+// header and accepted is true if the server acknowledged it.
+func (s *httpSink) upload(ctx context.Context, header http.Header, families []*clientmodel.MetricFamily, hash string) (bool, error) {
+	req := &http.Request{Method: "POST", URL: s.url, Header: header}
+	if len(hash) == 0 {
+		return false, s.client.Send(ctx, req, families)
+	}
+	return s.client.SendHashed(ctx, req, families, hash)
+}
+
+func (s *httpSink) uploadRaw(ctx context.Context, header http.Header, data []byte) error {
+	return s.client.SendRaw(ctx, &http.Request{Method: "POST", URL: s.url, Header: header}, data)
+}
+
+// batchSink is implemented by sinks that need to know when the worker starts sending
+// a new batch rather than retrying the previous one, see FanOut.
+type batchSink interface {
+	newBatch()
+}
+
+type fanOut struct {
+	lock  sync.Mutex
+	sinks []Sink
+	// sent is true for the sinks that received the current batch
+	sent []bool
+}
+
+// FanOut sends each batch to every sink in turn. It returns an error listing the
+// sinks that failed, after sending to all of them. Until every sink has received a
+// batch, further calls to Send only go to the sinks that failed, so that the retries
+// of the worker do not send duplicates to the others. The next batch of the worker,
+// or any batch once every sink received the previous one, goes to all of them.
+func FanOut(sinks ...Sink) Sink {
+	return &fanOut{sinks: sinks, sent: make([]bool, len(sinks))}
+}
+
+func (f *fanOut) Send(ctx context.Context, families []*clientmodel.MetricFamily) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var failed []string
+	for i, s := range f.sinks {
+		if f.sent[i] {
+			continue
+		}
+		if err := s.Send(ctx, families); err != nil {
+			failed = append(failed, fmt.Sprintf("sink %d: %v", i, err))
+			continue
+		}
+		f.sent[i] = true
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to send to %d of %d sinks: %s", len(failed), len(f.sinks), strings.Join(failed, "; "))
+	}
+	f.reset()
+	return nil
+}
+
+func (f *fanOut) newBatch() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.reset()
+}
+
+func (f *fanOut) reset() {
+	for i := range f.sent {
+		f.sent[i] = false
+	}
+}
@@ -0,0 +1,192 @@
+package forwarder
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/metricsclient"
+)
+
+// spoolSuffix is the extension of spooled batches, which are stored in the upload
+// format and named after the time they were spooled in nanoseconds.
+const spoolSuffix = ".batch"
+
+// spool stores batches that could not be uploaded in a directory so they can be
+// uploaded later, oldest first. The total size of the directory is limited to
+// maxBytes and batches older than maxAge are discarded.
+type spool struct {
+	lock     sync.Mutex
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+}
+
+func newSpool(dir string, maxBytes int64, maxAge time.Duration) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &spool{dir: dir, maxBytes: maxBytes, maxAge: maxAge}, nil
+}
+
+// Add stores families and discards the oldest batches until the spool fits its
+// limits.
+func (s *spool) Add(now time.Time, families []*clientmodel.MetricFamily) error {
+	buf := &bytes.Buffer{}
+	if err := metricsclient.Write(buf, families); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d%s", now.UnixNano(), spoolSuffix))
+	// written under a temporary name so a partial batch is never replayed
+	if err := ioutil.WriteFile(name+".tmp", buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	return s.trim(now)
+}
+
+// trim removes expired batches and then the oldest batches until the spool is no
+// larger than maxBytes. The lock must be held.
+func (s *spool) trim(now time.Time) error {
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, f := range files {
+		size += f.Size()
+	}
+	for _, f := range files {
+		if size <= s.maxBytes && !s.expired(now, f.Name()) {
+			break
+		}
+		if err := os.Remove(filepath.Join(s.dir, f.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		size -= f.Size()
+	}
+	return nil
+}
+
+// files returns the spooled batches, oldest first.
+func (s *spool) files() ([]os.FileInfo, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := infos[:0]
+	for _, info := range infos {
+		if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), spoolSuffix) {
+			files = append(files, info)
+		}
+	}
+	return files, nil
+}
+
+func (s *spool) expired(now time.Time, name string) bool {
+	ns, err := strconv.ParseInt(strings.TrimSuffix(name, spoolSuffix), 10, 64)
+	if err != nil {
+		return true
+	}
+	return now.Sub(time.Unix(0, ns)) > s.maxAge
+}
+
+// Replay passes the spooled batches to send oldest first and removes each batch that
+// was sent. send returns the families it could not send, which replace the batch
+// before Replay stops at the first error. It returns the number of batches sent.
+// Expired and unreadable batches are discarded.
+func (s *spool) Replay(now time.Time, send func([]*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error)) (int, error) {
+	s.lock.Lock()
+	err := s.trim(now)
+	var files []os.FileInfo
+	if err == nil {
+		files, err = s.files()
+	}
+	s.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, f := range files {
+		path := filepath.Join(s.dir, f.Name())
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			// removed by Add to make room
+			continue
+		}
+		var families []*clientmodel.MetricFamily
+		if err == nil {
+			families, err = metricsclient.Read(bytes.NewReader(data))
+		}
+		if err != nil {
+			log.Printf("warning: discarding unreadable spooled batch %s: %v", path, err)
+			os.Remove(path)
+			continue
+		}
+		if unsent, err := send(families); err != nil {
+			if len(unsent) > 0 {
+				if err := s.replace(path, unsent); err != nil {
+					log.Printf("warning: unable to remove the uploaded parts of spooled batch %s: %v", path, err)
+				}
+			}
+			return sent, err
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// replace stores families in place of the spooled batch at path, unless the batch
+// was removed in the meantime.
+func (s *spool) replace(path string, families []*clientmodel.MetricFamily) error {
+	buf := &bytes.Buffer{}
+	if err := metricsclient.Write(buf, families); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Size returns the total size of the spooled batches.
+func (s *spool) Size() (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	files, err := s.files()
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, f := range files {
+		size += f.Size()
+	}
+	return size, nil
+}
@@ -0,0 +1,128 @@
+package forwarder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestSpoolReplaysOldestFirst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newSpool(dir, 1024*1024, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1000, 0)
+	for i, name := range []string{"a", "b", "c"} {
+		if err := s.Add(start.Add(time.Duration(i)*time.Second), []*clientmodel.MetricFamily{family(name, []string{"k", "v"})}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var sent []string
+	fail := "b"
+	send := func(families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+		if families[0].GetName() == fail {
+			return families, fmt.Errorf("unavailable")
+		}
+		sent = append(sent, families[0].GetName())
+		return nil, nil
+	}
+	if n, err := s.Replay(start, send); err == nil || n != 1 {
+		t.Fatalf("Replay() = %d, %v, want 1 and an error", n, err)
+	}
+	fail = ""
+	if n, err := s.Replay(start, send); err != nil || n != 2 {
+		t.Fatalf("Replay() = %d, %v, want 2", n, err)
+	}
+	if fmt.Sprint(sent) != "[a b c]" {
+		t.Errorf("sent %v, want [a b c]", sent)
+	}
+	if size, _ := s.Size(); size != 0 {
+		t.Errorf("spool size after replay = %d, want 0", size)
+	}
+}
+
+func TestSpoolReplayKeepsUnsentFamilies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newSpool(dir, 1024*1024, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1000, 0)
+	if err := s.Add(start, []*clientmodel.MetricFamily{family("a", []string{"k", "v"}), family("b", []string{"k", "v"})}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a is uploaded and b fails
+	if n, err := s.Replay(start, func(families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+		return families[1:], fmt.Errorf("unavailable")
+	}); err == nil || n != 0 {
+		t.Fatalf("Replay() = %d, %v, want 0 and an error", n, err)
+	}
+	var replayed []string
+	if n, err := s.Replay(start, func(families []*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) {
+		for _, f := range families {
+			replayed = append(replayed, f.GetName())
+		}
+		return nil, nil
+	}); err != nil || n != 1 {
+		t.Fatalf("Replay() = %d, %v, want 1", n, err)
+	}
+	if fmt.Sprint(replayed) != "[b]" {
+		t.Errorf("replayed %v, want only the family that failed [b]", replayed)
+	}
+}
+
+func TestSpoolLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	batch := []*clientmodel.MetricFamily{family("a", []string{"k", "v"})}
+	probe, err := newSpool(dir, 1024*1024, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1000, 0)
+	if err := probe.Add(start, batch); err != nil {
+		t.Fatal(err)
+	}
+	size, _ := probe.Size()
+
+	// room for two batches
+	s := &spool{dir: dir, maxBytes: 2 * size, maxAge: time.Minute}
+	for i := 1; i < 3; i++ {
+		if err := s.Add(start.Add(time.Duration(i)*time.Second), batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, _ := s.files()
+	if len(files) != 2 || files[0].Name() != fmt.Sprintf("%020d%s", start.Add(time.Second).UnixNano(), spoolSuffix) {
+		t.Fatalf("unexpected spooled batches: %d", len(files))
+	}
+
+	n, err := s.Replay(start.Add(2*time.Minute), func([]*clientmodel.MetricFamily) ([]*clientmodel.MetricFamily, error) { return nil, nil })
+	if err != nil || n != 0 {
+		t.Fatalf("Replay() of expired batches = %d, %v, want 0", n, err)
+	}
+	if files, _ := s.files(); len(files) != 0 {
+		t.Errorf("expired batches were not removed: %d", len(files))
+	}
+}
@@ -0,0 +1,19 @@
+package http
+
+// BatchIDHeader identifies the batch an upload belongs to when a batch is split into
+// several uploads to stay below a size limit. Each upload is a complete payload that
+// can be stored on its own.
+const BatchIDHeader = "X-Telemeter-Batch-Id"
+
+// BatchChunkHeader numbers an upload among the uploads of its batch partition, in
+// the form "<chunk>/<chunks>" starting from 1.
+const BatchChunkHeader = "X-Telemeter-Batch-Chunk"
+
+// SequenceHeader numbers the uploads of a client to a server. The number increases by
+// one after each successful upload, so a retried upload has the same number as the
+// failed one and a gap means that uploads were lost. A jump may also mean that the
+// client restarted without keeping its numbers.
+const SequenceHeader = "X-Telemeter-Sequence"
+
+// ClientIDHeader carries the identifier a client was configured with.
+const ClientIDHeader = "X-Telemeter-Client-Id"
@@ -0,0 +1,72 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"time"
+)
+
+// maxCaptureSeconds limits the duration of a CPU profile captured by
+// /debug/pprof/capture.
+const maxCaptureSeconds = 300
+
+// captureProfile records a cpu, heap, or goroutine profile, selected with the type
+// parameter, and returns it as an attachment. CPU profiles run for the number of
+// seconds in the seconds parameter, 30 by default, and only one CPU profile may run
+// at a time.
+func captureProfile(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	profile := req.URL.Query().Get("type")
+	if len(profile) == 0 {
+		profile = "cpu"
+	}
+	seconds := 30
+	if s := req.URL.Query().Get("seconds"); len(s) > 0 {
+		var err error
+		seconds, err = strconv.Atoi(s)
+		if err != nil || seconds < 1 || seconds > maxCaptureSeconds {
+			http.Error(w, fmt.Sprintf("seconds must be a number between 1 and %d", maxCaptureSeconds), http.StatusBadRequest)
+			return
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	switch profile {
+	case "cpu":
+		if err := pprof.StartCPUProfile(buf); err != nil {
+			http.Error(w, fmt.Sprintf("unable to start a CPU profile: %v", err), http.StatusConflict)
+			return
+		}
+		select {
+		case <-time.After(time.Duration(seconds) * time.Second):
+		case <-req.Context().Done():
+		}
+		pprof.StopCPUProfile()
+		if req.Context().Err() != nil {
+			return
+		}
+	case "heap", "goroutine":
+		if profile == "heap" {
+			// report the heap as of the last collection
+			runtime.GC()
+		}
+		if err := pprof.Lookup(profile).WriteTo(buf, 0); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "type must be one of cpu, heap, or goroutine", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%d.pprof"`, profile, time.Now().Unix()))
+	w.Write(buf.Bytes())
+}
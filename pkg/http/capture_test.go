@@ -0,0 +1,49 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime/pprof"
+	"strings"
+	"testing"
+)
+
+func TestCaptureProfile(t *testing.T) {
+	tests := []struct {
+		query    string
+		wantCode int
+	}{
+		{query: "type=heap", wantCode: http.StatusOK},
+		{query: "type=goroutine", wantCode: http.StatusOK},
+		{query: "type=cpu&seconds=1", wantCode: http.StatusOK},
+		{query: "type=block", wantCode: http.StatusBadRequest},
+		{query: "type=cpu&seconds=0", wantCode: http.StatusBadRequest},
+		{query: "type=cpu&seconds=a", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			captureProfile(w, httptest.NewRequest("GET", "/debug/pprof/capture?"+tt.query, nil))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if tt.wantCode == http.StatusOK {
+				if !strings.HasPrefix(w.Header().Get("Content-Disposition"), "attachment;") || w.Body.Len() == 0 {
+					t.Errorf("expected a profile attachment, got %v with %d bytes", w.Header(), w.Body.Len())
+				}
+			}
+		})
+	}
+}
+
+func TestCaptureProfileConflict(t *testing.T) {
+	if err := pprof.StartCPUProfile(&strings.Builder{}); err != nil {
+		t.Fatal(err)
+	}
+	defer pprof.StopCPUProfile()
+	w := httptest.NewRecorder()
+	captureProfile(w, httptest.NewRequest("GET", "/debug/pprof/capture?seconds=1", nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusConflict)
+	}
+}
@@ -0,0 +1,6 @@
+package http
+
+// ContentHashHeader carries a checksum of an uploaded batch. A server that stored
+// the batch echoes the header in its response, so that a client can skip uploading
+// the same batch again.
+const ContentHashHeader = "X-Telemeter-Content-Hash"
@@ -0,0 +1,30 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AcceptsGzip returns true if the Accept-Encoding header lists gzip without
+// a zero quality value.
+func AcceptsGzip(header http.Header) bool {
+	for _, value := range header["Accept-Encoding"] {
+		for _, coding := range strings.Split(value, ",") {
+			parts := strings.Split(coding, ";")
+			if !strings.EqualFold(strings.TrimSpace(parts[0]), "gzip") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+						return false
+					}
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -1,11 +1,15 @@
 package http
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/pprof"
+	"strings"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/lex/httplex"
 )
 
 // AddDebug adds the debug handlers to a mux.
@@ -15,16 +19,51 @@ func AddDebug(mux *http.ServeMux) *http.ServeMux {
 	mux.Handle("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
 	mux.Handle("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
 	mux.Handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
+	mux.Handle("/debug/pprof/capture", http.HandlerFunc(captureProfile))
 	return mux
 }
 
-// AddHealth adds the health checks to a mux.
+// AddHealth adds the liveness checks to a mux. They succeed as long as the process
+// serves requests. /healthz/ready is kept for existing deployments and does not
+// reflect readiness, see AddReady.
 func AddHealth(mux *http.ServeMux) *http.ServeMux {
 	mux.Handle("/healthz", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { fmt.Fprintln(w, "ok") }))
 	mux.Handle("/healthz/ready", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { fmt.Fprintln(w, "ok") }))
 	return mux
 }
 
+// AddReady adds a readiness check at /readyz to a mux. It responds with 503 Service
+// Unavailable and the error returned by ready until ready returns nil.
+func AddReady(mux *http.ServeMux, ready func() error) *http.ServeMux {
+	mux.Handle("/readyz", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}))
+	return mux
+}
+
+// AddConfig serves the JSON encoding of the value returned by config at /config.
+// The value is encoded on every request and must not contain secrets.
+func AddConfig(mux *http.ServeMux, config func() interface{}) *http.ServeMux {
+	mux.Handle("/config", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := json.MarshalIndent(config(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}))
+	return mux
+}
+
 // AddMetrics adds the metrics endpoint to a mux.
 func AddMetrics(mux *http.ServeMux) *http.ServeMux {
 	mux.Handle("/metrics", prometheus.UninstrumentedHandler())
@@ -44,3 +83,93 @@ func (rt *bearerRoundTripper) RoundTrip(req *http.Request) (*http.Response, erro
 	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", rt.token))
 	return rt.wrapper.RoundTrip(req)
 }
+
+type basicAuthRoundTripper struct {
+	username string
+	password string
+	wrapper  http.RoundTripper
+}
+
+// NewBasicAuthRoundTripper sends the basic credentials with every request. They are
+// sent in the Authorization header unless the request already has one, such as a
+// bearer token added by an outer round tripper, which takes precedence. A request
+// can carry only one Authorization header, so the credentials are then sent in the
+// Proxy-Authorization header instead, for a gateway in front of the server. The
+// request passed in is not modified.
+func NewBasicAuthRoundTripper(username, password string, rt http.RoundTripper) http.RoundTripper {
+	return &basicAuthRoundTripper{username: username, password: password, wrapper: rt}
+}
+
+func (rt *basicAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	credentials := base64.StdEncoding.EncodeToString([]byte(rt.username + ":" + rt.password))
+	header := "Authorization"
+	if len(req.Header.Get("Authorization")) > 0 {
+		header = "Proxy-Authorization"
+	}
+	req = cloneRequest(req)
+	req.Header.Set(header, "Basic "+credentials)
+	return rt.wrapper.RoundTrip(req)
+}
+
+// cloneRequest returns a shallow copy of req with a copy of its headers, as round
+// trippers must not modify the request they are given.
+func cloneRequest(req *http.Request) *http.Request {
+	clone := new(http.Request)
+	*clone = *req
+	clone.Header = make(http.Header, len(req.Header))
+	for name, values := range req.Header {
+		clone.Header[name] = append([]string(nil), values...)
+	}
+	return clone
+}
+
+type userAgentRoundTripper struct {
+	userAgent string
+	wrapper   http.RoundTripper
+}
+
+// NewUserAgentRoundTripper sets the User-Agent header of every request to userAgent.
+func NewUserAgentRoundTripper(userAgent string, rt http.RoundTripper) http.RoundTripper {
+	return &userAgentRoundTripper{userAgent: userAgent, wrapper: rt}
+}
+
+func (rt *userAgentRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Header.Set("User-Agent", rt.userAgent)
+	return rt.wrapper.RoundTrip(req)
+}
+
+// ParseHeader parses a header in Name:Value form. Spaces around the value are
+// removed.
+func ParseHeader(s string) (name, value string, err error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("must be of the form Name:Value: %s", s)
+	}
+	name, value = parts[0], strings.TrimSpace(parts[1])
+	if !httplex.ValidHeaderFieldName(name) {
+		return "", "", fmt.Errorf("is not a valid header name: %s", s)
+	}
+	if !httplex.ValidHeaderFieldValue(value) {
+		return "", "", fmt.Errorf("is not a valid header value: %s", s)
+	}
+	return http.CanonicalHeaderKey(name), value, nil
+}
+
+type headerRoundTripper struct {
+	header  http.Header
+	wrapper http.RoundTripper
+}
+
+// NewHeaderRoundTripper sets the headers in header on every request, replacing the
+// values of headers with the same name.
+func NewHeaderRoundTripper(header http.Header, rt http.RoundTripper) http.RoundTripper {
+	return &headerRoundTripper{header: header, wrapper: rt}
+}
+
+func (rt *headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = cloneRequest(req)
+	for name, values := range rt.header {
+		req.Header[name] = append([]string(nil), values...)
+	}
+	return rt.wrapper.RoundTrip(req)
+}
@@ -0,0 +1,113 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseHeader(t *testing.T) {
+	tests := []struct {
+		s           string
+		name, value string
+		err         bool
+	}{
+		{s: "X-Tenant:a", name: "X-Tenant", value: "a"},
+		{s: "x-env: prod ", name: "X-Env", value: "prod"},
+		{s: "X-Url:http://b:80", name: "X-Url", value: "http://b:80"},
+		{s: "X-Empty:", name: "X-Empty"},
+		{s: "X-Tenant", err: true},
+		{s: ":a", err: true},
+		{s: "X Tenant:a", err: true},
+		{s: "X-Tenant:a\nb", err: true},
+	}
+	for _, tt := range tests {
+		name, value, err := ParseHeader(tt.s)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseHeader(%q) error = %v", tt.s, err)
+			continue
+		}
+		if name != tt.name || value != tt.value {
+			t.Errorf("ParseHeader(%q) = %q, %q, want %q, %q", tt.s, name, value, tt.name, tt.value)
+		}
+	}
+}
+
+func TestHeaderRoundTripper(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if got := req.Header["X-Tenant"]; len(got) != 1 || got[0] != "a" {
+			t.Errorf("X-Tenant = %v", got)
+		}
+		if got := req.Header.Get("X-Env"); got != "prod" {
+			t.Errorf("X-Env = %q", got)
+		}
+	}))
+	defer server.Close()
+
+	header := http.Header{}
+	header.Set("X-Tenant", "a")
+	header.Set("X-Env", "prod")
+	client := &http.Client{Transport: NewHeaderRoundTripper(header, http.DefaultTransport)}
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Tenant", "replaced")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := req.Header.Get("X-Tenant"); got != "replaced" || len(req.Header) != 1 {
+		t.Errorf("request headers were modified: %v", req.Header)
+	}
+}
+
+// roundTripperFunc adapts a function to http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return fn(req) }
+
+func TestBasicAuthRoundTripper(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		want          http.Header
+	}{
+		{
+			name: "no authorization",
+			want: http.Header{"Authorization": {"Basic dXNlcjpwYXNz"}},
+		},
+		{
+			name:          "bearer token takes precedence",
+			authorization: "Bearer token",
+			want:          http.Header{"Authorization": {"Bearer token"}, "Proxy-Authorization": {"Basic dXNlcjpwYXNz"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent http.Header
+			rt := NewBasicAuthRoundTripper("user", "pass", roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				sent = req.Header
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+			}))
+			req, err := http.NewRequest("GET", "http://example.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.authorization) > 0 {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			if _, err := rt.RoundTrip(req); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(sent, tt.want) {
+				t.Errorf("sent headers %v, want %v", sent, tt.want)
+			}
+			if len(req.Header) > 1 || req.Header.Get("Authorization") != tt.authorization {
+				t.Errorf("request headers were modified: %v", req.Header)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// RequestIDHeader is the header used to correlate the requests a client makes
+// for a single upload attempt.
+const RequestIDHeader = "X-Telemeter-Request-Id"
+
+type requestIDKey struct{}
+
+// NewRequestID returns a random identifier suitable for RequestIDHeader.
+func NewRequestID() string {
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(data)
+}
+
+// WithRequestID returns a context carrying the provided request ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID on the context or an empty string.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
@@ -12,6 +12,7 @@ import (
 	clientmodel "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 
+	telemeterhttp "github.com/openshift/telemeter/pkg/http"
 	"github.com/openshift/telemeter/pkg/transform"
 )
 
@@ -142,8 +143,17 @@ func (s *Server) Post(w http.ResponseWriter, req *http.Request) {
 		log.Printf("timeout processing incoming request")
 		return
 	case err := <-errCh:
+		if _, ok := err.(*transform.RequiredLabelError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// acknowledge the content hash so the client can skip identical batches
+		if hash := req.Header.Get(telemeterhttp.ContentHashHeader); len(hash) > 0 {
+			w.Header().Set(telemeterhttp.ContentHashHeader, hash)
 		}
 		return
 	}
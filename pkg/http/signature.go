@@ -0,0 +1,60 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureHeader carries an HMAC-SHA256 signature of an uploaded body made with a
+// key shared by the client and the server, in the form "t=<unix seconds>,v1=<hex>".
+// The timestamp is signed along with the body, so that a server can reject replayed
+// uploads once they are older than the skew it accepts.
+const SignatureHeader = "X-Telemeter-Signature"
+
+// Signature returns the value of SignatureHeader for body signed with key at t.
+func Signature(key []byte, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", timestamp, hex.EncodeToString(signature(key, timestamp, body)))
+}
+
+// VerifySignature returns an error unless header is a signature of body made with
+// key at most maxSkew before or after now.
+func VerifySignature(key []byte, header string, body []byte, now time.Time, maxSkew time.Duration) error {
+	var timestamp, value string
+	for _, part := range strings.Split(header, ",") {
+		switch {
+		case strings.HasPrefix(part, "t="):
+			timestamp = part[len("t="):]
+		case strings.HasPrefix(part, "v1="):
+			value = part[len("v1="):]
+		}
+	}
+	if len(timestamp) == 0 || len(value) == 0 {
+		return fmt.Errorf("signature must be of the form t=<timestamp>,v1=<signature>")
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("signature timestamp is not a number: %s", timestamp)
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > maxSkew || skew < -maxSkew {
+		return fmt.Errorf("signature timestamp is %s away from the current time", skew)
+	}
+	expected, err := hex.DecodeString(value)
+	if err != nil || !hmac.Equal(expected, signature(key, timestamp, body)) {
+		return fmt.Errorf("signature does not match the body")
+	}
+	return nil
+}
+
+func signature(key []byte, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,118 @@
+package http
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CertificateReloader serves a certificate and key from disk, reloading them when
+// either file changes.
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+
+	lock     sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+// NewCertificateReloader loads the certificate and key pair, returning an error if
+// they cannot be loaded.
+func NewCertificateReloader(certFile, keyFile string) (*CertificateReloader, error) {
+	r := &CertificateReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. If the files have changed but
+// cannot be loaded the previous certificate is returned.
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.load()
+}
+
+func (r *CertificateReloader) load() (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	modified, err := latestModTime(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	if r.cert != nil && !modified.After(r.modified) {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			log.Printf("error: unable to reload certificate, continuing to use the previous one: %v", err)
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	if r.cert != nil {
+		log.Printf("Reloaded certificate from %s", r.certFile)
+	}
+	r.cert = &cert
+	r.modified = modified
+	return r.cert, nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// ParseCertificatePin parses a certificate fingerprint in sha256:<hex> form. The
+// hex digits may be separated by colons, as printed by openssl.
+func ParseCertificatePin(pin string) ([]byte, error) {
+	if !strings.HasPrefix(pin, "sha256:") {
+		return nil, fmt.Errorf("must be of the form sha256:<hex>: %s", pin)
+	}
+	fingerprint, err := hex.DecodeString(strings.Replace(strings.TrimPrefix(pin, "sha256:"), ":", "", -1))
+	if err != nil || len(fingerprint) != sha256.Size {
+		return nil, fmt.Errorf("must have a SHA-256 fingerprint of %d hex encoded bytes: %s", sha256.Size, pin)
+	}
+	return fingerprint, nil
+}
+
+// PinCertificates configures config to accept only servers whose leaf certificate
+// has one of the SHA-256 fingerprints in pins. The pins replace verifying the
+// certificate chain and host name, so no certificate authority is trusted.
+func PinCertificates(config *tls.Config, pins [][]byte) {
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("the server presented no certificate")
+		}
+		fingerprint := sha256.Sum256(rawCerts[0])
+		for _, pin := range pins {
+			if bytes.Equal(pin, fingerprint[:]) {
+				return nil
+			}
+		}
+		return fmt.Errorf("the server certificate with fingerprint sha256:%s matches no pin", hex.EncodeToString(fingerprint[:]))
+	}
+}
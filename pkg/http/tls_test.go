@@ -0,0 +1,53 @@
+package http
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPinCertificates(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+	fingerprint := sha256.Sum256(server.TLS.Certificates[0].Certificate[0])
+
+	pin, err := ParseCertificatePin("sha256:" + hex.EncodeToString(fingerprint[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ParseCertificatePin("sha256:" + hex.EncodeToString(make([]byte, sha256.Size)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, invalid := range []string{"", "sha1:00", "sha256:zz", "sha256:0011"} {
+		if _, err := ParseCertificatePin(invalid); err == nil {
+			t.Errorf("ParseCertificatePin(%q) accepted an invalid pin", invalid)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		pins    [][]byte
+		wantErr bool
+	}{
+		{name: "matching", pins: [][]byte{other, pin}},
+		{name: "not matching", pins: [][]byte{other}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &tls.Config{}
+			PinCertificates(config, tt.pins)
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+			resp, err := client.Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Get() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
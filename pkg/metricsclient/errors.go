@@ -0,0 +1,105 @@
+package metricsclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/openshift/telemeter/pkg/reader"
+)
+
+// StatusError is returned when a server responds with an unexpected status code.
+type StatusError struct {
+	Code int
+	// RetryAfter is the delay the server asked for with a Retry-After header on a
+	// 429 or 503 response, zero if it did not.
+	RetryAfter time.Duration
+	msg        string
+}
+
+func newStatusError(code int, format string, args ...interface{}) error {
+	return &StatusError{Code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *StatusError) Error() string {
+	return e.msg
+}
+
+// RetryAfter returns the delay a server asked for before the next request if err is
+// a StatusError, and zero otherwise.
+func RetryAfter(err error) time.Duration {
+	if e, ok := err.(*StatusError); ok {
+		return e.RetryAfter
+	}
+	return 0
+}
+
+// parseRetryAfter parses the value of a Retry-After header, either a number of
+// seconds or an HTTP date, into a delay from now. Invalid values and dates in the
+// past yield zero.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds <= 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	date, err := http.ParseTime(value)
+	if err != nil || !date.After(now) {
+		return 0
+	}
+	return date.Sub(now)
+}
+
+// LimitExceededError is returned when a response is larger than the limit of the
+// client. It unwraps to reader.ErrTooLong.
+type LimitExceededError struct {
+	Limit int64
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("%v: the limit is %d bytes", reader.ErrTooLong, e.Limit)
+}
+
+func (e *LimitExceededError) Unwrap() error {
+	return reader.ErrTooLong
+}
+
+// TransportError is returned when a request could not be completed, because the
+// server could not be reached, the connection failed, or the request timed out.
+type TransportError struct {
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout returns true if the request timed out.
+func (e *TransportError) Timeout() bool {
+	if e.Err == context.DeadlineExceeded {
+		return true
+	}
+	err, ok := e.Err.(net.Error)
+	return ok && err.Timeout()
+}
+
+// limitError replaces reader.ErrTooLong with a LimitExceededError for the limit of c.
+func (c *Client) limitError(err error) error {
+	if err == reader.ErrTooLong {
+		return &LimitExceededError{Limit: c.maxBytes}
+	}
+	return err
+}
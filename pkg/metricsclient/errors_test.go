@@ -0,0 +1,81 @@
+package metricsclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSendStatusError(t *testing.T) {
+	for _, code := range []int{http.StatusUnauthorized, http.StatusRequestEntityTooLarge, http.StatusTooManyRequests, http.StatusInternalServerError} {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(code)
+		}))
+		c := New(&http.Client{Transport: DefaultTransport()}, 1024, time.Second, "test")
+		req, _ := http.NewRequest("POST", s.URL, nil)
+		err := c.Send(context.Background(), req, nil)
+		s.Close()
+		if err, ok := err.(*StatusError); !ok || err.Code != code {
+			t.Errorf("expected a StatusError with code %d, got %#v", code, err)
+		}
+	}
+}
+
+func TestSendRetryAfter(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer s.Close()
+	c := New(&http.Client{Transport: DefaultTransport()}, 1024, time.Second, "test")
+	req, _ := http.NewRequest("POST", s.URL, nil)
+	if delay := RetryAfter(c.Send(context.Background(), req, nil)); delay != 2*time.Minute {
+		t.Errorf("RetryAfter() = %s, want 2m", delay)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "30", want: 30 * time.Second},
+		{value: now.Add(time.Minute).Format(http.TimeFormat), want: time.Minute},
+		{value: now.Add(-time.Minute).Format(http.TimeFormat)},
+		{value: "-5"},
+		{value: "soon"},
+		{value: ""},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRetrieveTransportError(t *testing.T) {
+	s := httptest.NewServer(http.NotFoundHandler())
+	s.Close()
+	c := New(&http.Client{Transport: DefaultTransport()}, 1024, time.Second, "test")
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	_, err := c.Retrieve(context.Background(), req)
+	if err, ok := err.(*TransportError); !ok || err.Timeout() {
+		t.Fatalf("expected a TransportError that is not a timeout, got %#v", err)
+	}
+
+	done := make(chan struct{})
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-done
+	}))
+	defer s.Close()
+	defer close(done)
+	c = New(&http.Client{Transport: DefaultTransport()}, 1024, 10*time.Millisecond, "test")
+	req, _ = http.NewRequest("GET", s.URL, nil)
+	_, err = c.Retrieve(context.Background(), req)
+	if err, ok := err.(*TransportError); !ok || !err.Timeout() {
+		t.Fatalf("expected a TransportError that is a timeout, got %#v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package metricsclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/openshift/telemeter/pkg/reader"
+)
+
+type labelValuesResponse struct {
+	Status string   `json:"status"`
+	Data   []string `json:"data"`
+	Error  string   `json:"error"`
+}
+
+// LabelValues retrieves the values of a label from the Prometheus label values API
+// (/api/v1/label/<name>/values) at the request URL.
+func (c *Client) LabelValues(ctx context.Context, req *http.Request) ([]string, error) {
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	req = req.WithContext(ctx)
+	defer cancel()
+
+	var values []string
+	err := c.withCancel(ctx, req, func(resp *http.Response) error {
+		gaugeRequestRetrieve.WithLabelValues(c.metricsName, strconv.Itoa(resp.StatusCode)).Inc()
+		var r io.Reader = resp.Body
+		if c.maxBytes > 0 {
+			r = &reader.LimitedReader{R: resp.Body, N: c.maxBytes}
+		}
+		response := &labelValuesResponse{}
+		if err := json.NewDecoder(r).Decode(response); err != nil {
+			if resp.StatusCode != http.StatusOK {
+				return newStatusError(resp.StatusCode, "Prometheus server reported unexpected error code: %d", resp.StatusCode)
+			}
+			if err == reader.ErrTooLong {
+				return &LimitExceededError{Limit: c.maxBytes}
+			}
+			return fmt.Errorf("unable to parse label values response: %v", err)
+		}
+		if response.Status != "success" {
+			if resp.StatusCode != http.StatusOK {
+				return newStatusError(resp.StatusCode, "Prometheus server reported an error (%d): %s", resp.StatusCode, response.Error)
+			}
+			return fmt.Errorf("Prometheus server reported an error (%d): %s", resp.StatusCode, response.Error)
+		}
+		values = response.Data
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
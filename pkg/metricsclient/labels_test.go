@@ -0,0 +1,89 @@
+package metricsclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLabelValues(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/v1/label/__name__/values" {
+			t.Errorf("unexpected path: %s", req.URL.Path)
+		}
+		if got := req.Header.Get("Accept"); got != "application/json" {
+			t.Errorf("Accept = %q, want application/json", got)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"status":"success","data":["up","scrape_duration_seconds"]}`)
+	}))
+	defer s.Close()
+
+	c := New(&http.Client{Transport: DefaultTransport()}, 4096, time.Second, "test")
+	req, _ := http.NewRequest("GET", s.URL+"/api/v1/label/__name__/values", nil)
+	values, err := c.LabelValues(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"up", "scrape_duration_seconds"}; !reflect.DeepEqual(values, want) {
+		t.Errorf("LabelValues() = %q, want %q", values, want)
+	}
+}
+
+func TestLabelValuesErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     int
+		body     string
+		maxBytes int64
+		check    func(error) bool
+	}{
+		{name: "server error", code: http.StatusOK, body: `{"status":"error","error":"parse error"}`},
+		{name: "invalid response", code: http.StatusOK, body: `["up"]`},
+		{
+			name: "error status",
+			code: http.StatusServiceUnavailable,
+			body: "unavailable",
+			check: func(err error) bool {
+				_, ok := err.(*StatusError)
+				return ok
+			},
+		},
+		{
+			name:     "too long",
+			code:     http.StatusOK,
+			body:     `{"status":"success","data":["up","scrape_duration_seconds"]}`,
+			maxBytes: 10,
+			check: func(err error) bool {
+				_, ok := err.(*LimitExceededError)
+				return ok
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(tt.code)
+				io.WriteString(w, tt.body)
+			}))
+			defer s.Close()
+			maxBytes := tt.maxBytes
+			if maxBytes == 0 {
+				maxBytes = 4096
+			}
+			c := New(&http.Client{Transport: DefaultTransport()}, maxBytes, time.Second, "test")
+			req, _ := http.NewRequest("GET", s.URL+"/api/v1/label/__name__/values", nil)
+			_, err := c.LabelValues(context.Background(), req)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if tt.check != nil && !tt.check(err) {
+				t.Errorf("unexpected error type %T: %v", err, err)
+			}
+		})
+	}
+}
@@ -2,21 +2,30 @@ package metricsclient
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/hex"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/snappy"
 	"github.com/prometheus/client_golang/prometheus"
 	clientmodel "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"golang.org/x/net/http2"
 
+	telemeterhttp "github.com/openshift/telemeter/pkg/http"
+	"github.com/openshift/telemeter/pkg/ratelog"
 	"github.com/openshift/telemeter/pkg/reader"
 )
 
@@ -29,19 +38,82 @@ var (
 		Name: "metricsclient_request_send",
 		Help: "Tracks the number of metrics sends",
 	}, []string{"client", "status_code"})
+	counterRequestTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "metricsclient_request_timeouts_total",
+		Help: "Tracks the number of metrics retrievals and sends that exceeded their timeout",
+	}, []string{"client", "request"})
+	histogramRetrieveBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "metricsclient_retrieve_bytes",
+		Help:    "The size in bytes of retrieved metrics after decompression",
+		Buckets: prometheus.ExponentialBuckets(4*1024, 4, 7),
+	}, []string{"client"})
+	histogramSendBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "metricsclient_send_bytes",
+		Help:    "The size in bytes of the encoded and compressed metrics sent",
+		Buckets: prometheus.ExponentialBuckets(4*1024, 4, 7),
+	}, []string{"client"})
+	counterLimitTruncated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "telemeter_limit_truncated_total",
+		Help: "Tracks the number of retrievals that exceeded the size limit and were truncated",
+	}, []string{"client"})
+	counterScrapeNotModified = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "telemeter_scrape_not_modified_total",
+		Help: "Tracks the number of retrievals answered with 304 Not Modified that reused the previous response",
+	}, []string{"client"})
+	counterRetrievePartial = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "telemeter_retrieve_partial_total",
+		Help: "Tracks the number of retrievals that exceeded their timeout and returned the families read before it",
+	}, []string{"client"})
+	counterResponseProtocol = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "telemeter_http_responses_total",
+		Help: "Tracks the number of responses by the HTTP protocol negotiated with the server",
+	}, []string{"client", "protocol"})
 )
 
 func init() {
 	prometheus.MustRegister(
-		gaugeRequestRetrieve, gaugeRequestSend,
+		gaugeRequestRetrieve, gaugeRequestSend, counterRequestTimeouts,
+		histogramRetrieveBytes, histogramSendBytes, counterLimitTruncated,
+		counterScrapeNotModified, counterRetrievePartial, counterResponseProtocol,
 	)
 }
 
+// LimitMode controls what Retrieve does when a response exceeds the size limit.
+type LimitMode string
+
+const (
+	// LimitFail fails the retrieval with a *LimitExceededError.
+	LimitFail LimitMode = "fail"
+	// LimitTruncate returns the families that were read completely before the limit
+	// was reached and drops the rest.
+	LimitTruncate LimitMode = "truncate"
+)
+
 type Client struct {
 	client      *http.Client
 	maxBytes    int64
 	timeout     time.Duration
 	metricsName string
+	otlp        bool
+	limitMode   LimitMode
+	logger      *ratelog.Logger
+	signingKey  []byte
+	partial     bool
+
+	lock sync.Mutex
+	// retrieved is the last response, kept only for the URL it was retrieved from
+	// so that the responses of earlier match rules are not kept around
+	retrieved *retrievedResponse
+	protocol  string
+}
+
+// retrievedResponse is the last response retrieved from a URL that can be requested
+// conditionally.
+type retrievedResponse struct {
+	url          string
+	etag         string
+	lastModified string
+	families     []*clientmodel.MetricFamily
 }
 
 func New(client *http.Client, maxBytes int64, timeout time.Duration, metricsName string) *Client {
@@ -53,39 +125,113 @@ func New(client *http.Client, maxBytes int64, timeout time.Duration, metricsName
 	}
 }
 
+// NewOTLP returns a client that sends metrics as OTLP/HTTP protobuf requests instead
+// of the telemeter upload format. Retrieve is unchanged.
+func NewOTLP(client *http.Client, maxBytes int64, timeout time.Duration, metricsName string) *Client {
+	c := New(client, maxBytes, timeout, metricsName)
+	c.otlp = true
+	return c
+}
+
+// WithLimitMode sets how Retrieve handles responses larger than the size limit. The
+// default is LimitFail. When truncating a text response, families are only kept
+// whole if each of them starts with a # TYPE line, as Prometheus writes them.
+func (c *Client) WithLimitMode(mode LimitMode) *Client {
+	c.limitMode = mode
+	return c
+}
+
+// WithPartialOnTimeout makes Retrieve return the families read completely before the
+// timeout instead of an error when a response takes too long. The body is buffered
+// before it is decoded, because text responses can't be decoded incrementally.
+// Partial results are counted in telemeter_retrieve_partial_total.
+func (c *Client) WithPartialOnTimeout(partial bool) *Client {
+	c.partial = partial
+	return c
+}
+
+// WithLogger throttles the warnings logged for truncated responses with l.
+func (c *Client) WithLogger(l *ratelog.Logger) *Client {
+	c.logger = l
+	return c
+}
+
+// WithSigningKey signs the body of every upload with key, see
+// telemeterhttp.SignatureHeader.
+func (c *Client) WithSigningKey(key []byte) *Client {
+	c.signingKey = key
+	return c
+}
+
 func (c *Client) Retrieve(ctx context.Context, req *http.Request) ([]*clientmodel.MetricFamily, error) {
 	if req.Header == nil {
 		req.Header = make(http.Header)
 	}
 	req.Header.Set("Accept", strings.Join([]string{string(expfmt.FmtProtoDelim), string(expfmt.FmtText)}, " , "))
+	// setting the header disables transparent decompression by the transport
+	req.Header.Set("Accept-Encoding", "gzip")
+	key := req.URL.String()
+	previous := c.previousResponse(key)
+	if previous != nil {
+		if len(previous.etag) > 0 {
+			req.Header.Set("If-None-Match", previous.etag)
+		}
+		if len(previous.lastModified) > 0 {
+			req.Header.Set("If-Modified-Since", previous.lastModified)
+		}
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
 	req = req.WithContext(ctx)
 	defer cancel()
 
 	families := make([]*clientmodel.MetricFamily, 0, 100)
-	err := withCancel(ctx, c.client, req, func(resp *http.Response) error {
-		switch resp.StatusCode {
-		case http.StatusOK:
-			gaugeRequestRetrieve.WithLabelValues(c.metricsName, "200").Inc()
-		case http.StatusUnauthorized:
-			gaugeRequestRetrieve.WithLabelValues(c.metricsName, "401").Inc()
-			return fmt.Errorf("Prometheus server requires authentication: %s", resp.Request.URL)
-		case http.StatusForbidden:
-			gaugeRequestRetrieve.WithLabelValues(c.metricsName, "403").Inc()
-			return fmt.Errorf("Prometheus server forbidden: %s", resp.Request.URL)
-		case http.StatusBadRequest:
-			gaugeRequestRetrieve.WithLabelValues(c.metricsName, "400").Inc()
-			return fmt.Errorf("bad request: %s", resp.Request.URL)
-		default:
-			gaugeRequestRetrieve.WithLabelValues(c.metricsName, strconv.Itoa(resp.StatusCode)).Inc()
-			return fmt.Errorf("Prometheus server reported unexpected error code: %d", resp.StatusCode)
+	// complete is the number of families decoded in full, partial is true if the
+	// response was cut off by the timeout
+	complete, partial := 0, false
+	err := c.withCancel(ctx, req, func(resp *http.Response) error {
+		if resp.StatusCode == http.StatusNotModified && previous != nil {
+			gaugeRequestRetrieve.WithLabelValues(c.metricsName, "304").Inc()
+			counterScrapeNotModified.WithLabelValues(c.metricsName).Inc()
+			families = cloneFamilies(previous.families)
+			return nil
+		}
+		if err := c.retrieveStatus(resp); err != nil {
+			return err
 		}
 
-		// read the response into memory
+		// read the response into memory, limiting the decompressed size
+		body, err := decompressedBody(resp)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
 		format := expfmt.ResponseFormat(resp.Header)
-		r := &reader.LimitedReader{R: resp.Body, N: c.maxBytes}
-		decoder := expfmt.NewDecoder(r, format)
+		r := &reader.LimitedReader{R: body, N: c.maxBytes}
+		var in io.Reader = r
+		truncated := false
+		if c.limitMode == LimitTruncate || c.partial {
+			data, err := ioutil.ReadAll(r)
+			switch {
+			case err == reader.ErrTooLong && c.limitMode == LimitTruncate:
+				truncated = true
+				if format == expfmt.FmtText {
+					data = truncateText(data)
+				}
+				counterLimitTruncated.WithLabelValues(c.metricsName).Inc()
+				c.logger.Printf("truncated responses", "warning: response from %s exceeded the limit of %d bytes, dropping the remaining metrics", resp.Request.URL, c.maxBytes)
+			case err != nil && c.partial && ctx.Err() == context.DeadlineExceeded:
+				// the body was closed by the timeout, decode what was read before it
+				truncated, partial = true, true
+				if format == expfmt.FmtText {
+					data = truncateText(data)
+				}
+			case err != nil:
+				return c.limitError(err)
+			}
+			in = bytes.NewReader(data)
+		}
+		decoder := expfmt.NewDecoder(in, format)
 		for {
 			family := &clientmodel.MetricFamily{}
 			families = append(families, family)
@@ -93,36 +239,155 @@ func (c *Client) Retrieve(ctx context.Context, req *http.Request) ([]*clientmode
 				if err == io.EOF {
 					break
 				}
-				return err
+				if truncated {
+					// the family was cut off by the limit
+					families = families[:len(families)-1]
+					break
+				}
+				return c.limitError(err)
 			}
+			complete++
 		}
+		histogramRetrieveBytes.WithLabelValues(c.metricsName).Observe(float64(c.maxBytes - r.N))
 
+		var response *retrievedResponse
+		etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+		if !truncated && (len(etag) > 0 || len(lastModified) > 0) {
+			// kept apart from the returned families, which callers may modify
+			response = &retrievedResponse{url: key, etag: etag, lastModified: lastModified, families: cloneFamilies(families)}
+		}
+		c.setPreviousResponse(response)
 		return nil
 	})
 	if err != nil {
+		c.countTimeout(ctx, "retrieve")
+		if partial && complete > 0 {
+			counterRetrievePartial.WithLabelValues(c.metricsName).Inc()
+			c.logger.Printf("partial responses", "warning: retrieving from %s exceeded the timeout of %s, using the %d metric families read before it", req.URL, c.timeout, complete)
+			return families[:complete], nil
+		}
 		return nil, err
 	}
 	return families, nil
 }
 
+// previousResponse returns the last response if it was retrieved from key and can
+// be requested conditionally.
+func (c *Client) previousResponse(key string) *retrievedResponse {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.retrieved == nil || c.retrieved.url != key {
+		return nil
+	}
+	return c.retrieved
+}
+
+// setPreviousResponse replaces the last response, which is nil if the latest
+// response can't be requested conditionally.
+func (c *Client) setPreviousResponse(response *retrievedResponse) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.retrieved = response
+}
+
+func cloneFamilies(families []*clientmodel.MetricFamily) []*clientmodel.MetricFamily {
+	clone := make([]*clientmodel.MetricFamily, len(families))
+	for i, family := range families {
+		clone[i] = proto.Clone(family).(*clientmodel.MetricFamily)
+	}
+	return clone
+}
+
+// retrieveStatus counts the response to a retrieval and returns an error unless it
+// succeeded.
+func (c *Client) retrieveStatus(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		gaugeRequestRetrieve.WithLabelValues(c.metricsName, "200").Inc()
+		return nil
+	case http.StatusUnauthorized:
+		gaugeRequestRetrieve.WithLabelValues(c.metricsName, "401").Inc()
+		return newStatusError(resp.StatusCode, "Prometheus server requires authentication: %s", resp.Request.URL)
+	case http.StatusForbidden:
+		gaugeRequestRetrieve.WithLabelValues(c.metricsName, "403").Inc()
+		return newStatusError(resp.StatusCode, "Prometheus server forbidden: %s", resp.Request.URL)
+	case http.StatusBadRequest:
+		gaugeRequestRetrieve.WithLabelValues(c.metricsName, "400").Inc()
+		return newStatusError(resp.StatusCode, "bad request: %s", resp.Request.URL)
+	default:
+		gaugeRequestRetrieve.WithLabelValues(c.metricsName, strconv.Itoa(resp.StatusCode)).Inc()
+		return newStatusError(resp.StatusCode, "Prometheus server reported unexpected error code: %d", resp.StatusCode)
+	}
+}
+
+// decompressedBody returns the body of resp, decompressing it if it is gzip encoded.
+func decompressedBody(resp *http.Response) (io.ReadCloser, error) {
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return ioutil.NopCloser(resp.Body), nil
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress response: %v", err)
+	}
+	return gz, nil
+}
+
 func (c *Client) Send(ctx context.Context, req *http.Request, families []*clientmodel.MetricFamily) error {
-	buf := &bytes.Buffer{}
-	if err := Write(buf, families); err != nil {
-		return err
+	_, err := c.send(ctx, req, families)
+	return err
+}
+
+// SendHashed is like Send, but sends hash in the content hash header and returns true
+// if the server acknowledged that it stored the batch with that hash.
+func (c *Client) SendHashed(ctx context.Context, req *http.Request, families []*clientmodel.MetricFamily, hash string) (bool, error) {
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set(telemeterhttp.ContentHashHeader, hash)
+	header, err := c.send(ctx, req, families)
+	if err != nil {
+		return false, err
 	}
+	return header.Get(telemeterhttp.ContentHashHeader) == hash, nil
+}
 
+func (c *Client) send(ctx context.Context, req *http.Request, families []*clientmodel.MetricFamily) (http.Header, error) {
 	if req.Header == nil {
 		req.Header = make(http.Header)
 	}
-	req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
-	req.Header.Set("Content-Encoding", "snappy")
+	buf := &bytes.Buffer{}
+	if c.otlp {
+		if err := WriteOTLP(buf, families); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", OTLPContentType)
+	} else {
+		if err := Write(buf, families); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+		req.Header.Set("Content-Encoding", "snappy")
+	}
+	return c.post(ctx, req, buf)
+}
+
+// post sends the encoded body in buf with req and returns the response headers.
+func (c *Client) post(ctx context.Context, req *http.Request, buf *bytes.Buffer) (http.Header, error) {
+	if id := telemeterhttp.RequestIDFromContext(ctx); len(id) > 0 {
+		req.Header.Set(telemeterhttp.RequestIDHeader, id)
+	}
+	histogramSendBytes.WithLabelValues(c.metricsName).Observe(float64(buf.Len()))
+	if len(c.signingKey) > 0 {
+		req.Header.Set(telemeterhttp.SignatureHeader, telemeterhttp.Signature(c.signingKey, time.Now(), buf.Bytes()))
+	}
 	req.Body = ioutil.NopCloser(buf)
 
-	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
 	req = req.WithContext(ctx)
 	defer cancel()
 
-	return withCancel(ctx, c.client, req, func(resp *http.Response) error {
+	var header http.Header
+	err := c.withCancel(ctx, req, func(resp *http.Response) error {
 		defer func() {
 			io.Copy(ioutil.Discard, resp.Body)
 			resp.Body.Close()
@@ -133,24 +398,44 @@ func (c *Client) Send(ctx context.Context, req *http.Request, families []*client
 			gaugeRequestSend.WithLabelValues(c.metricsName, "200").Inc()
 		case http.StatusUnauthorized:
 			gaugeRequestSend.WithLabelValues(c.metricsName, "401").Inc()
-			return fmt.Errorf("gateway server requires authentication: %s", resp.Request.URL)
+			return newStatusError(resp.StatusCode, "gateway server requires authentication: %s", resp.Request.URL)
 		case http.StatusForbidden:
 			gaugeRequestSend.WithLabelValues(c.metricsName, "403").Inc()
-			return fmt.Errorf("gateway server forbidden: %s", resp.Request.URL)
+			return newStatusError(resp.StatusCode, "gateway server forbidden: %s", resp.Request.URL)
 		case http.StatusBadRequest:
 			gaugeRequestSend.WithLabelValues(c.metricsName, "400").Inc()
-			return fmt.Errorf("gateway server bad request: %s", resp.Request.URL)
+			return newStatusError(resp.StatusCode, "gateway server bad request: %s", resp.Request.URL)
 		default:
 			gaugeRequestSend.WithLabelValues(c.metricsName, strconv.Itoa(resp.StatusCode)).Inc()
 			body, _ := ioutil.ReadAll(resp.Body)
 			if len(body) > 1024 {
 				body = body[:1024]
 			}
-			return fmt.Errorf("gateway server reported unexpected error code: %d: %s", resp.StatusCode, string(body))
+			err := &StatusError{Code: resp.StatusCode, msg: fmt.Sprintf("gateway server reported unexpected error code: %d: %s", resp.StatusCode, string(body))}
+			if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+				err.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+				if err.RetryAfter > 0 {
+					err.msg = fmt.Sprintf("%s, retry after %s", err.msg, err.RetryAfter)
+				}
+			}
+			return err
 		}
 
+		header = resp.Header
 		return nil
 	})
+	if err != nil {
+		c.countTimeout(ctx, "send")
+		return nil, err
+	}
+	return header, nil
+}
+
+// countTimeout records a failed request if it failed because ctx hit its deadline.
+func (c *Client) countTimeout(ctx context.Context, request string) {
+	if ctx.Err() == context.DeadlineExceeded {
+		counterRequestTimeouts.WithLabelValues(c.metricsName, request).Inc()
+	}
 }
 
 func Read(r io.Reader) ([]*clientmodel.MetricFamily, error) {
@@ -170,6 +455,22 @@ func Read(r io.Reader) ([]*clientmodel.MetricFamily, error) {
 	return families, nil
 }
 
+// ContentHash returns a checksum of the protobuf encoding of families, which is
+// stable for identical batches in the same order.
+func ContentHash(families []*clientmodel.MetricFamily) (string, error) {
+	h := fnv.New64a()
+	encoder := expfmt.NewEncoder(h, expfmt.FmtProtoDelim)
+	for _, family := range families {
+		if family == nil {
+			continue
+		}
+		if err := encoder.Encode(family); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func Write(w io.Writer, families []*clientmodel.MetricFamily) error {
 	// output the filtered set
 	compress := snappy.NewBufferedWriter(w)
@@ -188,43 +489,129 @@ func Write(w io.Writer, families []*clientmodel.MetricFamily) error {
 	return nil
 }
 
-func withCancel(ctx context.Context, client *http.Client, req *http.Request, fn func(*http.Response) error) error {
-	resp, err := client.Do(req)
+// withCancel performs req and passes the response to fn, aborting it if ctx is done.
+// Errors performing the request and cancellation are returned as a TransportError.
+func (c *Client) withCancel(ctx context.Context, req *http.Request, fn func(*http.Response) error) error {
+	resp, err := c.client.Do(req)
 	defer func() {
 		if resp != nil {
 			resp.Body.Close()
 		}
 	}()
 	if err != nil {
-		return err
+		return &TransportError{Err: err}
 	}
+	c.observeProtocol(req, resp)
 
+	// fnErr is only read once done is closed, so the goroutine never races with
+	// the cancellation below
+	var fnErr error
 	done := make(chan struct{})
 	go func() {
-		err = fn(resp)
+		fnErr = fn(resp)
 		close(done)
 	}()
 
 	select {
 	case <-ctx.Done():
-		err = resp.Body.Close()
+		err := resp.Body.Close()
 		<-done
 		if err == nil {
 			err = ctx.Err()
 		}
+		return &TransportError{Err: err}
 	case <-done:
+		return fnErr
 	}
+}
 
-	return err
+// observeProtocol counts the HTTP protocol of resp and logs when it differs from the
+// protocol of the previous response, so that negotiating HTTP/2 can be confirmed.
+func (c *Client) observeProtocol(req *http.Request, resp *http.Response) {
+	counterResponseProtocol.WithLabelValues(c.metricsName, resp.Proto).Inc()
+	c.lock.Lock()
+	changed := c.protocol != resp.Proto
+	c.protocol = resp.Proto
+	c.lock.Unlock()
+	if changed {
+		log.Printf("Using %s for requests to %s", resp.Proto, req.URL.Host)
+	}
 }
 
-func DefaultTransport() *http.Transport {
-	return &http.Transport{
+// truncateText cuts a text exposition that was cut off by the size limit before the
+// last family that may be incomplete. A family starts at its # TYPE line, or at the
+// # HELP line right before it.
+func truncateText(data []byte) []byte {
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+	start := bytes.LastIndex(data, []byte("\n# TYPE "))
+	switch {
+	case start >= 0:
+		start++
+	case bytes.HasPrefix(data, []byte("# TYPE ")):
+		start = 0
+	default:
+		return nil
+	}
+	if start > 0 {
+		previous := bytes.LastIndexByte(data[:start-1], '\n') + 1
+		if bytes.HasPrefix(data[previous:], []byte("# HELP ")) {
+			start = previous
+		}
+	}
+	return data[:start]
+}
+
+// TransportOptions tune the connection pool of a transport returned by
+// NewTransport. Zero values keep the defaults of DefaultTransport.
+type TransportOptions struct {
+	// MaxIdleConns limits the idle connections across all hosts. The default is no
+	// limit.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost limits the idle connections kept to each host. The
+	// default is http.DefaultMaxIdleConnsPerHost, which is 2.
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout closes idle connections after this long. The default is to
+	// keep them open until the server closes them.
+	IdleConnTimeout time.Duration
+	// KeepAlive is the period of TCP keep-alive probes on new connections. The
+	// default is 30s.
+	KeepAlive time.Duration
+	// DisableKeepAlives opens a new connection for every request.
+	DisableKeepAlives bool
+	// HTTP2 negotiates HTTP/2 with servers that support it over TLS, falling back
+	// to HTTP/1.1 otherwise. Only HTTP/1.1 is used by default.
+	HTTP2 bool
+}
+
+// NewTransport returns a transport that honors the proxy environment variables,
+// with its connection pool tuned by o.
+func NewTransport(o TransportOptions) *http.Transport {
+	keepAlive := o.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = 30 * time.Second
+	}
+	t := &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
 		Dial: (&net.Dialer{
 			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
+			KeepAlive: keepAlive,
 		}).Dial,
 		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        o.MaxIdleConns,
+		MaxIdleConnsPerHost: o.MaxIdleConnsPerHost,
+		IdleConnTimeout:     o.IdleConnTimeout,
+		DisableKeepAlives:   o.DisableKeepAlives,
+	}
+	if o.HTTP2 {
+		// a transport with a custom dialer does not negotiate HTTP/2 on its own
+		if err := http2.ConfigureTransport(t); err != nil {
+			log.Printf("warning: unable to enable HTTP/2, using HTTP/1.1: %v", err)
+		}
 	}
+	return t
+}
+
+// DefaultTransport returns a transport with the default TransportOptions.
+func DefaultTransport() *http.Transport {
+	return NewTransport(TransportOptions{})
 }
@@ -0,0 +1,327 @@
+package metricsclient
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/openshift/telemeter/pkg/reader"
+	"github.com/openshift/telemeter/pkg/transform"
+)
+
+const sampleMetrics = `# TYPE up gauge
+up{job="a"} 1 1526160578685
+up{job="b"} 0 1526160578685
+`
+
+func federateHandler(t *testing.T, body string, allowGzip bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		if !allowGzip || !strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+			io.WriteString(w, body)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		if _, err := io.WriteString(gz, body); err != nil {
+			t.Error(err)
+		}
+		if err := gz.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestRetrieveEncoding(t *testing.T) {
+	for _, allowGzip := range []bool{true, false} {
+		s := httptest.NewServer(federateHandler(t, sampleMetrics, allowGzip))
+		c := New(&http.Client{Transport: DefaultTransport()}, 1024, time.Second, "test")
+		req, _ := http.NewRequest("GET", s.URL, nil)
+		families, err := c.Retrieve(context.Background(), req)
+		s.Close()
+		if err != nil {
+			t.Fatalf("gzip=%t: %v", allowGzip, err)
+		}
+		families = transform.Pack(families)
+		if len(families) != 1 || len(families[0].Metric) != 2 {
+			t.Fatalf("gzip=%t: unexpected families: %v", allowGzip, families)
+		}
+	}
+}
+
+func TestRetrieveGzipLimitsDecompressedSize(t *testing.T) {
+	body := sampleMetrics + strings.Repeat("# "+strings.Repeat("a", 100)+"\n", 100)
+	s := httptest.NewServer(federateHandler(t, body, true))
+	defer s.Close()
+
+	c := New(&http.Client{Transport: DefaultTransport()}, 1024, time.Second, "test")
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	_, err := c.Retrieve(context.Background(), req)
+	if err, ok := err.(*LimitExceededError); !ok || err.Limit != 1024 || err.Unwrap() != reader.ErrTooLong {
+		t.Fatalf("expected a LimitExceededError wrapping %v, got %v", reader.ErrTooLong, err)
+	}
+}
+
+func TestRetrieveTruncate(t *testing.T) {
+	var families []*clientmodel.MetricFamily
+	for i := 0; i < 20; i++ {
+		family := &clientmodel.MetricFamily{
+			Name: proto.String(fmt.Sprintf("metric_%d", i)),
+			Help: proto.String("A metric."),
+			Type: clientmodel.MetricType_GAUGE.Enum(),
+		}
+		for j := 0; j < 5; j++ {
+			family.Metric = append(family.Metric, &clientmodel.Metric{
+				Label: []*clientmodel.LabelPair{{Name: proto.String("instance"), Value: proto.String(fmt.Sprintf("instance-%d", j))}},
+				Gauge: &clientmodel.Gauge{Value: proto.Float64(1)},
+			})
+		}
+		families = append(families, family)
+	}
+
+	for _, format := range []expfmt.Format{expfmt.FmtText, expfmt.FmtProtoDelim} {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", string(format))
+			encoder := expfmt.NewEncoder(w, format)
+			for _, family := range families {
+				if err := encoder.Encode(family); err != nil {
+					t.Error(err)
+				}
+			}
+		}))
+		c := New(&http.Client{Transport: DefaultTransport()}, 1024, time.Second, "test").WithLimitMode(LimitTruncate)
+		req, _ := http.NewRequest("GET", s.URL, nil)
+		got, err := c.Retrieve(context.Background(), req)
+		s.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		got = transform.Pack(got)
+		if len(got) == 0 || len(got) >= len(families) {
+			t.Fatalf("%s: expected a truncated subset, got %d families", format, len(got))
+		}
+		for _, family := range got {
+			if len(family.Metric) != 5 {
+				t.Errorf("%s: family %s has %d metrics, want 5", format, family.GetName(), len(family.Metric))
+			}
+		}
+	}
+}
+
+func TestTruncateText(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			name: "cut inside a sample",
+			data: "# TYPE a gauge\na 1\n# TYPE b gauge\nb 1\nb{c=",
+			want: "# TYPE a gauge\na 1\n",
+		},
+		{
+			name: "keeps help with its family",
+			data: "# HELP a A.\n# TYPE a gauge\na 1\n# HELP b B.\n# TYPE b gauge\nb 1\n",
+			want: "# HELP a A.\n# TYPE a gauge\na 1\n",
+		},
+		{
+			name: "single family",
+			data: "# TYPE a gauge\na 1\na",
+			want: "",
+		},
+		{
+			name: "no type lines",
+			data: "a 1\nb 1\n",
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(truncateText([]byte(tt.data))); got != tt.want {
+				t.Errorf("truncateText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetrieveTimeoutIsCounted(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	c := New(server.Client(), 1024, 10*time.Millisecond, "test_timeout")
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	if _, err := c.Retrieve(context.Background(), req); err == nil {
+		t.Fatal("expected a timeout error")
+	}
+
+	m := &clientmodel.Metric{}
+	if err := counterRequestTimeouts.WithLabelValues("test_timeout", "retrieve").Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetCounter().GetValue(); got != 1 {
+		t.Errorf("timeouts = %v, want 1", got)
+	}
+}
+
+func TestRetrievePartialOnTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		io.WriteString(w, "# TYPE a gauge\na 1\n# TYPE b gauge\nb 2\n")
+		w.(http.Flusher).Flush()
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	if _, err := New(server.Client(), 1024, 50*time.Millisecond, "test_partial").Retrieve(context.Background(), req); err == nil {
+		t.Fatal("expected a timeout error without partial results")
+	}
+
+	c := New(server.Client(), 1024, 50*time.Millisecond, "test_partial").WithPartialOnTimeout(true)
+	req, _ = http.NewRequest("GET", server.URL, nil)
+	families, err := c.Retrieve(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b may have more samples after the timeout, so only a is complete
+	if len(families) != 1 || families[0].GetName() != "a" {
+		t.Fatalf("Retrieve() = %v, want only family a", families)
+	}
+
+	m := &clientmodel.Metric{}
+	if err := counterRetrievePartial.WithLabelValues("test_partial").Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetCounter().GetValue(); got != 1 {
+		t.Errorf("partial retrievals = %v, want 1", got)
+	}
+}
+
+func TestRetrieveNotModified(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("If-None-Match") == `"1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"1"`)
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		io.WriteString(w, sampleMetrics)
+	}))
+	defer server.Close()
+
+	c := New(server.Client(), 1024, time.Second, "test_not_modified")
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		families, err := c.Retrieve(context.Background(), req)
+		if err != nil {
+			t.Fatalf("retrieval %d: %v", i, err)
+		}
+		families = transform.Pack(families)
+		if len(families) != 1 || len(families[0].Metric) != 2 {
+			t.Fatalf("retrieval %d: unexpected families: %v", i, families)
+		}
+		// callers may modify the returned families
+		families[0].Metric = nil
+	}
+
+	m := &clientmodel.Metric{}
+	if err := counterScrapeNotModified.WithLabelValues("test_not_modified").Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetCounter().GetValue(); got != 1 {
+		t.Errorf("not modified retrievals = %v, want 1", got)
+	}
+}
+
+func TestRetrieveKeepsOnlyLatestURL(t *testing.T) {
+	var conditional []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if len(req.Header.Get("If-None-Match")) > 0 {
+			conditional = append(conditional, req.URL.RawQuery)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"1"`)
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		io.WriteString(w, sampleMetrics)
+	}))
+	defer server.Close()
+
+	c := New(server.Client(), 1024, time.Second, "test")
+	for _, query := range []string{"a", "a", "b", "a"} {
+		req, _ := http.NewRequest("GET", server.URL+"?"+query, nil)
+		if _, err := c.Retrieve(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the response for a is forgotten once b is retrieved
+	if want := []string{"a"}; !reflect.DeepEqual(conditional, want) {
+		t.Errorf("conditional requests = %q, want %q", conditional, want)
+	}
+	if c.retrieved == nil || c.retrieved.url != server.URL+"?a" {
+		t.Errorf("kept response = %+v, want only the last one", c.retrieved)
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	transport := NewTransport(TransportOptions{MaxIdleConns: 10, MaxIdleConnsPerHost: 5, IdleConnTimeout: time.Minute, DisableKeepAlives: true})
+	if transport.MaxIdleConns != 10 || transport.MaxIdleConnsPerHost != 5 || transport.IdleConnTimeout != time.Minute || !transport.DisableKeepAlives {
+		t.Errorf("NewTransport() did not apply the options: %+v", transport)
+	}
+	if transport := DefaultTransport(); transport.MaxIdleConns != 0 || transport.MaxIdleConnsPerHost != 0 || transport.IdleConnTimeout != 0 {
+		t.Errorf("DefaultTransport() changed the pool defaults: %+v", transport)
+	}
+}
+
+func TestNewTransportHTTP2(t *testing.T) {
+	s := httptest.NewUnstartedServer(federateHandler(t, sampleMetrics, false))
+	s.TLS = &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+	s.StartTLS()
+	defer s.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+
+	for _, enabled := range []bool{true, false} {
+		transport := NewTransport(TransportOptions{HTTP2: enabled})
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.RootCAs = pool
+		c := New(&http.Client{Transport: transport}, 1024, time.Second, "test")
+		req, _ := http.NewRequest("GET", s.URL, nil)
+		var proto string
+		err := c.withCancel(context.Background(), req, func(resp *http.Response) error {
+			proto = resp.Proto
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("http2=%t: %v", enabled, err)
+		}
+		want := "HTTP/1.1"
+		if enabled {
+			want = "HTTP/2.0"
+		}
+		if proto != want {
+			t.Errorf("http2=%t: negotiated %s, want %s", enabled, proto, want)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package metricsclient
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// The OTLP protobuf definitions are not vendored, so WriteOTLP encodes the subset of
+// opentelemetry.proto.collector.metrics.v1.ExportMetricsServiceRequest needed to
+// carry Prometheus families by hand. The field numbers below follow the v1 protos.
+const (
+	otlpRequestResourceMetrics = 1
+
+	otlpResourceMetricsScopeMetrics = 2
+
+	otlpScopeMetricsScope   = 1
+	otlpScopeMetricsMetrics = 2
+
+	otlpScopeName = 1
+
+	otlpMetricName        = 1
+	otlpMetricDescription = 2
+	otlpMetricGauge       = 5
+	otlpMetricSum         = 7
+	otlpMetricHistogram   = 9
+	otlpMetricSummary     = 11
+
+	otlpDataPoints             = 1
+	otlpAggregationTemporality = 2
+	otlpSumIsMonotonic         = 3
+
+	// AGGREGATION_TEMPORALITY_CUMULATIVE
+	otlpCumulative = 2
+
+	otlpNumberTime       = 3
+	otlpNumberAsDouble   = 4
+	otlpNumberAttributes = 7
+
+	otlpHistogramTime           = 3
+	otlpHistogramCount          = 4
+	otlpHistogramSum            = 5
+	otlpHistogramBucketCounts   = 6
+	otlpHistogramExplicitBounds = 7
+	otlpHistogramAttributes     = 9
+
+	otlpSummaryTime           = 3
+	otlpSummaryCount          = 4
+	otlpSummarySum            = 5
+	otlpSummaryQuantileValues = 6
+	otlpSummaryAttributes     = 7
+
+	otlpQuantileQuantile = 1
+	otlpQuantileValue    = 2
+
+	otlpKeyValueKey   = 1
+	otlpKeyValueValue = 2
+
+	otlpAnyValueString = 1
+)
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// OTLPContentType is the content type of the body written by WriteOTLP.
+const OTLPContentType = "application/x-protobuf"
+
+// WriteOTLP encodes families as an OTLP/HTTP protobuf ExportMetricsServiceRequest.
+// Counters become monotonic cumulative sums, gauges and untyped metrics become
+// gauges, and histograms and summaries map to their OTLP equivalents. Sample
+// timestamps are converted from milliseconds to nanoseconds.
+func WriteOTLP(w io.Writer, families []*clientmodel.MetricFamily) error {
+	var scope protoBuffer
+	var name protoBuffer
+	name.string(otlpScopeName, "telemeter")
+	scope.message(otlpScopeMetricsScope, name)
+	for _, family := range families {
+		if family == nil {
+			continue
+		}
+		scope.message(otlpScopeMetricsMetrics, otlpMetric(family))
+	}
+
+	var resource, request protoBuffer
+	resource.message(otlpResourceMetricsScopeMetrics, scope)
+	request.message(otlpRequestResourceMetrics, resource)
+	_, err := w.Write(request)
+	return err
+}
+
+func otlpMetric(family *clientmodel.MetricFamily) protoBuffer {
+	var metric protoBuffer
+	metric.string(otlpMetricName, family.GetName())
+	if len(family.GetHelp()) > 0 {
+		metric.string(otlpMetricDescription, family.GetHelp())
+	}
+
+	var data protoBuffer
+	switch family.GetType() {
+	case clientmodel.MetricType_COUNTER:
+		for _, m := range family.Metric {
+			if m != nil && m.Counter != nil {
+				data.message(otlpDataPoints, otlpNumberPoint(m, m.Counter.GetValue()))
+			}
+		}
+		data.varint(otlpAggregationTemporality, otlpCumulative)
+		data.varint(otlpSumIsMonotonic, 1)
+		metric.message(otlpMetricSum, data)
+	case clientmodel.MetricType_HISTOGRAM:
+		for _, m := range family.Metric {
+			if m != nil && m.Histogram != nil {
+				data.message(otlpDataPoints, otlpHistogramPoint(m))
+			}
+		}
+		data.varint(otlpAggregationTemporality, otlpCumulative)
+		metric.message(otlpMetricHistogram, data)
+	case clientmodel.MetricType_SUMMARY:
+		for _, m := range family.Metric {
+			if m != nil && m.Summary != nil {
+				data.message(otlpDataPoints, otlpSummaryPoint(m))
+			}
+		}
+		metric.message(otlpMetricSummary, data)
+	default:
+		for _, m := range family.Metric {
+			switch {
+			case m == nil:
+			case m.Gauge != nil:
+				data.message(otlpDataPoints, otlpNumberPoint(m, m.Gauge.GetValue()))
+			case m.Untyped != nil:
+				data.message(otlpDataPoints, otlpNumberPoint(m, m.Untyped.GetValue()))
+			}
+		}
+		metric.message(otlpMetricGauge, data)
+	}
+	return metric
+}
+
+func otlpNumberPoint(m *clientmodel.Metric, value float64) protoBuffer {
+	var point protoBuffer
+	point.fixed64(otlpNumberTime, otlpTime(m))
+	point.double(otlpNumberAsDouble, value)
+	point.attributes(otlpNumberAttributes, m.Label)
+	return point
+}
+
+func otlpHistogramPoint(m *clientmodel.Metric) protoBuffer {
+	h := m.Histogram
+	var point protoBuffer
+	point.fixed64(otlpHistogramTime, otlpTime(m))
+	point.fixed64(otlpHistogramCount, h.GetSampleCount())
+	point.double(otlpHistogramSum, h.GetSampleSum())
+
+	// Prometheus buckets are cumulative and may end with +Inf, OTLP buckets count
+	// the samples between consecutive bounds and have an implicit last bucket
+	var counts, bounds protoBuffer
+	var previous uint64
+	for _, b := range h.Bucket {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			break
+		}
+		counts.rawFixed64(b.GetCumulativeCount() - previous)
+		bounds.rawFixed64(math.Float64bits(b.GetUpperBound()))
+		previous = b.GetCumulativeCount()
+	}
+	counts.rawFixed64(h.GetSampleCount() - previous)
+	point.message(otlpHistogramBucketCounts, counts)
+	if len(bounds) > 0 {
+		point.message(otlpHistogramExplicitBounds, bounds)
+	}
+	point.attributes(otlpHistogramAttributes, m.Label)
+	return point
+}
+
+func otlpSummaryPoint(m *clientmodel.Metric) protoBuffer {
+	s := m.Summary
+	var point protoBuffer
+	point.fixed64(otlpSummaryTime, otlpTime(m))
+	point.fixed64(otlpSummaryCount, s.GetSampleCount())
+	point.double(otlpSummarySum, s.GetSampleSum())
+	for _, q := range s.Quantile {
+		var quantile protoBuffer
+		quantile.double(otlpQuantileQuantile, q.GetQuantile())
+		quantile.double(otlpQuantileValue, q.GetValue())
+		point.message(otlpSummaryQuantileValues, quantile)
+	}
+	point.attributes(otlpSummaryAttributes, m.Label)
+	return point
+}
+
+func otlpTime(m *clientmodel.Metric) uint64 {
+	return uint64(m.GetTimestampMs()) * 1000000
+}
+
+// protoBuffer appends protobuf wire format fields to a byte slice.
+type protoBuffer []byte
+
+func (b *protoBuffer) tag(field, wireType int) {
+	b.rawVarint(uint64(field<<3 | wireType))
+}
+
+func (b *protoBuffer) rawVarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	*b = append(*b, buf[:n]...)
+}
+
+func (b *protoBuffer) rawFixed64(v uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	*b = append(*b, buf[:]...)
+}
+
+func (b *protoBuffer) varint(field int, v uint64) {
+	b.tag(field, wireVarint)
+	b.rawVarint(v)
+}
+
+func (b *protoBuffer) fixed64(field int, v uint64) {
+	b.tag(field, wireFixed64)
+	b.rawFixed64(v)
+}
+
+func (b *protoBuffer) double(field int, v float64) {
+	b.fixed64(field, math.Float64bits(v))
+}
+
+func (b *protoBuffer) message(field int, m protoBuffer) {
+	b.tag(field, wireBytes)
+	b.rawVarint(uint64(len(m)))
+	*b = append(*b, m...)
+}
+
+func (b *protoBuffer) string(field int, s string) {
+	b.message(field, protoBuffer(s))
+}
+
+func (b *protoBuffer) attributes(field int, labels []*clientmodel.LabelPair) {
+	for _, label := range labels {
+		if label == nil {
+			continue
+		}
+		var value, kv protoBuffer
+		value.string(otlpAnyValueString, label.GetValue())
+		kv.string(otlpKeyValueKey, label.GetName())
+		kv.message(otlpKeyValueValue, value)
+		b.message(field, kv)
+	}
+}
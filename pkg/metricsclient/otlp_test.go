@@ -0,0 +1,103 @@
+package metricsclient
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// protoFields splits a protobuf message into its fields. Length-delimited fields
+// are returned as their contents and fixed64 fields as their 8 bytes.
+func protoFields(t *testing.T, b []byte) map[int][][]byte {
+	fields := make(map[int][][]byte)
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		b = b[n:]
+		var value []byte
+		switch key & 7 {
+		case wireVarint:
+			_, n = binary.Uvarint(b)
+			value, b = b[:n], b[n:]
+		case wireFixed64:
+			value, b = b[:8], b[8:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			value, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		fields[int(key>>3)] = append(fields[int(key>>3)], value)
+	}
+	return fields
+}
+
+func fixed64s(b []byte) []uint64 {
+	var values []uint64
+	for ; len(b) >= 8; b = b[8:] {
+		values = append(values, binary.LittleEndian.Uint64(b))
+	}
+	return values
+}
+
+func TestWriteOTLPHistogram(t *testing.T) {
+	family := &clientmodel.MetricFamily{
+		Name: proto.String("latency_seconds"),
+		Type: clientmodel.MetricType_HISTOGRAM.Enum(),
+		Metric: []*clientmodel.Metric{{
+			Label: []*clientmodel.LabelPair{{Name: proto.String("job"), Value: proto.String("a")}},
+			Histogram: &clientmodel.Histogram{
+				SampleCount: proto.Uint64(10),
+				SampleSum:   proto.Float64(4.5),
+				Bucket: []*clientmodel.Bucket{
+					{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(2)},
+					{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(7)},
+					{UpperBound: proto.Float64(math.Inf(1)), CumulativeCount: proto.Uint64(10)},
+				},
+			},
+			TimestampMs: proto.Int64(1500),
+		}},
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteOTLP(buf, []*clientmodel.MetricFamily{family, nil}); err != nil {
+		t.Fatal(err)
+	}
+
+	resource := protoFields(t, protoFields(t, buf.Bytes())[otlpRequestResourceMetrics][0])
+	scope := protoFields(t, resource[otlpResourceMetricsScopeMetrics][0])
+	if len(scope[otlpScopeMetricsMetrics]) != 1 {
+		t.Fatalf("metrics = %d, want 1", len(scope[otlpScopeMetricsMetrics]))
+	}
+	metric := protoFields(t, scope[otlpScopeMetricsMetrics][0])
+	if name := string(metric[otlpMetricName][0]); name != "latency_seconds" {
+		t.Errorf("name = %s", name)
+	}
+	histogram := protoFields(t, metric[otlpMetricHistogram][0])
+	point := protoFields(t, histogram[otlpDataPoints][0])
+
+	if got := fixed64s(point[otlpHistogramTime][0]); got[0] != 1500000000 {
+		t.Errorf("time = %d, want 1500000000", got[0])
+	}
+	if got := fixed64s(point[otlpHistogramCount][0]); got[0] != 10 {
+		t.Errorf("count = %d, want 10", got[0])
+	}
+	if got, want := fixed64s(point[otlpHistogramBucketCounts][0]), []uint64{2, 5, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("bucket counts = %v, want %v", got, want)
+	}
+	var bounds []float64
+	for _, v := range fixed64s(point[otlpHistogramExplicitBounds][0]) {
+		bounds = append(bounds, math.Float64frombits(v))
+	}
+	if want := []float64{0.1, 1}; !reflect.DeepEqual(bounds, want) {
+		t.Errorf("bounds = %v, want %v", bounds, want)
+	}
+	attribute := protoFields(t, point[otlpHistogramAttributes][0])
+	value := protoFields(t, attribute[otlpKeyValueValue][0])
+	if k, v := string(attribute[otlpKeyValueKey][0]), string(value[otlpAnyValueString][0]); k != "job" || v != "a" {
+		t.Errorf("attribute = %s=%s, want job=a", k, v)
+	}
+}
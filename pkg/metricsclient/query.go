@@ -0,0 +1,133 @@
+package metricsclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/reader"
+)
+
+type queryResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType string        `json:"resultType"`
+		Result     []querySample `json:"result"`
+	} `json:"data"`
+	Error string `json:"error"`
+}
+
+type querySample struct {
+	Metric map[string]string `json:"metric"`
+	// Value is a [timestamp, "value"] pair with the timestamp in seconds.
+	Value [2]json.RawMessage `json:"value"`
+}
+
+// Query evaluates the instant query in the request URL with the Prometheus query API
+// (/api/v1/query) and converts the resulting vector into families. The metric name of
+// each series is taken from its __name__ label, so queries that aggregate or otherwise
+// remove the name must restore it, for example with label_replace. Every series
+// becomes an untyped metric with the timestamp of its sample.
+func (c *Client) Query(ctx context.Context, req *http.Request) ([]*clientmodel.MetricFamily, error) {
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	req = req.WithContext(ctx)
+	defer cancel()
+
+	var families []*clientmodel.MetricFamily
+	err := c.withCancel(ctx, req, func(resp *http.Response) error {
+		gaugeRequestRetrieve.WithLabelValues(c.metricsName, strconv.Itoa(resp.StatusCode)).Inc()
+		var r io.Reader = resp.Body
+		if c.maxBytes > 0 {
+			r = &reader.LimitedReader{R: resp.Body, N: c.maxBytes}
+		}
+		response := &queryResponse{}
+		if err := json.NewDecoder(r).Decode(response); err != nil {
+			if resp.StatusCode != http.StatusOK {
+				return newStatusError(resp.StatusCode, "Prometheus server reported unexpected error code: %d", resp.StatusCode)
+			}
+			if err == reader.ErrTooLong {
+				return &LimitExceededError{Limit: c.maxBytes}
+			}
+			return fmt.Errorf("unable to parse query response: %v", err)
+		}
+		if response.Status != "success" {
+			if resp.StatusCode != http.StatusOK {
+				return newStatusError(resp.StatusCode, "Prometheus server reported an error (%d): %s", resp.StatusCode, response.Error)
+			}
+			return fmt.Errorf("Prometheus server reported an error (%d): %s", resp.StatusCode, response.Error)
+		}
+		if response.Data.ResultType != "vector" {
+			return fmt.Errorf("query returned a %s, only instant vectors are supported", response.Data.ResultType)
+		}
+		var err error
+		families, err = queryFamilies(response.Data.Result)
+		return err
+	})
+	if err != nil {
+		c.countTimeout(ctx, "retrieve")
+		return nil, err
+	}
+	return families, nil
+}
+
+// queryFamilies groups samples by metric name into families sorted by name.
+func queryFamilies(samples []querySample) ([]*clientmodel.MetricFamily, error) {
+	byName := make(map[string]*clientmodel.MetricFamily)
+	for _, sample := range samples {
+		name, ok := sample.Metric["__name__"]
+		if !ok || len(name) == 0 {
+			return nil, fmt.Errorf("query returned a series without a metric name: %v", sample.Metric)
+		}
+		var seconds float64
+		if err := json.Unmarshal(sample.Value[0], &seconds); err != nil {
+			return nil, fmt.Errorf("invalid timestamp for series %s: %v", name, err)
+		}
+		var s string
+		if err := json.Unmarshal(sample.Value[1], &s); err != nil {
+			return nil, fmt.Errorf("invalid value for series %s: %v", name, err)
+		}
+		value, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for series %s: %v", name, err)
+		}
+
+		m := &clientmodel.Metric{
+			Untyped:     &clientmodel.Untyped{Value: proto.Float64(value)},
+			TimestampMs: proto.Int64(int64(math.Round(seconds * 1000))),
+		}
+		for k, v := range sample.Metric {
+			if k == "__name__" {
+				continue
+			}
+			m.Label = append(m.Label, &clientmodel.LabelPair{Name: proto.String(k), Value: proto.String(v)})
+		}
+		sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+
+		family, ok := byName[name]
+		if !ok {
+			family = &clientmodel.MetricFamily{Name: proto.String(name), Type: clientmodel.MetricType_UNTYPED.Enum()}
+			byName[name] = family
+		}
+		family.Metric = append(family.Metric, m)
+	}
+
+	families := make([]*clientmodel.MetricFamily, 0, len(byName))
+	for _, family := range byName {
+		families = append(families, family)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+	return families, nil
+}
@@ -0,0 +1,81 @@
+package metricsclient
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+func queryHandler(t *testing.T, body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("query") == "" {
+			t.Errorf("missing query parameter: %s", req.URL)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	})
+}
+
+func TestQuery(t *testing.T) {
+	s := httptest.NewServer(queryHandler(t, `{"status":"success","data":{"resultType":"vector","result":[
+		{"metric":{"__name__":"up","job":"b","instance":"x"},"value":[1526160578.685,"0"]},
+		{"metric":{"__name__":"cluster:cpu:sum"},"value":[1526160578,"NaN"]},
+		{"metric":{"__name__":"up","job":"a"},"value":[1526160578.685,"1"]}
+	]}}`))
+	defer s.Close()
+
+	c := New(&http.Client{Transport: DefaultTransport()}, 4096, time.Second, "test")
+	req, _ := http.NewRequest("GET", s.URL+"/api/v1/query?query=up", nil)
+	families, err := c.Query(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 2 {
+		t.Fatalf("unexpected families: %v", families)
+	}
+	// encoding as text checks that the families are valid
+	want := `# TYPE cluster:cpu:sum untyped
+cluster:cpu:sum NaN 1526160578000
+# TYPE up untyped
+up{instance="x",job="b"} 0 1526160578685
+up{job="a"} 1 1526160578685
+`
+	buf := &bytes.Buffer{}
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(buf, family); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected families:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "server error", body: `{"status":"error","error":"parse error"}`},
+		{name: "not a vector", body: `{"status":"success","data":{"resultType":"matrix","result":[]}}`},
+		{name: "missing name", body: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"a"},"value":[1,"1"]}]}}`},
+		{name: "invalid value", body: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1,"a"]}]}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := httptest.NewServer(queryHandler(t, tt.body))
+			defer s.Close()
+			c := New(&http.Client{Transport: DefaultTransport()}, 4096, time.Second, "test")
+			req, _ := http.NewRequest("GET", s.URL+"/api/v1/query?query=up", nil)
+			if _, err := c.Query(context.Background(), req); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
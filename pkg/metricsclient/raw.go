@@ -0,0 +1,128 @@
+package metricsclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/golang/snappy"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/openshift/telemeter/pkg/reader"
+)
+
+// RetrieveRaw is like Retrieve, but returns the response body without decoding it
+// along with its format. The delimited protobuf format is requested, but servers
+// may respond with the text format. The size limit and limit mode apply as for
+// Retrieve.
+func (c *Client) RetrieveRaw(ctx context.Context, req *http.Request) ([]byte, expfmt.Format, error) {
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set("Accept", string(expfmt.FmtProtoDelim))
+	// setting the header disables transparent decompression by the transport
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	req = req.WithContext(ctx)
+	defer cancel()
+
+	var data []byte
+	var format expfmt.Format
+	err := c.withCancel(ctx, req, func(resp *http.Response) error {
+		if err := c.retrieveStatus(resp); err != nil {
+			return err
+		}
+		body, err := decompressedBody(resp)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		format = expfmt.ResponseFormat(resp.Header)
+		data, err = ioutil.ReadAll(&reader.LimitedReader{R: body, N: c.maxBytes})
+		if err == reader.ErrTooLong && c.limitMode == LimitTruncate {
+			if format == expfmt.FmtProtoDelim {
+				data = truncateDelimited(data)
+			} else {
+				data = truncateText(data)
+			}
+			counterLimitTruncated.WithLabelValues(c.metricsName).Inc()
+			c.logger.Printf("truncated responses", "warning: response from %s exceeded the limit of %d bytes, dropping the remaining metrics", resp.Request.URL, c.maxBytes)
+			err = nil
+		}
+		if err != nil {
+			return c.limitError(err)
+		}
+		histogramRetrieveBytes.WithLabelValues(c.metricsName).Observe(float64(len(data)))
+		return nil
+	})
+	if err != nil {
+		c.countTimeout(ctx, "retrieve")
+		return nil, "", err
+	}
+	return data, format, nil
+}
+
+// Decode decodes the families in data, a response body in format as returned by
+// RetrieveRaw.
+func Decode(data []byte, format expfmt.Format) ([]*clientmodel.MetricFamily, error) {
+	decoder := expfmt.NewDecoder(bytes.NewReader(data), format)
+	var families []*clientmodel.MetricFamily
+	for {
+		family := &clientmodel.MetricFamily{}
+		if err := decoder.Decode(family); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		families = append(families, family)
+	}
+	return families, nil
+}
+
+// SendRaw uploads data, metric families in the delimited protobuf format, without
+// decoding them. OTLP clients have to decode data to convert it.
+func (c *Client) SendRaw(ctx context.Context, req *http.Request, data []byte) error {
+	if c.otlp {
+		families, err := Decode(data, expfmt.FmtProtoDelim)
+		if err != nil {
+			return err
+		}
+		return c.Send(ctx, req, families)
+	}
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	buf := &bytes.Buffer{}
+	compress := snappy.NewBufferedWriter(buf)
+	if _, err := compress.Write(data); err != nil {
+		return err
+	}
+	if err := compress.Close(); err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+	req.Header.Set("Content-Encoding", "snappy")
+	_, err := c.post(ctx, req, buf)
+	return err
+}
+
+// truncateDelimited cuts delimited protobuf messages that were cut off by the size
+// limit after the last complete message.
+func truncateDelimited(data []byte) []byte {
+	end := 0
+	for end < len(data) {
+		size, n := binary.Uvarint(data[end:])
+		if n <= 0 || uint64(len(data)-end-n) < size {
+			break
+		}
+		end += n + int(size)
+	}
+	return data[:end]
+}
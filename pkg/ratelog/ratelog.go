@@ -0,0 +1,114 @@
+// Package ratelog collapses repeated log messages into periodic summaries.
+package ratelog
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Logger logs the first message of each kind immediately and then at most one
+// message of that kind per window. Messages within the window are counted and
+// reported with the next message that is logged, as in "3 upload failures in the
+// last 5m0s: <message>", or by Run with the last of them once the window is over.
+// A nil Logger logs every message.
+type Logger struct {
+	window time.Duration
+	now    func() time.Time
+
+	lock  sync.Mutex
+	kinds map[string]*kind
+}
+
+type kind struct {
+	logged     time.Time
+	suppressed int
+	// last is the last suppressed message.
+	last string
+}
+
+// New returns a logger that logs at most one message of each kind per window. A
+// window of zero or less logs every message.
+func New(window time.Duration) *Logger {
+	return &Logger{
+		window: window,
+		now:    time.Now,
+		kinds:  make(map[string]*kind),
+	}
+}
+
+// Printf logs a message of the given kind, which describes the message in plural,
+// such as "upload failures", unless a message of that kind was logged within the
+// window.
+func (l *Logger) Printf(kind, format string, args ...interface{}) {
+	if l == nil || l.window <= 0 {
+		log.Printf(format, args...)
+		return
+	}
+	if message, ok := l.message(kind, format, args...); ok {
+		log.Print(message)
+	}
+}
+
+func (l *Logger) message(name, format string, args ...interface{}) (string, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	k, ok := l.kinds[name]
+	if !ok {
+		l.kinds[name] = &kind{logged: now}
+		return fmt.Sprintf(format, args...), true
+	}
+	if now.Sub(k.logged) < l.window {
+		k.suppressed++
+		k.last = fmt.Sprintf(format, args...)
+		return "", false
+	}
+	suppressed := k.suppressed
+	k.logged, k.suppressed, k.last = now, 0, ""
+	if suppressed == 0 {
+		return fmt.Sprintf(format, args...), true
+	}
+	return fmt.Sprintf("%d %s in the last %s: %s", suppressed+1, name, l.window, fmt.Sprintf(format, args...)), true
+}
+
+// Run logs the messages that were suppressed in a window that is over, without
+// waiting for the next message of their kind, until ctx is done.
+func (l *Logger) Run(ctx context.Context) {
+	if l == nil || l.window <= 0 {
+		return
+	}
+	ticker := time.NewTicker(l.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, message := range l.flush() {
+				log.Print(message)
+			}
+		}
+	}
+}
+
+// flush returns a summary of the suppressed messages of each kind whose window is
+// over.
+func (l *Logger) flush() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	var messages []string
+	for name, k := range l.kinds {
+		if k.suppressed == 0 || now.Sub(k.logged) < l.window {
+			continue
+		}
+		messages = append(messages, fmt.Sprintf("%d %s in the last %s: %s", k.suppressed, name, l.window, k.last))
+		k.logged, k.suppressed, k.last = now, 0, ""
+	}
+	sort.Strings(messages)
+	return messages
+}
@@ -0,0 +1,63 @@
+package ratelog
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoggerMessage(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New(5 * time.Minute)
+	l.now = func() time.Time { return now }
+
+	steps := []struct {
+		after time.Duration
+		kind  string
+		err   string
+		want  string
+	}{
+		{kind: "upload failures", err: "a", want: "error: a"},
+		{after: time.Minute, kind: "upload failures", err: "b"},
+		{after: time.Minute, kind: "scrape failures", err: "c", want: "error: c"},
+		{after: time.Minute, kind: "upload failures", err: "d"},
+		{after: 3 * time.Minute, kind: "upload failures", err: "e", want: "3 upload failures in the last 5m0s: error: e"},
+		{after: 6 * time.Minute, kind: "upload failures", err: "f", want: "error: f"},
+	}
+	for i, step := range steps {
+		now = now.Add(step.after)
+		got, ok := l.message(step.kind, "error: %s", step.err)
+		if ok != (len(step.want) > 0) || got != step.want {
+			t.Errorf("step %d: message() = %q, %t, want %q", i, got, ok, step.want)
+		}
+	}
+}
+
+func TestLoggerFlush(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New(5 * time.Minute)
+	l.now = func() time.Time { return now }
+
+	l.message("upload failures", "error: %s", "a")
+	l.message("scrape failures", "error: %s", "b")
+	now = now.Add(time.Minute)
+	l.message("upload failures", "error: %s", "c")
+	l.message("upload failures", "error: %s", "d")
+	if got := l.flush(); len(got) != 0 {
+		t.Errorf("flush() within the window = %q, want nothing", got)
+	}
+
+	now = now.Add(4 * time.Minute)
+	if got, want := l.flush(), []string{"2 upload failures in the last 5m0s: error: d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("flush() = %q, want %q", got, want)
+	}
+	if got := l.flush(); len(got) != 0 {
+		t.Errorf("flush() after flushing = %q, want nothing", got)
+	}
+
+	// the flush starts a new window
+	now = now.Add(time.Minute)
+	if got, ok := l.message("upload failures", "error: %s", "e"); ok {
+		t.Errorf("message() after flushing = %q, want it suppressed", got)
+	}
+}
@@ -0,0 +1,108 @@
+package transform
+
+import (
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// AggregateOp controls how NewAggregator combines the values of series left with
+// the same labels.
+type AggregateOp string
+
+const (
+	// AggregateSum adds the values.
+	AggregateSum AggregateOp = "sum"
+	// AggregateMax keeps the largest value.
+	AggregateMax AggregateOp = "max"
+	// AggregateMin keeps the smallest value.
+	AggregateMin AggregateOp = "min"
+)
+
+// Aggregation describes how NewAggregator reduces the series of a metric.
+type Aggregation struct {
+	// Drop are the labels removed from every series.
+	Drop []string
+	// Op combines the series left with the same labels.
+	Op AggregateOp
+}
+
+type aggregator struct {
+	rules map[string]Aggregation
+}
+
+// NewAggregator removes the labels of each rule from the series of the metric named
+// by its key, and combines the series left with the same labels with the operation
+// of the rule. The combined series has the newest timestamp of the series it
+// replaces. Counters, gauges, and untyped metrics are aggregated, histograms and
+// summaries are left unchanged.
+func NewAggregator(rules map[string]Aggregation) Interface {
+	return &aggregator{rules: rules}
+}
+
+func (t *aggregator) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	rule, ok := t.rules[family.GetName()]
+	if !ok {
+		return true, nil
+	}
+	switch family.GetType() {
+	case clientmodel.MetricType_COUNTER, clientmodel.MetricType_GAUGE, clientmodel.MetricType_UNTYPED:
+	default:
+		return true, nil
+	}
+	drop := make(map[string]struct{}, len(rule.Drop))
+	for _, name := range rule.Drop {
+		drop[name] = struct{}{}
+	}
+	removeLabels(family, func(name string) bool {
+		_, ok := drop[name]
+		return !ok
+	})
+
+	seen := make(map[string]*clientmodel.Metric)
+	for i, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		value := sampleValue(m)
+		if value == nil {
+			continue
+		}
+		key := seriesKey(family.GetName(), m.Label)
+		previous, ok := seen[key]
+		if !ok {
+			seen[key] = m
+			continue
+		}
+		family.Metric[i] = nil
+		combined := sampleValue(previous)
+		switch rule.Op {
+		case AggregateMax:
+			if *value > *combined {
+				*combined = *value
+			}
+		case AggregateMin:
+			if *value < *combined {
+				*combined = *value
+			}
+		default:
+			*combined += *value
+		}
+		if m.TimestampMs != nil && m.GetTimestampMs() > previous.GetTimestampMs() {
+			previous.TimestampMs = m.TimestampMs
+		}
+	}
+	return true, nil
+}
+
+// sampleValue returns the value of a counter, gauge, or untyped metric, or nil for
+// other metrics.
+func sampleValue(m *clientmodel.Metric) *float64 {
+	switch {
+	case m.Counter != nil && m.Counter.Value != nil:
+		return m.Counter.Value
+	case m.Gauge != nil && m.Gauge.Value != nil:
+		return m.Gauge.Value
+	case m.Untyped != nil && m.Untyped.Value != nil:
+		return m.Untyped.Value
+	}
+	return nil
+}
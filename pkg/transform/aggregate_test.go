@@ -0,0 +1,69 @@
+package transform
+
+import (
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestAggregator(t *testing.T) {
+	series := func(timestamp int64, value float64, pairs ...string) *clientmodel.Metric {
+		return &clientmodel.Metric{Label: labels(pairs...), TimestampMs: int64p(timestamp), Counter: &clientmodel.Counter{Value: float64p(value)}}
+	}
+	tests := []struct {
+		op   AggregateOp
+		want []float64
+	}{
+		{op: AggregateSum, want: []float64{6, 4}},
+		{op: AggregateMax, want: []float64{3, 4}},
+		{op: AggregateMin, want: []float64{1, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.op), func(t *testing.T) {
+			family := &clientmodel.MetricFamily{Name: stringp("requests"), Type: clientmodel.MetricType_COUNTER.Enum(), Metric: []*clientmodel.Metric{
+				series(1, 2, "code", "200", "pod", "a"),
+				series(3, 3, "pod", "b", "code", "200"),
+				series(2, 1, "code", "200", "pod", "c", "instance", "x"),
+				series(1, 4, "code", "500", "pod", "a"),
+			}}
+
+			ok, err := NewAggregator(map[string]Aggregation{"requests": {Drop: []string{"pod", "instance"}, Op: tt.op}}).Transform(family)
+			if !ok || err != nil {
+				t.Fatalf("Transform() = %t, %v", ok, err)
+			}
+			var got []*clientmodel.Metric
+			for _, m := range family.Metric {
+				if m != nil {
+					got = append(got, m)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d series, want %d", len(got), len(tt.want))
+			}
+			for i, m := range got {
+				if len(m.Label) != 1 || m.Label[0].GetName() != "code" {
+					t.Errorf("series %d has labels %s, want only code", i, formatLabels(m.Label))
+				}
+				if m.Counter.GetValue() != tt.want[i] {
+					t.Errorf("series %d has value %g, want %g", i, m.Counter.GetValue(), tt.want[i])
+				}
+			}
+			if got[0].GetTimestampMs() != 3 {
+				t.Errorf("combined series has timestamp %d, want the newest 3", got[0].GetTimestampMs())
+			}
+		})
+	}
+
+	t.Run("other metrics", func(t *testing.T) {
+		family := &clientmodel.MetricFamily{Name: stringp("other"), Type: clientmodel.MetricType_COUNTER.Enum(), Metric: []*clientmodel.Metric{
+			series(1, 1, "pod", "a"),
+			series(1, 1, "pod", "b"),
+		}}
+		if _, err := NewAggregator(map[string]Aggregation{"requests": {Drop: []string{"pod"}}}).Transform(family); err != nil {
+			t.Fatal(err)
+		}
+		if family.Metric[0] == nil || family.Metric[1] == nil || len(family.Metric[0].Label) != 1 {
+			t.Errorf("series of other metrics were changed")
+		}
+	})
+}
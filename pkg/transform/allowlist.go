@@ -0,0 +1,111 @@
+package transform
+
+import (
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+type labelAllowlist struct {
+	keep map[string]struct{}
+}
+
+// NewLabelAllowlist removes every label not in keep from all metrics. The metric name
+// is always kept. When removing labels leaves several metrics in a family with the
+// same labels, only the one with the newest timestamp is kept.
+func NewLabelAllowlist(keep []string) Interface {
+	set := make(map[string]struct{}, len(keep))
+	for _, name := range keep {
+		set[name] = struct{}{}
+	}
+	return &labelAllowlist{keep: set}
+}
+
+func (t *labelAllowlist) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	filterLabels(family, func(name string) bool {
+		_, ok := t.keep[name]
+		return ok
+	})
+	return true, nil
+}
+
+// DefaultMetaLabels are the labels removed by NewStripMetaLabels. They are added by
+// Prometheus and its service discovery and identify where a series was scraped
+// rather than what it measures.
+var DefaultMetaLabels = []string{"prometheus", "prometheus_replica", "endpoint", "job"}
+
+type stripMetaLabels struct {
+	drop map[string]struct{}
+}
+
+// NewStripMetaLabels removes DefaultMetaLabels and the extra labels from all metrics.
+// Metrics left with the same labels are merged as with NewLabelAllowlist.
+func NewStripMetaLabels(extra ...string) Interface {
+	set := make(map[string]struct{}, len(DefaultMetaLabels)+len(extra))
+	for _, name := range DefaultMetaLabels {
+		set[name] = struct{}{}
+	}
+	for _, name := range extra {
+		set[name] = struct{}{}
+	}
+	return &stripMetaLabels{drop: set}
+}
+
+func (t *stripMetaLabels) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	filterLabels(family, func(name string) bool {
+		_, ok := t.drop[name]
+		return !ok
+	})
+	return true, nil
+}
+
+// filterLabels removes the labels of every metric in family for which keep returns
+// false and then merges the metrics left with the same labels, see keepNewestSeries.
+func filterLabels(family *clientmodel.MetricFamily, keep func(name string) bool) {
+	removeLabels(family, keep)
+	keepNewestSeries(family)
+}
+
+// removeLabels removes the labels of every metric in family for which keep returns
+// false.
+func removeLabels(family *clientmodel.MetricFamily, keep func(name string) bool) {
+	for _, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		packLabels := false
+		for j, label := range m.Label {
+			if label == nil {
+				continue
+			}
+			if !keep(label.GetName()) {
+				m.Label[j] = nil
+				packLabels = true
+			}
+		}
+		if packLabels {
+			m.Label = PackLabels(m.Label)
+		}
+	}
+}
+
+// keepNewestSeries keeps only the metric with the newest timestamp among the metrics
+// in family with the same labels.
+func keepNewestSeries(family *clientmodel.MetricFamily) {
+	seen := make(map[string]int)
+	for i, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		key := seriesKey(family.GetName(), m.Label)
+		previous, ok := seen[key]
+		if !ok {
+			seen[key] = i
+			continue
+		}
+		if m.GetTimestampMs() > family.Metric[previous].GetTimestampMs() {
+			family.Metric[previous] = nil
+			seen[key] = i
+		} else {
+			family.Metric[i] = nil
+		}
+	}
+}
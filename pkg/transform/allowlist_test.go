@@ -0,0 +1,60 @@
+package transform
+
+import (
+	"reflect"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestLabelAllowlist(t *testing.T) {
+	family := &clientmodel.MetricFamily{
+		Name: stringp("up"),
+		Metric: []*clientmodel.Metric{
+			{Label: labels("job", "a", "pod", "1"), TimestampMs: int64p(1)},
+			{Label: labels("job", "a", "pod", "2"), TimestampMs: int64p(3)},
+			{Label: labels("pod", "3", "job", "a"), TimestampMs: int64p(2)},
+			{Label: labels("job", "b", "new", "x"), TimestampMs: int64p(1)},
+			nil,
+		},
+	}
+	ok, err := NewLabelAllowlist([]string{"job"}).Transform(family)
+	if !ok || err != nil {
+		t.Fatalf("Transform() = %t, %v", ok, err)
+	}
+
+	want := []*clientmodel.Metric{
+		nil,
+		{Label: labels("job", "a"), TimestampMs: int64p(3)},
+		nil,
+		{Label: labels("job", "b"), TimestampMs: int64p(1)},
+		nil,
+	}
+	if !reflect.DeepEqual(family.Metric, want) {
+		t.Errorf("metrics = %v, want %v", family.Metric, want)
+	}
+}
+
+func TestStripMetaLabels(t *testing.T) {
+	family := &clientmodel.MetricFamily{
+		Name: stringp("up"),
+		Metric: []*clientmodel.Metric{
+			{Label: labels("job", "a", "prometheus_replica", "0", "pod", "1"), TimestampMs: int64p(1)},
+			{Label: labels("job", "a", "prometheus_replica", "1", "pod", "1"), TimestampMs: int64p(2)},
+			{Label: labels("shard", "2", "pod", "2"), TimestampMs: int64p(1)},
+		},
+	}
+	ok, err := NewStripMetaLabels("shard").Transform(family)
+	if !ok || err != nil {
+		t.Fatalf("Transform() = %t, %v", ok, err)
+	}
+
+	want := []*clientmodel.Metric{
+		nil,
+		{Label: labels("pod", "1"), TimestampMs: int64p(2)},
+		{Label: labels("pod", "2"), TimestampMs: int64p(1)},
+	}
+	if !reflect.DeepEqual(family.Metric, want) {
+		t.Errorf("metrics = %v, want %v", family.Metric, want)
+	}
+}
@@ -3,6 +3,8 @@ package transform
 import (
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"strconv"
 
 	clientmodel "github.com/prometheus/client_model/go"
 )
@@ -11,6 +13,7 @@ type AnonymizeMetrics struct {
 	salt     string
 	global   map[string]struct{}
 	byMetric map[string]map[string]struct{}
+	buckets  map[string]int
 }
 
 // NewMetricsAnonymizer hashes label values on the incoming metrics using a cryptographic hash.
@@ -39,19 +42,28 @@ func NewMetricsAnonymizer(salt string, labels []string, metricsLabels map[string
 	}
 }
 
+// WithBuckets maps the values of each label in buckets to one of the given number
+// of buckets instead of hashing them. Values that land in the same bucket become
+// equal, reducing cardinality while still hiding the original value. Labels in
+// buckets are anonymized even if they were not passed to NewMetricsAnonymizer.
+func (a *AnonymizeMetrics) WithBuckets(buckets map[string]int) *AnonymizeMetrics {
+	a.buckets = buckets
+	return a
+}
+
 func (a *AnonymizeMetrics) Transform(family *clientmodel.MetricFamily) (bool, error) {
 	if family == nil {
 		return false, nil
 	}
 	if set, ok := a.byMetric[family.GetName()]; ok {
-		transformMetricLabelValues(a.salt, family.Metric, a.global, set)
+		transformMetricLabelValues(a.salt, family.Metric, a.buckets, a.global, set)
 	} else {
-		transformMetricLabelValues(a.salt, family.Metric, a.global)
+		transformMetricLabelValues(a.salt, family.Metric, a.buckets, a.global)
 	}
 	return true, nil
 }
 
-func transformMetricLabelValues(salt string, metrics []*clientmodel.Metric, sets ...map[string]struct{}) {
+func transformMetricLabelValues(salt string, metrics []*clientmodel.Metric, buckets map[string]int, sets ...map[string]struct{}) {
 	for _, m := range metrics {
 		if m == nil {
 			continue
@@ -61,6 +73,11 @@ func transformMetricLabelValues(salt string, metrics []*clientmodel.Metric, sets
 				continue
 			}
 			name := pair.GetName()
+			if n, ok := buckets[name]; ok {
+				v := bucketValue(salt, pair.GetValue(), n)
+				pair.Value = &v
+				continue
+			}
 			for _, set := range sets {
 				_, ok := set[name]
 				if !ok {
@@ -80,3 +97,10 @@ func secureValueHash(salt, value string) string {
 	hash := sha256.Sum256([]byte(salt + value))
 	return base64.RawURLEncoding.EncodeToString(hash[:9])
 }
+
+// bucketValue deterministically maps the input value to one of n buckets using the
+// salted hash of the value and returns the bucket number as a label value.
+func bucketValue(salt, value string, n int) string {
+	hash := sha256.Sum256([]byte(salt + value))
+	return strconv.FormatUint(binary.BigEndian.Uint64(hash[:8])%uint64(n), 10)
+}
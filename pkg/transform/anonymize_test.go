@@ -0,0 +1,40 @@
+package transform
+
+import (
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestAnonymizeBuckets(t *testing.T) {
+	nodes := []string{"a", "b", "c", "d", "e", "f", "g", "h", "a"}
+	var metrics []*clientmodel.Metric
+	for _, node := range nodes {
+		metrics = append(metrics, &clientmodel.Metric{Label: labels("node", node, "pod", node)})
+	}
+	family := &clientmodel.MetricFamily{Name: stringp("m"), Metric: metrics}
+
+	a := NewMetricsAnonymizer("salt", []string{"pod"}, nil).WithBuckets(map[string]int{"node": 3})
+	if _, err := a.Transform(family); err != nil {
+		t.Fatal(err)
+	}
+
+	values := make(map[string]struct{})
+	for i, m := range family.Metric {
+		values[m.Label[0].GetValue()] = struct{}{}
+		switch v := m.Label[0].GetValue(); v {
+		case "0", "1", "2":
+		default:
+			t.Errorf("node = %q, want a bucket between 0 and 2", v)
+		}
+		if v, want := m.Label[1].GetValue(), secureValueHash("salt", nodes[i]); v != want {
+			t.Errorf("pod = %q, want %q", v, want)
+		}
+	}
+	if len(values) > 3 {
+		t.Errorf("got %d distinct buckets, want at most 3", len(values))
+	}
+	if first, last := metrics[0].Label[0].GetValue(), metrics[8].Label[0].GetValue(); first != last {
+		t.Errorf("equal values were mapped to buckets %s and %s", first, last)
+	}
+}
@@ -0,0 +1,88 @@
+package transform
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+type bucketReducer struct {
+	rules map[string][]float64
+}
+
+// NewBucketReducer keeps only the bucket boundaries listed in rules for each
+// histogram name in rules. The +Inf bucket, the sum, and the count are always kept.
+// Histogram families are reduced in place, and for histograms federated as separate
+// series the NAME_bucket series with other le values are dropped. Buckets are
+// cumulative, so a retained bucket already counts every observation at or below its
+// boundary and the reduced histogram stays monotonic. Boundaries in rules that the
+// histogram does not have are ignored.
+func NewBucketReducer(rules map[string][]float64) Interface {
+	return &bucketReducer{rules: rules}
+}
+
+func (t *bucketReducer) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	name := family.GetName()
+	if family.GetType() == clientmodel.MetricType_HISTOGRAM {
+		bounds, ok := t.rules[name]
+		if !ok {
+			return true, nil
+		}
+		for _, m := range family.Metric {
+			if m == nil || m.Histogram == nil {
+				continue
+			}
+			buckets := m.Histogram.Bucket[:0]
+			for _, b := range m.Histogram.Bucket {
+				if keepBucket(b.GetUpperBound(), bounds) {
+					buckets = append(buckets, b)
+				}
+			}
+			m.Histogram.Bucket = buckets
+		}
+		return true, nil
+	}
+
+	if !strings.HasSuffix(name, "_bucket") {
+		return true, nil
+	}
+	bounds, ok := t.rules[strings.TrimSuffix(name, "_bucket")]
+	if !ok {
+		return true, nil
+	}
+	pack := false
+	for i, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		for _, label := range m.Label {
+			if label == nil || label.GetName() != "le" {
+				continue
+			}
+			le, err := strconv.ParseFloat(label.GetValue(), 64)
+			if err == nil && !keepBucket(le, bounds) {
+				family.Metric[i] = nil
+				pack = true
+			}
+			break
+		}
+	}
+	if pack {
+		return PackMetrics.Transform(family)
+	}
+	return true, nil
+}
+
+func keepBucket(le float64, bounds []float64) bool {
+	if math.IsInf(le, 1) {
+		return true
+	}
+	for _, b := range bounds {
+		if b == le {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package transform
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func bucket(le float64, count uint64) *clientmodel.Bucket {
+	return &clientmodel.Bucket{UpperBound: &le, CumulativeCount: &count}
+}
+
+func TestBucketReducerHistogram(t *testing.T) {
+	inf := math.Inf(1)
+	family := &clientmodel.MetricFamily{
+		Name: stringp("latency"),
+		Type: clientmodel.MetricType_HISTOGRAM.Enum(),
+		Metric: []*clientmodel.Metric{{Histogram: &clientmodel.Histogram{
+			Bucket: []*clientmodel.Bucket{bucket(0.1, 1), bucket(0.5, 3), bucket(1, 4), bucket(5, 8), bucket(inf, 9)},
+		}}},
+	}
+	ok, err := NewBucketReducer(map[string][]float64{"latency": {1, 0.1, 2}}).Transform(family)
+	if err != nil || !ok {
+		t.Fatalf("Transform() = %t, %v", ok, err)
+	}
+	want := []*clientmodel.Bucket{bucket(0.1, 1), bucket(1, 4), bucket(inf, 9)}
+	if got := family.Metric[0].Histogram.Bucket; !reflect.DeepEqual(got, want) {
+		t.Errorf("buckets = %v, want %v", got, want)
+	}
+}
+
+func TestBucketReducerFederatedSeries(t *testing.T) {
+	series := func(name string, les ...string) *clientmodel.MetricFamily {
+		family := &clientmodel.MetricFamily{Name: stringp(name)}
+		for _, le := range les {
+			family.Metric = append(family.Metric, &clientmodel.Metric{Label: labels("job", "a", "le", le)})
+		}
+		return family
+	}
+	reducer := NewBucketReducer(map[string][]float64{"latency": {1, 10}})
+
+	family := series("latency_bucket", "0.1", "1.0", "5", "10", "+Inf")
+	if ok, err := reducer.Transform(family); err != nil || !ok {
+		t.Fatalf("Transform() = %t, %v", ok, err)
+	}
+	if want := series("latency_bucket", "1.0", "10", "+Inf"); !reflect.DeepEqual(family, want) {
+		t.Errorf("family = %v, want %v", family, want)
+	}
+
+	for _, name := range []string{"latency_sum", "latency_count", "other_bucket"} {
+		family := series(name, "0.1")
+		if ok, err := reducer.Transform(family); err != nil || !ok || len(family.Metric) != 1 {
+			t.Errorf("%s was changed: %v", name, family)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package transform
+
+import (
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// BudgetEnforcer drops whole families from a batch until its encoded size fits
+// within a budget.
+type BudgetEnforcer struct {
+	maxBytes int
+	priority func(name string) int
+	dropped  []string
+}
+
+// NewBudgetEnforcer keeps the encoded size of each batch at or below maxBytes. If a
+// batch is larger, families are dropped starting with the lowest priority and, among
+// families of equal priority, the largest. The size is that of the uncompressed
+// delimited protobuf encoding, so the uploaded payload is usually smaller. It should
+// run after every other transformer. This type is not thread-safe.
+func NewBudgetEnforcer(maxBytes int, priority func(name string) int) *BudgetEnforcer {
+	return &BudgetEnforcer{maxBytes: maxBytes, priority: priority}
+}
+
+func (t *BudgetEnforcer) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	return true, nil
+}
+
+// Dropped returns the names of the families dropped from the last batch.
+func (t *BudgetEnforcer) Dropped() []string {
+	return t.dropped
+}
+
+func (t *BudgetEnforcer) Append(families []*clientmodel.MetricFamily) []*clientmodel.MetricFamily {
+	t.dropped = nil
+	type candidate struct {
+		index    int
+		size     int
+		priority int
+	}
+	var candidates []candidate
+	total := 0
+	for i, family := range families {
+		if family == nil {
+			continue
+		}
+		size := proto.Size(family)
+		size += len(proto.EncodeVarint(uint64(size)))
+		total += size
+		candidates = append(candidates, candidate{index: i, size: size, priority: t.priority(family.GetName())})
+	}
+	if total <= t.maxBytes {
+		return families
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].priority != candidates[j].priority {
+			return candidates[i].priority < candidates[j].priority
+		}
+		return candidates[i].size > candidates[j].size
+	})
+	for _, c := range candidates {
+		if total <= t.maxBytes {
+			break
+		}
+		t.dropped = append(t.dropped, families[c.index].GetName())
+		families[c.index] = nil
+		total -= c.size
+	}
+	log.Printf("warning: batch exceeds %d bytes, dropped %d families: %s", t.maxBytes, len(t.dropped), strings.Join(t.dropped, ", "))
+	return families
+}
@@ -0,0 +1,81 @@
+package transform
+
+import (
+	"reflect"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func budgetFamily(name string, metrics int) *clientmodel.MetricFamily {
+	family := &clientmodel.MetricFamily{Name: stringp(name), Type: clientmodel.MetricType_GAUGE.Enum()}
+	for i := 0; i < metrics; i++ {
+		family.Metric = append(family.Metric, &clientmodel.Metric{
+			Label:       labels("instance", string('a'+rune(i))),
+			Gauge:       &clientmodel.Gauge{Value: float64p(1)},
+			TimestampMs: int64p(1),
+		})
+	}
+	return family
+}
+
+func TestBudgetEnforcer(t *testing.T) {
+	priorities := map[string]int{"high": 1, "low": -1}
+	priority := func(name string) int { return priorities[name] }
+	tests := []struct {
+		name        string
+		families    []*clientmodel.MetricFamily
+		maxBytes    int
+		wantDropped []string
+	}{
+		{
+			name:     "under budget",
+			families: []*clientmodel.MetricFamily{budgetFamily("high", 2), budgetFamily("low", 2)},
+			maxBytes: 1000,
+		},
+		{
+			name:        "lowest priority first",
+			families:    []*clientmodel.MetricFamily{budgetFamily("high", 1), budgetFamily("small", 1), budgetFamily("low", 1)},
+			maxBytes:    80,
+			wantDropped: []string{"low"},
+		},
+		{
+			name:        "largest first within a priority",
+			families:    []*clientmodel.MetricFamily{budgetFamily("high", 1), budgetFamily("small", 1), budgetFamily("large", 3)},
+			maxBytes:    80,
+			wantDropped: []string{"large"},
+		},
+		{
+			name:        "drops until it fits",
+			families:    []*clientmodel.MetricFamily{budgetFamily("high", 1), budgetFamily("small", 1), budgetFamily("low", 1)},
+			maxBytes:    40,
+			wantDropped: []string{"low", "small"},
+		},
+		{
+			name:        "drops everything",
+			families:    []*clientmodel.MetricFamily{budgetFamily("high", 1), nil},
+			maxBytes:    1,
+			wantDropped: []string{"high"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := len(Pack(append([]*clientmodel.MetricFamily(nil), tt.families...))) - len(tt.wantDropped)
+			b := NewBudgetEnforcer(tt.maxBytes, priority)
+			families := b.Append(tt.families)
+			if !reflect.DeepEqual(b.Dropped(), tt.wantDropped) {
+				t.Fatalf("Dropped() = %v, want %v", b.Dropped(), tt.wantDropped)
+			}
+			for _, family := range families {
+				for _, name := range tt.wantDropped {
+					if family != nil && family.GetName() == name {
+						t.Errorf("family %s was not removed", name)
+					}
+				}
+			}
+			if got := len(Pack(families)); got != want {
+				t.Errorf("kept %d families, want %d", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package transform
+
+import (
+	"sort"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+type buildInfo struct {
+	name   string
+	labels []*clientmodel.LabelPair
+	now    int64
+}
+
+// NewBuildInfo adds a gauge family called name with a single sample of 1 and the
+// given labels to each batch, timestamped with now. Families with the same name
+// already in the batch are dropped so the batch carries exactly one, even if the
+// transformer is applied more than once.
+func NewBuildInfo(name string, labels map[string]string, now time.Time) Interface {
+	pairs := make([]*clientmodel.LabelPair, 0, len(labels))
+	for k, v := range labels {
+		name, value := k, v
+		pairs = append(pairs, &clientmodel.LabelPair{Name: &name, Value: &value})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].GetName() < pairs[j].GetName() })
+	return &buildInfo{
+		name:   name,
+		labels: pairs,
+		now:    now.UnixNano() / int64(time.Millisecond),
+	}
+}
+
+func (t *buildInfo) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	return family.GetName() != t.name, nil
+}
+
+// Append inserts the build info family before the first family that sorts after it,
+// so a batch sorted by name stays sorted.
+func (t *buildInfo) Append(families []*clientmodel.MetricFamily) []*clientmodel.MetricFamily {
+	name, value, ts := t.name, float64(1), t.now
+	typ := clientmodel.MetricType_GAUGE
+	labels := make([]*clientmodel.LabelPair, len(t.labels))
+	copy(labels, t.labels)
+	family := &clientmodel.MetricFamily{
+		Name: &name,
+		Type: &typ,
+		Metric: []*clientmodel.Metric{{
+			Label:       labels,
+			Gauge:       &clientmodel.Gauge{Value: &value},
+			TimestampMs: &ts,
+		}},
+	}
+
+	return insertFamily(families, family)
+}
+
+// insertFamily inserts family before the first family in families that sorts after
+// it, so a batch sorted by name stays sorted.
+func insertFamily(families []*clientmodel.MetricFamily, family *clientmodel.MetricFamily) []*clientmodel.MetricFamily {
+	i := 0
+	for ; i < len(families); i++ {
+		if families[i] != nil && families[i].GetName() > family.GetName() {
+			break
+		}
+	}
+	families = append(families, nil)
+	copy(families[i+1:], families[i:])
+	families[i] = family
+	return families
+}
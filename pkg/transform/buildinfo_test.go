@@ -0,0 +1,42 @@
+package transform
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestBuildInfo(t *testing.T) {
+	now := time.Unix(100, 0)
+	families := []*clientmodel.MetricFamily{
+		{Name: stringp("a"), Metric: []*clientmodel.Metric{{}}},
+		nil,
+		{Name: stringp("build_info"), Metric: []*clientmodel.Metric{{}}},
+		{Name: stringp("c"), Metric: []*clientmodel.Metric{{}}},
+	}
+
+	for i := 0; i < 2; i++ {
+		info := NewBuildInfo("build_info", map[string]string{"version": "v1", "commit": "abc"}, now)
+		if err := Filter(families, info); err != nil {
+			t.Fatal(err)
+		}
+		families = Pack(info.(Appender).Append(families))
+	}
+
+	var names []string
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	if want := []string{"a", "build_info", "c"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("names = %v, want %v", names, want)
+	}
+	m := families[1].Metric[0]
+	if got, want := m.Label, labels("commit", "abc", "version", "v1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("labels = %v, want %v", got, want)
+	}
+	if m.GetGauge().GetValue() != 1 || m.GetTimestampMs() != 100000 {
+		t.Errorf("metric = %v, want value 1 at 100000", m)
+	}
+}
@@ -0,0 +1,46 @@
+package transform
+
+import (
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+type typeCoercer struct {
+	rules map[string]clientmodel.MetricType
+}
+
+// NewTypeCoercer declares untyped families named in rules as the type they map to,
+// which must be a counter or a gauge. The value of each sample is moved to the field
+// of the new type and is otherwise unchanged. Families that are not untyped or not
+// named in rules are left as they are.
+func NewTypeCoercer(rules map[string]clientmodel.MetricType) Interface {
+	return &typeCoercer{rules: rules}
+}
+
+func (t *typeCoercer) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	if family.GetType() != clientmodel.MetricType_UNTYPED {
+		return true, nil
+	}
+	typ, ok := t.rules[family.GetName()]
+	if !ok {
+		return true, nil
+	}
+	switch typ {
+	case clientmodel.MetricType_COUNTER, clientmodel.MetricType_GAUGE:
+	default:
+		return true, nil
+	}
+	family.Type = typ.Enum()
+	for _, m := range family.Metric {
+		if m == nil || m.Untyped == nil {
+			continue
+		}
+		value := m.Untyped.Value
+		m.Untyped = nil
+		if typ == clientmodel.MetricType_COUNTER {
+			m.Counter = &clientmodel.Counter{Value: value}
+		} else {
+			m.Gauge = &clientmodel.Gauge{Value: value}
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,47 @@
+package transform
+
+import (
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestTypeCoercer(t *testing.T) {
+	untyped := func(name string, value float64) *clientmodel.MetricFamily {
+		return &clientmodel.MetricFamily{
+			Name:   stringp(name),
+			Type:   clientmodel.MetricType_UNTYPED.Enum(),
+			Metric: []*clientmodel.Metric{{Label: labels("a", "b"), Untyped: &clientmodel.Untyped{Value: float64p(value)}}},
+		}
+	}
+	coercer := NewTypeCoercer(map[string]clientmodel.MetricType{
+		"requests": clientmodel.MetricType_COUNTER,
+		"load":     clientmodel.MetricType_GAUGE,
+	})
+
+	requests, load, other := untyped("requests", 3), untyped("load", 0.5), untyped("other", 1)
+	for _, family := range []*clientmodel.MetricFamily{requests, load, other} {
+		if ok, err := coercer.Transform(family); !ok || err != nil {
+			t.Fatalf("Transform() = %t, %v", ok, err)
+		}
+	}
+	if m := requests.Metric[0]; requests.GetType() != clientmodel.MetricType_COUNTER || m.Untyped != nil || m.Counter.GetValue() != 3 {
+		t.Errorf("requests was not coerced to a counter: %v", requests)
+	}
+	if m := load.Metric[0]; load.GetType() != clientmodel.MetricType_GAUGE || m.Untyped != nil || m.Gauge.GetValue() != 0.5 {
+		t.Errorf("load was not coerced to a gauge: %v", load)
+	}
+	if m := other.Metric[0]; other.GetType() != clientmodel.MetricType_UNTYPED || m.Untyped.GetValue() != 1 {
+		t.Errorf("other was changed: %v", other)
+	}
+
+	gauge := &clientmodel.MetricFamily{
+		Name:   stringp("requests"),
+		Type:   clientmodel.MetricType_GAUGE.Enum(),
+		Metric: []*clientmodel.Metric{{Gauge: &clientmodel.Gauge{Value: float64p(1)}}},
+	}
+	coercer.Transform(gauge)
+	if gauge.GetType() != clientmodel.MetricType_GAUGE || gauge.Metric[0].Gauge == nil {
+		t.Errorf("a family that is not untyped was changed: %v", gauge)
+	}
+}
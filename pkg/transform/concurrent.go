@@ -0,0 +1,102 @@
+package transform
+
+import (
+	"sync"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// minFamiliesPerShard keeps FilterConcurrent from starting goroutines for batches
+// that are faster to transform serially.
+const minFamiliesPerShard = 100
+
+// stateless is implemented by transformers that keep no state between calls to
+// Transform and only modify the family they are given, so that different families
+// may be transformed concurrently.
+type stateless interface {
+	stateless() bool
+}
+
+// IsStateless returns true if t may transform different families concurrently.
+func IsStateless(t Interface) bool {
+	s, ok := t.(stateless)
+	return ok && s.stateless()
+}
+
+// FilterConcurrent is equivalent to Filter, but splits families into at most
+// concurrency shards that are transformed in parallel if t is stateless. The error
+// of the first failing shard is returned.
+func FilterConcurrent(families []*clientmodel.MetricFamily, filter Interface, concurrency int) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	size := (len(families) + concurrency - 1) / concurrency
+	if size < minFamiliesPerShard {
+		size = minFamiliesPerShard
+	}
+	if !IsStateless(filter) || len(families) <= size {
+		return Filter(families, filter)
+	}
+
+	errs := make([]error, (len(families)+size-1)/size)
+	var wg sync.WaitGroup
+	for i := range errs {
+		end := (i + 1) * size
+		if end > len(families) {
+			end = len(families)
+		}
+		wg.Add(1)
+		go func(i int, shard []*clientmodel.MetricFamily) {
+			defer wg.Done()
+			errs[i] = Filter(shard, filter)
+		}(i, families[i*size:end])
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (transformers All) stateless() bool {
+	for _, t := range transformers {
+		if !IsStateless(t) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *timed) stateless() bool        { return IsStateless(t.t) }
+func (t *countDropped) stateless() bool { return IsStateless(t.t) }
+
+func (_ none) stateless() bool                         { return true }
+func (_ dropEmptyFamilies) stateless() bool            { return true }
+func (_ packMetrics) stateless() bool                  { return true }
+func (_ sortMetrics) stateless() bool                  { return true }
+func (_ RenameMetrics) stateless() bool                { return true }
+func (_ prefixMetrics) stateless() bool                { return true }
+func (_ requireLabel) stateless() bool                 { return true }
+func (_ dropStaleMarkers) stateless() bool             { return true }
+func (_ *dropInvalidFederateSamples) stateless() bool  { return true }
+func (_ *dropExpiredSamples) stateless() bool          { return true }
+func (_ *errorInvalidFederateSamples) stateless() bool { return true }
+func (_ *labelAllowlist) stateless() bool              { return true }
+func (_ *stripMetaLabels) stateless() bool             { return true }
+func (_ *labelValueTruncator) stateless() bool         { return true }
+func (_ *timestampAlign) stateless() bool              { return true }
+func (_ *relabeler) stateless() bool                   { return true }
+func (_ *valueRounder) stateless() bool                { return true }
+func (_ *buildInfo) stateless() bool                   { return true }
+func (_ *bucketReducer) stateless() bool               { return true }
+func (_ *LabelCountLimiter) stateless() bool           { return true }
+func (_ *aggregator) stateless() bool                  { return true }
+func (_ *ExtraMetrics) stateless() bool                { return true }
+func (_ *typeCoercer) stateless() bool                 { return true }
+func (_ *valueRemapper) stateless() bool               { return true }
+func (_ *MonotonicTimestamps) stateless() bool         { return true }
+func (_ *dropOldSamples) stateless() bool              { return true }
+func (_ *SummaryGauges) stateless() bool               { return true }
+func (_ *seriesSampler) stateless() bool               { return true }
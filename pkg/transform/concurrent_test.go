@@ -0,0 +1,87 @@
+package transform
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func concurrentFamilies(n int) []*clientmodel.MetricFamily {
+	typ := clientmodel.MetricType_GAUGE
+	families := make([]*clientmodel.MetricFamily, 0, n)
+	for i := 0; i < n; i++ {
+		var metrics []*clientmodel.Metric
+		for j := 0; j < 10; j++ {
+			metrics = append(metrics, &clientmodel.Metric{
+				Label:       labels("pod", fmt.Sprintf("pod-%d-%d-with-a-long-name", i, j), "job", "a"),
+				Gauge:       &clientmodel.Gauge{Value: float64p(float64(i*j) + 0.123)},
+				TimestampMs: int64p(int64(10 - j)),
+			})
+		}
+		if i%7 == 0 {
+			metrics[3] = nil
+		}
+		families = append(families, &clientmodel.MetricFamily{Name: stringp(fmt.Sprintf("metric_%d", i)), Type: &typ, Metric: metrics})
+	}
+	return families
+}
+
+func concurrentTransforms() All {
+	return All{
+		NewLabelValueTruncator(16),
+		NewValueRounder(map[string]Rounding{"metric_3": {Mode: RoundNearest, Precision: 1}}),
+		NewDropInvalidFederateSamples(time.Unix(0, 0)),
+		RenameMetrics{Names: map[string]string{"metric_5": "renamed"}},
+		PackMetrics,
+		SortMetrics,
+	}
+}
+
+func TestFilterConcurrentMatchesFilter(t *testing.T) {
+	serial, concurrent := concurrentFamilies(1000), concurrentFamilies(1000)
+	for _, f := range concurrentTransforms() {
+		if !IsStateless(f) {
+			t.Fatalf("%T is not stateless", f)
+		}
+		if err := Filter(serial, f); err != nil {
+			t.Fatal(err)
+		}
+		if err := FilterConcurrent(concurrent, f, 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(serial, concurrent) {
+		t.Error("concurrent transform differs from serial transform")
+	}
+}
+
+func TestIsStateless(t *testing.T) {
+	if IsStateless(NewNameValidator(InvalidNamesSanitize)) || IsStateless(NewLabel(nil, nil)) {
+		t.Error("stateful transformers must not be stateless")
+	}
+	if IsStateless(All{PackMetrics, NewCounterResetGuard(time.Minute, 1)}) {
+		t.Error("All with a stateful transformer must not be stateless")
+	}
+	if !IsStateless(NewTimed(PackMetrics, func(time.Duration) {})) {
+		t.Error("timed stateless transformer must be stateless")
+	}
+}
+
+func benchmarkFilter(b *testing.B, concurrency int) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		families := concurrentFamilies(5000)
+		b.StartTimer()
+		for _, f := range concurrentTransforms() {
+			if err := FilterConcurrent(families, f, concurrency); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkFilterSerial(b *testing.B)     { benchmarkFilter(b, 1) }
+func BenchmarkFilterConcurrent(b *testing.B) { benchmarkFilter(b, 4) }
@@ -0,0 +1,86 @@
+package transform
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+type counterSample struct {
+	value     float64
+	timestamp int64
+}
+
+// CounterResetGuard remembers the last value of each counter series across batches
+// and suppresses decreases that are unlikely to be real counter resets. This type is
+// not thread-safe.
+type CounterResetGuard struct {
+	window int64
+	series *simplelru.LRU
+}
+
+// NewCounterResetGuard returns a guard that tracks at most maxSeries counter series,
+// forgetting the least recently seen series first.
+//
+// Federation returns point-in-time snapshots, possibly from different Prometheus
+// replicas whose counters differ slightly, so not every decrease is a reset. A
+// decrease is treated as a genuine reset and passed through if the sample is more
+// than window newer than the last sample of the series, or if the new value is less
+// than half of the previous value (the process restarted and has not yet caught up).
+// Any other decrease, including samples that are not newer than the last one, is
+// replaced with the previous value so that downstream rates never go negative.
+func NewCounterResetGuard(window time.Duration, maxSeries int) *CounterResetGuard {
+	if maxSeries < 1 {
+		maxSeries = 1
+	}
+	series, _ := simplelru.NewLRU(maxSeries, nil)
+	return &CounterResetGuard{
+		window: int64(window / time.Millisecond),
+		series: series,
+	}
+}
+
+func (g *CounterResetGuard) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	if family.GetType() != clientmodel.MetricType_COUNTER {
+		return true, nil
+	}
+	for _, m := range family.Metric {
+		if m == nil || m.Counter == nil || m.TimestampMs == nil {
+			continue
+		}
+		key := seriesKey(family.GetName(), m.Label)
+		current := counterSample{value: m.Counter.GetValue(), timestamp: m.GetTimestampMs()}
+		if v, ok := g.series.Get(key); ok {
+			last := v.(counterSample)
+			if current.value < last.value && !isCounterReset(last, current, g.window) {
+				value := last.value
+				m.Counter.Value = &value
+				current.value = last.value
+			}
+		}
+		g.series.Add(key, current)
+	}
+	return true, nil
+}
+
+func isCounterReset(last, current counterSample, window int64) bool {
+	if current.timestamp <= last.timestamp {
+		return false
+	}
+	return current.timestamp-last.timestamp > window || current.value < last.value/2
+}
+
+// seriesKey identifies a series by its metric name and its labels in name order.
+func seriesKey(name string, labels []*clientmodel.LabelPair) string {
+	pairs := make([]string, 0, len(labels))
+	for _, label := range labels {
+		if label != nil {
+			pairs = append(pairs, label.GetName()+"\xff"+label.GetValue())
+		}
+	}
+	sort.Strings(pairs)
+	return name + "\xfe" + strings.Join(pairs, "\xfe")
+}
@@ -0,0 +1,86 @@
+package transform
+
+import (
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func counterFamily(value float64, timestamp int64, labelPairs ...string) *clientmodel.MetricFamily {
+	typ := clientmodel.MetricType_COUNTER
+	return &clientmodel.MetricFamily{
+		Name: stringp("requests_total"),
+		Type: &typ,
+		Metric: []*clientmodel.Metric{{
+			Label:       labels(labelPairs...),
+			Counter:     &clientmodel.Counter{Value: &value},
+			TimestampMs: &timestamp,
+		}},
+	}
+}
+
+func TestCounterResetGuard(t *testing.T) {
+	minute := int64(time.Minute / time.Millisecond)
+	tests := []struct {
+		name    string
+		samples [][2]float64
+		want    []float64
+	}{
+		{
+			name:    "increasing",
+			samples: [][2]float64{{0, 10}, {1, 20}, {2, 30}},
+			want:    []float64{10, 20, 30},
+		},
+		{
+			name:    "small decrease is carried forward",
+			samples: [][2]float64{{0, 100}, {1, 98}, {2, 99}, {3, 105}},
+			want:    []float64{100, 100, 100, 105},
+		},
+		{
+			name:    "large decrease is a reset",
+			samples: [][2]float64{{0, 100}, {1, 10}, {2, 20}},
+			want:    []float64{100, 10, 20},
+		},
+		{
+			name:    "decrease after the window is a reset",
+			samples: [][2]float64{{0, 100}, {20, 90}},
+			want:    []float64{100, 90},
+		},
+		{
+			name:    "older sample is carried forward",
+			samples: [][2]float64{{5, 100}, {4, 10}},
+			want:    []float64{100, 100},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewCounterResetGuard(10*time.Minute, 10)
+			for i, sample := range tt.samples {
+				family := counterFamily(sample[1], int64(sample[0])*minute, "job", "a")
+				if _, err := g.Transform(family); err != nil {
+					t.Fatal(err)
+				}
+				if got := family.Metric[0].Counter.GetValue(); got != tt.want[i] {
+					t.Errorf("sample %d = %v, want %v", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCounterResetGuardBounded(t *testing.T) {
+	g := NewCounterResetGuard(time.Minute, 1)
+	g.Transform(counterFamily(100, 0, "job", "a"))
+	g.Transform(counterFamily(100, 0, "job", "b"))
+
+	// the first series was evicted, so the decrease is not suppressed
+	family := counterFamily(90, 1, "job", "a")
+	g.Transform(family)
+	if got := family.Metric[0].Counter.GetValue(); got != 90 {
+		t.Errorf("value = %v, want 90", got)
+	}
+	if g.series.Len() != 1 {
+		t.Errorf("tracked series = %d, want 1", g.series.Len())
+	}
+}
@@ -0,0 +1,99 @@
+package transform
+
+import (
+	"log"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// DedupePolicy controls which series NewDedupeSeries keeps when several series in a
+// family have identical labels.
+type DedupePolicy string
+
+const (
+	// DedupeNewest keeps the series with the newest timestamp.
+	DedupeNewest DedupePolicy = "newest"
+	// DedupeMax keeps the series with the largest value. The sample count is
+	// compared for histograms and summaries.
+	DedupeMax DedupePolicy = "max"
+	// DedupeDrop drops every series that has a duplicate.
+	DedupeDrop DedupePolicy = "drop"
+)
+
+type dedupeSeries struct {
+	policy DedupePolicy
+}
+
+// NewDedupeSeries resolves series with identical labels within a family according to
+// policy. Ties keep the series that came first. It should run after every
+// transformer that changes metric or label names.
+func NewDedupeSeries(policy DedupePolicy) Interface {
+	return &dedupeSeries{policy: policy}
+}
+
+func (t *dedupeSeries) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	if t.policy != DedupeMax && t.policy != DedupeDrop {
+		// DedupeNewest is the default
+		before := countMetrics(family)
+		keepNewestSeries(family)
+		t.resolved(family, before-countMetrics(family))
+		return true, nil
+	}
+	seen := make(map[string]int)
+	var duplicates []int
+	resolved := 0
+	for i, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		key := seriesKey(family.GetName(), m.Label)
+		previous, ok := seen[key]
+		if !ok {
+			seen[key] = i
+			continue
+		}
+		resolved++
+		switch t.policy {
+		case DedupeDrop:
+			family.Metric[i] = nil
+			duplicates = append(duplicates, previous)
+		default:
+			if seriesValue(m) > seriesValue(family.Metric[previous]) {
+				family.Metric[previous] = nil
+				seen[key] = i
+			} else {
+				family.Metric[i] = nil
+			}
+		}
+	}
+	for _, i := range duplicates {
+		family.Metric[i] = nil
+	}
+	t.resolved(family, resolved)
+	return true, nil
+}
+
+// resolved logs the number of duplicate series of family that were resolved.
+func (t *dedupeSeries) resolved(family *clientmodel.MetricFamily, resolved int) {
+	if resolved > 0 {
+		log.Printf("warning: resolved %d duplicate series of metric %s by policy %s", resolved, family.GetName(), t.policy)
+	}
+}
+
+// seriesValue returns the value of a counter, gauge, or untyped metric, or the sample
+// count of a histogram or summary.
+func seriesValue(m *clientmodel.Metric) float64 {
+	switch {
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	case m.Untyped != nil:
+		return m.Untyped.GetValue()
+	case m.Histogram != nil:
+		return float64(m.Histogram.GetSampleCount())
+	case m.Summary != nil:
+		return float64(m.Summary.GetSampleCount())
+	}
+	return 0
+}
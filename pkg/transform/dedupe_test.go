@@ -0,0 +1,50 @@
+package transform
+
+import (
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestDedupeSeries(t *testing.T) {
+	series := func(timestamp int64, value float64, pairs ...string) *clientmodel.Metric {
+		return &clientmodel.Metric{Label: labels(pairs...), TimestampMs: int64p(timestamp), Gauge: &clientmodel.Gauge{Value: float64p(value)}}
+	}
+	tests := []struct {
+		policy DedupePolicy
+		want   []int
+	}{
+		{policy: DedupeNewest, want: []int{1, 3}},
+		{policy: DedupeMax, want: []int{0, 3}},
+		{policy: DedupeDrop, want: []int{3}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			family := &clientmodel.MetricFamily{Name: stringp("m"), Metric: []*clientmodel.Metric{
+				series(1, 3, "a", "1", "b", "2"),
+				series(2, 1, "b", "2", "a", "1"),
+				series(0, 0, "a", "1", "b", "2"),
+				series(1, 1, "a", "2"),
+			}}
+
+			ok, err := NewDedupeSeries(tt.policy).Transform(family)
+			if !ok || err != nil {
+				t.Fatalf("Transform() = %t, %v", ok, err)
+			}
+			var kept []int
+			for i, m := range family.Metric {
+				if m != nil {
+					kept = append(kept, i)
+				}
+			}
+			if len(kept) != len(tt.want) {
+				t.Fatalf("kept series %v, want %v", kept, tt.want)
+			}
+			for i := range kept {
+				if kept[i] != tt.want[i] {
+					t.Fatalf("kept series %v, want %v", kept, tt.want)
+				}
+			}
+		})
+	}
+}
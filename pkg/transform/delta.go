@@ -0,0 +1,110 @@
+package transform
+
+import (
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// CounterToDelta replaces the value of each counter series with its increase since
+// the previous delivered batch. This type is not thread-safe.
+type CounterToDelta struct {
+	suffix string
+	window int64
+	series *simplelru.LRU
+	// pending holds the samples of the current batch until it is committed.
+	pending map[string]counterSample
+}
+
+// NewCounterToDelta returns a transformer that converts counters to gauges holding
+// the increase of each series since it was last seen, and appends suffix to their
+// names. A decrease is a counter reset and yields zero. The first sample of a
+// series, and a sample more than window newer than the last one of its series, only
+// establish a baseline and are dropped, as are samples without a timestamp. Samples
+// that are not newer than the last one yield zero. At most maxSeries series are
+// tracked, forgetting the least recently seen series first.
+//
+// The samples of a batch only become the baseline of their series once Commit is
+// called for it, so that the increase of a batch that was not delivered is included
+// in the next one.
+func NewCounterToDelta(suffix string, window time.Duration, maxSeries int) *CounterToDelta {
+	if maxSeries < 1 {
+		maxSeries = 1
+	}
+	series, _ := simplelru.NewLRU(maxSeries, nil)
+	return &CounterToDelta{
+		suffix:  suffix,
+		window:  int64(window / time.Millisecond),
+		series:  series,
+		pending: make(map[string]counterSample),
+	}
+}
+
+func (t *CounterToDelta) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	if family.GetType() != clientmodel.MetricType_COUNTER {
+		return true, nil
+	}
+	for i, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		if m.Counter == nil || m.TimestampMs == nil {
+			// no increase can be computed
+			family.Metric[i] = nil
+			continue
+		}
+		key := seriesKey(family.GetName(), m.Label)
+		current := counterSample{value: m.Counter.GetValue(), timestamp: m.GetTimestampMs()}
+		last, ok := t.last(key)
+		if !ok {
+			t.pending[key] = current
+			family.Metric[i] = nil
+			continue
+		}
+		var delta float64
+		switch {
+		case current.timestamp <= last.timestamp:
+		case current.timestamp-last.timestamp > t.window:
+			t.pending[key] = current
+			family.Metric[i] = nil
+			continue
+		default:
+			if current.value > last.value {
+				delta = current.value - last.value
+			}
+			t.pending[key] = current
+		}
+		m.Counter = nil
+		m.Gauge = &clientmodel.Gauge{Value: &delta}
+	}
+	name := family.GetName() + t.suffix
+	family.Name = &name
+	family.Type = clientmodel.MetricType_GAUGE.Enum()
+	return true, nil
+}
+
+// last returns the sample the increase of the series key is computed from, which is
+// an earlier sample of the same batch or the last committed one.
+func (t *CounterToDelta) last(key string) (counterSample, bool) {
+	if sample, ok := t.pending[key]; ok {
+		return sample, true
+	}
+	v, ok := t.series.Get(key)
+	if !ok {
+		return counterSample{}, false
+	}
+	return v.(counterSample), true
+}
+
+// Commit ends the current batch. If it was delivered its samples become the baseline
+// of their series, otherwise they are discarded and the next batch yields the
+// increase since the last delivered one.
+func (t *CounterToDelta) Commit(delivered bool) {
+	if delivered {
+		for key, sample := range t.pending {
+			t.series.Add(key, sample)
+		}
+	}
+	t.pending = make(map[string]counterSample)
+}
@@ -0,0 +1,97 @@
+package transform
+
+import (
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestCounterToDelta(t *testing.T) {
+	d := NewCounterToDelta("_delta", time.Minute, 10)
+	steps := []struct {
+		timestamp int64
+		value     float64
+		want      *float64
+	}{
+		{timestamp: 0, value: 10},
+		{timestamp: 30000, value: 15, want: float64p(5)},
+		{timestamp: 30000, value: 16, want: float64p(0)},
+		{timestamp: 60000, value: 3, want: float64p(0)},
+		{timestamp: 90000, value: 7, want: float64p(4)},
+		{timestamp: 200000, value: 20},
+		{timestamp: 230000, value: 21, want: float64p(1)},
+	}
+	for i, step := range steps {
+		family := &clientmodel.MetricFamily{
+			Name: stringp("requests_total"),
+			Type: clientmodel.MetricType_COUNTER.Enum(),
+			Metric: []*clientmodel.Metric{{
+				Label:       labels("a", "1"),
+				Counter:     &clientmodel.Counter{Value: float64p(step.value)},
+				TimestampMs: int64p(step.timestamp),
+			}},
+		}
+		if ok, err := d.Transform(family); !ok || err != nil {
+			t.Fatalf("step %d: Transform() = %t, %v", i, ok, err)
+		}
+		d.Commit(true)
+		if family.GetName() != "requests_total_delta" || family.GetType() != clientmodel.MetricType_GAUGE {
+			t.Fatalf("step %d: family is %s of type %s", i, family.GetName(), family.GetType())
+		}
+		m := family.Metric[0]
+		switch {
+		case step.want == nil && m != nil:
+			t.Errorf("step %d: expected the sample to be dropped, got %v", i, m)
+		case step.want != nil && m == nil:
+			t.Errorf("step %d: sample was dropped, want %v", i, *step.want)
+		case step.want != nil && (m.Counter != nil || m.GetGauge().GetValue() != *step.want):
+			t.Errorf("step %d: got %v, want gauge %v", i, m, *step.want)
+		}
+	}
+
+	gauge := &clientmodel.MetricFamily{Name: stringp("g"), Type: clientmodel.MetricType_GAUGE.Enum()}
+	if ok, err := d.Transform(gauge); !ok || err != nil || gauge.GetName() != "g" {
+		t.Errorf("Transform() changed a gauge: %v", gauge)
+	}
+}
+
+func TestCounterToDeltaCommit(t *testing.T) {
+	d := NewCounterToDelta("_delta", time.Minute, 10)
+	steps := []struct {
+		timestamp int64
+		value     float64
+		delivered bool
+		want      *float64
+	}{
+		{timestamp: 0, value: 10, delivered: false},
+		{timestamp: 30000, value: 12, delivered: true},
+		{timestamp: 60000, value: 15, delivered: false, want: float64p(3)},
+		{timestamp: 90000, value: 20, delivered: true, want: float64p(8)},
+		{timestamp: 120000, value: 21, delivered: true, want: float64p(1)},
+	}
+	for i, step := range steps {
+		family := &clientmodel.MetricFamily{
+			Name: stringp("requests_total"),
+			Type: clientmodel.MetricType_COUNTER.Enum(),
+			Metric: []*clientmodel.Metric{{
+				Label:       labels("a", "1"),
+				Counter:     &clientmodel.Counter{Value: float64p(step.value)},
+				TimestampMs: int64p(step.timestamp),
+			}},
+		}
+		if ok, err := d.Transform(family); !ok || err != nil {
+			t.Fatalf("step %d: Transform() = %t, %v", i, ok, err)
+		}
+		d.Commit(step.delivered)
+		m := family.Metric[0]
+		switch {
+		case step.want == nil && m != nil:
+			t.Errorf("step %d: expected the sample to be dropped, got %v", i, m)
+		case step.want != nil && m == nil:
+			t.Errorf("step %d: sample was dropped, want %v", i, *step.want)
+		case step.want != nil && m.GetGauge().GetValue() != *step.want:
+			t.Errorf("step %d: got %v, want gauge %v", i, m, *step.want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package transform
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Describe returns a description of t with its key parameters, for transformers
+// that implement fmt.Stringer, or the name of its type. Wrappers that record metrics
+// about a transformer are described as the transformer they wrap. Descriptions never
+// include secrets such as the anonymization salt or the values of added labels.
+func Describe(t Interface) string {
+	for {
+		w, ok := t.(interface{ Unwrap() Interface })
+		if !ok {
+			break
+		}
+		t = w.Unwrap()
+	}
+	if s, ok := t.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", t), "*")
+}
+
+// describe formats the name of a transformer followed by its parameters, skipping
+// empty ones.
+func describe(name string, params ...string) string {
+	parts := []string{name}
+	for i := 0; i+1 < len(params); i += 2 {
+		if len(params[i+1]) > 0 {
+			parts = append(parts, params[i]+"="+params[i+1])
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// keys returns the sorted keys of the map m, which must have string keys, separated
+// by commas.
+func keys(m interface{}) string {
+	v := reflect.ValueOf(m)
+	names := make([]string, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		names = append(names, k.String())
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// cutoff formats a timestamp in milliseconds.
+func cutoff(ms int64) string {
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+}
+
+func (transformers All) String() string {
+	descriptions := make([]string, 0, len(transformers))
+	for _, t := range transformers {
+		descriptions = append(descriptions, Describe(t))
+	}
+	return strings.Join(descriptions, "\n")
+}
+
+func (_ none) String() string              { return "none" }
+func (_ dropEmptyFamilies) String() string { return "drop-empty-families" }
+func (_ packMetrics) String() string       { return "pack" }
+func (_ sortMetrics) String() string       { return "sort" }
+func (_ dropStaleMarkers) String() string  { return "drop-stale-markers" }
+
+func (m RenameMetrics) String() string {
+	renames := make([]string, 0, len(m.Names))
+	for from, to := range m.Names {
+		renames = append(renames, from+"->"+to)
+	}
+	sort.Strings(renames)
+	return describe("rename", "names", strings.Join(renames, ","))
+}
+
+func (t prefixMetrics) String() string { return describe("prefix", "prefix", t.prefix) }
+
+func (t requireLabel) String() string {
+	if t.anyValue {
+		return describe("require-label", "names", keys(t.labels), "mode", string(t.mode))
+	}
+	return describe("require-labels", "keys", keys(t.labels))
+}
+
+func (t *label) String() string {
+	retriever := ""
+	if t.retriever != nil {
+		retriever = "true"
+	}
+	return describe("label", "keys", keys(t.labels), "retriever", retriever)
+}
+
+func (t *dropInvalidFederateSamples) String() string {
+	return describe("drop-invalid-federate-samples", "before", cutoff(t.min))
+}
+
+func (t *dropExpiredSamples) String() string {
+	return describe("drop-expired-samples", "before", cutoff(t.min))
+}
+
+func (t *errorInvalidFederateSamples) String() string {
+	return describe("error-invalid-federate-samples", "before", cutoff(t.min))
+}
+
+func (t *errorOnUnsorted) String() string {
+	return describe("error-on-unsorted", "require-timestamp", strconv.FormatBool(t.require))
+}
+
+func (t *labelAllowlist) String() string {
+	return describe("keep-labels", "keys", keys(t.keep))
+}
+
+func (t *stripMetaLabels) String() string {
+	return describe("strip-meta-labels", "keys", keys(t.drop))
+}
+
+func (a *AnonymizeMetrics) String() string {
+	byMetric := make([]string, 0, len(a.byMetric))
+	for name, labels := range a.byMetric {
+		byMetric = append(byMetric, name+":"+strings.Replace(keys(labels), ",", "+", -1))
+	}
+	sort.Strings(byMetric)
+	return describe("anonymize", "labels", keys(a.global), "metrics", strings.Join(byMetric, ","), "buckets", keys(a.buckets))
+}
+
+func (t *aggregator) String() string     { return describe("aggregate", "metrics", keys(t.rules)) }
+func (t *bucketReducer) String() string  { return describe("reduce-buckets", "metrics", keys(t.rules)) }
+func (t *typeCoercer) String() string    { return describe("coerce-types", "metrics", keys(t.rules)) }
+func (t *valueRounder) String() string   { return describe("round", "metrics", keys(t.rules)) }
+func (t *valueRemapper) String() string  { return describe("remap", "labels", keys(t.rules)) }
+func (t *dropOldSamples) String() string { return describe("max-age", "metrics", keys(t.min)) }
+func (t *Downsampler) String() string    { return describe("downsample", "metrics", keys(t.every)) }
+func (t *seriesSampler) String() string  { return describe("sample-rate", "metrics", keys(t.rates)) }
+func (t *dedupeSeries) String() string   { return describe("dedupe-series", "policy", string(t.policy)) }
+func (t *nameValidator) String() string  { return describe("invalid-names", "mode", string(t.mode)) }
+func (t *ExtraMetrics) String() string   { return describe("extra-metrics", "file", t.path) }
+func (t *LabelFile) String() string      { return describe("label-file", "file", t.path) }
+func (t *buildInfo) String() string      { return describe("build-info", "name", t.name) }
+
+func (t *SummaryGauges) String() string {
+	return describe("summary-to-gauge", "metrics", keys(t.quantiles), "summary", string(t.mode))
+}
+
+func (t *BudgetEnforcer) String() string {
+	return describe("max-batch-bytes", "bytes", strconv.Itoa(t.maxBytes))
+}
+
+func (t *labelValueTruncator) String() string {
+	return describe("truncate-label-values", "max", strconv.Itoa(t.max))
+}
+
+func (t *relabeler) String() string {
+	rules := make([]string, 0, len(t.rules))
+	for _, rule := range t.rules {
+		if len(rule.targetLabel) > 0 {
+			rules = append(rules, string(rule.action)+":"+rule.targetLabel)
+			continue
+		}
+		rules = append(rules, string(rule.action))
+	}
+	return describe("relabel", "rules", strings.Join(rules, ","))
+}
+
+func (t *LabelCountLimiter) String() string {
+	return describe("max-labels-per-series", "max", strconv.Itoa(t.max), "priority", strings.Join(t.priority, ","))
+}
+
+func (t *MonotonicTimestamps) String() string {
+	return describe("timestamp-order", "policy", string(t.policy))
+}
+
+func (g *CounterResetGuard) String() string {
+	return describe("counter-reset-guard", "window", (time.Duration(g.window) * time.Millisecond).String())
+}
+
+func (t *CounterToDelta) String() string {
+	return describe("counter-to-delta", "suffix", t.suffix, "window", (time.Duration(t.window) * time.Millisecond).String())
+}
+
+func (t *timestampAlign) String() string {
+	return describe("align-timestamps", "mode", string(t.mode),
+		"window", (time.Duration(t.fresh) * time.Millisecond).String(),
+		"max-shift", (time.Duration(t.maxShift) * time.Millisecond).String())
+}
@@ -0,0 +1,36 @@
+package transform
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDescribe(t *testing.T) {
+	tests := []struct {
+		t    Interface
+		want string
+	}{
+		{t: SortMetrics, want: "sort"},
+		{t: NewLabel(map[string]string{"id": "secret-id", "cluster": "a"}, nil), want: "label keys=cluster,id"},
+		{t: NewMetricsAnonymizer("salt", []string{"instance"}, map[string][]string{"up": {"job", "pod"}}), want: "anonymize labels=instance metrics=up:job+pod"},
+		{t: RenameMetrics{Names: map[string]string{"b": "c", "a": "d"}}, want: "rename names=a->d,b->c"},
+		{t: NewDropInvalidFederateSamples(time.Unix(3600, 0)), want: "drop-invalid-federate-samples before=1970-01-01T01:00:00Z"},
+		{t: NewCounterResetGuard(time.Minute, 1), want: "counter-reset-guard window=1m0s"},
+		{t: NewTimed(NewCountDropped("prefix", NewPrefixMetrics("cluster_"), testDropCounter{}), func(time.Duration) {}), want: "prefix prefix=cluster_"},
+		{t: &Count{}, want: "transform.Count"},
+	}
+	for _, tt := range tests {
+		if got := Describe(tt.t); got != tt.want {
+			t.Errorf("Describe() = %q, want %q", got, tt.want)
+		}
+	}
+
+	all := All{NewLabel(nil, nil), PackMetrics}
+	if got := all.String(); got != "label\npack" {
+		t.Errorf("String() = %q", got)
+	}
+	if got := Describe(NewMetricsAnonymizer("secret-salt", nil, nil)); strings.Contains(got, "secret") {
+		t.Errorf("Describe() includes the salt: %s", got)
+	}
+}
@@ -0,0 +1,36 @@
+package transform
+
+import (
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// Downsampler keeps selected families in only every Nth batch they appear in. This
+// type is not thread-safe.
+type Downsampler struct {
+	every map[string]int
+	seen  map[string]int
+}
+
+// NewDownsampler returns a downsampler that keeps each family named in every in one
+// of every N batches, where N is the value it maps to, and drops it from the others.
+// Families are kept the first time they are seen, so after a restart the count
+// starts over. Downstream, the samples of downsampled families are spaced unevenly
+// whenever the interval or the set of batches changes, and queries over a range
+// shorter than N intervals may find no samples.
+func NewDownsampler(every map[string]int) *Downsampler {
+	return &Downsampler{
+		every: every,
+		seen:  make(map[string]int),
+	}
+}
+
+func (t *Downsampler) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	name := family.GetName()
+	n, ok := t.every[name]
+	if !ok || n <= 1 {
+		return true, nil
+	}
+	count := t.seen[name]
+	t.seen[name] = (count + 1) % n
+	return count == 0, nil
+}
@@ -0,0 +1,30 @@
+package transform
+
+import (
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestDownsampler(t *testing.T) {
+	d := NewDownsampler(map[string]int{"slow": 3, "every": 1})
+	var kept []bool
+	for i := 0; i < 7; i++ {
+		ok, err := d.Transform(&clientmodel.MetricFamily{Name: stringp("slow")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept = append(kept, ok)
+		for _, name := range []string{"every", "other"} {
+			if ok, _ := d.Transform(&clientmodel.MetricFamily{Name: stringp(name)}); !ok {
+				t.Errorf("Transform() dropped %s in batch %d", name, i)
+			}
+		}
+	}
+	want := []bool{true, false, false, true, false, false, true}
+	for i := range want {
+		if kept[i] != want[i] {
+			t.Fatalf("Transform() kept slow = %v, want %v", kept, want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package transform
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// ExtraMetrics adds the metric families of a file in the text exposition format to
+// each batch, reloading the file when it changes.
+type ExtraMetrics struct {
+	path string
+
+	lock     sync.Mutex
+	families []*clientmodel.MetricFamily
+	names    map[string]struct{}
+	modified time.Time
+}
+
+// NewExtraMetrics reads the families to add from path, returning an error if the file
+// can't be read or parsed. Families with the same names already in the batch are
+// dropped. Samples without a timestamp are timestamped with the time they are added.
+func NewExtraMetrics(path string) (*ExtraMetrics, error) {
+	t := &ExtraMetrics{path: path}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *ExtraMetrics) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	_, ok := t.names[family.GetName()]
+	return !ok, nil
+}
+
+// Append inserts the families of the file so that a batch sorted by name stays
+// sorted. If the file has changed but can't be loaded the previous families are added.
+func (t *ExtraMetrics) Append(families []*clientmodel.MetricFamily) []*clientmodel.MetricFamily {
+	if err := t.load(); err != nil {
+		log.Printf("error: unable to reload %s, continuing to use the previous metrics: %v", t.path, err)
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for _, family := range t.families {
+		family = proto.Clone(family).(*clientmodel.MetricFamily)
+		for _, m := range family.Metric {
+			if m.TimestampMs == nil {
+				m.TimestampMs = proto.Int64(now)
+			}
+		}
+		families = insertFamily(families, family)
+	}
+	return families
+}
+
+// load reads the file if it has changed since it was last read.
+func (t *ExtraMetrics) load() error {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	loaded := t.families != nil && !info.ModTime().After(t.modified)
+	t.lock.Unlock()
+	if loaded {
+		return nil
+	}
+
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	parsed, err := (&expfmt.TextParser{}).TextToMetricFamilies(f)
+	if err != nil {
+		return fmt.Errorf("%s is not in the text exposition format: %v", t.path, err)
+	}
+	families := make([]*clientmodel.MetricFamily, 0, len(parsed))
+	names := make(map[string]struct{}, len(parsed))
+	for name, family := range parsed {
+		families = append(families, family)
+		names[name] = struct{}{}
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.families != nil {
+		log.Printf("Reloaded extra metrics from %s", t.path)
+	}
+	t.families = families
+	t.names = names
+	t.modified = info.ModTime()
+	return nil
+}
@@ -0,0 +1,57 @@
+package transform
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestExtraMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "extra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "extra.prom")
+	if err := ioutil.WriteFile(path, []byte("# TYPE deployment_info gauge\ndeployment_info{region=\"eu\"} 1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	extra, err := NewExtraMetrics(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := extra.Transform(&clientmodel.MetricFamily{Name: stringp("deployment_info")}); ok {
+		t.Errorf("Transform() kept a family with the name of an extra metric")
+	}
+	families := extra.Append([]*clientmodel.MetricFamily{{Name: stringp("a")}, {Name: stringp("z")}})
+	if len(families) != 3 || families[1].GetName() != "deployment_info" {
+		t.Fatalf("Append() did not insert the extra metric in order: %v", families)
+	}
+	if m := families[1].Metric[0]; m.TimestampMs == nil || m.Gauge.GetValue() != 1 || formatLabels(m.Label) != `{region="eu"}` {
+		t.Errorf("unexpected extra metric %v", m)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("tier 2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	families = extra.Append(nil)
+	if len(families) != 1 || families[0].GetName() != "tier" {
+		t.Fatalf("Append() did not reload the changed file: %v", families)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("not a metric\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewExtraMetrics(path); err == nil {
+		t.Errorf("NewExtraMetrics() accepted an invalid file")
+	}
+}
@@ -0,0 +1,66 @@
+package transform
+
+import (
+	"sync/atomic"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// LabelCountLimiter limits the number of labels of each series.
+type LabelCountLimiter struct {
+	max      int
+	priority []string
+	dropped  int64
+}
+
+// NewLabelCountLimiter removes labels from series with more than max labels. The
+// labels in keepPriority are kept first, in the order given, and the remaining
+// labels in the order of the series until max labels are kept. The metric name is
+// not a label and is always kept. Series left with the same labels are merged as
+// with NewLabelAllowlist.
+func NewLabelCountLimiter(max int, keepPriority []string) *LabelCountLimiter {
+	return &LabelCountLimiter{max: max, priority: keepPriority}
+}
+
+// Dropped returns the number of labels removed since the transformer was created.
+func (t *LabelCountLimiter) Dropped() int64 {
+	return atomic.LoadInt64(&t.dropped)
+}
+
+func (t *LabelCountLimiter) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	dropped := 0
+	for _, m := range family.Metric {
+		if m == nil || len(m.Label) <= t.max {
+			continue
+		}
+		// select the priority labels present on the series, then fill up with the rest
+		keep := make([]bool, len(m.Label))
+		kept := 0
+		for _, name := range t.priority {
+			for j, label := range m.Label {
+				if kept < t.max && label != nil && !keep[j] && label.GetName() == name {
+					keep[j] = true
+					kept++
+				}
+			}
+		}
+		for j, label := range m.Label {
+			if kept < t.max && label != nil && !keep[j] {
+				keep[j] = true
+				kept++
+			}
+		}
+		for j, label := range m.Label {
+			if label != nil && !keep[j] {
+				m.Label[j] = nil
+				dropped++
+			}
+		}
+		m.Label = PackLabels(m.Label)
+	}
+	if dropped > 0 {
+		atomic.AddInt64(&t.dropped, int64(dropped))
+		keepNewestSeries(family)
+	}
+	return true, nil
+}
@@ -0,0 +1,35 @@
+package transform
+
+import (
+	"reflect"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestLabelCountLimiter(t *testing.T) {
+	family := &clientmodel.MetricFamily{
+		Name: stringp("up"),
+		Metric: []*clientmodel.Metric{
+			{Label: labels("a", "1", "b", "1", "cluster", "c", "pod", "1"), TimestampMs: int64p(1)},
+			{Label: labels("a", "1", "b", "2", "cluster", "c", "pod", "2"), TimestampMs: int64p(2)},
+			{Label: labels("a", "2", "cluster", "c"), TimestampMs: int64p(1)},
+		},
+	}
+	limiter := NewLabelCountLimiter(2, []string{"cluster"})
+	if ok, err := limiter.Transform(family); !ok || err != nil {
+		t.Fatalf("Transform() = %t, %v", ok, err)
+	}
+
+	want := []*clientmodel.Metric{
+		nil,
+		{Label: labels("a", "1", "cluster", "c"), TimestampMs: int64p(2)},
+		{Label: labels("a", "2", "cluster", "c"), TimestampMs: int64p(1)},
+	}
+	if !reflect.DeepEqual(family.Metric, want) {
+		t.Errorf("metrics = %v, want %v", family.Metric, want)
+	}
+	if limiter.Dropped() != 4 {
+		t.Errorf("Dropped() = %d, want 4", limiter.Dropped())
+	}
+}
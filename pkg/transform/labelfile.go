@@ -0,0 +1,175 @@
+package transform
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// LabelFile adds the labels of a file of key=value lines, such as the labels or
+// annotations of a pod written by the Kubernetes downward API, to every metric in
+// a batch. The file is reloaded when it changes.
+type LabelFile struct {
+	path     string
+	expand   func(string) (string, error)
+	reloaded func(error)
+
+	lock     sync.Mutex
+	labels   map[string]*clientmodel.LabelPair
+	modified time.Time
+}
+
+// NewLabelFile reads the labels to add from path, returning an error if the file
+// can't be read or has a malformed line. Blank lines and lines starting with '#' are
+// ignored, and values may be double quoted. If expand is not nil, it is applied to
+// every key and value. Characters that are not valid in label names, such as the '.',
+// '/' and '-' of Kubernetes label keys, are replaced by '_'. If reloaded is not nil,
+// it is called with the result of every later attempt to reload the changed file.
+func NewLabelFile(path string, expand func(string) (string, error), reloaded func(error)) (*LabelFile, error) {
+	t := &LabelFile{path: path, expand: expand, reloaded: reloaded}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *LabelFile) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	return true, nil
+}
+
+// Append adds the labels to every metric in the batch, replacing labels with the
+// same names. The labels are added here rather than in Transform so that the whole
+// batch gets the labels of the same version of the file. If the file has changed but
+// can't be loaded the previous labels are added.
+func (t *LabelFile) Append(families []*clientmodel.MetricFamily) []*clientmodel.MetricFamily {
+	if err := t.load(); err != nil {
+		log.Printf("error: unable to reload %s, continuing to use the previous labels: %v", t.path, err)
+	}
+	t.lock.Lock()
+	labels := t.labels
+	t.lock.Unlock()
+	if len(labels) == 0 {
+		return families
+	}
+	for _, family := range families {
+		if family == nil {
+			continue
+		}
+		for _, m := range family.Metric {
+			if m != nil {
+				m.Label = appendLabels(m.Label, labels)
+			}
+		}
+	}
+	return families
+}
+
+// load reads the file if it has changed since it was last read.
+func (t *LabelFile) load() error {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return t.reload(err)
+	}
+	t.lock.Lock()
+	initial := t.labels == nil
+	loaded := !initial && !info.ModTime().After(t.modified)
+	t.lock.Unlock()
+	if loaded {
+		return nil
+	}
+	labels, err := t.read()
+	if err != nil {
+		if initial {
+			return err
+		}
+		return t.reload(err)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !initial {
+		log.Printf("Reloaded labels from %s", t.path)
+	}
+	t.labels = labels
+	t.modified = info.ModTime()
+	if !initial {
+		return t.reload(nil)
+	}
+	return nil
+}
+
+// reload reports the result of reloading the file and returns err.
+func (t *LabelFile) reload(err error) error {
+	if t.reloaded != nil {
+		t.reloaded(err)
+	}
+	return err
+}
+
+// read parses the labels in the file.
+func (t *LabelFile) read() (map[string]*clientmodel.LabelPair, error) {
+
+	f, err := os.Open(t.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	labels := make(map[string]*clientmodel.LabelPair)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		s := strings.TrimSpace(scanner.Text())
+		if len(s) == 0 || strings.HasPrefix(s, "#") {
+			continue
+		}
+		name, value, err := t.parseLine(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", t.path, line, err)
+		}
+		if !model.LabelName(name).IsValid() {
+			sanitized := sanitizeName(name, false)
+			log.Printf("warning: %s:%d: %q is not a valid label name, using %q", t.path, line, name, sanitized)
+			name = sanitized
+		}
+		labels[name] = &clientmodel.LabelPair{Name: &name, Value: &value}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", t.path, err)
+	}
+	return labels, nil
+}
+
+func (t *LabelFile) parseLine(s string) (string, string, error) {
+	values := strings.SplitN(s, "=", 2)
+	if len(values) != 2 || len(strings.TrimSpace(values[0])) == 0 {
+		return "", "", fmt.Errorf("must be of the form key=value: %s", s)
+	}
+	name, value := strings.TrimSpace(values[0]), strings.TrimSpace(values[1])
+	if strings.HasPrefix(value, `"`) {
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid quoted value: %s", s)
+		}
+		value = unquoted
+	}
+	if t.expand != nil {
+		var err error
+		if name, err = t.expand(name); err != nil {
+			return "", "", err
+		}
+		if value, err = t.expand(value); err != nil {
+			return "", "", err
+		}
+	}
+	if len(name) == 0 {
+		return "", "", fmt.Errorf("empty label name: %s", s)
+	}
+	return name, value, nil
+}
@@ -0,0 +1,119 @@
+package transform
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestLabelFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "labels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "labels")
+	if err := ioutil.WriteFile(path, []byte("# pod labels\napp=\"telemeter\"\n\ntier=$TIER\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expand := func(s string) (string, error) { return strings.Replace(s, "$TIER", "backend", -1), nil }
+
+	var reloads []error
+	labelFile, err := NewLabelFile(path, expand, func(err error) { reloads = append(reloads, err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	families := labelFile.Append([]*clientmodel.MetricFamily{{
+		Name:   stringp("up"),
+		Metric: []*clientmodel.Metric{{Label: labels("app", "old", "job", "a")}},
+	}})
+	if got, want := formatLabels(families[0].Metric[0].Label), `{app="telemeter",job="a",tier="backend"}`; got != want {
+		t.Errorf("Append() labels = %s, want %s", got, want)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("app=other\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	families = labelFile.Append([]*clientmodel.MetricFamily{{
+		Name:   stringp("up"),
+		Metric: []*clientmodel.Metric{{}},
+	}})
+	if got, want := formatLabels(families[0].Metric[0].Label), `{app="other"}`; got != want {
+		t.Errorf("Append() after reload labels = %s, want %s", got, want)
+	}
+	if len(reloads) != 1 || reloads[0] != nil {
+		t.Errorf("reloads = %v, want one successful reload", reloads)
+	}
+
+	for _, content := range []string{"app\n", "=value\n", "app=\"unterminated\n", "$EMPTY=a\n"} {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewLabelFile(path, func(s string) (string, error) { return strings.Replace(s, "$EMPTY", "", -1), nil }, nil); err == nil || !strings.Contains(err.Error(), path+":1:") {
+			t.Errorf("NewLabelFile(%q) error = %v, want an error for line 1", content, err)
+		}
+	}
+}
+
+func TestLabelFileSanitizesNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "labels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "labels")
+	if err := ioutil.WriteFile(path, []byte("app.kubernetes.io/name=telemeter\npod-template-hash=abc\n1tier=a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	labelFile, err := NewLabelFile(path, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	families := labelFile.Append([]*clientmodel.MetricFamily{{
+		Name:   stringp("up"),
+		Metric: []*clientmodel.Metric{{}},
+	}})
+	pairs := families[0].Metric[0].Label
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].GetName() < pairs[j].GetName() })
+	if got, want := formatLabels(pairs), `{_1tier="a",app_kubernetes_io_name="telemeter",pod_template_hash="abc"}`; got != want {
+		t.Errorf("Append() labels = %s, want %s", got, want)
+	}
+}
+
+func TestLabelFileCopiesLabels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "labels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "labels")
+	if err := ioutil.WriteFile(path, []byte("app=telemeter\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	labelFile, err := NewLabelFile(path, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		families := labelFile.Append([]*clientmodel.MetricFamily{{
+			Name:   stringp("up"),
+			Metric: []*clientmodel.Metric{{}, {}},
+		}})
+		// changed in place as the anonymizer does
+		hashed := "hashed"
+		families[0].Metric[0].Label[0].Value = &hashed
+		if got := families[0].Metric[1].Label[0].GetValue(); got != "telemeter" {
+			t.Fatalf("batch %d: label of the second metric = %q, want it unaffected by the first", i, got)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package transform
+
+import (
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+type dropOldSamples struct {
+	defaultMin int64
+	min        map[string]int64
+}
+
+// NewDropOldSamples drops samples older than the maximum age that ages maps their
+// metric name to, or older than defaultAge for metrics not in ages. Ages are
+// relative to now. A defaultAge of zero keeps samples of unlisted metrics of any age.
+// Samples without a timestamp are kept.
+func NewDropOldSamples(now time.Time, defaultAge time.Duration, ages map[string]time.Duration) Interface {
+	t := &dropOldSamples{min: make(map[string]int64, len(ages))}
+	if defaultAge > 0 {
+		t.defaultMin = now.Add(-defaultAge).UnixNano() / int64(time.Millisecond)
+	}
+	for name, age := range ages {
+		t.min[name] = now.Add(-age).UnixNano() / int64(time.Millisecond)
+	}
+	return t
+}
+
+func (t *dropOldSamples) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	min, ok := t.min[family.GetName()]
+	if !ok {
+		min = t.defaultMin
+	}
+	if min == 0 {
+		return true, nil
+	}
+	for i, m := range family.Metric {
+		if m == nil || m.TimestampMs == nil {
+			continue
+		}
+		if *m.TimestampMs < min {
+			family.Metric[i] = nil
+		}
+	}
+	return true, nil
+}
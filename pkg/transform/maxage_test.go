@@ -0,0 +1,52 @@
+package transform
+
+import (
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestDropOldSamples(t *testing.T) {
+	now := time.Unix(10000, 0)
+	ms := func(age time.Duration) *int64 {
+		return int64p(now.Add(-age).UnixNano() / int64(time.Millisecond))
+	}
+	family := func(name string) *clientmodel.MetricFamily {
+		return &clientmodel.MetricFamily{
+			Name: stringp(name),
+			Metric: []*clientmodel.Metric{
+				{TimestampMs: ms(time.Minute)},
+				{TimestampMs: ms(10 * time.Minute)},
+				{TimestampMs: ms(2 * time.Hour)},
+				{},
+			},
+		}
+	}
+	tests := []struct {
+		name       string
+		defaultAge time.Duration
+		want       int
+	}{
+		{name: "up", defaultAge: time.Hour, want: 2},
+		{name: "node_boot_time_seconds", defaultAge: time.Hour, want: 4},
+		{name: "other", defaultAge: time.Hour, want: 3},
+		{name: "other", want: 4},
+	}
+	for _, tt := range tests {
+		f := family(tt.name)
+		tr := NewDropOldSamples(now, tt.defaultAge, map[string]time.Duration{"up": 5 * time.Minute, "node_boot_time_seconds": 3 * time.Hour})
+		if ok, err := tr.Transform(f); !ok || err != nil {
+			t.Fatalf("Transform() = %t, %v", ok, err)
+		}
+		kept := 0
+		for _, m := range f.Metric {
+			if m != nil {
+				kept++
+			}
+		}
+		if kept != tt.want {
+			t.Errorf("%s with default %s: kept %d samples, want %d", tt.name, tt.defaultAge, kept, tt.want)
+		}
+	}
+}
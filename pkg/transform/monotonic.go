@@ -0,0 +1,79 @@
+package transform
+
+import (
+	"sync/atomic"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// TimestampOrderPolicy controls which samples NewMonotonicTimestamps removes from a
+// series whose timestamps do not increase.
+type TimestampOrderPolicy string
+
+const (
+	// TimestampOrderDrop keeps the samples that came first and drops each sample
+	// that is not newer than the last sample kept.
+	TimestampOrderDrop TimestampOrderPolicy = "drop"
+	// TimestampOrderKeepLast keeps the samples that came last and drops each
+	// earlier sample that is not older than a later one.
+	TimestampOrderKeepLast TimestampOrderPolicy = "keep-last"
+)
+
+// MonotonicTimestamps ensures that the timestamps of the samples of each series in a
+// family strictly increase.
+type MonotonicTimestamps struct {
+	policy TimestampOrderPolicy
+	fixed  int64
+}
+
+// NewMonotonicTimestamps drops samples so that the remaining samples of each series
+// in a family, in the order they appear, have strictly increasing timestamps. Which
+// samples are dropped depends on policy. Samples without a timestamp are left as
+// they are. It should run after SortMetrics, which leaves only samples with equal
+// timestamps to resolve.
+func NewMonotonicTimestamps(policy TimestampOrderPolicy) *MonotonicTimestamps {
+	return &MonotonicTimestamps{policy: policy}
+}
+
+// Fixed returns the number of samples dropped since the transformer was created.
+func (t *MonotonicTimestamps) Fixed() int64 {
+	return atomic.LoadInt64(&t.fixed)
+}
+
+func (t *MonotonicTimestamps) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	// the indexes of the samples kept so far for each series, in increasing
+	// timestamp order
+	kept := make(map[string][]int)
+	dropped := 0
+	for i, m := range family.Metric {
+		if m == nil || m.TimestampMs == nil {
+			continue
+		}
+		key := seriesKey(family.GetName(), m.Label)
+		indexes := kept[key]
+		if t.policy == TimestampOrderKeepLast {
+			for len(indexes) > 0 && family.Metric[indexes[len(indexes)-1]].GetTimestampMs() >= m.GetTimestampMs() {
+				family.Metric[indexes[len(indexes)-1]] = nil
+				indexes = indexes[:len(indexes)-1]
+				dropped++
+			}
+		} else if len(indexes) > 0 && family.Metric[indexes[len(indexes)-1]].GetTimestampMs() >= m.GetTimestampMs() {
+			family.Metric[i] = nil
+			dropped++
+			continue
+		}
+		kept[key] = append(indexes, i)
+	}
+	if dropped == 0 {
+		return true, nil
+	}
+	atomic.AddInt64(&t.fixed, int64(dropped))
+	metrics := family.Metric[:0]
+	for _, m := range family.Metric {
+		if m != nil {
+			metrics = append(metrics, m)
+		}
+	}
+	family.Metric = metrics
+	return true, nil
+}
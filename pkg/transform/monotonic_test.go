@@ -0,0 +1,59 @@
+package transform
+
+import (
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestMonotonicTimestamps(t *testing.T) {
+	sample := func(series string, ts int64, value float64) *clientmodel.Metric {
+		return &clientmodel.Metric{
+			Label:       labels("series", series),
+			Gauge:       &clientmodel.Gauge{Value: float64p(value)},
+			TimestampMs: int64p(ts),
+		}
+	}
+	tests := []struct {
+		policy TimestampOrderPolicy
+		want   []float64
+	}{
+		{policy: TimestampOrderDrop, want: []float64{1, 2, 4, 6}},
+		{policy: TimestampOrderKeepLast, want: []float64{1, 3, 4, 5, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			family := &clientmodel.MetricFamily{
+				Name: stringp("m"),
+				Type: clientmodel.MetricType_GAUGE.Enum(),
+				Metric: []*clientmodel.Metric{
+					sample("a", 10, 1),
+					sample("a", 20, 2),
+					sample("a", 15, 3),
+					sample("b", 20, 4),
+					sample("a", 20, 5),
+					{Label: labels("series", "a"), Gauge: &clientmodel.Gauge{Value: float64p(6)}},
+				},
+			}
+			tr := NewMonotonicTimestamps(tt.policy)
+			if ok, err := tr.Transform(family); !ok || err != nil {
+				t.Fatalf("Transform() = %t, %v", ok, err)
+			}
+			var got []float64
+			for _, m := range family.Metric {
+				got = append(got, m.GetGauge().GetValue())
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("kept %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("kept %v, want %v", got, tt.want)
+				}
+			}
+			if fixed := tr.Fixed(); fixed != int64(6-len(tt.want)) {
+				t.Errorf("Fixed() = %d, want %d", fixed, 6-len(tt.want))
+			}
+		})
+	}
+}
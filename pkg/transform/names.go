@@ -0,0 +1,138 @@
+package transform
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// InvalidNamesMode controls how NewNameValidator handles metric and label names
+// that do not satisfy the Prometheus naming rules.
+type InvalidNamesMode string
+
+const (
+	// InvalidNamesDrop removes families with invalid metric names and labels with
+	// invalid label names.
+	InvalidNamesDrop InvalidNamesMode = "drop"
+	// InvalidNamesSanitize replaces illegal characters in names with '_'.
+	InvalidNamesSanitize InvalidNamesMode = "sanitize"
+	// InvalidNamesError fails the transform on the first invalid name.
+	InvalidNamesError InvalidNamesMode = "error"
+)
+
+type nameValidator struct {
+	mode InvalidNamesMode
+	// names tracks the original name of every sanitized family so that two
+	// distinct families that sanitize to the same name can be reported.
+	names map[string]string
+}
+
+// NewNameValidator checks metric names with model.IsValidMetricName and label names
+// with model.LabelName.IsValid and handles invalid names according to mode. When
+// sanitizing, a label that collides with an existing label of the same name on the
+// metric is dropped in favor of the existing label, and families that collide with
+// another family are logged. The returned transformer tracks collisions for its
+// lifetime and should be recreated for each batch.
+func NewNameValidator(mode InvalidNamesMode) Interface {
+	return &nameValidator{
+		mode:  mode,
+		names: make(map[string]string),
+	}
+}
+
+func (t *nameValidator) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	name := family.GetName()
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		switch t.mode {
+		case InvalidNamesDrop:
+			return false, nil
+		case InvalidNamesError:
+			return false, fmt.Errorf("metric name %q is not a valid Prometheus metric name", name)
+		case InvalidNamesSanitize:
+			sanitized := sanitizeName(name, true)
+			family.Name = &sanitized
+		}
+	}
+	if t.mode == InvalidNamesSanitize {
+		sanitized := family.GetName()
+		if original, ok := t.names[sanitized]; ok && original != name {
+			log.Printf("warning: metric %q was sanitized to %q which collides with metric %q", name, sanitized, original)
+		} else {
+			t.names[sanitized] = name
+		}
+	}
+
+	for _, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		if err := t.transformLabels(family.GetName(), m); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (t *nameValidator) transformLabels(name string, m *clientmodel.Metric) error {
+	packLabels := false
+	for i, label := range m.Label {
+		if label == nil || model.LabelName(label.GetName()).IsValid() {
+			continue
+		}
+		switch t.mode {
+		case InvalidNamesDrop:
+			m.Label[i] = nil
+			packLabels = true
+		case InvalidNamesError:
+			return fmt.Errorf("label name %q on metric %q is not a valid Prometheus label name", label.GetName(), name)
+		case InvalidNamesSanitize:
+			sanitized := sanitizeName(label.GetName(), false)
+			if hasLabel(m.Label, sanitized) {
+				log.Printf("warning: label %q on metric %q was sanitized to %q which collides with an existing label, dropping it", label.GetName(), name, sanitized)
+				m.Label[i] = nil
+				packLabels = true
+				continue
+			}
+			m.Label[i] = &clientmodel.LabelPair{Name: &sanitized, Value: label.Value}
+		}
+	}
+	if packLabels {
+		m.Label = PackLabels(m.Label)
+	}
+	return nil
+}
+
+func hasLabel(labels []*clientmodel.LabelPair, name string) bool {
+	for _, label := range labels {
+		if label != nil && label.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeName replaces every character that is not allowed in a metric name (or a
+// label name if metric is false) with '_'. Names starting with a digit are prefixed
+// with '_' and empty names become '_'.
+func sanitizeName(name string, metric bool) string {
+	if len(name) == 0 {
+		return "_"
+	}
+	out := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r == ':' && metric:
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	if out[0] >= '0' && out[0] <= '9' {
+		out = "_" + out
+	}
+	return out
+}
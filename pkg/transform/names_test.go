@@ -0,0 +1,98 @@
+package transform
+
+import (
+	"reflect"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func labels(pairs ...string) []*clientmodel.LabelPair {
+	var out []*clientmodel.LabelPair
+	for i := 0; i < len(pairs); i += 2 {
+		out = append(out, &clientmodel.LabelPair{Name: stringp(pairs[i]), Value: stringp(pairs[i+1])})
+	}
+	return out
+}
+
+func TestNameValidator(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       InvalidNamesMode
+		family     *clientmodel.MetricFamily
+		wantOk     bool
+		wantErr    bool
+		wantName   string
+		wantLabels []*clientmodel.LabelPair
+	}{
+		{
+			name:       "valid is unchanged",
+			mode:       InvalidNamesError,
+			family:     &clientmodel.MetricFamily{Name: stringp("a:b_c"), Metric: []*clientmodel.Metric{{Label: labels("a", "1")}}},
+			wantOk:     true,
+			wantName:   "a:b_c",
+			wantLabels: labels("a", "1"),
+		},
+		{
+			name:    "error on metric name",
+			mode:    InvalidNamesError,
+			family:  &clientmodel.MetricFamily{Name: stringp("a.b"), Metric: []*clientmodel.Metric{{}}},
+			wantErr: true,
+		},
+		{
+			name:    "error on label name",
+			mode:    InvalidNamesError,
+			family:  &clientmodel.MetricFamily{Name: stringp("a"), Metric: []*clientmodel.Metric{{Label: labels("a-b", "1")}}},
+			wantErr: true,
+		},
+		{
+			name:   "drop family",
+			mode:   InvalidNamesDrop,
+			family: &clientmodel.MetricFamily{Name: stringp("1a"), Metric: []*clientmodel.Metric{{}}},
+		},
+		{
+			name:       "drop label",
+			mode:       InvalidNamesDrop,
+			family:     &clientmodel.MetricFamily{Name: stringp("a"), Metric: []*clientmodel.Metric{{Label: labels("a-b", "1", "c", "2")}}},
+			wantOk:     true,
+			wantName:   "a",
+			wantLabels: labels("c", "2"),
+		},
+		{
+			name:       "sanitize",
+			mode:       InvalidNamesSanitize,
+			family:     &clientmodel.MetricFamily{Name: stringp("1a.b"), Metric: []*clientmodel.Metric{{Label: labels("a-b", "1", "a:c", "2")}}},
+			wantOk:     true,
+			wantName:   "_1a_b",
+			wantLabels: labels("a_b", "1", "a_c", "2"),
+		},
+		{
+			name:       "sanitize collision keeps existing label",
+			mode:       InvalidNamesSanitize,
+			family:     &clientmodel.MetricFamily{Name: stringp("a"), Metric: []*clientmodel.Metric{{Label: labels("a_b", "1", "a-b", "2", "a.b", "3")}}},
+			wantOk:     true,
+			wantName:   "a",
+			wantLabels: labels("a_b", "1"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := NewNameValidator(tt.mode).Transform(tt.family)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Transform() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if ok != tt.wantOk {
+				t.Fatalf("Transform() = %t, want %t", ok, tt.wantOk)
+			}
+			if !ok {
+				return
+			}
+			if tt.family.GetName() != tt.wantName {
+				t.Errorf("name = %s, want %s", tt.family.GetName(), tt.wantName)
+			}
+			if got := tt.family.Metric[0].Label; !reflect.DeepEqual(got, tt.wantLabels) {
+				t.Errorf("labels = %v, want %v", got, tt.wantLabels)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package transform
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// RelabelAction is the action a RelabelConfig performs.
+type RelabelAction string
+
+const (
+	// RelabelReplace sets the target label to the replacement if the regex matches
+	// the concatenated source labels.
+	RelabelReplace RelabelAction = "replace"
+	// RelabelKeep drops metrics whose source labels do not match the regex.
+	RelabelKeep RelabelAction = "keep"
+	// RelabelDrop drops metrics whose source labels match the regex.
+	RelabelDrop RelabelAction = "drop"
+	// RelabelLabelDrop removes the labels whose name matches the regex.
+	RelabelLabelDrop RelabelAction = "labeldrop"
+	// RelabelLabelKeep removes the labels whose name does not match the regex.
+	RelabelLabelKeep RelabelAction = "labelkeep"
+)
+
+// RelabelConfig is a relabeling rule with the fields and defaults of a Prometheus
+// relabel_config.
+type RelabelConfig struct {
+	SourceLabels []string      `json:"source_labels"`
+	Separator    *string       `json:"separator"`
+	Regex        *string       `json:"regex"`
+	TargetLabel  string        `json:"target_label"`
+	Replacement  *string       `json:"replacement"`
+	Action       RelabelAction `json:"action"`
+}
+
+type relabelRule struct {
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	targetLabel  string
+	replacement  string
+	action       RelabelAction
+}
+
+type relabeler struct {
+	rules []relabelRule
+}
+
+// NewRelabeler applies configs in order to every metric, with the metric name
+// available as the __name__ label. A replace rule may rename a metric, but every
+// metric of a family that is kept must end up with the same name. The metric name
+// is never removed by labeldrop or labelkeep. When relabeling leaves several metrics
+// in a family with the same labels, only the one with the newest timestamp is kept.
+func NewRelabeler(configs []RelabelConfig) (Interface, error) {
+	var rules []relabelRule
+	for i, config := range configs {
+		rule := relabelRule{
+			sourceLabels: config.SourceLabels,
+			separator:    ";",
+			targetLabel:  config.TargetLabel,
+			replacement:  "$1",
+			action:       config.Action,
+		}
+		if config.Separator != nil {
+			rule.separator = *config.Separator
+		}
+		if config.Replacement != nil {
+			rule.replacement = *config.Replacement
+		}
+		if len(rule.action) == 0 {
+			rule.action = RelabelReplace
+		}
+		expr := "(.*)"
+		if config.Regex != nil {
+			expr = *config.Regex
+		}
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel rule %d: invalid regex %q: %v", i, expr, err)
+		}
+		rule.regex = re
+
+		switch rule.action {
+		case RelabelReplace:
+			if len(rule.targetLabel) == 0 {
+				return nil, fmt.Errorf("relabel rule %d: target_label is required for action %s", i, rule.action)
+			}
+		case RelabelKeep, RelabelDrop:
+			if len(rule.sourceLabels) == 0 {
+				return nil, fmt.Errorf("relabel rule %d: source_labels are required for action %s", i, rule.action)
+			}
+		case RelabelLabelDrop, RelabelLabelKeep:
+			if len(rule.sourceLabels) > 0 || len(rule.targetLabel) > 0 {
+				return nil, fmt.Errorf("relabel rule %d: source_labels and target_label are not allowed for action %s", i, rule.action)
+			}
+		default:
+			return nil, fmt.Errorf("relabel rule %d: unknown action %q", i, rule.action)
+		}
+		rules = append(rules, rule)
+	}
+	return &relabeler{rules: rules}, nil
+}
+
+func (t *relabeler) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	name := family.GetName()
+	renamed := ""
+	for i, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		labels := make(map[string]string, len(m.Label)+1)
+		for _, label := range m.Label {
+			if label != nil {
+				labels[label.GetName()] = label.GetValue()
+			}
+		}
+		labels[model.MetricNameLabel] = name
+		if !t.relabel(labels) {
+			family.Metric[i] = nil
+			continue
+		}
+
+		newName := labels[model.MetricNameLabel]
+		if !model.IsValidMetricName(model.LabelValue(newName)) {
+			return false, fmt.Errorf("relabeling metric %s produced the invalid metric name %q", name, newName)
+		}
+		if len(renamed) > 0 && newName != renamed {
+			return false, fmt.Errorf("relabeling metric %s produced both %s and %s, all metrics of a family must keep the same name", name, renamed, newName)
+		}
+		renamed = newName
+		delete(labels, model.MetricNameLabel)
+		m.Label = m.Label[:0]
+		for k, v := range labels {
+			if len(v) == 0 {
+				continue
+			}
+			k, v := k, v
+			m.Label = append(m.Label, &clientmodel.LabelPair{Name: &k, Value: &v})
+		}
+		sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+	}
+	if len(renamed) > 0 && renamed != name {
+		family.Name = &renamed
+	}
+	keepNewestSeries(family)
+	return true, nil
+}
+
+// relabel applies the rules to labels and returns false if the metric is dropped.
+func (t *relabeler) relabel(labels map[string]string) bool {
+	for _, rule := range t.rules {
+		values := make([]string, 0, len(rule.sourceLabels))
+		for _, name := range rule.sourceLabels {
+			values = append(values, labels[name])
+		}
+		value := strings.Join(values, rule.separator)
+
+		switch rule.action {
+		case RelabelKeep:
+			if !rule.regex.MatchString(value) {
+				return false
+			}
+		case RelabelDrop:
+			if rule.regex.MatchString(value) {
+				return false
+			}
+		case RelabelReplace:
+			indexes := rule.regex.FindStringSubmatchIndex(value)
+			if indexes == nil {
+				continue
+			}
+			target := string(rule.regex.ExpandString(nil, rule.targetLabel, value, indexes))
+			if !model.LabelName(target).IsValid() {
+				continue
+			}
+			result := string(rule.regex.ExpandString(nil, rule.replacement, value, indexes))
+			if len(result) == 0 {
+				delete(labels, target)
+				continue
+			}
+			labels[target] = result
+		case RelabelLabelDrop, RelabelLabelKeep:
+			for name := range labels {
+				if name == model.MetricNameLabel {
+					continue
+				}
+				if rule.regex.MatchString(name) == (rule.action == RelabelLabelDrop) {
+					delete(labels, name)
+				}
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,120 @@
+package transform
+
+import (
+	"reflect"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestRelabeler(t *testing.T) {
+	family := func(name string, metrics ...*clientmodel.Metric) *clientmodel.MetricFamily {
+		return &clientmodel.MetricFamily{Name: stringp(name), Metric: metrics}
+	}
+	tests := []struct {
+		name    string
+		configs []RelabelConfig
+		family  *clientmodel.MetricFamily
+		want    *clientmodel.MetricFamily
+		wantErr bool
+	}{
+		{
+			name:    "replace with defaults",
+			configs: []RelabelConfig{{SourceLabels: []string{"a"}, TargetLabel: "b"}},
+			family:  family("m", &clientmodel.Metric{Label: labels("a", "1")}),
+			want:    family("m", &clientmodel.Metric{Label: labels("a", "1", "b", "1")}),
+		},
+		{
+			name: "replace with groups and separator",
+			configs: []RelabelConfig{{
+				SourceLabels: []string{"a", "b"},
+				Separator:    stringp("/"),
+				Regex:        stringp("(.*)/(.*)"),
+				TargetLabel:  "c",
+				Replacement:  stringp("$2-$1"),
+			}},
+			family: family("m", &clientmodel.Metric{Label: labels("a", "1", "b", "2")}),
+			want:   family("m", &clientmodel.Metric{Label: labels("a", "1", "b", "2", "c", "2-1")}),
+		},
+		{
+			name:    "replace with an empty value removes the label",
+			configs: []RelabelConfig{{SourceLabels: []string{"missing"}, TargetLabel: "a"}},
+			family:  family("m", &clientmodel.Metric{Label: labels("a", "1", "b", "2")}),
+			want:    family("m", &clientmodel.Metric{Label: labels("b", "2")}),
+		},
+		{
+			name:    "keep",
+			configs: []RelabelConfig{{SourceLabels: []string{"a"}, Regex: stringp("1|2"), Action: RelabelKeep}},
+			family:  family("m", &clientmodel.Metric{Label: labels("a", "1")}, &clientmodel.Metric{Label: labels("a", "3")}),
+			want:    family("m", &clientmodel.Metric{Label: labels("a", "1")}, nil),
+		},
+		{
+			name:    "drop by name",
+			configs: []RelabelConfig{{SourceLabels: []string{"__name__"}, Regex: stringp("m"), Action: RelabelDrop}},
+			family:  family("m", &clientmodel.Metric{Label: labels("a", "1")}),
+			want:    family("m", nil),
+		},
+		{
+			name:    "labeldrop keeps the name",
+			configs: []RelabelConfig{{Regex: stringp("__name__|a"), Action: RelabelLabelDrop}},
+			family:  family("m", &clientmodel.Metric{Label: labels("a", "1", "b", "2")}),
+			want:    family("m", &clientmodel.Metric{Label: labels("b", "2")}),
+		},
+		{
+			name:    "labelkeep merges duplicates",
+			configs: []RelabelConfig{{Regex: stringp("a"), Action: RelabelLabelKeep}},
+			family: family("m",
+				&clientmodel.Metric{Label: labels("a", "1", "b", "2"), TimestampMs: int64p(2)},
+				&clientmodel.Metric{Label: labels("a", "1", "b", "3"), TimestampMs: int64p(1)},
+			),
+			want: family("m", &clientmodel.Metric{Label: labels("a", "1"), TimestampMs: int64p(2)}, nil),
+		},
+		{
+			name:    "rename",
+			configs: []RelabelConfig{{SourceLabels: []string{"__name__"}, Regex: stringp("(.*)_total"), TargetLabel: "__name__", Replacement: stringp("${1}_count")}},
+			family:  family("m_total", &clientmodel.Metric{Label: labels("a", "1")}),
+			want:    family("m_count", &clientmodel.Metric{Label: labels("a", "1")}),
+		},
+		{
+			name:    "rename to different names",
+			configs: []RelabelConfig{{SourceLabels: []string{"a"}, TargetLabel: "__name__"}},
+			family:  family("m", &clientmodel.Metric{Label: labels("a", "x")}, &clientmodel.Metric{Label: labels("a", "y")}),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRelabeler(tt.configs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ok, err := r.Transform(tt.family)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Transform() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !ok {
+				t.Fatalf("Transform() dropped the family")
+			}
+			if !reflect.DeepEqual(tt.family, tt.want) {
+				t.Errorf("Transform() = %v, want %v", tt.family, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRelabelerValidates(t *testing.T) {
+	for _, config := range []RelabelConfig{
+		{SourceLabels: []string{"a"}},
+		{Action: RelabelKeep},
+		{SourceLabels: []string{"a"}, Action: RelabelLabelDrop},
+		{SourceLabels: []string{"a"}, Regex: stringp("("), Action: RelabelKeep},
+		{SourceLabels: []string{"a"}, Action: "hashmod"},
+	} {
+		if _, err := NewRelabeler([]RelabelConfig{config}); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
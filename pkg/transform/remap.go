@@ -0,0 +1,116 @@
+package transform
+
+import (
+	"fmt"
+	"regexp"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// ValueRemap maps the values of a label to new values.
+type ValueRemap struct {
+	// Values maps values to their replacements.
+	Values map[string]string `json:"values"`
+	// Patterns are tried in order for values that are not in Values.
+	Patterns []ValuePattern `json:"patterns"`
+	// Default, if set, replaces the values that are neither in Values nor matched by
+	// one of Patterns. Other values are left unchanged.
+	Default *string `json:"default"`
+}
+
+// ValuePattern replaces the values that Regex matches in full with Replacement,
+// which may refer to capture groups as $1.
+type ValuePattern struct {
+	Regex       string `json:"regex"`
+	Replacement string `json:"replacement"`
+}
+
+type valuePattern struct {
+	regex       *regexp.Regexp
+	replacement string
+}
+
+type valueRemap struct {
+	values       map[string]string
+	patterns     []valuePattern
+	defaultValue *string
+}
+
+type valueRemapper struct {
+	rules map[string]valueRemap
+}
+
+// NewValueRemapper replaces the values of the labels named by the keys of rules in
+// every metric. A label whose new value is empty is removed. When remapping leaves
+// several metrics in a family with the same labels, only the one with the newest
+// timestamp is kept.
+func NewValueRemapper(rules map[string]ValueRemap) (Interface, error) {
+	remapper := &valueRemapper{rules: make(map[string]valueRemap, len(rules))}
+	for name, rule := range rules {
+		remap := valueRemap{values: rule.Values, defaultValue: rule.Default}
+		for i, pattern := range rule.Patterns {
+			re, err := regexp.Compile("^(?:" + pattern.Regex + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("label %s: pattern %d: invalid regex %q: %v", name, i, pattern.Regex, err)
+			}
+			remap.patterns = append(remap.patterns, valuePattern{regex: re, replacement: pattern.Replacement})
+		}
+		remapper.rules[name] = remap
+	}
+	return remapper, nil
+}
+
+func (t *valueRemapper) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	changed := false
+	for _, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		packLabels := false
+		for j, label := range m.Label {
+			if label == nil {
+				continue
+			}
+			rule, ok := t.rules[label.GetName()]
+			if !ok {
+				continue
+			}
+			value, ok := rule.remap(label.GetValue())
+			if !ok {
+				continue
+			}
+			changed = true
+			if len(value) == 0 {
+				m.Label[j] = nil
+				packLabels = true
+				continue
+			}
+			// label pairs may be shared between metrics
+			m.Label[j] = &clientmodel.LabelPair{Name: label.Name, Value: &value}
+		}
+		if packLabels {
+			m.Label = PackLabels(m.Label)
+		}
+	}
+	if changed {
+		keepNewestSeries(family)
+	}
+	return true, nil
+}
+
+// remap returns the new value for value and true, or false if value is unchanged.
+func (r valueRemap) remap(value string) (string, bool) {
+	if v, ok := r.values[value]; ok {
+		return v, v != value
+	}
+	for _, pattern := range r.patterns {
+		if match := pattern.regex.FindStringSubmatchIndex(value); match != nil {
+			v := string(pattern.regex.ExpandString(nil, pattern.replacement, value, match))
+			return v, v != value
+		}
+	}
+	if r.defaultValue != nil {
+		return *r.defaultValue, *r.defaultValue != value
+	}
+	return value, false
+}
@@ -0,0 +1,51 @@
+package transform
+
+import (
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestValueRemapper(t *testing.T) {
+	other := "other"
+	remapper, err := NewValueRemapper(map[string]ValueRemap{
+		"node_os": {
+			Values:   map[string]string{"Red Hat Enterprise Linux CoreOS 412.86": "rhcos", "Fedora": ""},
+			Patterns: []ValuePattern{{Regex: `Red Hat Enterprise Linux (\d+).*`, Replacement: "rhel$1"}},
+			Default:  &other,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := &clientmodel.LabelPair{Name: stringp("node_os"), Value: stringp("Red Hat Enterprise Linux CoreOS 412.86")}
+	family := &clientmodel.MetricFamily{Name: stringp("nodes"), Metric: []*clientmodel.Metric{
+		{Label: []*clientmodel.LabelPair{shared}, TimestampMs: int64p(1)},
+		{Label: labels("node_os", "Red Hat Enterprise Linux 8.6"), TimestampMs: int64p(1)},
+		{Label: labels("node_os", "Fedora", "zone", "a"), TimestampMs: int64p(1)},
+		{Label: labels("node_os", "Windows"), TimestampMs: int64p(1)},
+		{Label: labels("node_os", "Ubuntu"), TimestampMs: int64p(2)},
+		{Label: labels("arch", "Fedora"), TimestampMs: int64p(1)},
+	}}
+
+	if ok, err := remapper.Transform(family); !ok || err != nil {
+		t.Fatalf("Transform() = %t, %v", ok, err)
+	}
+	want := []string{`{node_os="rhcos"}`, `{node_os="rhel8"}`, `{zone="a"}`, "", `{node_os="other"}`, `{arch="Fedora"}`}
+	for i, m := range family.Metric {
+		got := ""
+		if m != nil {
+			got = formatLabels(m.Label)
+		}
+		if got != want[i] {
+			t.Errorf("series %d has labels %s, want %s", i, got, want[i])
+		}
+	}
+	if shared.GetValue() != "Red Hat Enterprise Linux CoreOS 412.86" {
+		t.Errorf("a label pair was modified in place")
+	}
+
+	if _, err := NewValueRemapper(map[string]ValueRemap{"a": {Patterns: []ValuePattern{{Regex: "("}}}}); err == nil {
+		t.Errorf("NewValueRemapper() accepted an invalid regex")
+	}
+}
@@ -0,0 +1,83 @@
+package transform
+
+import (
+	"math"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// RoundingMode controls how NewValueRounder rounds sample values.
+type RoundingMode string
+
+const (
+	// RoundNearest rounds values to the nearest multiple of the precision.
+	RoundNearest RoundingMode = "nearest"
+	// RoundSignificant rounds values to the given number of significant figures.
+	RoundSignificant RoundingMode = "significant"
+)
+
+// Rounding describes how the values of a metric are rounded.
+type Rounding struct {
+	Mode      RoundingMode
+	Precision float64
+	// Counters allows counters to be rounded, which may make rates over the
+	// rounded values misleading.
+	Counters bool
+}
+
+// Round returns v rounded according to r.
+func (r Rounding) Round(v float64) float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) || v == 0 {
+		return v
+	}
+	switch r.Mode {
+	case RoundNearest:
+		if r.Precision <= 0 {
+			return v
+		}
+		return math.Round(v/r.Precision) * r.Precision
+	case RoundSignificant:
+		digits := int(r.Precision)
+		if digits <= 0 {
+			return v
+		}
+		scale := math.Pow(10, float64(digits)-math.Ceil(math.Log10(math.Abs(v))))
+		return math.Round(v*scale) / scale
+	}
+	return v
+}
+
+type valueRounder struct {
+	rules map[string]Rounding
+}
+
+// NewValueRounder rounds the values of gauge and untyped metrics whose family name is
+// in rules. Counters are only rounded if their rule allows it, and histograms and
+// summaries are never changed.
+func NewValueRounder(rules map[string]Rounding) Interface {
+	return &valueRounder{rules: rules}
+}
+
+func (t *valueRounder) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	rule, ok := t.rules[family.GetName()]
+	if !ok {
+		return true, nil
+	}
+	for _, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		switch {
+		case m.Gauge != nil && m.Gauge.Value != nil:
+			v := rule.Round(m.Gauge.GetValue())
+			m.Gauge.Value = &v
+		case m.Untyped != nil && m.Untyped.Value != nil:
+			v := rule.Round(m.Untyped.GetValue())
+			m.Untyped.Value = &v
+		case m.Counter != nil && m.Counter.Value != nil && rule.Counters:
+			v := rule.Round(m.Counter.GetValue())
+			m.Counter.Value = &v
+		}
+	}
+	return true, nil
+}
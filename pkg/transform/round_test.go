@@ -0,0 +1,60 @@
+package transform
+
+import (
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestRoundingRound(t *testing.T) {
+	tests := []struct {
+		rounding Rounding
+		in, want float64
+	}{
+		{Rounding{Mode: RoundNearest, Precision: 10}, 1234, 1230},
+		{Rounding{Mode: RoundNearest, Precision: 10}, -15, -20},
+		{Rounding{Mode: RoundNearest, Precision: 0.5}, 1.3, 1.5},
+		{Rounding{Mode: RoundSignificant, Precision: 2}, 1234, 1200},
+		{Rounding{Mode: RoundSignificant, Precision: 2}, 0.012345, 0.012},
+		{Rounding{Mode: RoundSignificant, Precision: 2}, -987, -990},
+		{Rounding{Mode: RoundSignificant, Precision: 2}, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.rounding.Round(tt.in); got != tt.want {
+			t.Errorf("%v.Round(%v) = %v, want %v", tt.rounding, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestValueRounder(t *testing.T) {
+	gauge := &clientmodel.MetricFamily{
+		Name:   stringp("memory_bytes"),
+		Metric: []*clientmodel.Metric{{Gauge: &clientmodel.Gauge{Value: float64p(1234)}}, nil},
+	}
+	counter := &clientmodel.MetricFamily{
+		Name:   stringp("requests_total"),
+		Metric: []*clientmodel.Metric{{Counter: &clientmodel.Counter{Value: float64p(1234)}}},
+	}
+	other := &clientmodel.MetricFamily{
+		Name:   stringp("other"),
+		Metric: []*clientmodel.Metric{{Gauge: &clientmodel.Gauge{Value: float64p(1234)}}},
+	}
+	rounder := NewValueRounder(map[string]Rounding{
+		"memory_bytes":   {Mode: RoundSignificant, Precision: 1},
+		"requests_total": {Mode: RoundSignificant, Precision: 1},
+	})
+	for _, family := range []*clientmodel.MetricFamily{gauge, counter, other} {
+		if ok, err := rounder.Transform(family); !ok || err != nil {
+			t.Fatalf("Transform() = %t, %v", ok, err)
+		}
+	}
+	if v := gauge.Metric[0].GetGauge().GetValue(); v != 1000 {
+		t.Errorf("gauge = %v, want 1000", v)
+	}
+	if v := counter.Metric[0].GetCounter().GetValue(); v != 1234 {
+		t.Errorf("counter = %v, want 1234", v)
+	}
+	if v := other.Metric[0].GetGauge().GetValue(); v != 1234 {
+		t.Errorf("other = %v, want 1234", v)
+	}
+}
@@ -0,0 +1,49 @@
+package transform
+
+import (
+	"hash/fnv"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+type seriesSampler struct {
+	rates map[string]float64
+}
+
+// NewSeriesSampler keeps each series of the families named in rates with the
+// probability the name maps to, from 0 to 1, and drops the others. Whether a series
+// is kept depends only on a hash of its name and labels, so the same series is kept
+// or dropped in every batch and rates computed downstream stay meaningful. Series
+// whose labels change, such as after relabelling is reconfigured, are sampled anew.
+func NewSeriesSampler(rates map[string]float64) Interface {
+	return &seriesSampler{rates: rates}
+}
+
+func (t *seriesSampler) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	rate, ok := t.rates[family.GetName()]
+	if !ok || rate >= 1 {
+		return true, nil
+	}
+	for i, m := range family.Metric {
+		if m != nil && !sampled(seriesKey(family.GetName(), m.Label), rate) {
+			family.Metric[i] = nil
+		}
+	}
+	return true, nil
+}
+
+// sampled returns true if the series identified by key falls within rate.
+func sampled(key string, rate float64) bool {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// FNV spreads keys that differ only in their last bytes poorly across the high
+	// bits, so they are mixed with the finalizer of MurmurHash3
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	// the top 53 bits as a fraction in [0, 1)
+	return float64(x>>11)/(1<<53) < rate
+}
@@ -0,0 +1,56 @@
+package transform
+
+import (
+	"strconv"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestSeriesSampler(t *testing.T) {
+	family := func(name string) *clientmodel.MetricFamily {
+		f := &clientmodel.MetricFamily{Name: stringp(name)}
+		for i := 0; i < 1000; i++ {
+			f.Metric = append(f.Metric, &clientmodel.Metric{Label: labels("id", strconv.Itoa(i))})
+		}
+		return f
+	}
+	kept := func(f *clientmodel.MetricFamily) map[string]bool {
+		ids := make(map[string]bool)
+		for _, m := range f.Metric {
+			if m != nil {
+				ids[m.Label[0].GetValue()] = true
+			}
+		}
+		return ids
+	}
+
+	tr := NewSeriesSampler(map[string]float64{"sampled": 0.1, "none": 0, "all": 1})
+	first := family("sampled")
+	if ok, err := tr.Transform(first); !ok || err != nil {
+		t.Fatalf("Transform() = %t, %v", ok, err)
+	}
+	ids := kept(first)
+	if len(ids) < 60 || len(ids) > 140 {
+		t.Errorf("kept %d of 1000 series at a rate of 0.1", len(ids))
+	}
+	second := family("sampled")
+	tr.Transform(second)
+	if again := kept(second); len(again) != len(ids) {
+		t.Errorf("kept %d series in the next batch, want the same %d", len(again), len(ids))
+	} else {
+		for id := range again {
+			if !ids[id] {
+				t.Errorf("series %s was dropped in the first batch but kept in the next", id)
+			}
+		}
+	}
+
+	for name, want := range map[string]int{"none": 0, "all": 1000, "other": 1000} {
+		f := family(name)
+		tr.Transform(f)
+		if got := len(kept(f)); got != want {
+			t.Errorf("%s: kept %d series, want %d", name, got, want)
+		}
+	}
+}
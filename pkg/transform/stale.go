@@ -0,0 +1,51 @@
+package transform
+
+import (
+	"math"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// staleNaN is the bit pattern of the NaN value Prometheus uses to mark a series as
+// stale, value.StaleNaN in the Prometheus code base. Other NaN values are ordinary
+// sample values.
+const staleNaN uint64 = 0x7ff0000000000002
+
+// IsStaleNaN returns true if v is a Prometheus staleness marker.
+func IsStaleNaN(v float64) bool {
+	return math.Float64bits(v) == staleNaN
+}
+
+type dropStaleMarkers struct{}
+
+// NewDropStaleMarkers drops samples whose value is a Prometheus staleness marker.
+// Only the exact marker is matched, other NaN values are kept. The markers survive
+// only in the protobuf format, parsing the text format yields an ordinary NaN.
+func NewDropStaleMarkers() Interface {
+	return dropStaleMarkers{}
+}
+
+func (_ dropStaleMarkers) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	for i, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		var value *float64
+		switch {
+		case m.Counter != nil:
+			value = m.Counter.Value
+		case m.Gauge != nil:
+			value = m.Gauge.Value
+		case m.Untyped != nil:
+			value = m.Untyped.Value
+		case m.Histogram != nil:
+			value = m.Histogram.SampleSum
+		case m.Summary != nil:
+			value = m.Summary.SampleSum
+		}
+		if value != nil && IsStaleNaN(*value) {
+			family.Metric[i] = nil
+		}
+	}
+	return true, nil
+}
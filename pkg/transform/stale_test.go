@@ -0,0 +1,26 @@
+package transform
+
+import (
+	"math"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestDropStaleMarkers(t *testing.T) {
+	family := &clientmodel.MetricFamily{
+		Name: stringp("up"),
+		Metric: []*clientmodel.Metric{
+			{Gauge: &clientmodel.Gauge{Value: float64p(math.Float64frombits(staleNaN))}},
+			{Gauge: &clientmodel.Gauge{Value: float64p(math.NaN())}},
+			{Gauge: &clientmodel.Gauge{Value: float64p(1)}},
+			{Summary: &clientmodel.Summary{SampleSum: float64p(math.Float64frombits(staleNaN))}},
+		},
+	}
+	if ok, err := NewDropStaleMarkers().Transform(family); !ok || err != nil {
+		t.Fatalf("Transform() = %t, %v", ok, err)
+	}
+	if family.Metric[0] != nil || family.Metric[1] == nil || family.Metric[2] == nil || family.Metric[3] != nil {
+		t.Errorf("unexpected metrics kept: %v", family.Metric)
+	}
+}
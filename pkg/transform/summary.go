@@ -0,0 +1,125 @@
+package transform
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// SummaryMode controls what NewSummaryGauges does with a summary after extracting
+// its quantiles.
+type SummaryMode string
+
+const (
+	// SummaryKeep keeps the summary.
+	SummaryKeep SummaryMode = "keep"
+	// SummaryDrop drops the summary.
+	SummaryDrop SummaryMode = "drop"
+	// SummaryCounters replaces the summary with counters named after it with the
+	// _sum and _count suffixes.
+	SummaryCounters SummaryMode = "counters"
+)
+
+// SummaryGauges extracts quantiles of summaries into gauges.
+type SummaryGauges struct {
+	quantiles map[string][]float64
+	mode      SummaryMode
+
+	lock    sync.Mutex
+	pending []*clientmodel.MetricFamily
+}
+
+// NewSummaryGauges adds a gauge for each quantile that quantiles lists for the
+// summary named by its key. The gauge is named after the summary with a suffix for
+// the quantile as a percentile, _p99 for 0.99 and _p99_9 for 0.999, and has a series
+// with the labels and timestamp of each series of the summary that reports the
+// quantile. The summary is then handled according to mode. Other families are left
+// unchanged.
+func NewSummaryGauges(quantiles map[string][]float64, mode SummaryMode) *SummaryGauges {
+	return &SummaryGauges{quantiles: quantiles, mode: mode}
+}
+
+func (t *SummaryGauges) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	quantiles, ok := t.quantiles[family.GetName()]
+	if !ok || family.GetType() != clientmodel.MetricType_SUMMARY {
+		return true, nil
+	}
+	var added []*clientmodel.MetricFamily
+	for _, q := range quantiles {
+		gauge := &clientmodel.MetricFamily{
+			Name: proto.String(family.GetName() + "_p" + percentile(q)),
+			Help: family.Help,
+			Type: clientmodel.MetricType_GAUGE.Enum(),
+		}
+		for _, m := range family.Metric {
+			if m == nil || m.Summary == nil {
+				continue
+			}
+			for _, quantile := range m.Summary.Quantile {
+				if quantile.GetQuantile() == q {
+					gauge.Metric = append(gauge.Metric, summarySample(m, &clientmodel.Metric{Gauge: &clientmodel.Gauge{Value: proto.Float64(quantile.GetValue())}}))
+					break
+				}
+			}
+		}
+		if len(gauge.Metric) > 0 {
+			added = append(added, gauge)
+		}
+	}
+	if t.mode == SummaryCounters {
+		sum := &clientmodel.MetricFamily{Name: proto.String(family.GetName() + "_sum"), Type: clientmodel.MetricType_COUNTER.Enum()}
+		count := &clientmodel.MetricFamily{Name: proto.String(family.GetName() + "_count"), Type: clientmodel.MetricType_COUNTER.Enum()}
+		for _, m := range family.Metric {
+			if m == nil || m.Summary == nil {
+				continue
+			}
+			sum.Metric = append(sum.Metric, summarySample(m, &clientmodel.Metric{Counter: &clientmodel.Counter{Value: proto.Float64(m.Summary.GetSampleSum())}}))
+			count.Metric = append(count.Metric, summarySample(m, &clientmodel.Metric{Counter: &clientmodel.Counter{Value: proto.Float64(float64(m.Summary.GetSampleCount()))}}))
+		}
+		if len(sum.Metric) > 0 {
+			added = append(added, sum, count)
+		}
+	}
+
+	t.lock.Lock()
+	t.pending = append(t.pending, added...)
+	t.lock.Unlock()
+	return t.mode == "" || t.mode == SummaryKeep, nil
+}
+
+// Append inserts the gauges extracted from the batch so that a batch sorted by name
+// stays sorted.
+func (t *SummaryGauges) Append(families []*clientmodel.MetricFamily) []*clientmodel.MetricFamily {
+	t.lock.Lock()
+	pending := t.pending
+	t.pending = nil
+	t.lock.Unlock()
+	for _, family := range pending {
+		families = insertFamily(families, family)
+	}
+	return families
+}
+
+// summarySample sets copies of the labels and the timestamp of the summary series m
+// on sample.
+func summarySample(m, sample *clientmodel.Metric) *clientmodel.Metric {
+	sample.Label = make([]*clientmodel.LabelPair, 0, len(m.Label))
+	for _, label := range m.Label {
+		if label != nil {
+			sample.Label = append(sample.Label, &clientmodel.LabelPair{Name: proto.String(label.GetName()), Value: proto.String(label.GetValue())})
+		}
+	}
+	sample.TimestampMs = m.TimestampMs
+	return sample
+}
+
+// percentile formats the quantile q as a percentile for use in a metric name, with
+// an underscore in place of the decimal point.
+func percentile(q float64) string {
+	s := strconv.FormatFloat(q*100, 'f', 6, 64)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	return strings.Replace(s, ".", "_", -1)
+}
@@ -0,0 +1,81 @@
+package transform
+
+import (
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestSummaryGauges(t *testing.T) {
+	summary := func() *clientmodel.MetricFamily {
+		return &clientmodel.MetricFamily{
+			Name: stringp("duration_seconds"),
+			Type: clientmodel.MetricType_SUMMARY.Enum(),
+			Metric: []*clientmodel.Metric{{
+				Label:       labels("handler", "a"),
+				TimestampMs: int64p(1000),
+				Summary: &clientmodel.Summary{
+					SampleCount: uint64p(10),
+					SampleSum:   float64p(2.5),
+					Quantile: []*clientmodel.Quantile{
+						{Quantile: float64p(0.5), Value: float64p(0.1)},
+						{Quantile: float64p(0.99), Value: float64p(0.9)},
+					},
+				},
+			}},
+		}
+	}
+	tests := []struct {
+		mode      SummaryMode
+		keep      bool
+		wantNames []string
+	}{
+		{mode: SummaryKeep, keep: true, wantNames: []string{"a", "duration_seconds_p50", "duration_seconds_p99", "z"}},
+		{mode: SummaryDrop, wantNames: []string{"a", "duration_seconds_p50", "duration_seconds_p99", "z"}},
+		{mode: SummaryCounters, wantNames: []string{"a", "duration_seconds_count", "duration_seconds_p50", "duration_seconds_p99", "duration_seconds_sum", "z"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			tr := NewSummaryGauges(map[string][]float64{"duration_seconds": {0.5, 0.99, 0.75}}, tt.mode)
+			if ok, _ := tr.Transform(&clientmodel.MetricFamily{Name: stringp("duration_seconds_p50"), Type: clientmodel.MetricType_GAUGE.Enum()}); !ok {
+				t.Errorf("Transform() dropped a family that is not a summary")
+			}
+			if ok, err := tr.Transform(summary()); ok != tt.keep || err != nil {
+				t.Fatalf("Transform() = %t, %v, want %t", ok, err, tt.keep)
+			}
+			families := tr.Append([]*clientmodel.MetricFamily{{Name: stringp("a")}, {Name: stringp("z")}})
+			var names []string
+			for _, family := range families {
+				names = append(names, family.GetName())
+			}
+			if len(names) != len(tt.wantNames) {
+				t.Fatalf("Append() = %v, want %v", names, tt.wantNames)
+			}
+			for i := range names {
+				if names[i] != tt.wantNames[i] {
+					t.Fatalf("Append() = %v, want %v", names, tt.wantNames)
+				}
+			}
+			for _, family := range families {
+				if family.GetName() != "duration_seconds_p99" {
+					continue
+				}
+				m := family.Metric[0]
+				if family.GetType() != clientmodel.MetricType_GAUGE || m.GetGauge().GetValue() != 0.9 || m.GetTimestampMs() != 1000 || formatLabels(m.Label) != `{handler="a"}` {
+					t.Errorf("unexpected quantile gauge %v", family)
+				}
+			}
+			if families := tr.Append(nil); len(families) != 0 {
+				t.Errorf("Append() added the gauges again: %v", families)
+			}
+		})
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	for q, want := range map[float64]string{0.5: "50", 0.99: "99", 0.999: "99_9", 0.29: "29", 0.05: "5"} {
+		if got := percentile(q); got != want {
+			t.Errorf("percentile(%g) = %s, want %s", q, got, want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package transform
+
+import (
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// TimestampAlignMode controls how NewTimestampAlign changes sample timestamps.
+type TimestampAlignMode string
+
+const (
+	// TimestampAlignClamp sets stale sample timestamps to the scrape time.
+	TimestampAlignClamp TimestampAlignMode = "clamp"
+	// TimestampAlignShift moves stale sample timestamps forward by at most a
+	// maximum shift, never past the scrape time.
+	TimestampAlignShift TimestampAlignMode = "shift"
+)
+
+type timestampAlign struct {
+	mode     TimestampAlignMode
+	now      int64
+	fresh    int64
+	maxShift int64
+}
+
+// NewTimestampAlign moves the timestamps of samples older than fresh relative to now
+// closer to now, according to mode. Samples within the freshness window and samples
+// without timestamps are left untouched. This changes the meaning of the data and
+// should only be used when the receiver expects near real-time samples.
+func NewTimestampAlign(mode TimestampAlignMode, now time.Time, fresh, maxShift time.Duration) Interface {
+	return &timestampAlign{
+		mode:     mode,
+		now:      now.UnixNano() / int64(time.Millisecond),
+		fresh:    int64(fresh / time.Millisecond),
+		maxShift: int64(maxShift / time.Millisecond),
+	}
+}
+
+func (t *timestampAlign) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	for _, m := range family.Metric {
+		if m == nil || m.TimestampMs == nil {
+			continue
+		}
+		age := t.now - *m.TimestampMs
+		if age <= t.fresh {
+			continue
+		}
+		var ts int64
+		switch t.mode {
+		case TimestampAlignClamp:
+			ts = t.now
+		case TimestampAlignShift:
+			shift := age
+			if shift > t.maxShift {
+				shift = t.maxShift
+			}
+			ts = *m.TimestampMs + shift
+		default:
+			continue
+		}
+		m.TimestampMs = &ts
+	}
+	return true, nil
+}
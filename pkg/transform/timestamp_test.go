@@ -0,0 +1,43 @@
+package transform
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimestampAlign(t *testing.T) {
+	now := time.Unix(1000, 0)
+	nowMs := int64(1000 * 1000)
+	tests := []struct {
+		name string
+		mode TimestampAlignMode
+		in   []int64
+		want []int64
+	}{
+		{
+			name: "clamp",
+			mode: TimestampAlignClamp,
+			in:   []int64{nowMs - 600*1000, nowMs - 30*1000, nowMs},
+			want: []int64{nowMs, nowMs - 30*1000, nowMs},
+		},
+		{
+			name: "shift",
+			mode: TimestampAlignShift,
+			in:   []int64{nowMs - 600*1000, nowMs - 90*1000, nowMs - 30*1000},
+			want: []int64{nowMs - 480*1000, nowMs, nowMs - 30*1000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := family("test", tt.in...)
+			if ok, err := NewTimestampAlign(tt.mode, now, time.Minute, 2*time.Minute).Transform(f); !ok || err != nil {
+				t.Fatalf("Transform() = %t, %v", ok, err)
+			}
+			for i, m := range f.Metric {
+				if m.GetTimestampMs() != tt.want[i] {
+					t.Errorf("%d: timestamp = %d, want %d", i, m.GetTimestampMs(), tt.want[i])
+				}
+			}
+		})
+	}
+}
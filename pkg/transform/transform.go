@@ -1,17 +1,43 @@
 package transform
 
 import (
+	"context"
 	"fmt"
 	"sort"
+	"strings"
 	"time"
 
 	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/ratelog"
 )
 
 type Interface interface {
 	Transform(*clientmodel.MetricFamily) (ok bool, err error)
 }
 
+// Appender is implemented by transformers that add families to a batch or remove
+// them from it. Append is called with the batch after every family in it has been
+// passed to Transform, and the families it adds are seen by the transformers that
+// follow. Removed families are set to nil.
+type Appender interface {
+	Append(families []*clientmodel.MetricFamily) []*clientmodel.MetricFamily
+}
+
+// Preparer is implemented by transformers that make requests for a batch. Prepare is
+// called with the context of the batch before any family of it is passed to
+// Transform.
+type Preparer interface {
+	Prepare(ctx context.Context) error
+}
+
+// Committer is implemented by transformers that keep state across batches. Commit is
+// called once a batch has been handled, with delivered set if every destination
+// accepted it or stored it to upload later.
+type Committer interface {
+	Commit(delivered bool)
+}
+
 type none struct{}
 
 var None Interface = none{}
@@ -74,8 +100,13 @@ func Metrics(families []*clientmodel.MetricFamily) int {
 	return count
 }
 
+// Filter passes each non-nil family to filter and sets the families it rejects to
+// nil.
 func Filter(families []*clientmodel.MetricFamily, filter Interface) error {
 	for i, family := range families {
+		if family == nil {
+			continue
+		}
 		ok, err := filter.Transform(family)
 		if err != nil {
 			return err
@@ -454,6 +485,28 @@ func (m RenameMetrics) Transform(family *clientmodel.MetricFamily) (bool, error)
 	return true, nil
 }
 
+type prefixMetrics struct {
+	prefix string
+}
+
+// NewPrefixMetrics prepends prefix to the name of every family that does not already
+// start with it, so that applying it again leaves names unchanged. It should run
+// after RenameMetrics, which therefore matches the names without the prefix.
+func NewPrefixMetrics(prefix string) Interface {
+	return prefixMetrics{prefix: prefix}
+}
+
+func (t prefixMetrics) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	if family == nil || family.Name == nil {
+		return true, nil
+	}
+	if name := family.GetName(); !strings.HasPrefix(name, t.prefix) {
+		prefixed := t.prefix + name
+		family.Name = &prefixed
+	}
+	return true, nil
+}
+
 var SortMetrics = sortMetrics{}
 
 type sortMetrics struct{}
@@ -563,12 +616,41 @@ func (t *Count) Transform(family *clientmodel.MetricFamily) (bool, error) {
 	return true, nil
 }
 
+// RequireLabelsMode controls how NewRequireLabels handles series that lack a
+// required label.
+type RequireLabelsMode string
+
+const (
+	// RequireLabelsDrop removes series that lack a required label.
+	RequireLabelsDrop RequireLabelsMode = "drop"
+	// RequireLabelsError fails the batch on the first series that lacks a required
+	// label.
+	RequireLabelsError RequireLabelsMode = "error"
+)
+
 type requireLabel struct {
 	labels map[string]string
+	// anyValue accepts any non-empty value of the labels instead of their values in
+	// labels.
+	anyValue bool
+	mode     RequireLabelsMode
+	logger   *ratelog.Logger
 }
 
 func NewRequiredLabels(labels map[string]string) Interface {
-	return requireLabel{labels: labels}
+	return requireLabel{labels: labels, mode: RequireLabelsError}
+}
+
+// NewRequireLabels checks that every series has a non-empty value for each of names.
+// Unlike NewRequiredLabels the values are not checked. Series that lack one fail the
+// batch or are dropped and reported to logger, according to mode. It should run after
+// every transformer that changes labels.
+func NewRequireLabels(names []string, mode RequireLabelsMode, logger *ratelog.Logger) Interface {
+	labels := make(map[string]string, len(names))
+	for _, name := range names {
+		labels[name] = ""
+	}
+	return requireLabel{labels: labels, anyValue: true, mode: mode, logger: logger}
 }
 
 var (
@@ -576,32 +658,86 @@ var (
 	ErrRequiredLabelMissing       = fmt.Errorf("a required label is missing from the metric")
 )
 
+// RequiredLabelError is returned by NewRequiredLabels and NewRequireLabels for the
+// first series that lacks a required label or has a different value for it. It
+// unwraps to ErrRequiredLabelMissing or ErrRequiredLabelValueMismatch.
+type RequiredLabelError struct {
+	Metric string
+	Label  string
+	// Want is the required value of the label, empty if any value is accepted.
+	Want string
+	// Got is the value of the label, nil if the label is missing.
+	Got *string
+}
+
+func (e *RequiredLabelError) Error() string {
+	if e.Got == nil {
+		if len(e.Want) == 0 {
+			return fmt.Sprintf("metric %s is missing the required label %s", e.Metric, e.Label)
+		}
+		return fmt.Sprintf("metric %s is missing the required label %s=%q", e.Metric, e.Label, e.Want)
+	}
+	return fmt.Sprintf("metric %s has label %s=%q, expected %q", e.Metric, e.Label, *e.Got, e.Want)
+}
+
+func (e *RequiredLabelError) Unwrap() error {
+	if e.Got == nil {
+		return ErrRequiredLabelMissing
+	}
+	return ErrRequiredLabelValueMismatch
+}
+
 func (t requireLabel) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	dropped := 0
+	for i, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		err := t.check(family.GetName(), m)
+		if err == nil {
+			continue
+		}
+		if t.mode != RequireLabelsDrop {
+			return false, err
+		}
+		family.Metric[i] = nil
+		dropped++
+	}
+	if dropped > 0 {
+		t.logger.Printf("series without required labels", "warning: dropped %d series of metric %s without the required labels", dropped, family.GetName())
+	}
+	return true, nil
+}
+
+// check returns a *RequiredLabelError for the first required label that m lacks or
+// has a different value for. An empty value is missing if any value is accepted.
+func (t requireLabel) check(metric string, m *clientmodel.Metric) error {
+Labels:
 	for k, v := range t.labels {
-	Metrics:
-		for _, m := range family.Metric {
-			if m == nil {
+		for _, label := range m.Label {
+			if label == nil || label.GetName() != k {
 				continue
 			}
-			for _, label := range m.Label {
-				if label == nil {
-					continue
-				}
-				if label.GetName() == k {
-					if label.GetValue() != v {
-						return false, fmt.Errorf("expected label %s to have value %s instead of %s", label.GetName(), v, label.GetValue())
-					}
-					continue Metrics
+			if t.anyValue {
+				if len(label.GetValue()) > 0 {
+					continue Labels
 				}
+				break
 			}
-			return false, ErrRequiredLabelMissing
+			if label.GetValue() != v {
+				return &RequiredLabelError{Metric: metric, Label: k, Want: v, Got: label.Value}
+			}
+			continue Labels
 		}
+		return &RequiredLabelError{Metric: metric, Label: k, Want: v}
 	}
-	return true, nil
+	return nil
 }
 
+// LabelRetriever returns labels to add to every metric, such as the labels a server
+// requires.
 type LabelRetriever interface {
-	Labels() (map[string]string, error)
+	Labels(ctx context.Context) (map[string]string, error)
 }
 
 type label struct {
@@ -621,18 +757,29 @@ func NewLabel(labels map[string]string, retriever LabelRetriever) Interface {
 	}
 }
 
+// Prepare resolves the label retriever with the context of the batch.
+func (t *label) Prepare(ctx context.Context) error {
+	if t.retriever == nil {
+		return nil
+	}
+	added, err := t.retriever.Labels(ctx)
+	if err != nil {
+		return err
+	}
+	t.retriever = nil
+	for k, v := range added {
+		name, value := k, v
+		t.labels[k] = &clientmodel.LabelPair{Name: &name, Value: &value}
+	}
+	return nil
+}
+
 func (t *label) Transform(family *clientmodel.MetricFamily) (bool, error) {
-	// lazily resolve the label retriever as needed
+	// lazily resolve the label retriever if the batch was not prepared
 	if t.retriever != nil && len(family.Metric) > 0 {
-		added, err := t.retriever.Labels()
-		if err != nil {
+		if err := t.Prepare(context.Background()); err != nil {
 			return false, err
 		}
-		t.retriever = nil
-		for k, v := range added {
-			name, value := k, v
-			t.labels[k] = &clientmodel.LabelPair{Name: &name, Value: &value}
-		}
 	}
 	for _, m := range family.Metric {
 		m.Label = appendLabels(m.Label, t.labels)
@@ -640,18 +787,21 @@ func (t *label) Transform(family *clientmodel.MetricFamily) (bool, error) {
 	return true, nil
 }
 
+// appendLabels sets the labels in overrides on existing. Each metric gets its own
+// copy of the pairs, as later transformers such as the anonymizer change them in
+// place.
 func appendLabels(existing []*clientmodel.LabelPair, overrides map[string]*clientmodel.LabelPair) []*clientmodel.LabelPair {
 	var found []string
 	for i, pair := range existing {
 		name := pair.GetName()
 		if value, ok := overrides[name]; ok {
-			existing[i] = value
+			existing[i] = &clientmodel.LabelPair{Name: value.Name, Value: value.Value}
 			found = append(found, name)
 		}
 	}
 	for k, v := range overrides {
 		if !contains(found, k) {
-			existing = append(existing, v)
+			existing = append(existing, &clientmodel.LabelPair{Name: v.Name, Value: v.Value})
 		}
 	}
 	return existing
@@ -665,3 +815,122 @@ func contains(values []string, s string) bool {
 	}
 	return false
 }
+
+type timed struct {
+	t       Interface
+	observe func(time.Duration)
+}
+
+// NewTimed wraps t and reports the time spent in each call to Transform to observe.
+func NewTimed(t Interface, observe func(time.Duration)) Interface {
+	return &timed{t: t, observe: observe}
+}
+
+func (t *timed) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	start := time.Now()
+	ok, err := t.t.Transform(family)
+	t.observe(time.Since(start))
+	return ok, err
+}
+
+// Unwrap returns the wrapped transformer.
+func (t *timed) Unwrap() Interface { return t.t }
+
+func (t *timed) Prepare(ctx context.Context) error {
+	if p, ok := t.t.(Preparer); ok {
+		return p.Prepare(ctx)
+	}
+	return nil
+}
+
+func (t *timed) Commit(delivered bool) {
+	if c, ok := t.t.(Committer); ok {
+		c.Commit(delivered)
+	}
+}
+
+func (t *timed) Append(families []*clientmodel.MetricFamily) []*clientmodel.MetricFamily {
+	a, ok := t.t.(Appender)
+	if !ok {
+		return families
+	}
+	start := time.Now()
+	families = a.Append(families)
+	t.observe(time.Since(start))
+	return families
+}
+
+// DropCounter records the number of series dropped by a transformer. It must be safe
+// for concurrent use.
+type DropCounter interface {
+	Add(transform string, series int)
+}
+
+type countDropped struct {
+	name    string
+	t       Interface
+	counter DropCounter
+}
+
+// NewCountDropped wraps t and reports the number of series it drops to counter under
+// name. The series of a family that t rejects are counted as dropped. If counter is
+// nil, t is returned unchanged.
+func NewCountDropped(name string, t Interface, counter DropCounter) Interface {
+	if counter == nil {
+		return t
+	}
+	return &countDropped{name: name, t: t, counter: counter}
+}
+
+func (t *countDropped) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	before := countMetrics(family)
+	ok, err := t.t.Transform(family)
+	after := 0
+	if ok {
+		after = countMetrics(family)
+	}
+	if before > after {
+		t.counter.Add(t.name, before-after)
+	}
+	return ok, err
+}
+
+// Unwrap returns the wrapped transformer.
+func (t *countDropped) Unwrap() Interface { return t.t }
+
+func (t *countDropped) Prepare(ctx context.Context) error {
+	if p, ok := t.t.(Preparer); ok {
+		return p.Prepare(ctx)
+	}
+	return nil
+}
+
+func (t *countDropped) Commit(delivered bool) {
+	if c, ok := t.t.(Committer); ok {
+		c.Commit(delivered)
+	}
+}
+
+func (t *countDropped) Append(families []*clientmodel.MetricFamily) []*clientmodel.MetricFamily {
+	a, ok := t.t.(Appender)
+	if !ok {
+		return families
+	}
+	before := Metrics(families)
+	families = a.Append(families)
+	if after := Metrics(families); before > after {
+		t.counter.Add(t.name, before-after)
+	}
+	return families
+}
+
+// countMetrics returns the number of metrics in family.
+func countMetrics(family *clientmodel.MetricFamily) int {
+	count := 0
+	for _, m := range family.Metric {
+		if m != nil {
+			count++
+		}
+	}
+	return count
+}
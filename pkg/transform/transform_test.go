@@ -1,14 +1,28 @@
 package transform
 
 import (
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 
 	clientmodel "github.com/prometheus/client_model/go"
 )
 
-func int64p(i int64) *int64    { return &i }
-func stringp(s string) *string { return &s }
+func int64p(i int64) *int64       { return &i }
+func float64p(f float64) *float64 { return &f }
+func stringp(s string) *string    { return &s }
+func uint64p(u uint64) *uint64    { return &u }
+
+func formatLabels(labels []*clientmodel.LabelPair) string {
+	pairs := make([]string, 0, len(labels))
+	for _, label := range labels {
+		if label != nil {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", label.GetName(), label.GetValue()))
+		}
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
 
 func family(name string, timestamps ...int64) *clientmodel.MetricFamily {
 	families := &clientmodel.MetricFamily{Name: &name}
@@ -51,6 +65,18 @@ func TestPack(t *testing.T) {
 	}
 }
 
+func TestFilterSkipsRemovedFamilies(t *testing.T) {
+	families := []*clientmodel.MetricFamily{family("a"), family("b", 2, 1)}
+	for _, f := range []Interface{PackMetrics, SortMetrics} {
+		if err := Filter(families, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if families[0] != nil || families[1].GetName() != "b" || families[1].Metric[0].GetTimestampMs() != 1 {
+		t.Errorf("unexpected families: %v", families)
+	}
+}
+
 func TestPackMetrics(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -118,3 +144,102 @@ func TestMergeSort(t *testing.T) {
 	}
 
 }
+
+func TestPrefixMetrics(t *testing.T) {
+	for _, name := range []string{"up", "cluster_up"} {
+		family := &clientmodel.MetricFamily{Name: stringp(name)}
+		if ok, err := NewPrefixMetrics("cluster_").Transform(family); !ok || err != nil {
+			t.Fatalf("Transform() = %t, %v", ok, err)
+		}
+		if family.GetName() != "cluster_up" {
+			t.Errorf("Transform() renamed %s to %s, want cluster_up", name, family.GetName())
+		}
+	}
+}
+
+type testDropCounter map[string]int
+
+func (c testDropCounter) Add(transform string, series int) { c[transform] += series }
+
+func TestCountDropped(t *testing.T) {
+	if got := NewCountDropped("none", None, nil); got != None {
+		t.Errorf("NewCountDropped() without a counter = %v, want the transformer", got)
+	}
+
+	counter := make(testDropCounter)
+	families := []*clientmodel.MetricFamily{
+		{Name: stringp("a"), Metric: []*clientmodel.Metric{{Label: labels("job", "1")}, {Label: labels("job", "2")}}},
+		{Name: stringp("b"), Metric: []*clientmodel.Metric{{}}},
+	}
+	allowlist := NewCountDropped("allowlist", NewLabelAllowlist(nil), counter)
+	drop := NewCountDropped("drop", dropNamed("b"), counter)
+	for _, tr := range []Interface{allowlist, drop} {
+		if err := Filter(families, tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := (testDropCounter{"allowlist": 1, "drop": 1}); !reflect.DeepEqual(counter, want) {
+		t.Errorf("dropped = %v, want %v", counter, want)
+	}
+}
+
+type dropNamed string
+
+func (name dropNamed) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	return family.GetName() != string(name), nil
+}
+
+func TestRequiredLabels(t *testing.T) {
+	tests := []struct {
+		metric  []*clientmodel.LabelPair
+		wantErr error
+		want    string
+	}{
+		{metric: labels("_id", "a", "cluster", "b")},
+		{metric: labels("_id", "a"), wantErr: ErrRequiredLabelMissing, want: `metric m is missing the required label cluster="b"`},
+		{metric: labels("_id", "a", "cluster", "c"), wantErr: ErrRequiredLabelValueMismatch, want: `metric m has label cluster="c", expected "b"`},
+	}
+	for _, tt := range tests {
+		family := &clientmodel.MetricFamily{Name: stringp("m"), Metric: []*clientmodel.Metric{{Label: tt.metric}}}
+		ok, err := NewRequiredLabels(map[string]string{"_id": "a", "cluster": "b"}).Transform(family)
+		if tt.wantErr == nil {
+			if !ok || err != nil {
+				t.Errorf("Transform(%s) = %t, %v", formatLabels(tt.metric), ok, err)
+			}
+			continue
+		}
+		e, isLabelErr := err.(*RequiredLabelError)
+		if ok || !isLabelErr || e.Unwrap() != tt.wantErr || e.Error() != tt.want {
+			t.Errorf("Transform(%s) = %t, %v, want %q", formatLabels(tt.metric), ok, err, tt.want)
+		}
+	}
+}
+
+func TestRequireLabels(t *testing.T) {
+	newFamily := func() *clientmodel.MetricFamily {
+		return &clientmodel.MetricFamily{Name: stringp("m"), Metric: []*clientmodel.Metric{
+			{Label: labels("_id", "a", "cluster", "b")},
+			{Label: labels("cluster", "b")},
+			{Label: labels("_id", "", "cluster", "b")},
+		}}
+	}
+
+	family := newFamily()
+	ok, err := NewRequireLabels([]string{"_id", "cluster"}, RequireLabelsError, nil).Transform(family)
+	if e, isLabelErr := err.(*RequiredLabelError); ok || !isLabelErr || e.Unwrap() != ErrRequiredLabelMissing || e.Error() != "metric m is missing the required label _id" {
+		t.Errorf("Transform() = %t, %v, want a missing label error", ok, err)
+	}
+
+	family = newFamily()
+	counter := testDropCounter{}
+	require := NewCountDropped("require", NewRequireLabels([]string{"_id", "cluster"}, RequireLabelsDrop, nil), counter)
+	if ok, err := require.Transform(family); !ok || err != nil {
+		t.Fatalf("Transform() = %t, %v", ok, err)
+	}
+	if family.Metric[0] == nil || family.Metric[1] != nil || family.Metric[2] != nil {
+		t.Errorf("unexpected series kept: %v", family.Metric)
+	}
+	if counter["require"] != 2 {
+		t.Errorf("dropped %d series, want 2", counter["require"])
+	}
+}
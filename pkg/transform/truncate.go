@@ -0,0 +1,55 @@
+package transform
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"unicode/utf8"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// truncateHashLen is the length of the hash suffix appended to truncated values,
+// including the separator.
+const truncateHashLen = 9
+
+type labelValueTruncator struct {
+	max int
+}
+
+// NewLabelValueTruncator shortens label values longer than max bytes. A truncated
+// value keeps as much of its prefix as fits and ends with '-' and a short hash of
+// the full value, so that distinct values sharing a prefix remain distinct series.
+// Values are never split inside a UTF-8 sequence. max must be larger than the hash
+// suffix.
+func NewLabelValueTruncator(max int) Interface {
+	if max <= truncateHashLen {
+		max = truncateHashLen + 1
+	}
+	return &labelValueTruncator{max: max}
+}
+
+func (t *labelValueTruncator) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	for _, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		for i, label := range m.Label {
+			if label == nil || len(label.GetValue()) <= t.max {
+				continue
+			}
+			value := truncateValue(label.GetValue(), t.max)
+			m.Label[i] = &clientmodel.LabelPair{Name: label.Name, Value: &value}
+		}
+	}
+	return true, nil
+}
+
+func truncateValue(value string, max int) string {
+	hash := sha256.Sum256([]byte(value))
+	suffix := "-" + hex.EncodeToString(hash[:4])
+	prefix := value[:max-len(suffix)]
+	for len(prefix) > 0 && !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix)-1]
+	}
+	return prefix + suffix
+}
@@ -0,0 +1,40 @@
+package transform
+
+import (
+	"strings"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestLabelValueTruncator(t *testing.T) {
+	long := strings.Repeat("a", 40)
+	family := &clientmodel.MetricFamily{
+		Name: stringp("test"),
+		Metric: []*clientmodel.Metric{
+			{Label: labels("short", "value", "long", long+"1")},
+			{Label: labels("long", long+"2")},
+			{Label: labels("utf8", strings.Repeat("é", 20))},
+		},
+	}
+	if ok, err := NewLabelValueTruncator(20).Transform(family); !ok || err != nil {
+		t.Fatalf("Transform() = %t, %v", ok, err)
+	}
+
+	if v := family.Metric[0].Label[0].GetValue(); v != "value" {
+		t.Errorf("short value was modified: %s", v)
+	}
+	a, b := family.Metric[0].Label[1].GetValue(), family.Metric[1].Label[0].GetValue()
+	if len(a) != 20 || len(b) != 20 {
+		t.Errorf("expected truncated values of length 20: %q %q", a, b)
+	}
+	if !strings.HasPrefix(a, strings.Repeat("a", 11)+"-") {
+		t.Errorf("unexpected truncated value %q", a)
+	}
+	if a == b {
+		t.Errorf("distinct values collided after truncation: %q", a)
+	}
+	if v := family.Metric[2].Label[0].GetValue(); len(v) > 20 || !strings.HasPrefix(v, "ééééé-") {
+		t.Errorf("unexpected truncated utf8 value %q", v)
+	}
+}
@@ -50,7 +50,11 @@ func (v *Validator) ValidateUpload(ctx context.Context, req *http.Request) (stri
 		transforms = append(transforms, transform.NewLabel(v.labels, nil))
 	}
 
-	transforms = append(transforms, transform.NewRequiredLabels(user.Labels))
+	if user.SkipLabelCheck {
+		transforms = append(transforms, transform.NewLabel(user.Labels, nil))
+	} else {
+		transforms = append(transforms, transform.NewRequiredLabels(user.Labels))
+	}
 
 	transforms = append(transforms, transform.DropEmptyFamilies)
 
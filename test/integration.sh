@@ -42,7 +42,7 @@ trap 'kill $(jobs -p); exit 0' EXIT
     --to "http://localhost:9003" \
     --id "test" \
     --to-token a \
-    --interval 15s \
+    --interval 15s --allow-aggressive-interval \
     --anonymize-labels "instance" --anonymize-salt "a-unique-value" \
     --rename ALERTS=alerts --rename openshift_build_info=build_info --rename scrape_samples_scraped=scraped \
     --match-file "deploy/default-rules" \